@@ -0,0 +1,539 @@
+package tlog
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// AlertFormat is the payload template of an alert webhook.
+type AlertFormat int
+
+const (
+	// AlertJSON posts the alert as a plain JSON object.
+	AlertJSON AlertFormat = iota
+	// AlertSlack posts a Slack incoming webhook message.
+	AlertSlack
+	// AlertTeams posts a Microsoft Teams message with an Adaptive Card, as
+	// accepted by Teams workflow webhooks.
+	AlertTeams
+	// AlertTelegram posts a Telegram Bot API sendMessage request.
+	AlertTelegram
+)
+
+// AlertWebhook is a destination of error alerts.
+type AlertWebhook struct {
+	// URL is the webhook address. Required. For AlertTelegram it is the
+	// sendMessage method of the bot.
+	// Example: "https://api.telegram.org/bot<token>/sendMessage"
+	URL string
+
+	// Format is the payload template.
+	// Default: AlertJSON
+	Format AlertFormat
+
+	// ChatID is the Telegram chat receiving alerts. Required for
+	// AlertTelegram.
+	ChatID string
+
+	// Headers are added to every request, e.g. an Authorization header
+	// for AlertJSON receivers.
+	Headers map[string]string
+}
+
+// AlertConfig configures a sink posting error-level entries to webhooks.
+type AlertConfig struct {
+	// Webhooks receive every alert. Required.
+	Webhooks []AlertWebhook
+
+	// RateLimit is the minimum interval between two alerts of one group.
+	// Occurrences in between are counted and reported with the next alert.
+	// Default: 5m
+	RateLimit time.Duration
+
+	// GroupFields are fields added to the message and caller fingerprint,
+	// to split groups further.
+	// Example: []string{"path"} alerts per route for GinMiddleware 5xx
+	GroupFields []string
+
+	// Fields are the entry fields shown in alerts, besides request_id and
+	// error. Other fields, such as request and response bodies, never leave
+	// the service through a webhook.
+	// Default: DefaultAlertFields
+	Fields []string
+
+	// MaxGroups bounds the groups tracked; the least recently seen group is
+	// forgotten above it.
+	// Default: 1000
+	MaxGroups int
+
+	// StackFrames is the number of stack frames in the excerpt of an
+	// alert. Negative omits the stack.
+	// Default: 5
+	StackFrames int
+
+	// Client sends the requests.
+	// Default: a client with a 30s timeout
+	Client *http.Client
+}
+
+// DefaultAlertFields are the fields shown in alerts by default: request and
+// query identifiers, without bodies, SQL arguments or client details.
+var DefaultAlertFields = []string{
+	"component", "method", "path", "status_code", "duration_ms",
+	"trace_id", "span_id", "operation", "table", "sql_fingerprint",
+}
+
+// alertValueLimit is the length in runes of the error and of every field
+// value in an alert, below the 2000 characters of a Slack field.
+const alertValueLimit = 1000
+
+// AlertSink posts error-level entries to webhooks, grouped by message and
+// caller and rate-limited per group. Create it with NewAlertSink and add
+// it with a SinkOutput whose MinLevel is "error"; lower entries are
+// ignored anyway.
+type AlertSink struct {
+	cfg         AlertConfig
+	host        string
+	service     string
+	environment string
+	version     string
+
+	mu     sync.Mutex
+	groups map[string]*alertGroup
+}
+
+// alertGroup is the state of entries sharing a fingerprint.
+type alertGroup struct {
+	firstSeen  time.Time
+	lastSeen   time.Time
+	lastAlert  time.Time
+	total      int64
+	suppressed int
+}
+
+// alert is an alert of one group, rendered by the webhook templates.
+type alert struct {
+	Fingerprint string                 `json:"fingerprint"`
+	Service     string                 `json:"service,omitempty"`
+	Environment string                 `json:"environment,omitempty"`
+	Version     string                 `json:"version,omitempty"`
+	Host        string                 `json:"host,omitempty"`
+	Level       string                 `json:"level"`
+	Message     string                 `json:"message"`
+	Caller      string                 `json:"caller,omitempty"`
+	Logger      string                 `json:"logger,omitempty"`
+	RequestID   string                 `json:"request_id,omitempty"`
+	Error       string                 `json:"error,omitempty"`
+	Time        time.Time              `json:"time"`
+	FirstSeen   time.Time              `json:"first_seen"`
+	Count       int                    `json:"count"`
+	Total       int64                  `json:"total"`
+	Stack       string                 `json:"stack,omitempty"`
+	Fields      map[string]interface{} `json:"fields,omitempty"`
+}
+
+// NewAlertSink creates an alert sink, applying defaults to unset fields.
+func NewAlertSink(cfg AlertConfig) (*AlertSink, error) {
+	if len(cfg.Webhooks) == 0 {
+		return nil, errors.New("tlog: alert sink requires a webhook")
+	}
+	for i, w := range cfg.Webhooks {
+		if w.URL == "" {
+			return nil, fmt.Errorf("tlog: alert webhook %d requires a URL", i)
+		}
+		if w.Format < AlertJSON || w.Format > AlertTelegram {
+			return nil, fmt.Errorf("tlog: invalid alert format %d", int(w.Format))
+		}
+		if w.Format == AlertTelegram && w.ChatID == "" {
+			return nil, fmt.Errorf("tlog: telegram alert webhook %d requires a chat ID", i)
+		}
+	}
+	if cfg.RateLimit <= 0 {
+		cfg.RateLimit = 5 * time.Minute
+	}
+	if cfg.Fields == nil {
+		cfg.Fields = DefaultAlertFields
+	}
+	if cfg.MaxGroups <= 0 {
+		cfg.MaxGroups = 1000
+	}
+	if cfg.StackFrames == 0 {
+		cfg.StackFrames = 5
+	}
+	if cfg.Client == nil {
+		cfg.Client = defaultHTTPClient
+	}
+	host, _ := os.Hostname()
+	return &AlertSink{cfg: cfg, host: host, groups: make(map[string]*alertGroup)}, nil
+}
+
+// Name returns "alerts".
+func (s *AlertSink) Name() string { return "alerts" }
+
+// Close does nothing; requests are independent.
+func (s *AlertSink) Close() error { return nil }
+
+// configure takes the service identity from the logger configuration.
+func (s *AlertSink) configure(cfg Config) {
+	s.service = cfg.AppName
+	s.environment = cfg.Environment
+	s.version = cfg.Version
+}
+
+// Send groups the error-level entries of a batch and posts an alert for
+// each group outside its rate limit to every webhook. Alerts are not
+// retried by the batcher, since the group state already counted them; a
+// failed webhook is reported as a permanent error.
+func (s *AlertSink) Send(ctx context.Context, batch []SinkEntry) error {
+	alerts := s.collect(batch)
+
+	var errs []error
+	for _, a := range alerts {
+		for _, w := range s.cfg.Webhooks {
+			body, err := a.payload(w)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if _, err := postHTTP(ctx, s.cfg.Client, httpRequest{
+				url:         w.URL,
+				body:        body,
+				contentType: "application/json",
+				headers:     w.Headers,
+			}); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return PermanentError(errors.Join(errs...))
+	}
+	return nil
+}
+
+// collect updates the group state with a batch and returns the alerts due,
+// one per group at most.
+func (s *AlertSink) collect(batch []SinkEntry) []*alert {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var alerts []*alert
+	due := make(map[string]*alert)
+	for _, e := range batch {
+		if e.Level < zapcore.ErrorLevel {
+			continue
+		}
+		fp := s.fingerprint(e)
+		g := s.groups[fp]
+		if g == nil {
+			s.evict()
+			g = &alertGroup{firstSeen: e.Time}
+			s.groups[fp] = g
+		}
+		g.total++
+		g.lastSeen = e.Time
+
+		if a := due[fp]; a != nil {
+			a.Count++
+			a.Total = g.total
+			continue
+		}
+		if !g.lastAlert.IsZero() && e.Time.Sub(g.lastAlert) < s.cfg.RateLimit {
+			g.suppressed++
+			continue
+		}
+
+		a := s.newAlert(e, fp, g)
+		g.lastAlert = e.Time
+		g.suppressed = 0
+		due[fp] = a
+		alerts = append(alerts, a)
+	}
+	return alerts
+}
+
+// fingerprint identifies the group of an entry: its message, caller and
+// GroupFields.
+func (s *AlertSink) fingerprint(e SinkEntry) string {
+	h := sha256.New()
+	h.Write([]byte(e.Message))
+	h.Write([]byte{0})
+	if e.Caller.Defined {
+		h.Write([]byte(e.Caller.TrimmedPath()))
+	}
+	for _, f := range s.cfg.GroupFields {
+		h.Write([]byte{0})
+		if v, ok := e.Fields[f]; ok {
+			h.Write([]byte(syslogString(v)))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// evict forgets the least recently seen group when MaxGroups is reached.
+func (s *AlertSink) evict() {
+	if len(s.groups) < s.cfg.MaxGroups {
+		return
+	}
+	var oldest string
+	var oldestSeen time.Time
+	for fp, g := range s.groups {
+		if oldest == "" || g.lastSeen.Before(oldestSeen) {
+			oldest, oldestSeen = fp, g.lastSeen
+		}
+	}
+	delete(s.groups, oldest)
+}
+
+// newAlert builds the alert of an entry. Count includes the occurrences
+// suppressed since the previous alert of the group. Only the Fields of the
+// configuration are copied, and long values are truncated.
+func (s *AlertSink) newAlert(e SinkEntry, fp string, g *alertGroup) *alert {
+	a := &alert{
+		Fingerprint: fp,
+		Service:     s.service,
+		Environment: s.environment,
+		Version:     s.version,
+		Host:        s.host,
+		Level:       e.Level.String(),
+		Message:     e.Message,
+		Logger:      e.LoggerName,
+		Time:        e.Time,
+		FirstSeen:   g.firstSeen,
+		Count:       g.suppressed + 1,
+		Total:       g.total,
+		Stack:       stackExcerpt(e.Stack, s.cfg.StackFrames),
+		Fields:      make(map[string]interface{}, len(s.cfg.Fields)),
+	}
+	if e.Caller.Defined {
+		a.Caller = e.Caller.TrimmedPath()
+	}
+	if v, ok := e.Fields["request_id"]; ok {
+		a.RequestID = truncateString(syslogString(v), alertValueLimit)
+	}
+	if v, ok := e.Fields["error"]; ok {
+		a.Error = truncateString(syslogString(v), alertValueLimit)
+	}
+	for _, k := range s.cfg.Fields {
+		v, ok := e.Fields[k]
+		if !ok || k == "request_id" || k == "error" {
+			continue
+		}
+		if str := syslogString(v); len([]rune(str)) > alertValueLimit {
+			v = truncateString(str, alertValueLimit)
+		}
+		a.Fields[k] = v
+	}
+	return a
+}
+
+// stackExcerpt returns the first frames of a zap stack trace, which has a
+// function line and a file line per frame.
+func stackExcerpt(stack string, frames int) string {
+	if stack == "" || frames < 0 {
+		return ""
+	}
+	lines := strings.Split(strings.TrimRight(stack, "\n"), "\n")
+	if len(lines) <= 2*frames {
+		return strings.Join(lines, "\n")
+	}
+	return strings.Join(lines[:2*frames], "\n") + "\n..."
+}
+
+// title is the headline of an alert: the service and environment, and the
+// message.
+func (a *alert) title() string {
+	source := a.Service
+	if a.Environment != "" {
+		if source != "" {
+			source += "/"
+		}
+		source += a.Environment
+	}
+	if source == "" {
+		return a.Message
+	}
+	return "[" + source + "] " + a.Message
+}
+
+// facts lists the alert details shown by the chat templates, in order.
+func (a *alert) facts() [][2]string {
+	facts := [][2]string{{"Level", a.Level}}
+	add := func(name, value string) {
+		if value != "" {
+			facts = append(facts, [2]string{name, value})
+		}
+	}
+	add("Error", truncateString(a.Error, alertValueLimit))
+	add("Caller", a.Caller)
+	add("Request ID", a.RequestID)
+	add("Host", a.Host)
+	add("Version", a.Version)
+	count := fmt.Sprintf("%d since last alert, %d since %s", a.Count, a.Total, a.FirstSeen.UTC().Format(time.RFC3339))
+	facts = append(facts, [2]string{"Occurrences", count})
+	for _, k := range sortedFieldKeys(a.Fields) {
+		add(k, truncateString(syslogString(a.Fields[k]), alertValueLimit))
+	}
+	return facts
+}
+
+// sortedFieldKeys returns the keys of fields in order.
+func sortedFieldKeys(fields map[string]interface{}) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// truncateString shortens s to at most n runes, marking the cut.
+func truncateString(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
+
+// slackEscape escapes s for Slack mrkdwn within n characters, marking a
+// cut. Escaping lengthens the text, so s is cut before an escaped rune
+// rather than inside its entity.
+func slackEscape(s string, n int) string {
+	escaped := slackEscaper.Replace(s)
+	if utf8.RuneCountInString(escaped) <= n {
+		return escaped
+	}
+	var b strings.Builder
+	size := 0
+	for _, r := range s {
+		e := slackEscaper.Replace(string(r))
+		if size+utf8.RuneCountInString(e) > n-1 {
+			break
+		}
+		b.WriteString(e)
+		size += utf8.RuneCountInString(e)
+	}
+	return b.String() + "…"
+}
+
+// slackEscaper escapes the control characters of Slack mrkdwn.
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// payload renders the alert in the format of a webhook.
+func (a *alert) payload(w AlertWebhook) ([]byte, error) {
+	switch w.Format {
+	case AlertSlack:
+		return json.Marshal(a.slack())
+	case AlertTeams:
+		return json.Marshal(a.teams())
+	case AlertTelegram:
+		return json.Marshal(a.telegram(w.ChatID))
+	default:
+		return json.Marshal(a)
+	}
+}
+
+// slack renders a Slack message with Block Kit blocks; text is the
+// notification fallback.
+func (a *alert) slack() map[string]interface{} {
+	var fields []map[string]interface{}
+	for _, f := range a.facts() {
+		// A field text holds at most 2000 characters.
+		name := "*" + slackEscape(f[0], 100) + "*\n"
+		fields = append(fields, map[string]interface{}{
+			"type": "mrkdwn",
+			"text": name + slackEscape(f[1], 2000-utf8.RuneCountInString(name)),
+		})
+	}
+	blocks := []map[string]interface{}{
+		{
+			"type": "header",
+			"text": map[string]interface{}{"type": "plain_text", "text": truncateString(a.title(), 150)},
+		},
+	}
+	// A section holds at most 10 fields.
+	for len(fields) > 0 {
+		n := min(len(fields), 10)
+		blocks = append(blocks, map[string]interface{}{"type": "section", "fields": fields[:n]})
+		fields = fields[n:]
+	}
+	if a.Stack != "" {
+		blocks = append(blocks, map[string]interface{}{
+			"type": "section",
+			"text": map[string]interface{}{"type": "mrkdwn", "text": "```" + slackEscape(a.Stack, 2900) + "```"},
+		})
+	}
+	return map[string]interface{}{"text": a.title(), "blocks": blocks}
+}
+
+// teams renders a Teams message holding an Adaptive Card.
+func (a *alert) teams() map[string]interface{} {
+	var facts []map[string]interface{}
+	for _, f := range a.facts() {
+		facts = append(facts, map[string]interface{}{"title": f[0], "value": f[1]})
+	}
+	body := []map[string]interface{}{
+		{"type": "TextBlock", "text": a.title(), "weight": "Bolder", "size": "Medium", "color": "Attention", "wrap": true},
+		{"type": "FactSet", "facts": facts},
+	}
+	if a.Stack != "" {
+		body = append(body, map[string]interface{}{"type": "TextBlock", "text": a.Stack, "fontType": "Monospace", "size": "Small", "wrap": true})
+	}
+	return map[string]interface{}{
+		"type": "message",
+		"attachments": []map[string]interface{}{{
+			"contentType": "application/vnd.microsoft.card.adaptive",
+			"content": map[string]interface{}{
+				"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+				"type":    "AdaptiveCard",
+				"version": "1.4",
+				"body":    body,
+			},
+		}},
+	}
+}
+
+// telegram renders a sendMessage request with HTML formatting, within the
+// 4096 character message limit.
+func (a *alert) telegram(chatID string) map[string]interface{} {
+	var b strings.Builder
+	b.WriteString("<b>" + html.EscapeString(truncateString(a.title(), 1000)) + "</b>\n")
+	size := utf8.RuneCountInString(b.String())
+	for _, f := range a.facts() {
+		line := "\n<b>" + html.EscapeString(f[0]) + ":</b> " + html.EscapeString(f[1])
+		// Facts past the limit are left out rather than cut inside a tag.
+		if size+utf8.RuneCountInString(line) > 4000 {
+			b.WriteString("\n…")
+			break
+		}
+		b.WriteString(line)
+		size += utf8.RuneCountInString(line)
+	}
+	if a.Stack != "" {
+		room := 4000 - size
+		if room > 100 {
+			b.WriteString("\n\n<pre>" + html.EscapeString(truncateString(a.Stack, room/2)) + "</pre>")
+		}
+	}
+	return map[string]interface{}{
+		"chat_id":                  chatID,
+		"text":                     b.String(),
+		"parse_mode":               "HTML",
+		"disable_web_page_preview": true,
+	}
+}
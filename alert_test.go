@@ -0,0 +1,251 @@
+package tlog
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// webhookMock records the JSON bodies posted to it, answering with status.
+type webhookMock struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	bodies []map[string]interface{}
+	status int
+}
+
+func newWebhookMock(t *testing.T) *webhookMock {
+	t.Helper()
+	m := &webhookMock{status: http.StatusOK}
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		var body map[string]interface{}
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Errorf("webhook body is not JSON: %v", err)
+		}
+		m.mu.Lock()
+		m.bodies = append(m.bodies, body)
+		status := m.status
+		m.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *webhookMock) received() []map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]map[string]interface{}(nil), m.bodies...)
+}
+
+// testAlertEntry is a failed request, as logged by GinMiddleware.
+func testAlertEntry(at time.Time) SinkEntry {
+	return SinkEntry{
+		Time:    at,
+		Level:   zapcore.ErrorLevel,
+		Message: "Request completed with server error",
+		Fields: map[string]interface{}{
+			"request_id":    "req-1",
+			"error":         "db: " + strings.Repeat("x", 3000),
+			"method":        "POST",
+			"path":          "/api/orders",
+			"status_code":   int64(500),
+			"request_body":  `{"password":"secret"}`,
+			"response_body": `{"token":"secret"}`,
+			"client_ip":     "203.0.113.7",
+		},
+	}
+}
+
+func TestAlertSinkFormats(t *testing.T) {
+	tests := []struct {
+		format AlertFormat
+		// text returns the rendered text of every fact of a payload.
+		text func(body map[string]interface{}) []string
+	}{
+		{AlertJSON, func(body map[string]interface{}) []string {
+			texts := []string{body["error"].(string), body["request_id"].(string)}
+			for k, v := range body["fields"].(map[string]interface{}) {
+				texts = append(texts, k+"="+syslogString(v))
+			}
+			return texts
+		}},
+		{AlertSlack, func(body map[string]interface{}) []string {
+			var texts []string
+			for _, block := range body["blocks"].([]interface{}) {
+				fields, _ := block.(map[string]interface{})["fields"].([]interface{})
+				for _, f := range fields {
+					texts = append(texts, f.(map[string]interface{})["text"].(string))
+				}
+			}
+			return texts
+		}},
+		{AlertTeams, func(body map[string]interface{}) []string {
+			card := body["attachments"].([]interface{})[0].(map[string]interface{})["content"].(map[string]interface{})
+			var texts []string
+			for _, item := range card["body"].([]interface{}) {
+				facts, _ := item.(map[string]interface{})["facts"].([]interface{})
+				for _, f := range facts {
+					texts = append(texts, f.(map[string]interface{})["title"].(string)+"="+f.(map[string]interface{})["value"].(string))
+				}
+			}
+			return texts
+		}},
+		{AlertTelegram, func(body map[string]interface{}) []string {
+			if body["chat_id"] != "42" || body["parse_mode"] != "HTML" {
+				t.Errorf("telegram request = %v", body)
+			}
+			return strings.Split(body["text"].(string), "\n")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run([]string{"json", "slack", "teams", "telegram"}[tt.format], func(t *testing.T) {
+			mock := newWebhookMock(t)
+			sink, err := NewAlertSink(AlertConfig{Webhooks: []AlertWebhook{{URL: mock.URL, Format: tt.format, ChatID: "42"}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := sink.Send(context.Background(), []SinkEntry{testAlertEntry(time.Now())}); err != nil {
+				t.Fatal(err)
+			}
+			bodies := mock.received()
+			if len(bodies) != 1 {
+				t.Fatalf("got %d requests, want 1", len(bodies))
+			}
+			texts := tt.text(bodies[0])
+			all := strings.Join(texts, "\n")
+			for _, want := range []string{"POST", "/api/orders", "500", "req-1", "db: xxx"} {
+				if !strings.Contains(all, want) {
+					t.Errorf("alert misses %q:\n%s", want, all)
+				}
+			}
+			for _, secret := range []string{"secret", "203.0.113.7", "request_body", "response_body"} {
+				if strings.Contains(all, secret) {
+					t.Errorf("alert leaks %q:\n%s", secret, all)
+				}
+			}
+			for _, text := range texts {
+				if n := utf8.RuneCountInString(text); n > 2000 {
+					t.Errorf("fact of %d characters, want at most 2000", n)
+				}
+			}
+			if strings.Contains(all, strings.Repeat("x", 3000)) {
+				t.Error("error was not truncated")
+			}
+		})
+	}
+}
+
+func TestAlertSinkFields(t *testing.T) {
+	mock := newWebhookMock(t)
+	sink, err := NewAlertSink(AlertConfig{
+		Webhooks: []AlertWebhook{{URL: mock.URL}},
+		Fields:   []string{"client_ip", "tenant"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := testAlertEntry(time.Now())
+	e.Fields["tenant"] = strings.Repeat("t", 5000)
+	if err := sink.Send(context.Background(), []SinkEntry{e}); err != nil {
+		t.Fatal(err)
+	}
+	fields := mock.received()[0]["fields"].(map[string]interface{})
+	if len(fields) != 2 || fields["client_ip"] != "203.0.113.7" {
+		t.Errorf("fields = %v, want client_ip and tenant only", fields)
+	}
+	if n := utf8.RuneCountInString(fields["tenant"].(string)); n != alertValueLimit {
+		t.Errorf("tenant has %d characters, want %d", n, alertValueLimit)
+	}
+}
+
+func TestAlertSinkRateLimit(t *testing.T) {
+	mock := newWebhookMock(t)
+	sink, err := NewAlertSink(AlertConfig{Webhooks: []AlertWebhook{{URL: mock.URL}}, RateLimit: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	batch := []SinkEntry{testAlertEntry(start), testAlertEntry(start.Add(time.Second))}
+	info := testAlertEntry(start)
+	info.Level = zapcore.InfoLevel
+	batch = append(batch, info)
+	if err := sink.Send(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	// Suppressed within RateLimit, counted by the next alert
+	sink.Send(context.Background(), []SinkEntry{testAlertEntry(start.Add(30 * time.Second))})
+	sink.Send(context.Background(), []SinkEntry{testAlertEntry(start.Add(2 * time.Minute))})
+
+	bodies := mock.received()
+	if len(bodies) != 2 {
+		t.Fatalf("got %d alerts, want 2", len(bodies))
+	}
+	for i, want := range [][2]float64{{2, 2}, {2, 4}} {
+		if bodies[i]["count"] != want[0] || bodies[i]["total"] != want[1] {
+			t.Errorf("alert %d: count %v, total %v, want %v", i, bodies[i]["count"], bodies[i]["total"], want)
+		}
+	}
+}
+
+func TestAlertSinkWebhookError(t *testing.T) {
+	mock := newWebhookMock(t)
+	mock.status = http.StatusServiceUnavailable
+	sink, err := NewAlertSink(AlertConfig{Webhooks: []AlertWebhook{{URL: mock.URL, Format: AlertSlack}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sink.Send(context.Background(), []SinkEntry{testAlertEntry(time.Now())})
+	if err == nil || !isPermanent(err) {
+		t.Errorf("Send() = %v, want a permanent error", err)
+	}
+}
+
+func TestSlackEscape(t *testing.T) {
+	tests := []struct {
+		in   string
+		n    int
+		want string
+	}{
+		{"a<b>&c", 20, "a&lt;b&gt;&amp;c"},
+		{"a<b>&c", 16, "a&lt;b&gt;&amp;c"},
+		{"a<b>&c", 8, "a&lt;b…"},
+		{"a<b>&c", 5, "a…"},
+		{"héllo wörld", 6, "héllo…"},
+	}
+	for _, tt := range tests {
+		if got := slackEscape(tt.in, tt.n); got != tt.want {
+			t.Errorf("slackEscape(%q, %d) = %q, want %q", tt.in, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestNewAlertSinkValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  AlertConfig
+	}{
+		{"no webhook", AlertConfig{}},
+		{"no URL", AlertConfig{Webhooks: []AlertWebhook{{Format: AlertSlack}}}},
+		{"bad format", AlertConfig{Webhooks: []AlertWebhook{{URL: "http://x", Format: AlertFormat(9)}}}},
+		{"telegram without chat", AlertConfig{Webhooks: []AlertWebhook{{URL: "http://x", Format: AlertTelegram}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewAlertSink(tt.cfg); err == nil {
+				t.Error("NewAlertSink() accepted an invalid configuration")
+			}
+		})
+	}
+}
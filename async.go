@@ -0,0 +1,429 @@
+package tlog
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/buffer"
+	"go.uber.org/zap/zapcore"
+)
+
+// OverflowPolicy decides what happens to an entry when the async queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes the logging call wait for space in the queue.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest discards the entry being logged.
+	OverflowDropNewest
+	// OverflowDropOldest discards the oldest queued entry to make room.
+	OverflowDropOldest
+	// OverflowDropBelowLevel discards entries below AsyncConfig.DropBelowLevel
+	// and blocks for the rest.
+	OverflowDropBelowLevel
+)
+
+// String returns the policy name used in drop reports.
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropNewest:
+		return "drop_newest"
+	case OverflowDropOldest:
+		return "drop_oldest"
+	case OverflowDropBelowLevel:
+		return "drop_below_level"
+	default:
+		return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+	}
+}
+
+// AsyncConfig configures the asynchronous write path. Entries are encoded by
+// the logging goroutine and written by a background worker in batches, so a
+// stalled disk or stdout no longer blocks callers until the queue fills up.
+type AsyncConfig struct {
+	// Enabled turns on asynchronous writes.
+	// Default: false
+	Enabled bool
+
+	// QueueSize is the maximum number of entries waiting to be written.
+	// Default: 8192
+	QueueSize int
+
+	// BatchSize is the maximum number of entries written per batch.
+	// Default: 256
+	BatchSize int
+
+	// Overflow decides what happens when the queue is full.
+	// Default: OverflowBlock
+	Overflow OverflowPolicy
+
+	// DropBelowLevel is the level below which OverflowDropBelowLevel drops entries.
+	// Default: "warn"
+	DropBelowLevel string
+
+	// ReportInterval is how often dropped entry counts are logged.
+	// Default: 1m
+	ReportInterval time.Duration
+
+	// DrainTimeout bounds how long Sync and Close wait for the queue to drain.
+	// Default: 5s
+	DrainTimeout time.Duration
+}
+
+// DefaultAsyncConfig returns an enabled AsyncConfig with sensible defaults.
+func DefaultAsyncConfig() AsyncConfig {
+	return AsyncConfig{
+		Enabled:        true,
+		QueueSize:      8192,
+		BatchSize:      256,
+		Overflow:       OverflowBlock,
+		DropBelowLevel: "warn",
+		ReportInterval: time.Minute,
+		DrainTimeout:   5 * time.Second,
+	}
+}
+
+// validate applies defaults to unset fields.
+func (c *AsyncConfig) validate() error {
+	defaults := DefaultAsyncConfig()
+	if c.QueueSize <= 0 {
+		c.QueueSize = defaults.QueueSize
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = defaults.BatchSize
+	}
+	if c.DropBelowLevel == "" {
+		c.DropBelowLevel = defaults.DropBelowLevel
+	}
+	if c.ReportInterval <= 0 {
+		c.ReportInterval = defaults.ReportInterval
+	}
+	if c.DrainTimeout <= 0 {
+		c.DrainTimeout = defaults.DrainTimeout
+	}
+	if c.Overflow < OverflowBlock || c.Overflow > OverflowDropBelowLevel {
+		return fmt.Errorf("tlog: invalid async overflow policy %d", int(c.Overflow))
+	}
+	if _, err := zapcore.ParseLevel(c.DropBelowLevel); err != nil {
+		return fmt.Errorf("tlog: invalid async drop level %q: %w", c.DropBelowLevel, err)
+	}
+	return nil
+}
+
+// asyncOutput is an output of an async core. Records are grouped by its
+// address, since WriteSyncer values need not be comparable.
+type asyncOutput struct {
+	zapcore.WriteSyncer
+}
+
+// asyncRecord is an encoded entry waiting to be written.
+type asyncRecord struct {
+	level zapcore.Level
+	buf   *buffer.Buffer
+	out   *asyncOutput
+}
+
+// asyncQueue is the bounded queue and background writer shared by the cores
+// of one logger.
+type asyncQueue struct {
+	cfg       AsyncConfig
+	dropBelow zapcore.Level
+	ch        chan asyncRecord
+
+	pending atomic.Int64
+	dropped atomic.Uint64
+	closed  atomic.Bool
+
+	reportMu sync.Mutex
+	reported uint64
+
+	closeOnce sync.Once
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+// newAsyncQueue starts the background writer. cfg must be validated.
+func newAsyncQueue(cfg AsyncConfig) *asyncQueue {
+	dropBelow, _ := zapcore.ParseLevel(cfg.DropBelowLevel)
+	q := &asyncQueue{
+		cfg:       cfg,
+		dropBelow: dropBelow,
+		ch:        make(chan asyncRecord, cfg.QueueSize),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// enqueue queues rec according to the overflow policy. After Close, records
+// are written directly.
+func (q *asyncQueue) enqueue(rec asyncRecord) {
+	if q.closed.Load() {
+		q.write(rec)
+		return
+	}
+	q.pending.Add(1)
+	q.send(rec)
+
+	// A close that started after the check above may have stopped the
+	// writer before rec reached the queue; write what it left behind.
+	if q.closed.Load() {
+		q.drainStopped()
+	}
+}
+
+// send puts rec in the queue according to the overflow policy.
+func (q *asyncQueue) send(rec asyncRecord) {
+	policy := q.cfg.Overflow
+	if policy == OverflowDropBelowLevel {
+		if rec.level < q.dropBelow {
+			policy = OverflowDropNewest
+		} else {
+			policy = OverflowBlock
+		}
+	}
+
+	switch policy {
+	case OverflowDropNewest:
+		select {
+		case q.ch <- rec:
+		default:
+			q.drop(rec)
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case q.ch <- rec:
+				return
+			default:
+			}
+			select {
+			case old := <-q.ch:
+				q.drop(old)
+			default:
+			}
+		}
+	default:
+		select {
+		case q.ch <- rec:
+		case <-q.done:
+			q.pending.Add(-1)
+			q.write(rec)
+		}
+	}
+}
+
+// drainStopped waits for the writer to stop, within DrainTimeout, and
+// writes the records still queued.
+func (q *asyncQueue) drainStopped() {
+	select {
+	case <-q.stopped:
+	case <-time.After(q.cfg.DrainTimeout):
+		return
+	}
+	for {
+		select {
+		case rec := <-q.ch:
+			q.writeBatch([]asyncRecord{rec})
+		default:
+			return
+		}
+	}
+}
+
+// drop discards a record and counts it.
+func (q *asyncQueue) drop(rec asyncRecord) {
+	rec.buf.Free()
+	q.dropped.Add(1)
+	q.pending.Add(-1)
+}
+
+// run writes queued records in batches until the queue is closed, then
+// writes whatever is left.
+func (q *asyncQueue) run() {
+	defer close(q.stopped)
+
+	batch := make([]asyncRecord, 0, q.cfg.BatchSize)
+	for {
+		select {
+		case rec := <-q.ch:
+			batch = q.fill(append(batch[:0], rec))
+			q.writeBatch(batch)
+		case <-q.done:
+			for {
+				select {
+				case rec := <-q.ch:
+					batch = q.fill(append(batch[:0], rec))
+					q.writeBatch(batch)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// fill adds already queued records to batch without blocking.
+func (q *asyncQueue) fill(batch []asyncRecord) []asyncRecord {
+	for len(batch) < q.cfg.BatchSize {
+		select {
+		case rec := <-q.ch:
+			batch = append(batch, rec)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// writeBatch writes consecutive records for the same output with a single Write.
+func (q *asyncQueue) writeBatch(batch []asyncRecord) {
+	for i := 0; i < len(batch); {
+		out := batch[i].out
+		buf := batch[i].buf
+		j := i + 1
+		for ; j < len(batch) && batch[j].out == out; j++ {
+			buf.Write(batch[j].buf.Bytes())
+			batch[j].buf.Free()
+		}
+		q.write(asyncRecord{out: out, buf: buf})
+		q.pending.Add(-int64(j - i))
+		i = j
+	}
+}
+
+// write writes a record to its output, reporting failures on stderr since
+// the caller has already returned.
+func (q *asyncQueue) write(rec asyncRecord) {
+	if _, err := rec.out.Write(rec.buf.Bytes()); err != nil {
+		fmt.Fprintf(os.Stderr, "%v tlog: async write error: %v\n", time.Now(), err)
+	}
+	rec.buf.Free()
+}
+
+// flush waits until every queued record has been written or DrainTimeout passes.
+func (q *asyncQueue) flush() error {
+	deadline := time.Now().Add(q.cfg.DrainTimeout)
+	for q.pending.Load() > 0 {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("tlog: async queue not drained within %s (%d entries pending)", q.cfg.DrainTimeout, q.pending.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
+// reportDrops periodically logs the number of entries dropped since the
+// previous report, until the queue is closed.
+func (q *asyncQueue) reportDrops(logger *zap.Logger) {
+	ticker := time.NewTicker(q.cfg.ReportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			q.logDrops(logger)
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// logDrops logs the entries dropped since the previous report, if any.
+func (q *asyncQueue) logDrops(logger *zap.Logger) {
+	q.reportMu.Lock()
+	defer q.reportMu.Unlock()
+
+	total := q.dropped.Load()
+	if total == q.reported {
+		return
+	}
+	logger.Warn("Log entries dropped",
+		zap.Uint64("dropped", total-q.reported),
+		zap.Uint64("dropped_total", total),
+		zap.String("overflow_policy", q.cfg.Overflow.String()),
+		zap.Int("queue_size", q.cfg.QueueSize),
+	)
+	q.reported = total
+}
+
+// close drains the queue within DrainTimeout and stops the writer. Entries
+// logged afterwards are written synchronously.
+func (q *asyncQueue) close() error {
+	var err error
+	q.closeOnce.Do(func() {
+		err = q.flush()
+		q.closed.Store(true)
+		close(q.done)
+
+		select {
+		case <-q.stopped:
+		case <-time.After(q.cfg.DrainTimeout):
+			if err == nil {
+				err = fmt.Errorf("tlog: async writer did not stop within %s", q.cfg.DrainTimeout)
+			}
+		}
+	})
+	return err
+}
+
+// asyncCore is a zapcore.Core that encodes entries in the caller's goroutine
+// and hands them to an asyncQueue for writing.
+type asyncCore struct {
+	zapcore.LevelEnabler
+	enc   zapcore.Encoder
+	out   *asyncOutput
+	queue *asyncQueue
+}
+
+// newAsyncCore creates a core writing to out through queue.
+func newAsyncCore(enc zapcore.Encoder, out zapcore.WriteSyncer, enab zapcore.LevelEnabler, queue *asyncQueue) zapcore.Core {
+	return &asyncCore{LevelEnabler: enab, enc: enc, out: &asyncOutput{out}, queue: queue}
+}
+
+// With adds structured context to the core.
+func (c *asyncCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := *c
+	clone.enc = c.enc.Clone()
+	for _, f := range fields {
+		f.AddTo(clone.enc)
+	}
+	return &clone
+}
+
+// Check adds the core to the checked entry when the level is enabled.
+func (c *asyncCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+// Write encodes the entry and queues it. Entries above error level are
+// flushed before returning, since the process may be about to exit.
+func (c *asyncCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	buf, err := c.enc.EncodeEntry(ent, fields)
+	if err != nil {
+		return err
+	}
+	c.queue.enqueue(asyncRecord{level: ent.Level, buf: buf, out: c.out})
+	if ent.Level > zapcore.ErrorLevel {
+		return c.Sync()
+	}
+	return nil
+}
+
+// Sync drains the queue and syncs the output.
+func (c *asyncCore) Sync() error {
+	if err := c.queue.flush(); err != nil {
+		return err
+	}
+	return c.out.Sync()
+}
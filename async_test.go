@@ -0,0 +1,202 @@
+package tlog
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// lineSyncer collects written lines. The slice field makes it a
+// non-comparable WriteSyncer.
+type lineSyncer struct {
+	mu     *sync.Mutex
+	writes *[]string
+	tags   []string
+}
+
+func newLineSyncer() lineSyncer {
+	return lineSyncer{mu: new(sync.Mutex), writes: new([]string)}
+}
+
+func (s lineSyncer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	*s.writes = append(*s.writes, string(p))
+	return len(p), nil
+}
+
+func (s lineSyncer) Sync() error { return nil }
+
+func (s lineSyncer) lines() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return strings.Split(strings.TrimSpace(strings.Join(*s.writes, "")), "\n")
+}
+
+// newAsyncTestLogger returns a logger writing through queue to every out.
+func newAsyncTestLogger(queue *asyncQueue, outs ...zapcore.WriteSyncer) *zap.Logger {
+	enc := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	var cores []zapcore.Core
+	for _, out := range outs {
+		cores = append(cores, newAsyncCore(enc, out, zapcore.DebugLevel, queue))
+	}
+	return zap.New(zapcore.NewTee(cores...))
+}
+
+func TestAsyncQueueNonComparableOutputs(t *testing.T) {
+	cfg := DefaultAsyncConfig()
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	queue := newAsyncQueue(cfg)
+	a, b := newLineSyncer(), newLineSyncer()
+	logger := newAsyncTestLogger(queue, a, b)
+
+	for i := 0; i < 100; i++ {
+		logger.Info("entry")
+	}
+	if err := queue.close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(a.lines()); got != 100 {
+		t.Errorf("output a got %d lines, want 100", got)
+	}
+	if got := len(b.lines()); got != 100 {
+		t.Errorf("output b got %d lines, want 100", got)
+	}
+}
+
+func TestAsyncQueueCloseRace(t *testing.T) {
+	policies := []OverflowPolicy{OverflowBlock, OverflowDropNewest, OverflowDropOldest, OverflowDropBelowLevel}
+	for _, policy := range policies {
+		t.Run(policy.String(), func(t *testing.T) {
+			for round := 0; round < 20; round++ {
+				cfg := DefaultAsyncConfig()
+				cfg.QueueSize = 4
+				cfg.Overflow = policy
+				cfg.DrainTimeout = 2 * time.Second
+				if err := cfg.validate(); err != nil {
+					t.Fatal(err)
+				}
+				queue := newAsyncQueue(cfg)
+				out := newLineSyncer()
+				logger := newAsyncTestLogger(queue, out)
+
+				var wg sync.WaitGroup
+				for g := 0; g < 8; g++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for i := 0; i < 50; i++ {
+							logger.Warn("entry")
+						}
+					}()
+				}
+				queue.close()
+				wg.Wait()
+
+				if err := queue.flush(); err != nil {
+					t.Fatalf("round %d: %v", round, err)
+				}
+				if n := queue.pending.Load(); n != 0 {
+					t.Fatalf("round %d: %d entries pending after close", round, n)
+				}
+				written := uint64(len(out.lines()))
+				if written+queue.dropped.Load() != 400 {
+					t.Fatalf("round %d: %d written + %d dropped, want 400", round, written, queue.dropped.Load())
+				}
+			}
+		})
+	}
+}
+
+// stalledSyncer blocks writes until release is closed.
+type stalledSyncer struct {
+	lineSyncer
+	release chan struct{}
+}
+
+func (s stalledSyncer) Write(p []byte) (int, error) {
+	<-s.release
+	return s.lineSyncer.Write(p)
+}
+
+func TestAsyncQueueOverflow(t *testing.T) {
+	tests := []struct {
+		policy      OverflowPolicy
+		wantDropped bool
+		wantLast    bool
+	}{
+		{OverflowDropNewest, true, false},
+		{OverflowDropOldest, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			cfg := DefaultAsyncConfig()
+			cfg.QueueSize = 2
+			cfg.BatchSize = 1
+			cfg.Overflow = tt.policy
+			if err := cfg.validate(); err != nil {
+				t.Fatal(err)
+			}
+			queue := newAsyncQueue(cfg)
+			out := stalledSyncer{lineSyncer: newLineSyncer(), release: make(chan struct{})}
+			logger := newAsyncTestLogger(queue, out)
+
+			for i := 0; i < 10; i++ {
+				logger.Info("entry", zap.Int("i", i))
+			}
+			close(out.release)
+			if err := queue.close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := queue.dropped.Load() > 0; got != tt.wantDropped {
+				t.Errorf("dropped = %d", queue.dropped.Load())
+			}
+			lines := out.lines()
+			if got := strings.Contains(lines[len(lines)-1], `"i":9`); got != tt.wantLast {
+				t.Errorf("last entry written = %t, want %t; lines %q", got, tt.wantLast, lines)
+			}
+		})
+	}
+}
+
+func TestAsyncQueueSendAfterStop(t *testing.T) {
+	for _, policy := range []OverflowPolicy{OverflowDropNewest, OverflowDropOldest} {
+		t.Run(policy.String(), func(t *testing.T) {
+			cfg := DefaultAsyncConfig()
+			cfg.Overflow = policy
+			cfg.DrainTimeout = time.Second
+			if err := cfg.validate(); err != nil {
+				t.Fatal(err)
+			}
+			queue := newAsyncQueue(cfg)
+			if err := queue.close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// What enqueue does for a caller that found the queue open
+			// just before close stopped the writer.
+			out := newLineSyncer()
+			buf, _ := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()).EncodeEntry(zapcore.Entry{Message: "late"}, nil)
+			queue.pending.Add(1)
+			queue.send(asyncRecord{level: zapcore.InfoLevel, buf: buf, out: &asyncOutput{out}})
+			if !queue.closed.Load() {
+				t.Fatal("queue not closed")
+			}
+			queue.drainStopped()
+
+			if err := queue.flush(); err != nil {
+				t.Fatal(err)
+			}
+			if lines := out.lines(); len(lines) != 1 || !strings.Contains(lines[0], "late") {
+				t.Errorf("written %q, want the late entry", lines)
+			}
+		})
+	}
+}
@@ -0,0 +1,556 @@
+package tlog
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	gormlogger "gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+)
+
+// auditLoggerName is the name of the default audit logger. Sampling and
+// dedup pass its entries through.
+const auditLoggerName = "audit"
+
+const (
+	// auditOldRowsKey is the statement setting holding rows loaded before an update or delete.
+	auditOldRowsKey = "tlog:audit_old_rows"
+	// auditEventsKey is the statement setting holding events until the statement ends.
+	auditEventsKey = "tlog:audit_events"
+)
+
+// Auditable marks GORM models whose changes are recorded by AuditPlugin.
+// Embed AuditModel to implement it.
+type Auditable interface {
+	IsAuditable() bool
+}
+
+// AuditModel can be embedded in a GORM model to mark it as auditable.
+type AuditModel struct{}
+
+// IsAuditable implements Auditable.
+func (AuditModel) IsAuditable() bool { return true }
+
+// AuditConfig contains configuration for the audit plugin.
+type AuditConfig struct {
+	// Logger is the sink audit events are written to. Audit events must not
+	// be lossy, so it should not sample or dedup entries.
+	// Default: the outputs of the global logger, named "audit", bypassing its
+	// level, sampling and dedup
+	Logger *zap.Logger
+
+	// MaskPatterns is a list of compiled regex patterns for column names to mask.
+	// Old and new values of matching columns are replaced with "******".
+	// Default: DefaultMaskPatterns
+	MaskPatterns []*regexp.Regexp
+
+	// IgnoreColumns lists columns left out of diffs, e.g. "updated_at".
+	IgnoreColumns []string
+
+	// MaxRows limits how many rows a single update or delete records.
+	// Default: 100
+	MaxRows int
+}
+
+// DefaultAuditConfig returns an AuditConfig with sensible defaults.
+func DefaultAuditConfig() AuditConfig {
+	return AuditConfig{
+		MaskPatterns: compilePatterns(DefaultMaskPatterns),
+		MaxRows:      100,
+	}
+}
+
+// AuditOption is a function that configures AuditConfig.
+type AuditOption func(*AuditConfig)
+
+// WithAuditLogger sets the logger audit events are written to.
+// Example: a dedicated file built with tlog.New(tlog.DefaultConfig().WithConsole(false).WithFile("logs/audit.log")),
+// closed with the returned close func on shutdown
+func WithAuditLogger(logger *zap.Logger) AuditOption {
+	return func(c *AuditConfig) {
+		c.Logger = logger
+	}
+}
+
+// WithAuditMaskPatterns sets regex patterns for column names to mask in audit events,
+// replacing DefaultMaskPatterns. Call it without patterns to disable masking.
+// Example: WithAuditMaskPatterns(append(tlog.DefaultMaskPatterns, `(?i)^email$`)...)
+func WithAuditMaskPatterns(patterns ...string) AuditOption {
+	return func(c *AuditConfig) {
+		c.MaskPatterns = compilePatterns(patterns)
+	}
+}
+
+// WithAuditIgnoreColumns sets columns left out of diffs.
+func WithAuditIgnoreColumns(columns ...string) AuditOption {
+	return func(c *AuditConfig) {
+		c.IgnoreColumns = columns
+	}
+}
+
+// WithAuditMaxRows sets how many rows a single update or delete records.
+func WithAuditMaxRows(n int) AuditOption {
+	return func(c *AuditConfig) {
+		c.MaxRows = n
+	}
+}
+
+// AuditPlugin is a gorm.Plugin that records create, update and delete of
+// Auditable models as "audit" events with before/after values.
+//
+// Events are written once the statement succeeds. Inside a transaction
+// tracked by GormPlugin, they are held until it commits, and dropped when it
+// or their savepoint rolls back. Inside an untracked transaction, they are
+// written right away with committed=false.
+type AuditPlugin struct {
+	cfg    AuditConfig
+	ignore map[string]bool
+}
+
+// NewAuditPlugin creates a new audit plugin.
+// Register it with db.Use(tlog.NewAuditPlugin()).
+func NewAuditPlugin(opts ...AuditOption) *AuditPlugin {
+	cfg := DefaultAuditConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	ignore := make(map[string]bool, len(cfg.IgnoreColumns))
+	for _, c := range cfg.IgnoreColumns {
+		ignore[c] = true
+	}
+	return &AuditPlugin{cfg: cfg, ignore: ignore}
+}
+
+// Name returns the plugin name.
+func (p *AuditPlugin) Name() string {
+	return "tlog:audit"
+}
+
+// Initialize registers the audit callbacks.
+func (p *AuditPlugin) Initialize(db *gorm.DB) error {
+	cb := db.Callback()
+	return errors.Join(
+		cb.Create().After("gorm:create").Register("tlog:audit_create", p.afterCreate),
+		cb.Create().After("*").Register("tlog:audit_write_create", p.write),
+		cb.Update().Before("gorm:update").Register("tlog:audit_before_update", p.loadOldRows),
+		cb.Update().After("gorm:update").Register("tlog:audit_update", p.afterUpdate),
+		cb.Update().After("*").Register("tlog:audit_write_update", p.write),
+		cb.Delete().Before("gorm:delete").Register("tlog:audit_before_delete", p.loadOldRows),
+		cb.Delete().After("gorm:delete").Register("tlog:audit_delete", p.afterDelete),
+		cb.Delete().After("*").Register("tlog:audit_write_delete", p.write),
+	)
+}
+
+// auditChange is a single changed column.
+type auditChange struct {
+	Field string
+	Old   any
+	New   any
+}
+
+// MarshalLogObject implements zapcore.ObjectMarshaler.
+func (c auditChange) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("field", c.Field)
+	if err := enc.AddReflected("old", c.Old); err != nil {
+		return err
+	}
+	return enc.AddReflected("new", c.New)
+}
+
+// auditChanges is a list of changes that marshals as a JSON array.
+type auditChanges []auditChange
+
+// MarshalLogArray implements zapcore.ArrayMarshaler.
+func (cs auditChanges) MarshalLogArray(enc zapcore.ArrayEncoder) error {
+	for _, c := range cs {
+		if err := enc.AppendObject(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// auditRow is a row snapshot keyed by column name.
+type auditRow map[string]any
+
+// isAuditable reports whether the statement model is marked Auditable.
+func isAuditable(db *gorm.DB) bool {
+	if db.Error != nil || db.Statement.Schema == nil {
+		return false
+	}
+	model := db.Statement.Model
+	if model == nil {
+		model = db.Statement.Dest
+	}
+	if a, ok := model.(Auditable); ok {
+		return a.IsAuditable()
+	}
+	modelType := db.Statement.Schema.ModelType
+	if modelType == nil {
+		return false
+	}
+	a, ok := reflect.New(modelType).Interface().(Auditable)
+	return ok && a.IsAuditable()
+}
+
+// afterCreate records the inserted rows.
+func (p *AuditPlugin) afterCreate(db *gorm.DB) {
+	if !isAuditable(db) {
+		return
+	}
+	s := db.Statement.Schema
+	ctx := db.Statement.Context
+
+	eachRecord(db.Statement.ReflectValue, func(rv reflect.Value) {
+		row := make(auditRow, len(s.DBNames))
+		for _, f := range s.Fields {
+			if f.DBName == "" {
+				continue
+			}
+			if v, zero := f.ValueOf(ctx, rv); !zero {
+				row[f.DBName] = v
+			}
+		}
+		p.emit(db, "create", s, row, nil, row)
+	})
+}
+
+// loadOldRows snapshots the rows an update or delete is about to change.
+func (p *AuditPlugin) loadOldRows(db *gorm.DB) {
+	if !isAuditable(db) {
+		return
+	}
+	rows, err := p.loadRows(db, nil)
+	if err != nil {
+		FromContext(db.Statement.Context).Warn("Audit snapshot failed",
+			zap.String("table", db.Statement.Table), zap.Error(err))
+		return
+	}
+	db.InstanceSet(auditOldRowsKey, rows)
+}
+
+// afterUpdate diffs the snapshotted rows against their new state.
+func (p *AuditPlugin) afterUpdate(db *gorm.DB) {
+	oldRows, ok := p.oldRows(db)
+	if !ok || len(oldRows) == 0 {
+		return
+	}
+	s := db.Statement.Schema
+
+	newRows, err := p.loadRows(db, oldRows)
+	if err != nil {
+		FromContext(db.Statement.Context).Warn("Audit snapshot failed",
+			zap.String("table", db.Statement.Table), zap.Error(err))
+		return
+	}
+	byKey := make(map[string]auditRow, len(newRows))
+	for _, row := range newRows {
+		byKey[primaryKeyString(s, row)] = row
+	}
+
+	for _, old := range oldRows {
+		if row, ok := byKey[primaryKeyString(s, old)]; ok {
+			p.emit(db, "update", s, old, old, row)
+		}
+	}
+}
+
+// afterDelete records the snapshotted rows as deleted.
+func (p *AuditPlugin) afterDelete(db *gorm.DB) {
+	oldRows, ok := p.oldRows(db)
+	if !ok {
+		return
+	}
+	for _, old := range oldRows {
+		p.emit(db, "delete", db.Statement.Schema, old, old, nil)
+	}
+}
+
+// oldRows returns the rows snapshotted before a successful statement.
+func (p *AuditPlugin) oldRows(db *gorm.DB) ([]auditRow, bool) {
+	if db.Error != nil || db.RowsAffected == 0 {
+		return nil, false
+	}
+	v, ok := db.InstanceGet(auditOldRowsKey)
+	if !ok {
+		return nil, false
+	}
+	rows, ok := v.([]auditRow)
+	return rows, ok
+}
+
+// loadRows selects the rows targeted by the statement. When keys is nil, the
+// statement's WHERE clause and the model primary key select the rows;
+// otherwise the primary keys of keys do.
+func (p *AuditPlugin) loadRows(db *gorm.DB, keys []auditRow) ([]auditRow, error) {
+	stmt := db.Statement
+	s := stmt.Schema
+
+	q := db.Session(&gorm.Session{
+		NewDB:     true,
+		SkipHooks: true,
+		Context:   stmt.Context,
+		Logger:    db.Logger.LogMode(gormlogger.Silent),
+	}).Model(reflect.New(s.ModelType).Interface()).Table(stmt.Table)
+
+	if keys != nil {
+		q = q.Where(primaryKeyCondition(s, keys))
+	} else {
+		if where, ok := stmt.Clauses["WHERE"]; ok {
+			if w, ok := where.Expression.(clause.Where); ok && len(w.Exprs) > 0 {
+				q = q.Clauses(w)
+			}
+		}
+		if conds := modelPrimaryKeys(stmt); len(conds) > 0 {
+			q = q.Where(primaryKeyCondition(s, conds))
+		}
+	}
+
+	var rows []map[string]any
+	if err := q.Limit(p.cfg.MaxRows).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	result := make([]auditRow, len(rows))
+	for i, row := range rows {
+		result[i] = auditRow(row)
+	}
+	return result, nil
+}
+
+// modelPrimaryKeys returns primary key values set on the statement model.
+func modelPrimaryKeys(stmt *gorm.Statement) []auditRow {
+	s := stmt.Schema
+	if len(s.PrimaryFields) == 0 {
+		return nil
+	}
+
+	var keys []auditRow
+	eachRecord(stmt.ReflectValue, func(rv reflect.Value) {
+		key := make(auditRow, len(s.PrimaryFields))
+		for _, f := range s.PrimaryFields {
+			v, zero := f.ValueOf(stmt.Context, rv)
+			if zero {
+				return
+			}
+			key[f.DBName] = v
+		}
+		keys = append(keys, key)
+	})
+	return keys
+}
+
+// primaryKeyCondition builds a condition matching any of the rows' primary keys.
+func primaryKeyCondition(s *schema.Schema, rows []auditRow) clause.Expression {
+	if len(s.PrimaryFields) == 1 {
+		col := s.PrimaryFields[0].DBName
+		values := make([]any, len(rows))
+		for i, row := range rows {
+			values[i] = row[col]
+		}
+		return clause.IN{Column: clause.Column{Table: clause.CurrentTable, Name: col}, Values: values}
+	}
+
+	exprs := make([]clause.Expression, len(rows))
+	for i, row := range rows {
+		eqs := make([]clause.Expression, len(s.PrimaryFields))
+		for j, f := range s.PrimaryFields {
+			eqs[j] = clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: f.DBName}, Value: row[f.DBName]}
+		}
+		exprs[i] = clause.And(eqs...)
+	}
+	return clause.Or(exprs...)
+}
+
+// primaryKeyString returns a comparable representation of a row's primary key.
+func primaryKeyString(s *schema.Schema, row auditRow) string {
+	parts := make([]string, len(s.PrimaryFields))
+	for i, f := range s.PrimaryFields {
+		parts[i] = fmt.Sprint(normalizeAuditValue(row[f.DBName]))
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// eachRecord calls fn for the struct value or every element of a slice.
+func eachRecord(rv reflect.Value, fn func(reflect.Value)) {
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return
+		}
+		rv = rv.Elem()
+	}
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			eachRecord(rv.Index(i), fn)
+		}
+	case reflect.Struct:
+		fn(rv)
+	}
+}
+
+// auditEvent is an audit event waiting for its statement to end.
+type auditEvent struct {
+	fields []zap.Field
+	site   callSite
+}
+
+// emit records one audit event, written by write when the statement ends.
+// key holds the primary key columns; old and new are nil for creates and
+// deletes respectively.
+func (p *AuditPlugin) emit(db *gorm.DB, action string, s *schema.Schema, key, old, new auditRow) {
+	changes := p.diff(s, old, new)
+	if action == "update" && len(changes) == 0 {
+		return
+	}
+
+	fields := append(contextFields(db.Statement.Context),
+		zap.String("event", "audit"),
+		zap.String("action", action),
+		zap.String("table", db.Statement.Table),
+		zap.String("model", s.Name),
+		primaryKeyField(s, key),
+		zap.Array("changes", changes),
+	)
+	v, _ := db.InstanceGet(auditEventsKey)
+	events, _ := v.([]auditEvent)
+	db.InstanceSet(auditEventsKey, append(events, auditEvent{fields: fields, site: gormCallSite()}))
+}
+
+// write writes the events of a successful statement after GORM committed
+// or rolled back its own transaction. Events of a statement inside a
+// tracked transaction wait for its commit.
+func (p *AuditPlugin) write(db *gorm.DB) {
+	v, ok := db.InstanceGet(auditEventsKey)
+	if !ok || db.Error != nil {
+		return
+	}
+	events := v.([]auditEvent)
+	if len(events) == 0 {
+		return
+	}
+
+	pool := db.Statement.ConnPool
+	if tx := trackedTxOf(pool); tx != nil {
+		tx.afterCommit(func() { p.log(events) })
+		return
+	}
+	if _, inTx := pool.(gorm.TxCommitter); inTx {
+		for i := range events {
+			events[i].fields = append(events[i].fields, zap.Bool("committed", false))
+		}
+	}
+	p.log(events)
+}
+
+// log writes audit events with the caller set to the application code that
+// changed the rows.
+func (p *AuditPlugin) log(events []auditEvent) {
+	logger := p.logger()
+	for _, e := range events {
+		if ce := logger.Check(zapcore.InfoLevel, "audit"); ce != nil {
+			e.site.annotate(ce)
+			ce.Write(e.fields...)
+		}
+	}
+}
+
+// logger returns the configured audit sink.
+func (p *AuditPlugin) logger() *zap.Logger {
+	if p.cfg.Logger != nil {
+		return p.cfg.Logger
+	}
+	if globalOutputs == nil {
+		return L().Named(auditLoggerName)
+	}
+	return zap.New(auditCore{globalOutputs}, zap.AddCaller()).Named(auditLoggerName)
+}
+
+// auditCore writes every entry to the global logger's outputs, bypassing
+// its level, sampling and dedup.
+type auditCore struct {
+	zapcore.Core
+}
+
+// Enabled reports true: audit events are always written.
+func (c auditCore) Enabled(zapcore.Level) bool { return true }
+
+// With adds structured context.
+func (c auditCore) With(fields []zapcore.Field) zapcore.Core {
+	return auditCore{c.Core.With(fields)}
+}
+
+// Check adds the core regardless of the level of the outputs.
+func (c auditCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	return ce.AddCore(ent, c)
+}
+
+// diff returns the columns whose values differ between old and new, in
+// schema order, with masked columns replaced.
+func (p *AuditPlugin) diff(s *schema.Schema, old, new auditRow) auditChanges {
+	var changes auditChanges
+	for _, col := range s.DBNames {
+		if p.ignore[col] {
+			continue
+		}
+		oldVal, inOld := old[col]
+		newVal, inNew := new[col]
+		if !inOld && !inNew {
+			continue
+		}
+		oldVal, newVal = normalizeAuditValue(oldVal), normalizeAuditValue(newVal)
+		if inOld && inNew && fmt.Sprint(oldVal) == fmt.Sprint(newVal) {
+			continue
+		}
+		if shouldMask(col, p.cfg.MaskPatterns) {
+			if inOld {
+				oldVal = DefaultMaskValue
+			}
+			if inNew {
+				newVal = DefaultMaskValue
+			}
+		}
+		changes = append(changes, auditChange{Field: col, Old: oldVal, New: newVal})
+	}
+	return changes
+}
+
+// primaryKeyField returns the primary_key field: a single value, or an object
+// for composite keys.
+func primaryKeyField(s *schema.Schema, row auditRow) zap.Field {
+	if len(s.PrimaryFields) == 1 {
+		return zap.Any("primary_key", normalizeAuditValue(row[s.PrimaryFields[0].DBName]))
+	}
+	key := make(map[string]any, len(s.PrimaryFields))
+	for _, f := range s.PrimaryFields {
+		key[f.DBName] = normalizeAuditValue(row[f.DBName])
+	}
+	return zap.Any("primary_key", key)
+}
+
+// normalizeAuditValue converts driver values into comparable, loggable values.
+func normalizeAuditValue(v any) any {
+	switch val := v.(type) {
+	case []byte:
+		return string(val)
+	case *any:
+		if val == nil {
+			return nil
+		}
+		return normalizeAuditValue(*val)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil
+		}
+		return normalizeAuditValue(rv.Elem().Interface())
+	}
+	return v
+}
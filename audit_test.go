@@ -0,0 +1,292 @@
+package tlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gorm.io/gorm"
+)
+
+type auditTestAccount struct {
+	AuditModel
+	ID       uint
+	Email    string
+	Password string
+	APIKey   string
+}
+
+// newBufferLogger returns a logger writing JSON lines to the returned buffer.
+func newBufferLogger() (*zap.Logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	enc := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	return zap.New(zapcore.NewCore(enc, zapcore.AddSync(&buf), zapcore.DebugLevel)), &buf
+}
+
+func TestAuditPluginMasking(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       []AuditOption
+		wantHidden []string
+		wantShown  []string
+	}{
+		{
+			name:       "default patterns",
+			wantHidden: []string{"hunter2", "hunter3", "k-123"},
+			wantShown:  []string{"a@b.c", `"field":"password","old":"******","new":"******"`},
+		},
+		{
+			name:       "custom patterns replace defaults",
+			opts:       []AuditOption{WithAuditMaskPatterns(`(?i)^email$`)},
+			wantHidden: []string{"a@b.c"},
+			wantShown:  []string{"hunter2", "k-123"},
+		},
+		{
+			name:      "masking disabled",
+			opts:      []AuditOption{WithAuditMaskPatterns()},
+			wantShown: []string{"a@b.c", "hunter2", "hunter3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, buf := newBufferLogger()
+			db := openTestDB(t, ":memory:", NewGormLogger())
+			if err := db.AutoMigrate(&auditTestAccount{}); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Use(NewAuditPlugin(append(tt.opts, WithAuditLogger(logger))...)); err != nil {
+				t.Fatal(err)
+			}
+
+			account := auditTestAccount{Email: "a@b.c", Password: "hunter2", APIKey: "k-123"}
+			if err := db.Create(&account).Error; err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Model(&account).Update("password", "hunter3").Error; err != nil {
+				t.Fatal(err)
+			}
+
+			out := buf.String()
+			if strings.Count(out, "\n") != 2 {
+				t.Fatalf("got audit events:\n%s", out)
+			}
+			for _, s := range tt.wantHidden {
+				if strings.Contains(out, s) {
+					t.Errorf("audit events contain %q:\n%s", s, out)
+				}
+			}
+			for _, s := range tt.wantShown {
+				if !strings.Contains(out, s) {
+					t.Errorf("audit events lack %q:\n%s", s, out)
+				}
+			}
+		})
+	}
+}
+
+// decodeAuditEvents decodes the JSON lines written by newBufferLogger.
+func decodeAuditEvents(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var events []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var e map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// openAuditTestDB opens a SQLite file database with the audit plugin
+// writing to the returned buffer, and GormPlugin when tracked is set.
+func openAuditTestDB(t *testing.T, tracked bool) (*gorm.DB, *bytes.Buffer) {
+	t.Helper()
+	logger, buf := newBufferLogger()
+	db := openTestDB(t, filepath.Join(t.TempDir(), "audit.db"), NewGormLogger())
+	if err := db.AutoMigrate(&auditTestAccount{}); err != nil {
+		t.Fatal(err)
+	}
+	if tracked {
+		if err := db.Use(NewGormPlugin()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Use(NewAuditPlugin(WithAuditLogger(logger), WithAuditMaskPatterns())); err != nil {
+		t.Fatal(err)
+	}
+	return db, buf
+}
+
+// auditChangesOf returns the changes of an event by field.
+func auditChangesOf(e map[string]interface{}) map[string][2]interface{} {
+	changes := make(map[string][2]interface{})
+	list, _ := e["changes"].([]interface{})
+	for _, c := range list {
+		c := c.(map[string]interface{})
+		changes[c["field"].(string)] = [2]interface{}{c["old"], c["new"]}
+	}
+	return changes
+}
+
+func TestAuditPluginEvents(t *testing.T) {
+	db, buf := openAuditTestDB(t, false)
+
+	account := auditTestAccount{Email: "a@b.c", Password: "p1"}
+	db.Create(&account)
+	db.Model(&account).Update("email", "b@b.c")
+	db.Model(&account).Update("email", "b@b.c") // no change
+	db.Model(&account).Updates(map[string]interface{}{"email": "c@b.c", "api_key": "k-1"})
+	db.Model(&auditTestAccount{}).Where("email = ?", "nobody").Update("email", "x") // no rows
+	db.Delete(&account)
+
+	events := decodeAuditEvents(t, buf)
+	want := []struct {
+		action  string
+		changes map[string][2]interface{}
+	}{
+		{"create", map[string][2]interface{}{"id": {nil, 1.0}, "email": {nil, "a@b.c"}, "password": {nil, "p1"}}},
+		{"update", map[string][2]interface{}{"email": {"a@b.c", "b@b.c"}}},
+		{"update", map[string][2]interface{}{"email": {"b@b.c", "c@b.c"}, "api_key": {"", "k-1"}}},
+		{"delete", map[string][2]interface{}{"id": {1.0, nil}, "email": {"c@b.c", nil}, "password": {"p1", nil}, "api_key": {"k-1", nil}}},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d:\n%s", len(events), len(want), buf)
+	}
+	for i, w := range want {
+		e := events[i]
+		if e["action"] != w.action || e["event"] != "audit" || e["table"] != "audit_test_accounts" ||
+			e["model"] != "auditTestAccount" || e["primary_key"] != 1.0 {
+			t.Errorf("event %d = %v", i, e)
+		}
+		if got := auditChangesOf(e); !equalAuditChanges(got, w.changes) {
+			t.Errorf("%s changes = %v, want %v", w.action, got, w.changes)
+		}
+		if _, ok := e["committed"]; ok {
+			t.Errorf("%s outside a transaction marked committed", w.action)
+		}
+	}
+}
+
+// equalAuditChanges reports whether two sets of changes are equal.
+func equalAuditChanges(got, want map[string][2]interface{}) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for k, w := range want {
+		if g, ok := got[k]; !ok || g != w {
+			return false
+		}
+	}
+	return true
+}
+
+func TestAuditPluginTransactions(t *testing.T) {
+	errRollback := errors.New("rollback")
+
+	t.Run("tracked", func(t *testing.T) {
+		db, buf := openAuditTestDB(t, true)
+		err := db.Transaction(func(tx *gorm.DB) error {
+			tx.Create(&auditTestAccount{Email: "kept"})
+			tx.Transaction(func(tx2 *gorm.DB) error {
+				tx2.Create(&auditTestAccount{Email: "savepoint rolled back"})
+				return errRollback
+			})
+			tx.Create(&auditTestAccount{Email: "kept too"})
+			if buf.Len() > 0 {
+				t.Errorf("events written before commit:\n%s", buf)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Transaction(func(tx *gorm.DB) error {
+			tx.Create(&auditTestAccount{Email: "rolled back"})
+			return errRollback
+		})
+
+		events := decodeAuditEvents(t, buf)
+		if len(events) != 2 {
+			t.Fatalf("got %d events, want the committed creates:\n%s", len(events), buf)
+		}
+		for i, email := range []string{"kept", "kept too"} {
+			if got := auditChangesOf(events[i])["email"][1]; got != email {
+				t.Errorf("event %d email = %v, want %s", i, got, email)
+			}
+			if id, _ := events[i]["tx_id"].(string); id == "" || id != events[0]["tx_id"] {
+				t.Errorf("event %d tx_id = %v", i, events[i]["tx_id"])
+			}
+			if _, ok := events[i]["committed"]; ok {
+				t.Errorf("committed event %d marked", i)
+			}
+		}
+	})
+
+	t.Run("untracked", func(t *testing.T) {
+		db, buf := openAuditTestDB(t, false)
+		db.Transaction(func(tx *gorm.DB) error {
+			tx.Create(&auditTestAccount{Email: "rolled back"})
+			return errRollback
+		})
+		db.Create(&auditTestAccount{Email: "own transaction"})
+
+		events := decodeAuditEvents(t, buf)
+		if len(events) != 2 {
+			t.Fatalf("got %d events:\n%s", len(events), buf)
+		}
+		if events[0]["committed"] != false {
+			t.Errorf("event in an untracked transaction = %v, want committed=false", events[0])
+		}
+		if _, ok := events[1]["committed"]; ok {
+			t.Errorf("event of a committed statement = %v, want no marker", events[1])
+		}
+	})
+
+	t.Run("failed statement", func(t *testing.T) {
+		db, buf := openAuditTestDB(t, true)
+		db.Create(&auditTestAccount{ID: 1, Email: "first"})
+		db.Create(&auditTestAccount{ID: 1, Email: "duplicate"})
+		if events := decodeAuditEvents(t, buf); len(events) != 1 {
+			t.Errorf("got %d events, want the failed insert left out:\n%s", len(events), buf)
+		}
+	})
+}
+
+func TestAuditPluginDefaultLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	initTestLogger(t, DefaultConfig().WithConsole(false).WithLevel("error").WithFile(path).
+		WithSampling(SamplingConfig{Initial: 1}).
+		WithDedup(DedupConfig{KeyFields: []string{"event"}}))
+
+	db := openTestDB(t, filepath.Join(t.TempDir(), "audit.db"), NewGormLogger())
+	if err := db.AutoMigrate(&auditTestAccount{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Use(NewAuditPlugin()); err != nil {
+		t.Fatal(err)
+	}
+	for _, email := range []string{"a", "b", "c"} {
+		db.Create(&auditTestAccount{Email: email})
+	}
+	Info("dropped by the level")
+	Sync()
+
+	entries := readJSONLines(t, path)
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want every audit event despite level, sampling and dedup", len(entries))
+	}
+	for _, e := range entries {
+		if e["logger"] != "audit" || e["action"] != "create" {
+			t.Errorf("entry = %v", e)
+		}
+	}
+}
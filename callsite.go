@@ -0,0 +1,95 @@
+package tlog
+
+import (
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// tlogFuncPrefix prefixes the function names of this package in stack frames.
+var tlogFuncPrefix = reflect.TypeOf(GormLogger{}).PkgPath() + "."
+
+// callSite is the application code that called into GORM.
+type callSite struct {
+	frame runtime.Frame
+
+	// migration is the outermost migrator method on the stack, e.g.
+	// "AutoMigrate", or "" when the call is not part of a migration.
+	migration string
+}
+
+// gormCallSite walks the stack past GORM, driver migrators and this package
+// to find the application frame, noting the migrator methods passed on the way.
+func gormCallSite() callSite {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	var site callSite
+	for {
+		f, more := frames.Next()
+		m := migratorMethod(f.Function)
+		if m == "" && !isGormInternalFrame(f) {
+			site.frame = f
+			return site
+		}
+		if m != "" {
+			site.migration = m
+		}
+		if !more {
+			return site
+		}
+	}
+}
+
+// isGormInternalFrame reports whether f belongs to GORM, a GORM driver,
+// database/sql or this package.
+func isGormInternalFrame(f runtime.Frame) bool {
+	return strings.HasPrefix(f.Function, "gorm.io/") ||
+		strings.HasPrefix(f.Function, "database/sql.") ||
+		strings.HasPrefix(f.Function, tlogFuncPrefix) ||
+		strings.HasSuffix(f.File, ".gen.go")
+}
+
+// migratorMethod returns the method name when fn is a method of a GORM
+// Migrator (gorm.io/gorm/migrator or a driver's) or DB.AutoMigrate.
+func migratorMethod(fn string) string {
+	if strings.HasSuffix(fn, ".(*DB).AutoMigrate") {
+		return "AutoMigrate"
+	}
+	for _, recv := range []string{".Migrator.", ".(*Migrator)."} {
+		if i := strings.Index(fn, recv); i >= 0 {
+			method := fn[i+len(recv):]
+			if j := strings.IndexByte(method, '.'); j >= 0 {
+				method = method[:j] // closure inside the method
+			}
+			return method
+		}
+	}
+	return ""
+}
+
+// source formats the call site as file:line, like utils.FileWithLineNum.
+func (s callSite) source() string {
+	if s.frame.PC == 0 {
+		return ""
+	}
+	return s.frame.File + ":" + strconv.Itoa(s.frame.Line)
+}
+
+// annotate points the entry caller at the call site when caller reporting is enabled.
+func (s callSite) annotate(ce *zapcore.CheckedEntry) {
+	if !ce.Caller.Defined || s.frame.PC == 0 {
+		return
+	}
+	ce.Caller = zapcore.EntryCaller{
+		Defined:  true,
+		PC:       s.frame.PC,
+		File:     s.frame.File,
+		Line:     s.frame.Line,
+		Function: s.frame.Function,
+	}
+}
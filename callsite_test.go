@@ -0,0 +1,220 @@
+package tlog_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/thienel/tlog"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+// The tests run outside package tlog, whose frames are skipped as internal
+// like GORM's.
+
+type callSiteUser struct {
+	ID   uint
+	Name string
+}
+
+type callSiteOrder struct {
+	ID     uint
+	UserID uint
+}
+
+// observeCallers replaces the global zap logger, which tlog.L falls back to,
+// with one reporting callers.
+func observeCallers(t *testing.T) *observer.ObservedLogs {
+	t.Helper()
+	core, logs := observer.New(zapcore.DebugLevel)
+	t.Cleanup(zap.ReplaceGlobals(zap.New(core, zap.AddCaller())))
+	return logs
+}
+
+// openCallSiteDB opens a SQLite database logging every query, with the
+// callback plugin.
+func openCallSiteDB(t *testing.T) (*gorm.DB, *tlog.GormLogger) {
+	t.Helper()
+	logger := tlog.NewGormLogger(tlog.WithGormLogLevel(gormlogger.Info))
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	if err := db.Use(tlog.NewGormPlugin()); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&callSiteUser{}); err != nil {
+		t.Fatal(err)
+	}
+	return db, logger
+}
+
+// nextLine returns the line after the call.
+func nextLine() int {
+	_, _, line, _ := runtime.Caller(1)
+	return line + 1
+}
+
+// checkCaller reports entries with msg not attributed to line of this file.
+func checkCaller(t *testing.T, logs *observer.ObservedLogs, msg string, line int) {
+	t.Helper()
+	entries := logs.FilterMessage(msg).All()
+	if len(entries) == 0 {
+		t.Errorf("no %q entry", msg)
+		return
+	}
+	for _, e := range entries {
+		if filepath.Base(e.Caller.File) != "callsite_test.go" || e.Caller.Line != line {
+			t.Errorf("%q caller = %s, want callsite_test.go:%d", msg, e.Caller.TrimmedPath(), line)
+		}
+	}
+}
+
+func TestGormCallerQueries(t *testing.T) {
+	db, _ := openCallSiteDB(t)
+
+	t.Run("create", func(t *testing.T) {
+		logs := observeCallers(t)
+		line := nextLine()
+		db.Create(&callSiteUser{Name: "alice"})
+		checkCaller(t, logs, "Database query executed", line)
+		checkCaller(t, logs, "Database statement finished", line)
+	})
+	t.Run("find", func(t *testing.T) {
+		logs := observeCallers(t)
+		line := nextLine()
+		db.Where("name = ?", "alice").Find(&[]callSiteUser{})
+		checkCaller(t, logs, "Database query executed", line)
+	})
+	t.Run("failed query", func(t *testing.T) {
+		logs := observeCallers(t)
+		line := nextLine()
+		db.Table("missing").Find(&[]callSiteUser{})
+		checkCaller(t, logs, "Database query failed", line)
+	})
+	t.Run("transaction", func(t *testing.T) {
+		logs := observeCallers(t)
+		var createLine int
+		line := nextLine()
+		db.Transaction(func(tx *gorm.DB) error {
+			createLine = nextLine()
+			return tx.Create(&callSiteUser{Name: "bob"}).Error
+		})
+		checkCaller(t, logs, "Database transaction started", line)
+		checkCaller(t, logs, "Database transaction committed", line)
+		checkCaller(t, logs, "Database query executed", createLine)
+	})
+	t.Run("generated code", func(t *testing.T) {
+		logs := observeCallers(t)
+		line := nextLine()
+		findGenerated(db)
+		checkCaller(t, logs, "Database query executed", line)
+	})
+}
+
+func TestGormCallerMigrations(t *testing.T) {
+	db, _ := openCallSiteDB(t)
+	logs := observeCallers(t)
+
+	line := nextLine()
+	if err := db.AutoMigrate(&callSiteOrder{}); err != nil {
+		t.Fatal(err)
+	}
+	checkCaller(t, logs, "Database migration executed", line)
+	for _, e := range logs.FilterMessage("Database migration executed").All() {
+		if e.ContextMap()["migration"] != "AutoMigrate" {
+			t.Errorf("migration = %v, want AutoMigrate", e.ContextMap()["migration"])
+		}
+	}
+
+	line = nextLine()
+	if err := db.Migrator().DropTable(&callSiteOrder{}); err != nil {
+		t.Fatal(err)
+	}
+	entries := logs.FilterMessage("Database migration executed").All()
+	last := entries[len(entries)-1]
+	if last.ContextMap()["migration"] != "DropTable" || last.Caller.Line != line {
+		t.Errorf("drop logged as %v at line %d, want DropTable at %d", last.ContextMap()["migration"], last.Caller.Line, line)
+	}
+
+	// Ordinary queries are not tagged
+	db.Find(&[]callSiteUser{})
+	queries := logs.FilterMessage("Database query executed").All()
+	if _, ok := queries[len(queries)-1].ContextMap()["migration"]; ok {
+		t.Error("query outside a migration tagged as one")
+	}
+}
+
+func TestGormLoggerMessages(t *testing.T) {
+	_, logger := openCallSiteDB(t)
+	errFailed := errors.New("connection reset")
+	tests := []struct {
+		level zapcore.Level
+		log   func()
+		msg   string
+		args  []interface{}
+		err   string
+	}{
+		{zapcore.InfoLevel, func() { logger.Info(context.Background(), "replica %s added, %d total\n", "db-2", 3) }, "replica db-2 added, 3 total", []interface{}{"db-2", 3}, ""},
+		{zapcore.WarnLevel, func() { logger.Warn(context.Background(), "retrying %s: %v", "ping", errFailed) }, "retrying ping: connection reset", []interface{}{"ping", "connection reset"}, "connection reset"},
+		{zapcore.ErrorLevel, func() { logger.Error(context.Background(), "failed to close %s", "stmt") }, "failed to close stmt", []interface{}{"stmt"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level.String(), func(t *testing.T) {
+			logs := observeCallers(t)
+			tt.log()
+			entries := logs.All()
+			if len(entries) != 1 {
+				t.Fatalf("logged %d entries, want 1", len(entries))
+			}
+			e := entries[0]
+			fields := e.ContextMap()
+			if e.Level != tt.level || e.Message != tt.msg || fields["component"] != "gorm" {
+				t.Errorf("entry = %s %q %v", e.Level, e.Message, fields)
+			}
+			if template, _ := fields["template"].(string); !strings.Contains(template, "%s") || strings.HasSuffix(template, "\n") {
+				t.Errorf("template = %q", fields["template"])
+			}
+			args, _ := fields["args"].([]interface{})
+			if len(args) != len(tt.args) {
+				t.Fatalf("args = %v, want %v", args, tt.args)
+			}
+			for i, want := range tt.args {
+				if got := args[i]; got != want && !(got == int64(3) && want == 3) {
+					t.Errorf("args[%d] = %#v, want %#v", i, got, want)
+				}
+			}
+			if got, _ := fields["error"].(string); got != tt.err {
+				t.Errorf("error = %q, want %q", got, tt.err)
+			}
+			if source, _ := fields["source"].(string); !strings.Contains(source, "callsite_test.go:") {
+				t.Errorf("source = %q, want the test file", source)
+			}
+			if filepath.Base(e.Caller.File) != "callsite_test.go" {
+				t.Errorf("caller = %s, want the test file", e.Caller.TrimmedPath())
+			}
+		})
+	}
+}
+
+// findGenerated stands for a query method of gorm/gen, whose frames are
+// skipped like GORM's. It is last in the file so the line directive only
+// moves it.
+//
+//line query/users.gen.go:1
+func findGenerated(db *gorm.DB) {
+	db.Find(&[]callSiteUser{})
+}
@@ -1,6 +1,10 @@
 package tlog
 
-import "time"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
 // Config contains all configuration options for the logger.
 type Config struct {
@@ -26,11 +30,43 @@ type Config struct {
 	MaxAgeDays int    // Maximum age in days to keep (0 = unlimited)
 	Compress   bool   // Compress rotated files
 
+	// ExternalRotation writes FilePath as a plain file without built-in
+	// rotation, for hosts that rotate it with logrotate and signal the
+	// process to reopen it. See Reopen and HandleReopenSignal.
+	// Default: false
+	ExternalRotation bool
+
+	// Rotation replaces lumberjack with time- and size-based rotation,
+	// date-named files and a total size cap.
+	// Default: disabled
+	Rotation RotationConfig
+
+	// Outputs are additional log files, each receiving the entries within a
+	// level range and, optionally, from some components only.
+	// Example: errors.log with warn+, access.log with "http" entries
+	Outputs []FileOutput
+
+	// Sinks send entries to remote systems such as Loki, in batches from a
+	// background goroutine.
+	Sinks []SinkOutput
+
 	// Console output
 	EnableConsole bool // Enable console (stdout) output
 
 	// Timezone for log timestamps
 	Timezone *time.Location
+
+	// Async configures asynchronous, batched writes with a bounded queue.
+	// Default: disabled
+	Async AsyncConfig
+
+	// Sampling limits entries per level and message per tick.
+	// Default: disabled
+	Sampling SamplingConfig
+
+	// Dedup collapses repeated entries within a window into one with a repeated count.
+	// Default: disabled
+	Dedup DedupConfig
 }
 
 // DefaultConfig returns a Config with sensible defaults.
@@ -101,6 +137,34 @@ func (c Config) WithFileRotation(maxSizeMB, maxBackups, maxAgeDays int, compress
 	return c
 }
 
+// WithExternalRotation disables built-in rotation so FilePath can be
+// rotated externally and reopened with Reopen.
+func (c Config) WithExternalRotation() Config {
+	c.ExternalRotation = true
+	return c
+}
+
+// WithRotation enables the built-in rotating writer with the given settings.
+// Unset Pattern is derived from FilePath and Interval.
+func (c Config) WithRotation(rotation RotationConfig) Config {
+	rotation.Enabled = true
+	c.Rotation = rotation
+	return c
+}
+
+// WithOutput adds a file output with its own level range, component filter
+// and rotation.
+func (c Config) WithOutput(output FileOutput) Config {
+	c.Outputs = append(c.Outputs[:len(c.Outputs):len(c.Outputs)], output)
+	return c
+}
+
+// WithSink adds a remote sink with its own level, batching and retry settings.
+func (c Config) WithSink(output SinkOutput) Config {
+	c.Sinks = append(c.Sinks[:len(c.Sinks):len(c.Sinks)], output)
+	return c
+}
+
 // WithTimezone sets the timezone for log timestamps.
 func (c Config) WithTimezone(loc *time.Location) Config {
 	c.Timezone = loc
@@ -113,6 +177,30 @@ func (c Config) WithConsole(enabled bool) Config {
 	return c
 }
 
+// WithAsync enables asynchronous writes with the given settings.
+// Unset fields take their DefaultAsyncConfig values.
+func (c Config) WithAsync(async AsyncConfig) Config {
+	async.Enabled = true
+	c.Async = async
+	return c
+}
+
+// WithSampling enables sampling with the given settings.
+// Unset Tick, Initial and Thereafter take their defaults.
+func (c Config) WithSampling(sampling SamplingConfig) Config {
+	sampling.Enabled = true
+	c.Sampling = sampling
+	return c
+}
+
+// WithDedup enables duplicate suppression with the given settings.
+// Unset Window and MaxGroups take their defaults.
+func (c Config) WithDedup(dedup DedupConfig) Config {
+	dedup.Enabled = true
+	c.Dedup = dedup
+	return c
+}
+
 // Validate checks if the configuration is valid.
 func (c *Config) Validate() error {
 	if c.Level == "" {
@@ -134,5 +222,51 @@ func (c *Config) Validate() error {
 		}
 		c.Timezone = loc
 	}
+	if c.ExternalRotation && c.Rotation.Enabled {
+		return errors.New("tlog: ExternalRotation and Rotation cannot both be enabled")
+	}
+	if c.EnableFile && c.Rotation.Enabled {
+		if err := c.Rotation.validate(c.FilePath); err != nil {
+			return err
+		}
+	}
+	if len(c.Outputs) > 0 {
+		c.Outputs = append([]FileOutput(nil), c.Outputs...)
+		for i := range c.Outputs {
+			if err := c.Outputs[i].validate(); err != nil {
+				return err
+			}
+		}
+	}
+	if len(c.Sinks) > 0 {
+		c.Sinks = append([]SinkOutput(nil), c.Sinks...)
+		spools := make(map[*Spool]bool)
+		for i := range c.Sinks {
+			if err := c.Sinks[i].validate(); err != nil {
+				return err
+			}
+			if sp := c.Sinks[i].Spool; sp != nil {
+				if spools[sp] {
+					return fmt.Errorf("tlog: spool in %s is shared by several sink outputs", sp.cfg.Dir)
+				}
+				spools[sp] = true
+			}
+		}
+	}
+	if c.Async.Enabled {
+		if err := c.Async.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Sampling.Enabled {
+		if err := c.Sampling.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Dedup.Enabled {
+		if err := c.Dedup.validate(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
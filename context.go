@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 // Context keys for storing logger-related values.
@@ -16,16 +17,35 @@ const (
 	UserIDKey contextKey = "user_id"
 	// TraceIDKey is the context key for trace ID.
 	TraceIDKey contextKey = "trace_id"
+	// SpanIDKey is the context key for span ID.
+	SpanIDKey contextKey = "span_id"
+	// TxIDKey is the context key for database transaction ID.
+	TxIDKey contextKey = "tx_id"
 )
 
-// FromContext returns a logger with context fields (request_id, user_id, trace_id).
+// FromContext returns a logger with context fields (request_id, user_id, trace_id, span_id, tx_id).
 // If no context is provided or no fields are found, returns the global logger.
+// When the context carries a request buffer (see RequestBufferConfig), entries
+// below its level are buffered until the request ends.
 func FromContext(ctx context.Context) *zap.Logger {
+	logger := L()
+	if buf := requestBufferFrom(ctx); buf != nil {
+		logger = logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+			return &bufferingCore{Core: core, buf: buf}
+		}))
+	}
+	if fields := contextFields(ctx); len(fields) > 0 {
+		return logger.With(fields...)
+	}
+	return logger
+}
+
+// contextFields returns the logger fields carried by the context.
+func contextFields(ctx context.Context) []zap.Field {
 	if ctx == nil {
-		return L()
+		return nil
 	}
 
-	logger := L()
 	var fields []zap.Field
 
 	// Add request_id if present
@@ -43,11 +63,17 @@ func FromContext(ctx context.Context) *zap.Logger {
 		fields = append(fields, zap.String("trace_id", traceID))
 	}
 
-	if len(fields) > 0 {
-		return logger.With(fields...)
+	// Add span_id if present
+	if spanID, ok := ctx.Value(SpanIDKey).(string); ok && spanID != "" {
+		fields = append(fields, zap.String("span_id", spanID))
 	}
 
-	return logger
+	// Add tx_id if present
+	if txID, ok := ctx.Value(TxIDKey).(string); ok && txID != "" {
+		fields = append(fields, zap.String("tx_id", txID))
+	}
+
+	return fields
 }
 
 // WithRequestID adds a request ID to the context.
@@ -65,6 +91,16 @@ func WithTraceID(ctx context.Context, traceID string) context.Context {
 	return context.WithValue(ctx, TraceIDKey, traceID)
 }
 
+// WithSpanID adds a span ID to the context.
+func WithSpanID(ctx context.Context, spanID string) context.Context {
+	return context.WithValue(ctx, SpanIDKey, spanID)
+}
+
+// WithTxID adds a database transaction ID to the context.
+func WithTxID(ctx context.Context, txID string) context.Context {
+	return context.WithValue(ctx, TxIDKey, txID)
+}
+
 // ContextWithFields adds multiple fields to the context at once.
 func ContextWithFields(ctx context.Context, requestID string, userID uint, traceID string) context.Context {
 	if requestID != "" {
@@ -0,0 +1,429 @@
+package tlog
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ElasticsearchConfig configures a sink for the Elasticsearch or OpenSearch
+// _bulk API.
+type ElasticsearchConfig struct {
+	// URL is the cluster address. Required.
+	// Example: "https://es.internal:9200"
+	URL string
+
+	// Index is the index name pattern, formatted with the entry time in
+	// Config.Timezone. Supported verbs: %Y %m %d %H. The default stays out of
+	// the logs-*-* pattern of the built-in Elasticsearch data stream template.
+	// Default: "tlog-%Y.%m.%d"
+	Index string
+
+	// MaxBulkBytes splits a batch into several _bulk requests above this size.
+	// Default: 5 MiB
+	MaxBulkBytes int
+
+	// DeadLetterPath is a file where documents rejected by the cluster, such
+	// as mapping conflicts, are appended as JSON lines with the error.
+	// Default: none, rejected documents are dropped
+	DeadLetterPath string
+
+	// InstallTemplate installs IndexTemplate as TemplateName before the first
+	// request, so field mappings do not drift between daily indices. A failed
+	// installation is reported on stderr and never holds back documents; it
+	// is retried after a minute unless the cluster rejected the template.
+	// Default: false
+	InstallTemplate bool
+
+	// TemplateName is the name of the installed index template.
+	// Default: "tlog"
+	TemplateName string
+
+	// TemplatePriority is the priority of the installed index template.
+	// Elasticsearch rejects a template whose patterns overlap another one
+	// with the same priority; its built-in templates use 100.
+	// Default: 200
+	TemplatePriority int
+
+	// Username and Password enable basic authentication.
+	Username string
+	Password string
+
+	// APIKey is sent as "Authorization: ApiKey <APIKey>".
+	APIKey string
+
+	// Headers are added to every request.
+	Headers map[string]string
+
+	// Gzip compresses request bodies.
+	// Default: false
+	Gzip bool
+
+	// Client sends the requests.
+	// Default: a client with a 30s timeout
+	Client *http.Client
+}
+
+// ElasticsearchSink writes entries with the _bulk API. Create it with
+// NewElasticsearchSink.
+type ElasticsearchSink struct {
+	cfg     ElasticsearchConfig
+	headers map[string]string
+	loc     *time.Location
+
+	mu          sync.Mutex
+	installed   bool
+	nextInstall time.Time
+
+	// rejected holds the IDs of dead-lettered documents, so a retried batch
+	// does not dead-letter them again.
+	rejected map[string]bool
+}
+
+// NewElasticsearchSink creates an Elasticsearch sink, applying defaults to
+// unset fields.
+func NewElasticsearchSink(cfg ElasticsearchConfig) (*ElasticsearchSink, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("tlog: elasticsearch URL is required")
+	}
+	cfg.URL = strings.TrimRight(cfg.URL, "/")
+	if cfg.Index == "" {
+		cfg.Index = "tlog-%Y.%m.%d"
+	}
+	if cfg.MaxBulkBytes <= 0 {
+		cfg.MaxBulkBytes = 5 << 20
+	}
+	if cfg.TemplateName == "" {
+		cfg.TemplateName = "tlog"
+	}
+	if cfg.TemplatePriority <= 0 {
+		cfg.TemplatePriority = 200
+	}
+	if cfg.Client == nil {
+		cfg.Client = defaultHTTPClient
+	}
+	if _, err := patternRegexp(cfg.Index); err != nil {
+		return nil, err
+	}
+
+	headers := make(map[string]string, len(cfg.Headers)+1)
+	for k, v := range cfg.Headers {
+		headers[k] = v
+	}
+	switch {
+	case cfg.APIKey != "":
+		headers["Authorization"] = "ApiKey " + cfg.APIKey
+	case cfg.Username != "" || cfg.Password != "":
+		headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(cfg.Username+":"+cfg.Password))
+	}
+
+	return &ElasticsearchSink{cfg: cfg, headers: headers, loc: time.UTC, rejected: make(map[string]bool)}, nil
+}
+
+// Name returns "elasticsearch".
+func (s *ElasticsearchSink) Name() string { return "elasticsearch" }
+
+// Close does nothing; requests are independent.
+func (s *ElasticsearchSink) Close() error { return nil }
+
+// configure names indices in the logger's timezone.
+func (s *ElasticsearchSink) configure(cfg Config) {
+	if cfg.Timezone != nil {
+		s.loc = cfg.Timezone
+	}
+}
+
+// esDocument is an encoded document with its bulk action.
+type esDocument struct {
+	id     string
+	action []byte
+	source []byte
+}
+
+// Send writes a batch. Each document gets an ID derived from its content
+// and is created with the "create" action, so documents indexed by an
+// earlier attempt of a retried batch are reported as conflicts and skipped
+// instead of duplicated.
+func (s *ElasticsearchSink) Send(ctx context.Context, batch []SinkEntry) error {
+	s.installTemplate(ctx)
+
+	docs := make([]esDocument, 0, len(batch))
+	for _, e := range batch {
+		rec := e.record()
+		rec["@timestamp"] = e.Time.In(s.loc).Format(time.RFC3339Nano)
+		source, err := json.Marshal(rec)
+		if err != nil {
+			s.deadLetter(formatPattern(s.cfg.Index, e.Time.In(s.loc)), 0, err.Error(), []byte(fmt.Sprintf("%q", e.Message)))
+			continue
+		}
+
+		sum := sha256.Sum256(source)
+		id := base64.RawURLEncoding.EncodeToString(sum[:15])
+		if s.wasRejected(id) {
+			continue
+		}
+		action, _ := json.Marshal(map[string]map[string]string{"create": {
+			"_index": formatPattern(s.cfg.Index, e.Time.In(s.loc)),
+			"_id":    id,
+		}})
+		docs = append(docs, esDocument{id: id, action: action, source: source})
+	}
+
+	var retry int
+	for len(docs) > 0 {
+		var body bytes.Buffer
+		n := 0
+		for ; n < len(docs); n++ {
+			size := len(docs[n].action) + len(docs[n].source) + 2
+			if n > 0 && body.Len()+size > s.cfg.MaxBulkBytes {
+				break
+			}
+			body.Write(docs[n].action)
+			body.WriteByte('\n')
+			body.Write(docs[n].source)
+			body.WriteByte('\n')
+		}
+
+		failed, err := s.bulk(ctx, body.Bytes(), docs[:n])
+		if err != nil {
+			return err
+		}
+		retry += failed
+		docs = docs[n:]
+	}
+
+	if retry > 0 {
+		return fmt.Errorf("tlog: elasticsearch rejected %d documents with a retryable status", retry)
+	}
+	return nil
+}
+
+// esBulkResponse is the part of a _bulk response needed to find failures.
+type esBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Index  string          `json:"_index"`
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// bulk sends one _bulk request and returns the number of documents that
+// failed with a retryable status. Documents rejected otherwise are written
+// to the dead-letter file.
+func (s *ElasticsearchSink) bulk(ctx context.Context, body []byte, docs []esDocument) (int, error) {
+	resp, err := postHTTP(ctx, s.cfg.Client, httpRequest{
+		url:         s.cfg.URL + "/_bulk",
+		body:        body,
+		contentType: "application/x-ndjson",
+		headers:     s.headers,
+		gzip:        s.cfg.Gzip,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var result esBulkResponse
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return 0, fmt.Errorf("tlog: decode elasticsearch bulk response: %w", err)
+	}
+	if !result.Errors {
+		return 0, nil
+	}
+
+	retry := 0
+	for i, item := range result.Items {
+		if i >= len(docs) {
+			break
+		}
+		for _, r := range item {
+			switch {
+			case r.Status < 300, r.Status == http.StatusConflict:
+				// Created, or created by an earlier attempt
+			case r.Status == http.StatusTooManyRequests, r.Status >= 500:
+				retry++
+			default:
+				s.reject(docs[i].id)
+				s.deadLetter(r.Index, r.Status, string(r.Error), docs[i].source)
+			}
+		}
+	}
+	return retry, nil
+}
+
+// maxRejectedIDs bounds the memory used to remember rejected documents.
+const maxRejectedIDs = 10000
+
+// reject remembers a rejected document until its batch is no longer retried.
+func (s *ElasticsearchSink) reject(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.rejected) >= maxRejectedIDs {
+		s.rejected = make(map[string]bool)
+	}
+	s.rejected[id] = true
+}
+
+// wasRejected reports whether a document was already dead-lettered.
+func (s *ElasticsearchSink) wasRejected(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rejected[id]
+}
+
+// deadLetter appends a rejected document to DeadLetterPath.
+func (s *ElasticsearchSink) deadLetter(index string, status int, reason string, source []byte) {
+	if s.cfg.DeadLetterPath == "" {
+		return
+	}
+
+	var errValue interface{} = reason
+	if json.Valid([]byte(reason)) {
+		errValue = json.RawMessage(reason)
+	}
+	line, _ := json.Marshal(map[string]interface{}{
+		"timestamp": time.Now().In(s.loc).Format(time.RFC3339Nano),
+		"index":     index,
+		"status":    status,
+		"error":     errValue,
+		"document":  json.RawMessage(source),
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(s.cfg.DeadLetterPath), 0o755); err != nil {
+		fmt.Fprintf(os.Stderr, "%v tlog: elasticsearch dead letter: %v\n", time.Now(), err)
+		return
+	}
+	f, err := os.OpenFile(s.cfg.DeadLetterPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v tlog: elasticsearch dead letter: %v\n", time.Now(), err)
+		return
+	}
+	defer f.Close()
+	f.Write(append(line, '\n'))
+}
+
+// templateRetryInterval is the wait before retrying a template installation
+// that failed with a retryable error.
+const templateRetryInterval = time.Minute
+
+// installTemplate installs the index template once, if configured. Failures
+// are reported on stderr only: documents are indexed either way, with
+// dynamic mappings.
+func (s *ElasticsearchSink) installTemplate(ctx context.Context) {
+	if !s.cfg.InstallTemplate {
+		return
+	}
+	s.mu.Lock()
+	skip := s.installed || time.Now().Before(s.nextInstall)
+	s.mu.Unlock()
+	if skip {
+		return
+	}
+
+	_, err := postHTTP(ctx, s.cfg.Client, httpRequest{
+		method:      http.MethodPut,
+		url:         s.cfg.URL + "/_index_template/" + s.cfg.TemplateName,
+		body:        s.IndexTemplate(),
+		contentType: "application/json",
+		headers:     s.headers,
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case err == nil:
+		s.installed = true
+	case isPermanent(err):
+		// Retrying would only be rejected again
+		s.installed = true
+		fmt.Fprintf(os.Stderr, "%v tlog: install elasticsearch index template %s: %v\n", time.Now(), s.cfg.TemplateName, err)
+	default:
+		s.nextInstall = time.Now().Add(templateRetryInterval)
+		fmt.Fprintf(os.Stderr, "%v tlog: install elasticsearch index template %s, retrying in %s: %v\n", time.Now(), s.cfg.TemplateName, templateRetryInterval, err)
+	}
+}
+
+// IndexTemplate returns a composable index template for the indices matching
+// Index, mapping the fields tlog writes. Unknown string fields are mapped as
+// keywords. Install it with PUT _index_template/<name>, or set
+// InstallTemplate.
+func (s *ElasticsearchSink) IndexTemplate() []byte {
+	pattern := s.cfg.Index
+	if i := strings.IndexByte(pattern, '%'); i >= 0 {
+		pattern = pattern[:i] + "*"
+	}
+
+	template := map[string]interface{}{
+		"index_patterns": []string{pattern},
+		"priority":       s.cfg.TemplatePriority,
+		"template": map[string]interface{}{
+			"mappings": map[string]interface{}{
+				"dynamic_templates": []interface{}{
+					map[string]interface{}{"strings": map[string]interface{}{
+						"match_mapping_type": "string",
+						"mapping":            map[string]interface{}{"type": "keyword", "ignore_above": 1024},
+					}},
+				},
+				"properties": esFieldSchema,
+			},
+		},
+		"_meta": map[string]interface{}{"generated_by": "tlog"},
+	}
+	body, _ := json.Marshal(template)
+	return body
+}
+
+// esFieldSchema maps the fields written by tlog and its integrations.
+var esFieldSchema = func() map[string]interface{} {
+	keyword := map[string]interface{}{"type": "keyword", "ignore_above": 1024}
+	text := map[string]interface{}{"type": "text"}
+	long := map[string]interface{}{"type": "long"}
+	double := map[string]interface{}{"type": "double"}
+
+	schema := map[string]interface{}{
+		"@timestamp": map[string]interface{}{"type": "date_nanos"},
+		"message":    map[string]interface{}{"type": "text", "fields": map[string]interface{}{"keyword": keyword}},
+		"stacktrace": map[string]interface{}{"type": "text", "index": false},
+		"plan":       map[string]interface{}{"type": "text", "index": false},
+		"changes":    map[string]interface{}{"type": "object", "enabled": false},
+		"args":       map[string]interface{}{"type": "object", "enabled": false},
+		"slow_query": map[string]interface{}{"type": "boolean"},
+		"read_only":  map[string]interface{}{"type": "boolean"},
+	}
+	for _, f := range []string{
+		"level", "logger", "caller", "service", "version", "component",
+		"request_id", "trace_id", "span_id", "tx_id", "user_id",
+		"method", "path", "host", "protocol", "client_ip", "ip_address", "user_agent", "query_string",
+		"sql_fingerprint", "sql_hash", "operation", "table", "tables", "model", "callback", "migration",
+		"source", "event", "action", "isolation", "sink", "warning",
+	} {
+		schema[f] = keyword
+	}
+	for _, f := range []string{"sql", "error", "gin_errors", "request_body", "response_body", "template"} {
+		schema[f] = text
+	}
+	for _, f := range []string{
+		"status_code", "duration_ms", "response_size", "rows_affected", "explain_ms",
+		"repeated", "buffer_dropped", "dropped", "dropped_total",
+		"goroutines", "heap_alloc_bytes", "heap_inuse_bytes", "heap_objects", "sys_bytes", "open_fds",
+		"open_connections", "in_use", "idle", "wait_count", "wait_duration_ms",
+	} {
+		schema[f] = long
+	}
+	for _, f := range []string{"gc_pause_total_ms", "gc_pause_max_ms"} {
+		schema[f] = double
+	}
+	return schema
+}()
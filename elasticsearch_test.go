@@ -0,0 +1,282 @@
+package tlog
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// esTestServer is a fake cluster. status decides the bulk item status of a
+// document from its message; templateStatus is the status of template PUTs.
+type esTestServer struct {
+	*httptest.Server
+
+	mu             sync.Mutex
+	templateStatus int
+	templates      [][]byte
+	bulks          [][]map[string]interface{}
+	status         func(message string) int
+	auth           string
+}
+
+func newESTestServer(t *testing.T) *esTestServer {
+	t.Helper()
+	s := &esTestServer{templateStatus: http.StatusOK}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *esTestServer) handle(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.auth = r.Header.Get("Authorization")
+
+	switch {
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/_index_template/"):
+		s.templates = append(s.templates, body)
+		w.WriteHeader(s.templateStatus)
+		fmt.Fprint(w, `{"acknowledged":true}`)
+	case r.Method == http.MethodPost && r.URL.Path == "/_bulk":
+		var docs []map[string]interface{}
+		var items []interface{}
+		errors := false
+		sc := bufio.NewScanner(bytes.NewReader(body))
+		for sc.Scan() {
+			var action map[string]map[string]string
+			json.Unmarshal(sc.Bytes(), &action)
+			sc.Scan()
+			var doc map[string]interface{}
+			json.Unmarshal(sc.Bytes(), &doc)
+			docs = append(docs, doc)
+
+			status := http.StatusCreated
+			if s.status != nil {
+				status = s.status(fmt.Sprint(doc["message"]))
+			}
+			item := map[string]interface{}{"_index": action["create"]["_index"], "_id": action["create"]["_id"], "status": status}
+			if status >= 300 {
+				errors = true
+				item["error"] = map[string]string{"type": "mapper_parsing_exception"}
+			}
+			items = append(items, map[string]interface{}{"create": item})
+		}
+		s.bulks = append(s.bulks, docs)
+		json.NewEncoder(w).Encode(map[string]interface{}{"errors": errors, "items": items})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func esTestEntries(messages ...string) []SinkEntry {
+	batch := make([]SinkEntry, len(messages))
+	for i, m := range messages {
+		batch[i] = SinkEntry{
+			Time:    time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC),
+			Level:   zapcore.InfoLevel,
+			Message: m,
+			Fields:  map[string]interface{}{"request_id": "r-1"},
+		}
+	}
+	return batch
+}
+
+func TestElasticsearchSinkSend(t *testing.T) {
+	srv := newESTestServer(t)
+	sink, err := NewElasticsearchSink(ElasticsearchConfig{URL: srv.URL + "/", APIKey: "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Send(context.Background(), esTestEntries("one", "two")); err != nil {
+		t.Fatal(err)
+	}
+
+	if srv.auth != "ApiKey key" {
+		t.Errorf("Authorization = %q", srv.auth)
+	}
+	if len(srv.templates) != 0 {
+		t.Error("template installed without InstallTemplate")
+	}
+	if len(srv.bulks) != 1 || len(srv.bulks[0]) != 2 {
+		t.Fatalf("bulks = %v", srv.bulks)
+	}
+	doc := srv.bulks[0][0]
+	if doc["message"] != "one" || doc["request_id"] != "r-1" || doc["@timestamp"] != "2026-03-04T05:06:07Z" {
+		t.Errorf("document = %v", doc)
+	}
+}
+
+func TestElasticsearchSinkItemStatus(t *testing.T) {
+	srv := newESTestServer(t)
+	srv.status = func(message string) int {
+		switch message {
+		case "conflict":
+			return http.StatusConflict
+		case "busy":
+			return http.StatusTooManyRequests
+		case "mapping":
+			return http.StatusBadRequest
+		}
+		return http.StatusCreated
+	}
+	deadLetter := filepath.Join(t.TempDir(), "dead.jsonl")
+	sink, err := NewElasticsearchSink(ElasticsearchConfig{URL: srv.URL, DeadLetterPath: deadLetter})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch := esTestEntries("ok", "conflict", "busy", "mapping")
+	err = sink.Send(context.Background(), batch)
+	if err == nil || isPermanent(err) {
+		t.Fatalf("Send() error = %v, want a retryable error for the 429 item", err)
+	}
+
+	// The retry of the batch skips the dead-lettered document
+	srv.status = nil
+	if err := sink.Send(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(srv.bulks[1]); n != 3 {
+		t.Errorf("retry sent %d documents, want 3", n)
+	}
+
+	data, err := os.ReadFile(deadLetter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("dead letter has %d lines:\n%s", len(lines), data)
+	}
+	var rec map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec["status"] != float64(400) || rec["index"] != "tlog-2026.03.04" || rec["document"].(map[string]interface{})["message"] != "mapping" {
+		t.Errorf("dead letter = %v", rec)
+	}
+}
+
+func TestElasticsearchSinkSplitsBulk(t *testing.T) {
+	srv := newESTestServer(t)
+	sink, err := NewElasticsearchSink(ElasticsearchConfig{URL: srv.URL, MaxBulkBytes: 300})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Send(context.Background(), esTestEntries("a", "b", "c", "d")); err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, docs := range srv.bulks {
+		total += len(docs)
+	}
+	if len(srv.bulks) < 2 || total != 4 {
+		t.Errorf("got %d bulk requests with %d documents, want several with 4", len(srv.bulks), total)
+	}
+}
+
+func TestElasticsearchSinkTemplate(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        int
+		wantInstalled bool
+		wantRetry     bool
+	}{
+		{"installed", http.StatusOK, true, false},
+		{"rejected", http.StatusBadRequest, true, false},
+		{"unavailable", http.StatusServiceUnavailable, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newESTestServer(t)
+			srv.templateStatus = tt.status
+			sink, err := NewElasticsearchSink(ElasticsearchConfig{URL: srv.URL, InstallTemplate: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Documents are sent whether or not the template was installed
+			for i := 0; i < 2; i++ {
+				if err := sink.Send(context.Background(), esTestEntries("entry")); err != nil {
+					t.Fatalf("Send() error = %v", err)
+				}
+			}
+			if len(srv.bulks) != 2 {
+				t.Errorf("sent %d bulk requests, want 2", len(srv.bulks))
+			}
+			if len(srv.templates) != 1 {
+				t.Errorf("template PUT %d times, want 1", len(srv.templates))
+			}
+			if sink.installed != tt.wantInstalled {
+				t.Errorf("installed = %t, want %t", sink.installed, tt.wantInstalled)
+			}
+			if retry := !sink.nextInstall.IsZero(); retry != tt.wantRetry {
+				t.Errorf("retry scheduled = %t, want %t", retry, tt.wantRetry)
+			}
+
+			if tt.wantRetry {
+				sink.nextInstall = time.Now().Add(-time.Second)
+				srv.templateStatus = http.StatusOK
+				if err := sink.Send(context.Background(), esTestEntries("entry")); err != nil {
+					t.Fatal(err)
+				}
+				if len(srv.templates) != 2 || !sink.installed {
+					t.Errorf("template not installed on retry: %d PUTs", len(srv.templates))
+				}
+			}
+		})
+	}
+}
+
+func TestElasticsearchIndexTemplate(t *testing.T) {
+	tests := []struct {
+		name         string
+		cfg          ElasticsearchConfig
+		wantPattern  string
+		wantPriority float64
+	}{
+		{"defaults", ElasticsearchConfig{}, "tlog-*", 200},
+		{"custom", ElasticsearchConfig{Index: "billing-%Y.%m", TemplatePriority: 300}, "billing-*", 300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.URL = "http://es:9200"
+			sink, err := NewElasticsearchSink(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var template struct {
+				IndexPatterns []string `json:"index_patterns"`
+				Priority      float64  `json:"priority"`
+				Template      struct {
+					Mappings struct {
+						Properties map[string]map[string]interface{} `json:"properties"`
+					} `json:"mappings"`
+				} `json:"template"`
+			}
+			if err := json.Unmarshal(sink.IndexTemplate(), &template); err != nil {
+				t.Fatal(err)
+			}
+			if len(template.IndexPatterns) != 1 || template.IndexPatterns[0] != tt.wantPattern || template.Priority != tt.wantPriority {
+				t.Errorf("patterns = %v, priority = %v", template.IndexPatterns, template.Priority)
+			}
+			if template.Template.Mappings.Properties["status_code"]["type"] != "long" {
+				t.Errorf("status_code mapping = %v", template.Template.Mappings.Properties["status_code"])
+			}
+		})
+	}
+}
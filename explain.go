@@ -0,0 +1,275 @@
+package tlog
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ExplainConfig configures asynchronous EXPLAIN capture for slow queries.
+// Plans are captured for statements whose bind variables are known: GORM
+// queries run with GormPlugin registered and queries through WrapDriver.
+type ExplainConfig struct {
+	// DB is the connection pool EXPLAIN runs on. Use a pool separate from the
+	// application's so plan capture never competes for its connections.
+	DB *sql.DB
+
+	// Dialect selects the EXPLAIN syntax: EXPLAIN for Postgres and MySQL,
+	// EXPLAIN QUERY PLAN for SQLite.
+	// Default: the dialect the statement was lexed with
+	Dialect SQLDialect
+
+	// Timeout bounds each EXPLAIN.
+	// Default: 2s
+	Timeout time.Duration
+
+	// MaxPerMinute limits how many plans are captured per minute.
+	// Default: 10
+	MaxPerMinute int
+
+	// DedupWindow skips queries whose fingerprint was explained within the window.
+	// Default: 10m
+	DedupWindow time.Duration
+
+	// QueueSize bounds the number of pending captures; extra ones are dropped.
+	// Default: 16
+	QueueSize int
+}
+
+// boundQuery is a statement as sent to the database: SQL with placeholders
+// and the values bound to them.
+type boundQuery struct {
+	sql  string
+	vars []any
+}
+
+// explainJob is a pending EXPLAIN for one slow query.
+type explainJob struct {
+	ctx        context.Context
+	query      boundQuery
+	dialect    SQLDialect
+	normalized normalizedSQL
+}
+
+// slowQueryExplainer runs EXPLAIN for slow SELECTs in the background with
+// rate limiting and deduplication by fingerprint hash.
+type slowQueryExplainer struct {
+	cfg   ExplainConfig
+	queue chan explainJob
+
+	// ctx is canceled by close to abort the running EXPLAIN; done is closed
+	// when the worker exits.
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu          sync.Mutex
+	closed      bool
+	seen        map[string]time.Time
+	windowStart time.Time
+	windowCount int
+}
+
+// newSlowQueryExplainer applies defaults to cfg and starts an explainer,
+// or returns nil when no DB is configured.
+func newSlowQueryExplainer(cfg ExplainConfig) *slowQueryExplainer {
+	if cfg.DB == nil {
+		return nil
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 2 * time.Second
+	}
+	if cfg.MaxPerMinute <= 0 {
+		cfg.MaxPerMinute = 10
+	}
+	if cfg.DedupWindow <= 0 {
+		cfg.DedupWindow = 10 * time.Minute
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 16
+	}
+	e := &slowQueryExplainer{
+		cfg:   cfg,
+		queue: make(chan explainJob, cfg.QueueSize),
+		done:  make(chan struct{}),
+		seen:  make(map[string]time.Time),
+	}
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+	go e.run()
+	return e
+}
+
+// submit queues an EXPLAIN of query for a slow query lexed with dialect.
+// It never blocks and reports whether the query was queued. Only queued
+// queries count against deduplication and the rate limit.
+func (e *slowQueryExplainer) submit(ctx context.Context, query boundQuery, dialect SQLDialect, info sqlInfo, normalized normalizedSQL) bool {
+	if info.Operation != sqlOpSelect || !isExplainable(query.sql) {
+		return false
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	if e.closed || !e.allow(normalized.Hash, now) {
+		return false
+	}
+
+	job := explainJob{ctx: context.WithoutCancel(ctx), query: query, dialect: dialect, normalized: normalized}
+	select {
+	case e.queue <- job:
+		e.record(normalized.Hash, now)
+		return true
+	default:
+		return false
+	}
+}
+
+// allow applies deduplication and the per-minute rate limit. e.mu must be held.
+func (e *slowQueryExplainer) allow(hash string, now time.Time) bool {
+	if last, ok := e.seen[hash]; ok && now.Sub(last) < e.cfg.DedupWindow {
+		return false
+	}
+	if now.Sub(e.windowStart) >= time.Minute {
+		e.windowStart = now
+		e.windowCount = 0
+	}
+	return e.windowCount < e.cfg.MaxPerMinute
+}
+
+// record counts a queued capture against the rate limit and marks its hash
+// as explained. e.mu must be held.
+func (e *slowQueryExplainer) record(hash string, now time.Time) {
+	e.windowCount++
+
+	if len(e.seen) >= 1024 {
+		for h, t := range e.seen {
+			if now.Sub(t) >= e.cfg.DedupWindow {
+				delete(e.seen, h)
+			}
+		}
+	}
+	e.seen[hash] = now
+}
+
+// close stops the explainer: queued captures are discarded, the running
+// EXPLAIN is canceled, and close returns once the worker has exited.
+func (e *slowQueryExplainer) close() {
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.queue)
+	}
+	e.mu.Unlock()
+
+	e.cancel()
+	<-e.done
+}
+
+// run processes queued EXPLAIN jobs one at a time until the explainer is closed.
+func (e *slowQueryExplainer) run() {
+	defer close(e.done)
+	for job := range e.queue {
+		if e.ctx.Err() != nil {
+			continue
+		}
+		e.explain(job)
+	}
+}
+
+// explain runs EXPLAIN for a job and logs the plan.
+func (e *slowQueryExplainer) explain(job explainJob) {
+	ctx, cancel := context.WithTimeout(job.ctx, e.cfg.Timeout)
+	defer cancel()
+	stop := context.AfterFunc(e.ctx, cancel)
+	defer stop()
+
+	dialect := e.cfg.Dialect
+	if dialect == DialectAuto {
+		dialect = job.dialect
+	}
+
+	logger := FromContext(job.ctx)
+	fields := []zap.Field{
+		zap.String("component", "gorm"),
+		zap.String("sql_fingerprint", job.normalized.Fingerprint),
+		zap.String("sql_hash", job.normalized.Hash),
+	}
+
+	start := time.Now()
+	plan, err := queryPlan(ctx, e.cfg.DB, explainStatement(dialect, job.query.sql), job.query.vars...)
+	fields = append(fields, zap.Int64("explain_ms", time.Since(start).Milliseconds()))
+	if err != nil {
+		logger.Debug("Slow query plan capture failed", append(fields, zap.Error(err))...)
+		return
+	}
+
+	logger.Warn("Slow query plan captured", append(fields, zap.String("plan", plan))...)
+}
+
+// explainStatement returns the EXPLAIN statement for sql in the given dialect.
+func explainStatement(dialect SQLDialect, sql string) string {
+	if dialect == DialectSQLite {
+		return "EXPLAIN QUERY PLAN " + sql
+	}
+	return "EXPLAIN " + sql
+}
+
+// isExplainable reports whether sql is a plain query that EXPLAIN accepts.
+func isExplainable(sql string) bool {
+	upper := strings.ToUpper(strings.TrimLeft(sql, " \t\r\n("))
+	return strings.HasPrefix(upper, "SELECT") || strings.HasPrefix(upper, "WITH")
+}
+
+// queryPlan runs an EXPLAIN statement with its bind variables and renders
+// its rows as text, one row per line with columns separated by " | ".
+func queryPlan(ctx context.Context, db *sql.DB, stmt string, vars ...any) (string, error) {
+	rows, err := db.QueryContext(ctx, stmt, vars...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	if len(cols) > 1 {
+		b.WriteString(strings.Join(cols, " | "))
+	}
+
+	values := make([]any, len(cols))
+	ptrs := make([]any, len(cols))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return "", err
+		}
+		if b.Len() > 0 {
+			b.WriteByte('\n')
+		}
+		for i, v := range values {
+			if i > 0 {
+				b.WriteString(" | ")
+			}
+			switch v := v.(type) {
+			case nil:
+				b.WriteString("NULL")
+			case []byte:
+				b.Write(v)
+			default:
+				fmt.Fprint(&b, v)
+			}
+		}
+	}
+	return b.String(), rows.Err()
+}
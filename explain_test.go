@@ -0,0 +1,173 @@
+package tlog
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// waitForLog waits up to a few seconds for an entry with message msg.
+func waitForLog(t *testing.T, logs *observer.ObservedLogs, msg string) observer.LoggedEntry {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if entries := logs.FilterMessage(msg).All(); len(entries) > 0 {
+			return entries[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no %q entry logged", msg)
+	return observer.LoggedEntry{}
+}
+
+func TestSlowQueryPlanCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.db")
+	explainDB, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer explainDB.Close()
+
+	logger := NewGormLogger(
+		WithSlowThreshold(time.Nanosecond),
+		WithSlowQueryExplain(ExplainConfig{DB: explainDB}),
+	)
+	defer logger.Close()
+	db := openTestDB(t, path, logger)
+	if err := db.Use(NewGormPlugin()); err != nil {
+		t.Fatal(err)
+	}
+
+	logs := observeLogs(t, zapcore.DebugLevel)
+	var users []gormTestUser
+	name := `x"); DROP TABLE gorm_test_users; --`
+	if err := db.Where("name = ?", name).Find(&users).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	slow := logs.FilterMessage("Slow database query detected").All()
+	if len(slow) != 1 || slow[0].ContextMap()["plan_pending"] != true {
+		t.Fatalf("slow query entry = %v, want plan_pending", slow)
+	}
+	entry := waitForLog(t, logs, "Slow query plan captured")
+	plan, _ := entry.ContextMap()["plan"].(string)
+	if !strings.Contains(plan, "gorm_test_users") {
+		t.Errorf("plan %q does not mention the table", plan)
+	}
+	if entry.ContextMap()["sql_hash"] != slow[0].ContextMap()["sql_hash"] {
+		t.Error("plan and slow query sql_hash differ")
+	}
+	if !db.Migrator().HasTable(&gormTestUser{}) {
+		t.Error("EXPLAIN executed the interpolated value")
+	}
+}
+
+func TestSlowQueryPlanNeedsBindVariables(t *testing.T) {
+	explainDB, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer explainDB.Close()
+
+	logger := NewGormLogger(
+		WithSlowThreshold(time.Nanosecond),
+		WithSlowQueryExplain(ExplainConfig{DB: explainDB}),
+	)
+	defer logger.Close()
+	db := openTestDB(t, ":memory:", logger)
+
+	logs := observeLogs(t, zapcore.DebugLevel)
+	var users []gormTestUser
+	db.Where("name = ?", "x").Find(&users)
+
+	slow := logs.FilterMessage("Slow database query detected").All()
+	if len(slow) != 1 {
+		t.Fatalf("got %d slow query entries, want 1", len(slow))
+	}
+	if _, ok := slow[0].ContextMap()["plan_pending"]; ok {
+		t.Error("plan queued without the plugin's bind variables")
+	}
+}
+
+func TestSlowQueryExplainerLimits(t *testing.T) {
+	e := &slowQueryExplainer{
+		cfg:   ExplainConfig{MaxPerMinute: 2, DedupWindow: time.Minute},
+		queue: make(chan explainJob, 1),
+		seen:  make(map[string]time.Time),
+	}
+	info := sqlInfo{Operation: sqlOpSelect}
+	submit := func(hash string) bool {
+		return e.submit(context.Background(), boundQuery{sql: "SELECT 1"}, DialectSQLite, info, normalizedSQL{Hash: hash})
+	}
+
+	if !submit("a") {
+		t.Fatal("first query not queued")
+	}
+	if submit("a") {
+		t.Error("duplicate queued within the dedup window")
+	}
+	if submit("b") {
+		t.Error("queued into a full queue")
+	}
+	if _, ok := e.seen["b"]; ok || e.windowCount != 1 {
+		t.Errorf("dropped query recorded: seen=%v windowCount=%d", e.seen, e.windowCount)
+	}
+
+	<-e.queue
+	if !submit("b") {
+		t.Error("query dropped for a full queue not queued once there is room")
+	}
+	<-e.queue
+	if submit("c") {
+		t.Error("queued over MaxPerMinute")
+	}
+}
+
+func TestSlowQueryExplainerClose(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	e := newSlowQueryExplainer(ExplainConfig{DB: db})
+	e.close()
+	e.close()
+
+	info := sqlInfo{Operation: sqlOpSelect}
+	if e.submit(context.Background(), boundQuery{sql: "SELECT 1"}, DialectSQLite, info, normalizedSQL{Hash: "a"}) {
+		t.Error("queued after close")
+	}
+}
+
+func TestExplainStatement(t *testing.T) {
+	tests := []struct {
+		dialect SQLDialect
+		want    string
+	}{
+		{DialectSQLite, "EXPLAIN QUERY PLAN SELECT 1"},
+		{DialectPostgres, "EXPLAIN SELECT 1"},
+		{DialectMySQL, "EXPLAIN SELECT 1"},
+	}
+	for _, tt := range tests {
+		if got := explainStatement(tt.dialect, "SELECT 1"); got != tt.want {
+			t.Errorf("explainStatement(%v) = %q, want %q", tt.dialect, got, tt.want)
+		}
+	}
+	for sql, want := range map[string]bool{
+		"SELECT 1":                             true,
+		" (SELECT 1)":                          true,
+		"WITH a AS (SELECT 1) SELECT * FROM a": true,
+		"DELETE FROM t":                        false,
+	} {
+		if got := isExplainable(sql); got != want {
+			t.Errorf("isExplainable(%q) = %v, want %v", sql, got, want)
+		}
+	}
+}
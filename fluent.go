@@ -0,0 +1,281 @@
+package tlog
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// FluentMode is the Forward protocol event mode.
+type FluentMode int
+
+const (
+	// FluentForward sends a batch as one array of [time, record] entries.
+	FluentForward FluentMode = iota
+	// FluentPackedForward sends a batch as one binary stream of msgpack
+	// entries, optionally gzip compressed.
+	FluentPackedForward
+	// FluentMessage sends each entry as its own message.
+	FluentMessage
+)
+
+// FluentConfig configures a sink for Fluentd or Fluent Bit forward inputs.
+type FluentConfig struct {
+	// Address is the host:port of the forward input. Required.
+	// Example: "fluent-bit:24224"
+	Address string
+
+	// Tag is the event tag, used by Fluentd/Fluent Bit for routing.
+	// Default: Config.AppName, or "tlog"
+	Tag string
+
+	// Mode is the event mode.
+	// Default: FluentForward
+	Mode FluentMode
+
+	// Compress gzips FluentPackedForward entries.
+	// Default: false
+	Compress bool
+
+	// RequireAck asks the server to acknowledge each chunk; unacknowledged
+	// chunks are retried, giving at-least-once delivery.
+	// Default: false
+	RequireAck bool
+
+	// AckTimeout is how long to wait for an acknowledgement.
+	// Default: 10s
+	AckTimeout time.Duration
+
+	// TLSConfig enables TLS.
+	// Default: nil (plain TCP)
+	TLSConfig *tls.Config
+
+	// DialTimeout bounds connecting to Address.
+	// Default: 5s
+	DialTimeout time.Duration
+}
+
+// FluentSink sends entries with the Fluent Forward protocol. Create it with
+// NewFluentSink.
+type FluentSink struct {
+	cfg FluentConfig
+	tag string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NewFluentSink creates a Forward protocol sink, applying defaults to unset
+// fields. The connection is opened on the first Send.
+func NewFluentSink(cfg FluentConfig) (*FluentSink, error) {
+	if cfg.Address == "" {
+		return nil, errors.New("tlog: fluent address is required")
+	}
+	if cfg.Mode < FluentForward || cfg.Mode > FluentMessage {
+		return nil, fmt.Errorf("tlog: invalid fluent mode %d", int(cfg.Mode))
+	}
+	if cfg.Compress && cfg.Mode != FluentPackedForward {
+		return nil, errors.New("tlog: fluent compression requires FluentPackedForward")
+	}
+	if cfg.AckTimeout <= 0 {
+		cfg.AckTimeout = 10 * time.Second
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = 5 * time.Second
+	}
+	s := &FluentSink{cfg: cfg}
+	s.configure(Config{})
+	return s, nil
+}
+
+// Name returns "fluent".
+func (s *FluentSink) Name() string { return "fluent" }
+
+// configure takes the tag from the logger configuration.
+func (s *FluentSink) configure(cfg Config) {
+	s.tag = s.cfg.Tag
+	if s.tag == "" {
+		s.tag = cfg.AppName
+	}
+	if s.tag == "" {
+		s.tag = "tlog"
+	}
+}
+
+// Send writes a batch as one chunk, or as one message per entry in
+// FluentMessage mode, and waits for acknowledgements when RequireAck is
+// set. A failure closes the connection; the batcher keeps the entries
+// queued and retries them on a new one.
+func (s *FluentSink) Send(ctx context.Context, batch []SinkEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil && !connAlive(s.conn) {
+		s.closeConn()
+	}
+	if s.conn == nil {
+		if err := s.dial(ctx); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if s.cfg.Mode == FluentMessage {
+		for _, e := range batch {
+			if err = s.send(ctx, func(opt map[string]interface{}) []byte {
+				return s.message(e, opt)
+			}); err != nil {
+				break
+			}
+		}
+	} else {
+		err = s.send(ctx, func(opt map[string]interface{}) []byte {
+			return s.forward(batch, opt)
+		})
+	}
+	if err != nil {
+		s.closeConn()
+	}
+	return err
+}
+
+// Close closes the connection.
+func (s *FluentSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeConn()
+}
+
+// send writes one event built with the given option map, adding a chunk ID
+// and reading the acknowledgement when RequireAck is set.
+func (s *FluentSink) send(ctx context.Context, build func(opt map[string]interface{}) []byte) error {
+	opt := make(map[string]interface{}, 3)
+	var chunk string
+	if s.cfg.RequireAck {
+		var id [16]byte
+		if _, err := rand.Read(id[:]); err != nil {
+			return err
+		}
+		chunk = base64.StdEncoding.EncodeToString(id[:])
+		opt["chunk"] = chunk
+	}
+	msg := build(opt)
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.conn.SetWriteDeadline(deadline)
+	}
+	if _, err := s.conn.Write(msg); err != nil {
+		return err
+	}
+	if !s.cfg.RequireAck {
+		return nil
+	}
+
+	_ = s.conn.SetReadDeadline(time.Now().Add(s.cfg.AckTimeout))
+	defer s.conn.SetReadDeadline(time.Time{})
+	resp, err := readMsgpack(s.reader)
+	if err != nil {
+		return fmt.Errorf("tlog: fluent ack: %w", err)
+	}
+	m, _ := resp.(map[string]interface{})
+	if ack, _ := m["ack"].(string); ack != chunk {
+		return fmt.Errorf("tlog: fluent ack %q does not match chunk %q", ack, chunk)
+	}
+	return nil
+}
+
+// message encodes an entry in Message mode: [tag, time, record, option].
+func (s *FluentSink) message(e SinkEntry, opt map[string]interface{}) []byte {
+	b := appendMsgpackArrayHeader(nil, 4)
+	b = appendMsgpackString(b, s.tag)
+	b = appendFluentTime(b, e.Time)
+	b = appendMsgpack(b, e.record())
+	return appendMsgpack(b, opt)
+}
+
+// forward encodes a batch in Forward mode, [tag, [[time, record], ...],
+// option], or PackedForward mode, [tag, bin, option] with the entries
+// concatenated in the bin.
+func (s *FluentSink) forward(batch []SinkEntry, opt map[string]interface{}) []byte {
+	b := appendMsgpackArrayHeader(nil, 3)
+	b = appendMsgpackString(b, s.tag)
+
+	if s.cfg.Mode == FluentForward {
+		b = appendMsgpackArrayHeader(b, len(batch))
+		for _, e := range batch {
+			b = appendFluentEntry(b, e)
+		}
+		return appendMsgpack(b, opt)
+	}
+
+	var entries []byte
+	for _, e := range batch {
+		entries = appendFluentEntry(entries, e)
+	}
+	opt["size"] = len(batch)
+	if s.cfg.Compress {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write(entries)
+		_ = zw.Close()
+		entries = buf.Bytes()
+		opt["compressed"] = "gzip"
+	}
+	b = appendMsgpackBin(b, entries)
+	return appendMsgpack(b, opt)
+}
+
+// appendFluentEntry appends a [time, record] entry.
+func appendFluentEntry(b []byte, e SinkEntry) []byte {
+	b = appendMsgpackArrayHeader(b, 2)
+	b = appendFluentTime(b, e.Time)
+	return appendMsgpack(b, e.record())
+}
+
+// appendFluentTime appends t as an EventTime: extension type 0 holding
+// big-endian seconds and nanoseconds.
+func appendFluentTime(b []byte, t time.Time) []byte {
+	b = append(b, 0xd7, 0x00)
+	b = binary.BigEndian.AppendUint32(b, uint32(t.Unix()))
+	return binary.BigEndian.AppendUint32(b, uint32(t.Nanosecond()))
+}
+
+// dial connects to the forward input.
+func (s *FluentSink) dial(ctx context.Context) error {
+	d := net.Dialer{Timeout: s.cfg.DialTimeout}
+	var conn net.Conn
+	var err error
+	if s.cfg.TLSConfig != nil {
+		td := tls.Dialer{NetDialer: &d, Config: s.cfg.TLSConfig}
+		conn, err = td.DialContext(ctx, "tcp", s.cfg.Address)
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", s.cfg.Address)
+	}
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	s.reader = bufio.NewReader(conn)
+	return nil
+}
+
+// closeConn closes and forgets the connection.
+func (s *FluentSink) closeConn() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn, s.reader = nil, nil
+	return err
+}
@@ -0,0 +1,304 @@
+package tlog
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// fluentEvent is an event received by a test forward server.
+type fluentEvent struct {
+	tag    string
+	time   time.Time
+	record map[string]interface{}
+}
+
+// fluentTestServer is an in-process Forward protocol input. It decodes all
+// three event modes and acknowledges chunks unless noAck is set.
+type fluentTestServer struct {
+	t      *testing.T
+	ln     net.Listener
+	events chan fluentEvent
+	conns  chan net.Conn
+	chunks atomic.Int64
+	noAck  atomic.Bool
+}
+
+func newFluentTestServer(t *testing.T) *fluentTestServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fluentTestServer{t: t, ln: ln, events: make(chan fluentEvent, 100), conns: make(chan net.Conn, 10)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.conns <- conn
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fluentTestServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		v, err := readMsgpack(r)
+		if err != nil {
+			return
+		}
+		if err := s.handle(conn, v); err != nil {
+			s.t.Error(err)
+			return
+		}
+	}
+}
+
+func (s *fluentTestServer) handle(conn net.Conn, v interface{}) error {
+	msg, ok := v.([]interface{})
+	if !ok || len(msg) < 3 {
+		return fmt.Errorf("fluent: unexpected message %v", v)
+	}
+	tag, _ := msg[0].(string)
+
+	var events []fluentEvent
+	var opt map[string]interface{}
+	if len(msg) == 4 {
+		// Message mode: [tag, time, record, option]
+		ev, err := fluentTestEvent(tag, msg[1], msg[2])
+		if err != nil {
+			return err
+		}
+		events = append(events, ev)
+		opt, _ = msg[3].(map[string]interface{})
+	} else {
+		opt, _ = msg[2].(map[string]interface{})
+		switch entries := msg[1].(type) {
+		case []interface{}:
+			// Forward mode: [tag, [[time, record], ...], option]
+			for _, e := range entries {
+				pair := e.([]interface{})
+				ev, err := fluentTestEvent(tag, pair[0], pair[1])
+				if err != nil {
+					return err
+				}
+				events = append(events, ev)
+			}
+		case []byte:
+			// PackedForward mode: [tag, bin, option]
+			var r io.Reader = bytes.NewReader(entries)
+			if opt["compressed"] == "gzip" {
+				zr, err := gzip.NewReader(r)
+				if err != nil {
+					return err
+				}
+				r = zr
+			}
+			br := bufio.NewReader(r)
+			for {
+				e, err := readMsgpack(br)
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					return err
+				}
+				pair := e.([]interface{})
+				ev, err := fluentTestEvent(tag, pair[0], pair[1])
+				if err != nil {
+					return err
+				}
+				events = append(events, ev)
+			}
+			if size, _ := opt["size"].(int64); int(size) != len(events) {
+				return fmt.Errorf("fluent: size option %v for %d entries", opt["size"], len(events))
+			}
+		default:
+			return fmt.Errorf("fluent: unexpected entries %T", msg[1])
+		}
+	}
+
+	s.chunks.Add(1)
+	for _, ev := range events {
+		s.events <- ev
+	}
+	if chunk, ok := opt["chunk"].(string); ok && !s.noAck.Load() {
+		_, err := conn.Write(appendMsgpack(nil, map[string]interface{}{"ack": chunk}))
+		return err
+	}
+	return nil
+}
+
+// fluentTestEvent decodes an EventTime and a record.
+func fluentTestEvent(tag string, t, record interface{}) (fluentEvent, error) {
+	ext, ok := t.([]byte)
+	if !ok || len(ext) != 9 || ext[0] != 0 {
+		return fluentEvent{}, fmt.Errorf("fluent: time %v is not an EventTime", t)
+	}
+	ts := time.Unix(int64(binary.BigEndian.Uint32(ext[1:])), int64(binary.BigEndian.Uint32(ext[5:])))
+	rec, ok := record.(map[string]interface{})
+	if !ok {
+		return fluentEvent{}, fmt.Errorf("fluent: record %v is not a map", record)
+	}
+	return fluentEvent{tag: tag, time: ts, record: rec}, nil
+}
+
+func (s *fluentTestServer) receive(t *testing.T, n int) []fluentEvent {
+	t.Helper()
+	events := make([]fluentEvent, 0, n)
+	for len(events) < n {
+		select {
+		case ev := <-s.events:
+			events = append(events, ev)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d events, want %d", len(events), n)
+		}
+	}
+	return events
+}
+
+func fluentTestBatch() []SinkEntry {
+	base := time.Unix(1700000000, 123456789)
+	return []SinkEntry{
+		{Time: base, Level: zapcore.InfoLevel, Message: "first", Fields: map[string]interface{}{"request_id": "r-1", "status_code": 200}},
+		{Time: base.Add(time.Second), Level: zapcore.ErrorLevel, Message: "second", Fields: map[string]interface{}{"ok": false}},
+	}
+}
+
+func TestFluentSinkModes(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       FluentMode
+		compress   bool
+		requireAck bool
+		wantChunks int64
+	}{
+		{"forward", FluentForward, false, false, 1},
+		{"forward ack", FluentForward, false, true, 1},
+		{"packed", FluentPackedForward, false, false, 1},
+		{"packed gzip ack", FluentPackedForward, true, true, 1},
+		{"message", FluentMessage, false, false, 2},
+		{"message ack", FluentMessage, false, true, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newFluentTestServer(t)
+			sink, err := NewFluentSink(FluentConfig{
+				Address:    srv.ln.Addr().String(),
+				Tag:        "app.api",
+				Mode:       tt.mode,
+				Compress:   tt.compress,
+				RequireAck: tt.requireAck,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sink.Close()
+
+			batch := fluentTestBatch()
+			if err := sink.Send(context.Background(), batch); err != nil {
+				t.Fatal(err)
+			}
+			events := srv.receive(t, 2)
+			for i, ev := range events {
+				if ev.tag != "app.api" || !ev.time.Equal(batch[i].Time) || ev.record["message"] != batch[i].Message {
+					t.Errorf("event %d = %+v", i, ev)
+				}
+			}
+			if events[0].record["request_id"] != "r-1" || events[0].record["status_code"] != uint64(200) || events[1].record["ok"] != false {
+				t.Errorf("records = %v, %v", events[0].record, events[1].record)
+			}
+			if got := srv.chunks.Load(); got != tt.wantChunks {
+				t.Errorf("server got %d chunks, want %d", got, tt.wantChunks)
+			}
+		})
+	}
+}
+
+func TestFluentSinkMissingAck(t *testing.T) {
+	srv := newFluentTestServer(t)
+	srv.noAck.Store(true)
+	sink, err := NewFluentSink(FluentConfig{Address: srv.ln.Addr().String(), RequireAck: true, AckTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	if err := sink.Send(context.Background(), fluentTestBatch()); err == nil {
+		t.Fatal("Send() without an ack succeeded")
+	}
+	if sink.conn != nil {
+		t.Error("connection kept after a missing ack")
+	}
+
+	// The retried batch is delivered again on a new connection
+	srv.noAck.Store(false)
+	if err := sink.Send(context.Background(), fluentTestBatch()); err != nil {
+		t.Fatal(err)
+	}
+	srv.receive(t, 4)
+	if len(srv.conns) != 2 {
+		t.Errorf("server accepted %d connections, want 2", len(srv.conns))
+	}
+}
+
+func TestFluentSinkReconnects(t *testing.T) {
+	srv := newFluentTestServer(t)
+	sink, err := NewFluentSink(FluentConfig{Address: srv.ln.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.configure(Config{AppName: "billing"})
+	defer sink.Close()
+
+	if err := sink.Send(context.Background(), fluentTestBatch()[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if ev := srv.receive(t, 1)[0]; ev.tag != "billing" {
+		t.Errorf("tag = %q, want the app name", ev.tag)
+	}
+
+	(<-srv.conns).Close()
+	time.Sleep(10 * time.Millisecond)
+	if err := sink.Send(context.Background(), fluentTestBatch()[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if ev := srv.receive(t, 1)[0]; ev.record["message"] != "second" {
+		t.Errorf("event after reconnect = %v", ev.record)
+	}
+}
+
+func TestNewFluentSinkValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  FluentConfig
+	}{
+		{"no address", FluentConfig{}},
+		{"bad mode", FluentConfig{Address: "fluent:24224", Mode: FluentMode(5)}},
+		{"compress without packed forward", FluentConfig{Address: "fluent:24224", Compress: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewFluentSink(tt.cfg); err == nil {
+				t.Error("NewFluentSink() error = nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,388 @@
+package tlog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// GELFTransport is the network transport of a GELF sink.
+type GELFTransport int
+
+const (
+	// GELFUDP sends each message as one datagram, chunked when it is larger
+	// than ChunkSize.
+	GELFUDP GELFTransport = iota
+	// GELFTCP sends null-byte terminated messages over a stream connection.
+	GELFTCP
+)
+
+// GELFCompression is the compression of GELF UDP messages.
+type GELFCompression int
+
+const (
+	// GELFGzip compresses messages with gzip.
+	GELFGzip GELFCompression = iota
+	// GELFZlib compresses messages with zlib.
+	GELFZlib
+	// GELFNoCompression sends plain JSON.
+	GELFNoCompression
+)
+
+const (
+	// gelfChunkMagic starts every chunk of a chunked UDP message.
+	gelfChunkMagic = "\x1e\x0f"
+	// gelfChunkHeader is the size of the magic, message ID, sequence
+	// number and sequence count.
+	gelfChunkHeader = 12
+	// gelfMaxChunks is the most chunks a GELF message may have.
+	gelfMaxChunks = 128
+)
+
+// GELFConfig configures a sink for Graylog GELF inputs.
+type GELFConfig struct {
+	// Address is the host:port of the GELF input. Required.
+	// Example: "graylog:12201"
+	Address string
+
+	// Transport is the network transport.
+	// Default: GELFUDP
+	Transport GELFTransport
+
+	// Compression is applied to UDP messages; Graylog TCP inputs do not
+	// accept compressed messages.
+	// Default: GELFGzip
+	Compression GELFCompression
+
+	// ChunkSize is the maximum UDP datagram size, including the chunk
+	// header. Keep it below the path MTU; 8192 at most.
+	// Default: 1420
+	ChunkSize int
+
+	// Host is the host field of every message.
+	// Default: the hostname
+	Host string
+
+	// TLSConfig enables TLS for TCP.
+	// Default: nil (plain TCP)
+	TLSConfig *tls.Config
+
+	// DialTimeout bounds connecting to Address.
+	// Default: 5s
+	DialTimeout time.Duration
+}
+
+// GELFSink sends entries in GELF 1.1. Create it with NewGELFSink.
+type GELFSink struct {
+	cfg GELFConfig
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewGELFSink creates a GELF sink, applying defaults to unset fields. The
+// connection is opened on the first Send.
+func NewGELFSink(cfg GELFConfig) (*GELFSink, error) {
+	if cfg.Address == "" {
+		return nil, errors.New("tlog: GELF address is required")
+	}
+	if cfg.Transport != GELFUDP && cfg.Transport != GELFTCP {
+		return nil, fmt.Errorf("tlog: invalid GELF transport %d", int(cfg.Transport))
+	}
+	if cfg.Compression < GELFGzip || cfg.Compression > GELFNoCompression {
+		return nil, fmt.Errorf("tlog: invalid GELF compression %d", int(cfg.Compression))
+	}
+	if cfg.ChunkSize <= 0 {
+		cfg.ChunkSize = 1420
+	}
+	if cfg.ChunkSize <= gelfChunkHeader || cfg.ChunkSize > 8192 {
+		return nil, fmt.Errorf("tlog: GELF chunk size must be between %d and 8192", gelfChunkHeader+1)
+	}
+	if cfg.TLSConfig != nil && cfg.Transport != GELFTCP {
+		return nil, errors.New("tlog: GELF TLS requires the TCP transport")
+	}
+	if cfg.Host == "" {
+		cfg.Host, _ = os.Hostname()
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = 5 * time.Second
+	}
+	return &GELFSink{cfg: cfg}, nil
+}
+
+// Name returns "gelf".
+func (s *GELFSink) Name() string { return "gelf" }
+
+// Send writes the entries of a batch one message at a time. A failed write
+// closes the connection and is retried once on a new one; a batch retried
+// by the batcher may repeat messages written before the failure. Messages
+// that cannot be encoded, or need more than 128 UDP chunks, are skipped.
+func (s *GELFSink) Send(ctx context.Context, batch []SinkEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil && s.cfg.Transport == GELFTCP && !connAlive(s.conn) {
+		s.closeConn()
+	}
+	for _, e := range batch {
+		msg, err := s.message(e)
+		if err != nil {
+			continue
+		}
+		if err := s.write(ctx, msg); err != nil {
+			if isPermanent(err) {
+				continue
+			}
+			s.closeConn()
+			if err := s.write(ctx, msg); err != nil {
+				s.closeConn()
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes the connection.
+func (s *GELFSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeConn()
+}
+
+// message encodes an entry for the transport: compressed JSON for UDP,
+// null-terminated JSON for TCP.
+func (s *GELFSink) message(e SinkEntry) ([]byte, error) {
+	data, err := encodeGELF(e, s.cfg.Host)
+	if err != nil {
+		return nil, err
+	}
+	if s.cfg.Transport == GELFTCP {
+		return append(data, 0), nil
+	}
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch s.cfg.Compression {
+	case GELFGzip:
+		w = gzip.NewWriter(&buf)
+	case GELFZlib:
+		w = zlib.NewWriter(&buf)
+	default:
+		return data, nil
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// write sends one message, dialing when there is no connection.
+func (s *GELFSink) write(ctx context.Context, msg []byte) error {
+	if s.conn == nil {
+		conn, err := s.dial(ctx)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.conn.SetWriteDeadline(deadline)
+	}
+
+	if s.cfg.Transport == GELFTCP || len(msg) <= s.cfg.ChunkSize {
+		_, err := s.conn.Write(msg)
+		return err
+	}
+
+	chunks, err := gelfChunks(msg, s.cfg.ChunkSize)
+	if err != nil {
+		return PermanentError(err)
+	}
+	for _, c := range chunks {
+		if _, err := s.conn.Write(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dial connects to the GELF input.
+func (s *GELFSink) dial(ctx context.Context) (net.Conn, error) {
+	d := net.Dialer{Timeout: s.cfg.DialTimeout}
+	if s.cfg.Transport == GELFUDP {
+		return d.DialContext(ctx, "udp", s.cfg.Address)
+	}
+	if s.cfg.TLSConfig != nil {
+		td := tls.Dialer{NetDialer: &d, Config: s.cfg.TLSConfig}
+		return td.DialContext(ctx, "tcp", s.cfg.Address)
+	}
+	return d.DialContext(ctx, "tcp", s.cfg.Address)
+}
+
+// closeConn closes and forgets the connection.
+func (s *GELFSink) closeConn() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// connAlive reports whether the peer of a stream connection it never reads
+// from is still connected. A write to a connection closed by the peer
+// succeeds once before failing, so the message would be lost; reading
+// detects the close first.
+func connAlive(conn net.Conn) bool {
+	if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return false
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// gelfChunks splits a message into chunks of at most size bytes, each with
+// the chunk magic, a shared random message ID, its sequence number and the
+// sequence count.
+func gelfChunks(msg []byte, size int) ([][]byte, error) {
+	payload := size - gelfChunkHeader
+	count := (len(msg) + payload - 1) / payload
+	if count > gelfMaxChunks {
+		return nil, fmt.Errorf("tlog: GELF message of %d bytes needs more than %d chunks", len(msg), gelfMaxChunks)
+	}
+
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	chunks := make([][]byte, 0, count)
+	for seq := 0; seq < count; seq++ {
+		part := msg[seq*payload:]
+		if len(part) > payload {
+			part = part[:payload]
+		}
+		c := make([]byte, 0, gelfChunkHeader+len(part))
+		c = append(c, gelfChunkMagic...)
+		c = append(c, id[:]...)
+		c = append(c, byte(seq), byte(count))
+		chunks = append(chunks, append(c, part...))
+	}
+	return chunks, nil
+}
+
+// encodeGELF encodes an entry as a GELF 1.1 message. Fields become
+// additional fields prefixed with "_"; values other than strings and
+// numbers are encoded as JSON strings.
+func encodeGELF(e SinkEntry, host string) ([]byte, error) {
+	msg := make(map[string]interface{}, len(e.Fields)+10)
+	for k, v := range e.Fields {
+		msg[gelfFieldName(k)] = gelfValue(v)
+	}
+
+	short := e.Message
+	if short == "" {
+		short = "-"
+	}
+	msg["version"] = "1.1"
+	msg["host"] = host
+	msg["short_message"] = short
+	msg["timestamp"] = math.Round(float64(e.Time.UnixNano())/1e6) / 1e3
+	msg["level"] = syslogSeverity(e.Level)
+	msg["_level_name"] = e.Level.String()
+	if e.Stack != "" {
+		msg["full_message"] = e.Message + "\n" + e.Stack
+	}
+	if e.LoggerName != "" {
+		msg["_logger"] = e.LoggerName
+	}
+	if e.Caller.Defined {
+		msg["_caller"] = e.Caller.TrimmedPath()
+	}
+	return json.Marshal(msg)
+}
+
+// gelfFieldName returns the additional field name of a field: "_" followed
+// by the name with characters outside [A-Za-z0-9_.-] replaced. "_id" is
+// reserved by GELF, so the id field becomes "_id_".
+func gelfFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '.', r == '-':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+	if name == "id" {
+		return "_id_"
+	}
+	return "_" + name
+}
+
+// gelfValue converts a field value to a GELF additional field value, which
+// must be a string or a number.
+func gelfValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case time.Duration:
+		return v.String()
+	case nil:
+		return ""
+	case fmt.Stringer:
+		return v.String()
+	default:
+		if data, err := json.Marshal(v); err == nil {
+			return string(data)
+		}
+		return fmt.Sprint(v)
+	}
+}
+
+// syslogSeverity maps a level to a syslog severity: debug 7, info 6,
+// warn 4, error 3, dpanic 2 (critical), panic 1 (alert), fatal 0
+// (emergency).
+func syslogSeverity(level zapcore.Level) int {
+	switch level {
+	case zapcore.DebugLevel:
+		return 7
+	case zapcore.InfoLevel:
+		return 6
+	case zapcore.WarnLevel:
+		return 4
+	case zapcore.ErrorLevel:
+		return 3
+	case zapcore.DPanicLevel:
+		return 2
+	case zapcore.PanicLevel:
+		return 1
+	case zapcore.FatalLevel:
+		return 0
+	default:
+		return 6
+	}
+}
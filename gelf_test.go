@@ -0,0 +1,287 @@
+package tlog
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math/rand/v2"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// gelfUDPListener reassembles the GELF messages received on a local UDP
+// port, checking that no datagram exceeds maxSize.
+func gelfUDPListener(t *testing.T, maxSize int) (string, chan map[string]interface{}) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	messages := make(chan map[string]interface{}, 10)
+	go func() {
+		partial := map[string][][]byte{}
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n > maxSize {
+				t.Errorf("datagram of %d bytes exceeds %d", n, maxSize)
+			}
+			data := append([]byte(nil), buf[:n]...)
+			if bytes.HasPrefix(data, []byte(gelfChunkMagic)) {
+				id, seq, count := string(data[2:10]), int(data[10]), int(data[11])
+				if partial[id] == nil {
+					partial[id] = make([][]byte, count)
+				}
+				partial[id][seq] = data[gelfChunkHeader:]
+				complete := true
+				for _, c := range partial[id] {
+					complete = complete && c != nil
+				}
+				if !complete {
+					continue
+				}
+				data = bytes.Join(partial[id], nil)
+				delete(partial, id)
+			}
+			messages <- decodeGELFDatagram(t, data)
+		}
+	}()
+	return conn.LocalAddr().String(), messages
+}
+
+// decodeGELFDatagram decompresses a message by its magic bytes and decodes it.
+func decodeGELFDatagram(t *testing.T, data []byte) map[string]interface{} {
+	var r io.Reader = bytes.NewReader(data)
+	var err error
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		r, err = gzip.NewReader(r)
+	case data[0] == 0x78:
+		r, err = zlib.NewReader(r)
+	}
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	var msg map[string]interface{}
+	if err := json.NewDecoder(r).Decode(&msg); err != nil {
+		t.Error(err)
+	}
+	return msg
+}
+
+func receiveGELF(t *testing.T, messages chan map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no GELF message received")
+		return nil
+	}
+}
+
+// gelfTestText returns n bytes of hex text that compresses to about half.
+func gelfTestText(n int) string {
+	r := rand.New(rand.NewPCG(3, 4))
+	b := make([]byte, n/2)
+	for i := range b {
+		b[i] = byte(r.IntN(256))
+	}
+	return hex.EncodeToString(b)
+}
+
+func TestGELFSinkUDP(t *testing.T) {
+	long := gelfTestText(20000)
+	tests := []struct {
+		name        string
+		compression GELFCompression
+		message     string
+	}{
+		{"gzip", GELFGzip, "short"},
+		{"zlib", GELFZlib, "short"},
+		{"plain", GELFNoCompression, "short"},
+		{"gzip chunked", GELFGzip, long},
+		{"plain chunked", GELFNoCompression, long},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, messages := gelfUDPListener(t, 1420)
+			sink, err := NewGELFSink(GELFConfig{Address: addr, Compression: tt.compression, Host: "web-1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sink.Close()
+
+			entry := SinkEntry{
+				Time:       time.Unix(1700000000, 123456789),
+				Level:      zapcore.ErrorLevel,
+				LoggerName: "db",
+				Message:    tt.message,
+				Stack:      "goroutine 1",
+				Fields:     map[string]interface{}{"id": "x", "http.method": "GET", "status code": 500, "tags": []string{"a"}},
+			}
+			if err := sink.Send(context.Background(), []SinkEntry{entry}); err != nil {
+				t.Fatal(err)
+			}
+
+			msg := receiveGELF(t, messages)
+			want := map[string]interface{}{
+				"version":       "1.1",
+				"host":          "web-1",
+				"short_message": tt.message,
+				"full_message":  tt.message + "\ngoroutine 1",
+				"timestamp":     1700000000.123,
+				"level":         float64(3),
+				"_level_name":   "error",
+				"_logger":       "db",
+				"_id_":          "x",
+				"_http.method":  "GET",
+				"_status_code":  float64(500),
+				"_tags":         `["a"]`,
+			}
+			for k, v := range want {
+				if msg[k] != v {
+					t.Errorf("%s = %v, want %v", k, msg[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestGELFSinkSkipsOversizedMessage(t *testing.T) {
+	addr, messages := gelfUDPListener(t, 100)
+	sink, err := NewGELFSink(GELFConfig{Address: addr, ChunkSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	batch := []SinkEntry{
+		{Time: time.Now(), Message: gelfTestText(40000)},
+		{Time: time.Now(), Message: "after"},
+	}
+	if err := sink.Send(context.Background(), batch); err != nil {
+		t.Fatalf("Send() error = %v, want the oversized message skipped", err)
+	}
+	if msg := receiveGELF(t, messages); msg["short_message"] != "after" {
+		t.Errorf("got %v, want only the second message", msg["short_message"])
+	}
+}
+
+func TestGELFChunks(t *testing.T) {
+	msg := []byte(gelfTestText(1000))
+	chunks, err := gelfChunks(msg, 112)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 10 {
+		t.Fatalf("got %d chunks, want 10", len(chunks))
+	}
+	var joined []byte
+	for seq, c := range chunks {
+		if len(c) > 112 || string(c[:2]) != gelfChunkMagic || !bytes.Equal(c[2:10], chunks[0][2:10]) || int(c[10]) != seq || int(c[11]) != 10 {
+			t.Errorf("chunk %d header = %x", seq, c[:gelfChunkHeader])
+		}
+		joined = append(joined, c[gelfChunkHeader:]...)
+	}
+	if !bytes.Equal(joined, msg) {
+		t.Error("chunks do not reassemble to the message")
+	}
+
+	if _, err := gelfChunks(make([]byte, 129*100), 112); err == nil {
+		t.Error("message needing 129 chunks accepted")
+	}
+}
+
+func TestGELFSinkTCPReconnects(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	messages := make(chan map[string]interface{}, 10)
+	conns := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+			go func() {
+				r := bufio.NewReader(conn)
+				for {
+					data, err := r.ReadBytes(0)
+					if err != nil {
+						return
+					}
+					var msg map[string]interface{}
+					if err := json.Unmarshal(data[:len(data)-1], &msg); err != nil {
+						t.Error(err)
+					}
+					messages <- msg
+				}
+			}()
+		}
+	}()
+
+	sink, err := NewGELFSink(GELFConfig{Address: ln.Addr().String(), Transport: GELFTCP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	if err := sink.Send(context.Background(), []SinkEntry{{Time: time.Now(), Message: "first"}}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receiveGELF(t, messages); msg["short_message"] != "first" {
+		t.Fatalf("got %v", msg)
+	}
+
+	// The server drops the connection; the next message goes over a new one
+	(<-conns).Close()
+	time.Sleep(10 * time.Millisecond)
+	if err := sink.Send(context.Background(), []SinkEntry{{Time: time.Now(), Message: "second"}}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receiveGELF(t, messages); msg["short_message"] != "second" {
+		t.Fatalf("got %v", msg)
+	}
+}
+
+func TestNewGELFSinkValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  GELFConfig
+	}{
+		{"no address", GELFConfig{}},
+		{"bad transport", GELFConfig{Address: "graylog:12201", Transport: GELFTransport(3)}},
+		{"bad compression", GELFConfig{Address: "graylog:12201", Compression: GELFCompression(7)}},
+		{"chunk too small", GELFConfig{Address: "graylog:12201", ChunkSize: 12}},
+		{"chunk too large", GELFConfig{Address: "graylog:12201", ChunkSize: 9000}},
+		{"tls over udp", GELFConfig{Address: "graylog:12201", TLSConfig: new(tls.Config)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewGELFSink(tt.cfg); err == nil {
+				t.Error("NewGELFSink() error = nil")
+			}
+		})
+	}
+}
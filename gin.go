@@ -12,9 +12,6 @@ import (
 	"go.uber.org/zap"
 )
 
-// DefaultMaskValue is the default replacement for masked fields.
-const DefaultMaskValue = "******"
-
 // GinConfig contains configuration for the Gin middleware.
 type GinConfig struct {
 	// RequestIDHeader is the header key for request ID.
@@ -43,6 +40,11 @@ type GinConfig struct {
 	// MaskPatterns is a list of compiled regex patterns for field names to mask.
 	// Values of fields whose names match any pattern will be replaced with "******".
 	MaskPatterns []*regexp.Regexp
+
+	// RequestBuffer enables fingers-crossed logging for entries logged with
+	// FromContext(c.Request.Context()): they are flushed only when the request fails.
+	// Default: disabled
+	RequestBuffer RequestBufferConfig
 }
 
 // DefaultGinConfig returns a GinConfig with sensible defaults.
@@ -107,12 +109,18 @@ func WithUUIDv7(enabled bool) GinOptionFunc {
 // Example: WithMaskPatterns(`(?i)password`, `(?i)secret`, `(?i)token`)
 func WithMaskPatterns(patterns ...string) GinOptionFunc {
 	return func(c *GinConfig) {
-		c.MaskPatterns = make([]*regexp.Regexp, 0, len(patterns))
-		for _, p := range patterns {
-			if re, err := regexp.Compile(p); err == nil {
-				c.MaskPatterns = append(c.MaskPatterns, re)
-			}
-		}
+		c.MaskPatterns = compilePatterns(patterns)
+	}
+}
+
+// WithRequestBuffer enables per-request buffering of entries below cfg.Level.
+// Buffered entries are discarded when the request succeeds and written when an
+// entry at cfg.FlushLevel is logged or the status code is 500 or more.
+// Example: WithRequestBuffer(tlog.RequestBufferConfig{Level: "info", MaxEntries: 500})
+func WithRequestBuffer(cfg RequestBufferConfig) GinOptionFunc {
+	return func(c *GinConfig) {
+		cfg.Enabled = true
+		c.RequestBuffer = cfg
 	}
 }
 
@@ -145,16 +153,6 @@ func maskJSONFields(data any, patterns []*regexp.Regexp) any {
 	}
 }
 
-// shouldMask checks if a field name matches any of the mask patterns.
-func shouldMask(fieldName string, patterns []*regexp.Regexp) bool {
-	for _, p := range patterns {
-		if p.MatchString(fieldName) {
-			return true
-		}
-	}
-	return false
-}
-
 // maskBody parses JSON body and masks sensitive fields, returning the masked JSON string.
 // If parsing fails, returns the original body unchanged.
 func maskBody(body string, patterns []*regexp.Regexp) string {
@@ -199,6 +197,13 @@ func GinMiddleware(opts ...GinOptionFunc) gin.HandlerFunc {
 		skipPathMap[path] = true
 	}
 
+	if cfg.RequestBuffer.Enabled {
+		if err := cfg.RequestBuffer.validate(); err != nil {
+			L().Warn("Request buffering disabled", zap.String("component", "http"), zap.Error(err))
+			cfg.RequestBuffer.Enabled = false
+		}
+	}
+
 	return func(c *gin.Context) {
 		path := c.Request.URL.Path
 
@@ -220,6 +225,15 @@ func GinMiddleware(opts ...GinOptionFunc) gin.HandlerFunc {
 		c.Set("request_id", requestID)
 		c.Header(cfg.RequestIDHeader, requestID)
 
+		// Expose the request ID, and the request buffer if enabled, to FromContext
+		ctx := WithRequestID(c.Request.Context(), requestID)
+		var buf *requestBuffer
+		if cfg.RequestBuffer.Enabled {
+			buf = newRequestBuffer(cfg.RequestBuffer, zap.String("request_id", requestID))
+			ctx = withRequestBuffer(ctx, buf)
+		}
+		c.Request = c.Request.WithContext(ctx)
+
 		// Request start time
 		start := time.Now()
 
@@ -250,6 +264,7 @@ func GinMiddleware(opts ...GinOptionFunc) gin.HandlerFunc {
 
 		// Log request received
 		L().Info("Request received",
+			zap.String("component", "http"),
 			zap.String("request_id", requestID),
 			zap.String("method", method),
 			zap.String("path", path),
@@ -279,6 +294,7 @@ func GinMiddleware(opts ...GinOptionFunc) gin.HandlerFunc {
 
 		// Build log fields
 		logFields := []zap.Field{
+			zap.String("component", "http"),
 			zap.String("request_id", requestID),
 			zap.String("method", method),
 			zap.String("path", path),
@@ -325,6 +341,11 @@ func GinMiddleware(opts ...GinOptionFunc) gin.HandlerFunc {
 			logFields = append(logFields, zap.String("gin_errors", c.Errors.String()))
 		}
 
+		// Flush buffered entries of failed requests ahead of the completion entry
+		if buf != nil {
+			buf.close(statusCode >= 500)
+		}
+
 		// Log based on status code
 		switch {
 		case statusCode >= 500:
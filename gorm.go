@@ -3,14 +3,17 @@ package tlog
 import (
 	"context"
 	"errors"
+	"fmt"
+	"math/rand/v2"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"gorm.io/gorm"
 	gormlogger "gorm.io/gorm/logger"
-	"gorm.io/gorm/utils"
 )
 
 // GormConfig contains configuration for the GORM logger adapter.
@@ -26,6 +29,84 @@ type GormConfig struct {
 	// LogLevel sets the GORM log level.
 	// Default: gormlogger.Warn
 	LogLevel gormlogger.LogLevel
+
+	// SQLMode controls how SQL text is logged.
+	// SQLModeFull logs the executed statement, SQLModeRedacted replaces all literals with "?".
+	// Default: SQLModeFull
+	SQLMode SQLMode
+
+	// MaskColumns is a list of compiled regex patterns for column names to mask.
+	// Values compared with or inserted into matching columns are replaced with '******'
+	// when SQLMode is SQLModeFull.
+	// Default: DefaultMaskPatterns
+	MaskColumns []*regexp.Regexp
+
+	// Dialect selects the SQL quoting rules used to parse and redact statements.
+	// DialectAuto takes the dialect from db.Dialector.Name() once GormPlugin is
+	// registered on the database.
+	// Default: DialectAuto
+	Dialect SQLDialect
+
+	// Explain enables asynchronous EXPLAIN capture for slow SELECTs when Explain.DB is set.
+	// Default: disabled
+	Explain ExplainConfig
+
+	// Policies override SlowThreshold, LogLevel, sampling and SQL text per
+	// table and operation. The first matching policy wins; unmatched queries
+	// use the settings above.
+	Policies []GormPolicy
+}
+
+// GormPolicy overrides logging behaviour for queries matching a table and/or operation.
+type GormPolicy struct {
+	// Table matches any table referenced by the query, case-insensitively.
+	// "users" also matches "public.users". Empty matches every table.
+	Table string
+
+	// Operation matches the statement operation, e.g. "SELECT" or "UPSERT".
+	// Empty matches every operation.
+	Operation string
+
+	// SlowThreshold overrides GormConfig.SlowThreshold. Zero inherits.
+	SlowThreshold time.Duration
+
+	// LogLevel overrides GormConfig.LogLevel. Zero inherits. It does not
+	// apply to sessions silenced with LogMode(gormlogger.Silent).
+	LogLevel gormlogger.LogLevel
+
+	// SampleRate is the fraction (0, 1] of successful queries that are logged.
+	// Failed and slow queries are never sampled. Zero inherits (log every query).
+	SampleRate float64
+
+	// OmitSQL drops the sql field; sql_fingerprint and sql_hash are kept.
+	OmitSQL bool
+}
+
+// matches reports whether the policy applies to a parsed statement.
+func (p GormPolicy) matches(info sqlInfo) bool {
+	if p.Operation != "" && !strings.EqualFold(p.Operation, info.Operation) {
+		return false
+	}
+	if p.Table == "" {
+		return true
+	}
+	for _, table := range info.Tables {
+		if strings.EqualFold(p.Table, table) {
+			return true
+		}
+		if i := strings.LastIndexByte(table, '.'); i >= 0 && strings.EqualFold(p.Table, table[i+1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// queryPolicy is the effective logging behaviour for one query.
+type queryPolicy struct {
+	slowThreshold time.Duration
+	logLevel      gormlogger.LogLevel
+	sampleRate    float64
+	omitSQL       bool
 }
 
 // DefaultGormConfig returns a GormConfig with sensible defaults.
@@ -34,6 +115,8 @@ func DefaultGormConfig() GormConfig {
 		SlowThreshold:        200 * time.Millisecond,
 		IgnoreRecordNotFound: true,
 		LogLevel:             gormlogger.Warn,
+		SQLMode:              SQLModeFull,
+		MaskColumns:          compilePatterns(DefaultMaskPatterns),
 	}
 }
 
@@ -61,9 +144,64 @@ func WithGormLogLevel(level gormlogger.LogLevel) GormOption {
 	}
 }
 
+// WithSQLMode sets how SQL text is logged.
+func WithSQLMode(mode SQLMode) GormOption {
+	return func(c *GormConfig) {
+		c.SQLMode = mode
+	}
+}
+
+// WithSQLMaskColumns sets regex patterns for column names whose values are masked in logged SQL,
+// replacing DefaultMaskPatterns. Call it without patterns to disable masking.
+// Example: WithSQLMaskColumns(append(tlog.DefaultMaskPatterns, `(?i)^email$`)...)
+func WithSQLMaskColumns(patterns ...string) GormOption {
+	return func(c *GormConfig) {
+		c.MaskColumns = compilePatterns(patterns)
+	}
+}
+
+// WithSQLDialect sets the SQL dialect used to parse and redact statements.
+// Example: WithSQLDialect(tlog.ParseSQLDialect(db.Dialector.Name()))
+func WithSQLDialect(dialect SQLDialect) GormOption {
+	return func(c *GormConfig) {
+		c.Dialect = dialect
+	}
+}
+
+// WithGormPolicies appends per-table/per-operation policies. The first matching policy wins.
+// Example:
+//
+//	WithGormPolicies(
+//		tlog.GormPolicy{Table: "analytics_events", SlowThreshold: 5 * time.Second, SampleRate: 0.01},
+//		tlog.GormPolicy{Table: "sessions", SlowThreshold: 50 * time.Millisecond, LogLevel: gormlogger.Info},
+//	)
+func WithGormPolicies(policies ...GormPolicy) GormOption {
+	return func(c *GormConfig) {
+		c.Policies = append(c.Policies, policies...)
+	}
+}
+
+// WithSlowQueryExplain enables EXPLAIN capture for slow SELECT queries.
+// Plans are captured asynchronously on cfg.DB and logged as "Slow query plan captured"
+// with the same request_id and sql_hash as the slow query warning.
+func WithSlowQueryExplain(cfg ExplainConfig) GormOption {
+	return func(c *GormConfig) {
+		c.Explain = cfg
+	}
+}
+
 // GormLogger is a custom GORM logger that uses tlog.
 type GormLogger struct {
-	cfg GormConfig
+	cfg       GormConfig
+	explainer *slowQueryExplainer
+
+	// dialect is the dialect bound by GormPlugin when cfg.Dialect is
+	// DialectAuto. It is shared by the copies made by LogMode.
+	dialect *atomic.Int32
+
+	// silent is set on copies made by LogMode(gormlogger.Silent); policies
+	// cannot raise their level.
+	silent bool
 }
 
 // NewGormLogger creates a new GORM logger adapter.
@@ -72,113 +210,219 @@ func NewGormLogger(opts ...GormOption) *GormLogger {
 	for _, opt := range opts {
 		opt(&cfg)
 	}
-	return &GormLogger{cfg: cfg}
+	return &GormLogger{
+		cfg:       cfg,
+		explainer: newSlowQueryExplainer(cfg.Explain),
+		dialect:   new(atomic.Int32),
+	}
+}
+
+// bindDialect sets the dialect of the database the logger is used with,
+// from its dialector name, unless a dialect is configured.
+func (l *GormLogger) bindDialect(name string) {
+	if l.cfg.Dialect == DialectAuto && l.dialect != nil {
+		l.dialect.Store(int32(ParseSQLDialect(name)))
+	}
+}
+
+// dialectFor returns the dialect sql is lexed with: the configured one, the
+// one bound by GormPlugin or, when neither is known, DialectSQLite for
+// statements quoting identifiers with backticks. GORM's MySQL and SQLite
+// dialects both do, and neither writes "..." identifiers, so "..." is a
+// string there.
+func (l *GormLogger) dialectFor(sql string) SQLDialect {
+	if l.cfg.Dialect != DialectAuto {
+		return l.cfg.Dialect
+	}
+	if l.dialect != nil {
+		if d := SQLDialect(l.dialect.Load()); d != DialectAuto {
+			return d
+		}
+	}
+	if strings.Contains(sql, "`") {
+		return DialectSQLite
+	}
+	return DialectAuto
 }
 
 // LogMode sets the log level and returns a new logger.
 func (l *GormLogger) LogMode(level gormlogger.LogLevel) gormlogger.Interface {
 	newLogger := *l
 	newLogger.cfg.LogLevel = level
+	newLogger.silent = level <= gormlogger.Silent
 	return &newLogger
 }
 
 // Info logs informational messages.
 func (l *GormLogger) Info(ctx context.Context, msg string, data ...interface{}) {
 	if l.cfg.LogLevel >= gormlogger.Info {
-		FromContext(ctx).Sugar().Infof(msg, data...)
+		l.logMessage(ctx, zapcore.InfoLevel, msg, data)
 	}
 }
 
 // Warn logs warning messages.
 func (l *GormLogger) Warn(ctx context.Context, msg string, data ...interface{}) {
 	if l.cfg.LogLevel >= gormlogger.Warn {
-		FromContext(ctx).Sugar().Warnf(msg, data...)
+		l.logMessage(ctx, zapcore.WarnLevel, msg, data)
 	}
 }
 
 // Error logs error messages.
 func (l *GormLogger) Error(ctx context.Context, msg string, data ...interface{}) {
 	if l.cfg.LogLevel >= gormlogger.Error {
-		FromContext(ctx).Sugar().Errorf(msg, data...)
+		l.logMessage(ctx, zapcore.ErrorLevel, msg, data)
 	}
 }
 
-// parseSQL extracts operation and table name from SQL query.
-func parseSQL(sql string) (operation string, table string) {
-	sql = strings.TrimSpace(sql)
-	upperSQL := strings.ToUpper(sql)
+// logMessage logs a GORM printf-style message with the rendered text as the
+// message and the template, arguments and call site as fields.
+func (l *GormLogger) logMessage(ctx context.Context, level zapcore.Level, template string, data []interface{}) {
+	ce := FromContext(ctx).Check(level, strings.TrimSpace(fmt.Sprintf(template, data...)))
+	if ce == nil {
+		return
+	}
 
-	// Determine operation
-	switch {
-	case strings.HasPrefix(upperSQL, "SELECT"):
-		operation = "SELECT"
-	case strings.HasPrefix(upperSQL, "INSERT"):
-		operation = "INSERT"
-	case strings.HasPrefix(upperSQL, "UPDATE"):
-		operation = "UPDATE"
-	case strings.HasPrefix(upperSQL, "DELETE"):
-		operation = "DELETE"
-	default:
-		operation = "OTHER"
-	}
-
-	// Extract table name based on operation
-	table = extractTableName(sql, operation)
-	return
-}
-
-// extractTableName extracts the table name from SQL based on operation type.
-func extractTableName(sql string, operation string) string {
-	var pattern *regexp.Regexp
-
-	switch operation {
-	case "SELECT":
-		// SELECT ... FROM "table_name" or SELECT ... FROM table_name
-		pattern = regexp.MustCompile(`(?i)\bFROM\s+["` + "`" + `]?(\w+)["` + "`" + `]?`)
-	case "INSERT":
-		// INSERT INTO "table_name" or INSERT INTO table_name
-		pattern = regexp.MustCompile(`(?i)\bINTO\s+["` + "`" + `]?(\w+)["` + "`" + `]?`)
-	case "UPDATE":
-		// UPDATE "table_name" or UPDATE table_name
-		pattern = regexp.MustCompile(`(?i)\bUPDATE\s+["` + "`" + `]?(\w+)["` + "`" + `]?`)
-	case "DELETE":
-		// DELETE FROM "table_name" or DELETE FROM table_name
-		pattern = regexp.MustCompile(`(?i)\bFROM\s+["` + "`" + `]?(\w+)["` + "`" + `]?`)
-	default:
-		return ""
-	}
-
-	if pattern != nil {
-		matches := pattern.FindStringSubmatch(sql)
-		if len(matches) > 1 {
-			return matches[1]
+	site := gormCallSite()
+	site.annotate(ce)
+
+	fields := []zap.Field{
+		zap.String("component", "gorm"),
+		zap.String("template", strings.TrimSpace(template)),
+		zap.Array("args", gormArgs(data)),
+	}
+	if source := site.source(); source != "" {
+		fields = append(fields, zap.String("source", source))
+	}
+	if site.migration != "" {
+		fields = append(fields, zap.String("migration", site.migration))
+	}
+	for _, arg := range data {
+		if err, ok := arg.(error); ok {
+			fields = append(fields, zap.Error(err))
+			break
+		}
+	}
+	ce.Write(fields...)
+}
+
+// gormArgs marshals GORM message arguments, rendering errors and
+// fmt.Stringers as text.
+type gormArgs []interface{}
+
+// MarshalLogArray implements zapcore.ArrayMarshaler.
+func (a gormArgs) MarshalLogArray(enc zapcore.ArrayEncoder) error {
+	for _, arg := range a {
+		switch v := arg.(type) {
+		case error:
+			enc.AppendString(v.Error())
+		case fmt.Stringer:
+			enc.AppendString(v.String())
+		default:
+			if err := enc.AppendReflected(v); err != nil {
+				enc.AppendString(fmt.Sprint(v))
+			}
+		}
+	}
+	return nil
+}
+
+// policyFor returns the effective policy for a parsed statement.
+func (l *GormLogger) policyFor(info sqlInfo) queryPolicy {
+	policy := queryPolicy{
+		slowThreshold: l.cfg.SlowThreshold,
+		logLevel:      l.cfg.LogLevel,
+		sampleRate:    1,
+	}
+	for _, p := range l.cfg.Policies {
+		if !p.matches(info) {
+			continue
+		}
+		if p.SlowThreshold != 0 {
+			policy.slowThreshold = p.SlowThreshold
 		}
+		if p.LogLevel != 0 {
+			policy.logLevel = p.LogLevel
+		}
+		if p.SampleRate > 0 {
+			policy.sampleRate = p.SampleRate
+		}
+		policy.omitSQL = p.OmitSQL
+		break
 	}
-	return ""
+	return policy
 }
 
 // Trace logs SQL queries with timing information.
 func (l *GormLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
-	if l.cfg.LogLevel <= gormlogger.Silent {
+	var bound func() boundQuery
+	if stmt, ok := ctx.Value(gormStatementKey{}).(*gorm.Statement); ok {
+		bound = func() boundQuery {
+			return boundQuery{sql: stmt.SQL.String(), vars: stmt.Vars}
+		}
+	}
+	l.trace(ctx, "gorm", begin, fc, bound, err)
+}
+
+// Close stops slow query plan capture, discarding pending captures. Queries
+// are still logged afterwards. Close is shared by the loggers LogMode returns.
+func (l *GormLogger) Close() error {
+	if l.explainer != nil {
+		l.explainer.close()
+	}
+	return nil
+}
+
+// trace logs a finished query tagged with component. It is shared by
+// Trace and the database/sql driver wrapper. bound returns the statement
+// with its bind variables for plan capture; it is nil when unknown.
+func (l *GormLogger) trace(ctx context.Context, component string, begin time.Time, fc func() (string, int64), bound func() boundQuery, err error) {
+	if l.silent || (l.cfg.LogLevel <= gormlogger.Silent && len(l.cfg.Policies) == 0) {
 		return
 	}
 
 	elapsed := time.Since(begin)
 	sql, rows := fc()
 
-	// Parse SQL to extract operation and table
-	operation, table := parseSQL(sql)
+	// Parse SQL to extract operation and tables, then apply the matching policy
+	dialect := l.dialectFor(sql)
+	tokens := lexSQL(sql, dialect)
+	info := analyzeSQL(tokens)
+	policy := l.policyFor(info)
+	if policy.logLevel <= gormlogger.Silent {
+		return
+	}
 
 	// Check if slow query
-	isSlowQuery := elapsed > l.cfg.SlowThreshold
+	isSlowQuery := elapsed > policy.slowThreshold
+
+	// Sample successful queries; slow ones are always logged
+	if err == nil && !isSlowQuery && policy.sampleRate < 1 && rand.Float64() >= policy.sampleRate {
+		return
+	}
+
+	// Redact literals and compute the statement fingerprint
+	normalized := normalizeSQL(sql, tokens, l.cfg.SQLMode, l.cfg.MaskColumns)
+
+	site := gormCallSite()
 
 	fields := []zap.Field{
-		zap.String("operation", operation),
-		zap.String("table", table),
+		zap.String("component", component),
+		zap.String("operation", info.Operation),
+		zap.String("table", info.Table),
 		zap.Int64("duration_ms", elapsed.Milliseconds()),
 		zap.Int64("rows_affected", rows),
-		zap.String("sql", sql),
-		zap.String("caller", utils.FileWithLineNum()),
+	}
+	if !policy.omitSQL {
+		fields = append(fields, zap.String("sql", normalized.Statement))
+	}
+	fields = append(fields,
+		zap.String("sql_fingerprint", normalized.Fingerprint),
+		zap.String("sql_hash", normalized.Hash),
+	)
+
+	// List every table when the statement touches more than one
+	if len(info.Tables) > 1 {
+		fields = append(fields, zap.Strings("tables", info.Tables))
 	}
 
 	// Add slow_query flag if applicable
@@ -186,23 +430,50 @@ func (l *GormLogger) Trace(ctx context.Context, begin time.Time, fc func() (stri
 		fields = append(fields, zap.Bool("slow_query", true))
 	}
 
+	// Tag statements issued by AutoMigrate and other migrator methods
+	if site.migration != "" {
+		fields = append(fields, zap.String("migration", site.migration))
+	}
+
 	logger := FromContext(ctx)
+	write := func(level zapcore.Level, msg string) {
+		if ce := logger.Check(level, msg); ce != nil {
+			site.annotate(ce)
+			ce.Write(fields...)
+		}
+	}
 
 	switch {
 	// Case 1: Log errors (except record not found if configured to ignore)
-	case err != nil && l.cfg.LogLevel >= gormlogger.Error:
+	case err != nil && policy.logLevel >= gormlogger.Error:
 		if l.cfg.IgnoreRecordNotFound && errors.Is(err, gorm.ErrRecordNotFound) {
 			return
 		}
 		fields = append(fields, zap.Error(err))
-		logger.Error("Database query failed", fields...)
+		write(zapcore.ErrorLevel, "Database query failed")
 
 	// Case 2: Log slow queries
-	case isSlowQuery && l.cfg.LogLevel >= gormlogger.Warn:
-		logger.Warn("Slow database query detected", fields...)
+	case isSlowQuery && policy.logLevel >= gormlogger.Warn:
+		if l.explainer != nil && bound != nil && l.explainer.submit(ctx, bound(), dialect, info, normalized) {
+			fields = append(fields, zap.Bool("plan_pending", true))
+		}
+		write(zapcore.WarnLevel, "Slow database query detected")
+
+	// Case 3: Log schema changes made by migrations as progress
+	case site.migration != "" && isSchemaChange(info.Operation) && policy.logLevel >= gormlogger.Warn:
+		write(zapcore.InfoLevel, "Database migration executed")
+
+	// Case 4: Log all queries (Info level)
+	case policy.logLevel >= gormlogger.Info:
+		write(zapcore.InfoLevel, "Database query executed")
+	}
+}
 
-	// Case 3: Log all queries (Info level)
-	case l.cfg.LogLevel >= gormlogger.Info:
-		logger.Info("Database query executed", fields...)
+// isSchemaChange reports whether op changes the database schema.
+func isSchemaChange(op string) bool {
+	switch op {
+	case sqlOpCreate, sqlOpAlter, sqlOpDrop:
+		return true
 	}
+	return false
 }
@@ -0,0 +1,159 @@
+package tlog
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"go.uber.org/zap/zapcore"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+type gormTestUser struct {
+	ID       uint
+	Name     string
+	Password string
+}
+
+// openTestDB opens the SQLite database dsn logging through logger.
+func openTestDB(t *testing.T, dsn string, logger *GormLogger) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger})
+	if err != nil {
+		t.Fatalf("open sqlite: %v", err)
+	}
+	if err := db.AutoMigrate(&gormTestUser{}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
+
+func TestGormLoggerBindsDialect(t *testing.T) {
+	logger := NewGormLogger(WithGormLogLevel(gormlogger.Info))
+	db := openTestDB(t, ":memory:", logger)
+	if err := db.Use(NewGormPlugin()); err != nil {
+		t.Fatalf("use plugin: %v", err)
+	}
+	if got := logger.dialectFor("SELECT 1"); got != DialectSQLite {
+		t.Fatalf("dialectFor() = %v, want DialectSQLite", got)
+	}
+
+	logs := observeLogs(t, zapcore.DebugLevel)
+	var users []gormTestUser
+	db.Where("password = ?", "hunter2").Find(&users)
+
+	entries := logs.FilterMessage("Database query executed").All()
+	if len(entries) == 0 {
+		t.Fatal("query was not logged")
+	}
+	sql, _ := entries[len(entries)-1].ContextMap()["sql"].(string)
+	if strings.Contains(sql, "hunter2") {
+		t.Errorf("sql %q contains the password", sql)
+	}
+	if !strings.Contains(sql, "password = '******'") {
+		t.Errorf("sql %q does not mask the password", sql)
+	}
+}
+
+func TestGormLoggerDialectFor(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured SQLDialect
+		bound      string
+		sql        string
+		want       SQLDialect
+	}{
+		{"configured wins", DialectPostgres, "sqlite", "SELECT `a`", DialectPostgres},
+		{"bound", DialectAuto, "postgres", "SELECT `a`", DialectPostgres},
+		{"backticks", DialectAuto, "", "SELECT `a` FROM `t`", DialectSQLite},
+		{"unknown", DialectAuto, "", `SELECT "a" FROM t`, DialectAuto},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewGormLogger(WithSQLDialect(tt.configured))
+			if tt.bound != "" {
+				l.bindDialect(tt.bound)
+			}
+			if got := l.dialectFor(tt.sql); got != tt.want {
+				t.Errorf("dialectFor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGormLoggerZeroValue(t *testing.T) {
+	var l GormLogger
+	if got := l.dialectFor(`SELECT "a"`); got != DialectAuto {
+		t.Errorf("dialectFor() = %v, want DialectAuto", got)
+	}
+}
+
+func TestGormLoggerPolicies(t *testing.T) {
+	rare := GormPolicy{Table: "events", SampleRate: 1e-9}
+	verbose := GormPolicy{Table: "events", LogLevel: gormlogger.Info}
+
+	tests := []struct {
+		name     string
+		logger   gormlogger.Interface
+		elapsed  time.Duration
+		err      error
+		wantMsgs []string
+	}{
+		{
+			name:   "sampled out",
+			logger: NewGormLogger(WithGormLogLevel(gormlogger.Info), WithGormPolicies(rare)),
+		},
+		{
+			name:     "slow query exempt from sampling",
+			logger:   NewGormLogger(WithSlowThreshold(time.Millisecond), WithGormPolicies(rare)),
+			elapsed:  time.Second,
+			wantMsgs: []string{"Slow database query detected"},
+		},
+		{
+			name:     "failed query exempt from sampling",
+			logger:   NewGormLogger(WithGormPolicies(rare)),
+			err:      errors.New("boom"),
+			wantMsgs: []string{"Database query failed"},
+		},
+		{
+			name:     "policy raises level",
+			logger:   NewGormLogger(WithGormLogLevel(gormlogger.Silent), WithGormPolicies(verbose)),
+			wantMsgs: []string{"Database query executed"},
+		},
+		{
+			name:   "silent session wins over policy",
+			logger: NewGormLogger(WithGormPolicies(verbose)).LogMode(gormlogger.Silent),
+			err:    errors.New("boom"),
+		},
+		{
+			name:     "session level restored",
+			logger:   NewGormLogger(WithGormPolicies(verbose)).LogMode(gormlogger.Silent).LogMode(gormlogger.Warn),
+			wantMsgs: []string{"Database query executed"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := observeLogs(t, zapcore.DebugLevel)
+			tt.logger.Trace(context.Background(), time.Now().Add(-tt.elapsed), func() (string, int64) {
+				return "SELECT * FROM events WHERE id = 1", 1
+			}, tt.err)
+
+			var msgs []string
+			for _, e := range logs.All() {
+				msgs = append(msgs, e.Message)
+			}
+			if strings.Join(msgs, ",") != strings.Join(tt.wantMsgs, ",") {
+				t.Errorf("logged %q, want %q", msgs, tt.wantMsgs)
+			}
+		})
+	}
+}
@@ -0,0 +1,456 @@
+package tlog
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gorm.io/gorm"
+)
+
+// gormPluginStartKey is the statement setting holding the callback chain start time.
+const gormPluginStartKey = "tlog:start"
+
+// gormStatementKey is the context key under which the plugin passes the
+// statement to GormLogger.Trace, for plan capture with its bind variables.
+type gormStatementKey struct{}
+
+// GormPluginConfig contains configuration for the GORM callback plugin.
+type GormPluginConfig struct {
+	// LogStatements logs a structured event when each callback chain finishes.
+	// Default: true
+	LogStatements bool
+
+	// StatementLevel is the level of statement events.
+	// Default: zapcore.DebugLevel
+	StatementLevel zapcore.Level
+
+	// TrackTransactions wraps the connection pool to log transaction
+	// begin/commit/rollback and tag every query in a transaction with tx_id.
+	// Default: true
+	TrackTransactions bool
+
+	// TransactionLevel is the level of transaction events. Failures are
+	// always logged at error level.
+	// Default: zapcore.DebugLevel
+	TransactionLevel zapcore.Level
+}
+
+// DefaultGormPluginConfig returns a GormPluginConfig with sensible defaults.
+func DefaultGormPluginConfig() GormPluginConfig {
+	return GormPluginConfig{
+		LogStatements:     true,
+		StatementLevel:    zapcore.DebugLevel,
+		TrackTransactions: true,
+		TransactionLevel:  zapcore.DebugLevel,
+	}
+}
+
+// GormPluginOption is a function that configures GormPluginConfig.
+type GormPluginOption func(*GormPluginConfig)
+
+// WithPluginStatements enables/disables statement events.
+func WithPluginStatements(enabled bool) GormPluginOption {
+	return func(c *GormPluginConfig) {
+		c.LogStatements = enabled
+	}
+}
+
+// WithPluginStatementLevel sets the level of statement events.
+func WithPluginStatementLevel(level zapcore.Level) GormPluginOption {
+	return func(c *GormPluginConfig) {
+		c.StatementLevel = level
+	}
+}
+
+// WithPluginTransactions enables/disables transaction tracking.
+func WithPluginTransactions(enabled bool) GormPluginOption {
+	return func(c *GormPluginConfig) {
+		c.TrackTransactions = enabled
+	}
+}
+
+// WithPluginTransactionLevel sets the level of transaction events.
+func WithPluginTransactionLevel(level zapcore.Level) GormPluginOption {
+	return func(c *GormPluginConfig) {
+		c.TransactionLevel = level
+	}
+}
+
+// GormPlugin is a gorm.Plugin that logs structured database events from
+// GORM callbacks: transaction begin/commit/rollback and, for each statement,
+// the callback chain, model, destination type and model hooks involved.
+type GormPlugin struct {
+	cfg GormPluginConfig
+}
+
+// NewGormPlugin creates a new GORM callback plugin.
+// Register it with db.Use(tlog.NewGormPlugin()).
+func NewGormPlugin(opts ...GormPluginOption) *GormPlugin {
+	cfg := DefaultGormPluginConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return &GormPlugin{cfg: cfg}
+}
+
+// Name returns the plugin name.
+func (p *GormPlugin) Name() string {
+	return "tlog"
+}
+
+// Initialize registers the plugin callbacks, binds the dialect of a
+// GormLogger using DialectAuto to db.Dialector.Name() and, when transaction
+// tracking is enabled, wraps the connection pool.
+func (p *GormPlugin) Initialize(db *gorm.DB) error {
+	if l, ok := db.Logger.(*GormLogger); ok && db.Dialector != nil {
+		l.bindDialect(db.Dialector.Name())
+	}
+	if p.cfg.TrackTransactions {
+		if _, wrapped := db.ConnPool.(*txTrackingPool); !wrapped {
+			pool := &txTrackingPool{ConnPool: db.ConnPool, level: p.cfg.TransactionLevel}
+			db.ConnPool = pool
+			if db.Statement != nil {
+				db.Statement.ConnPool = pool
+			}
+		}
+	}
+
+	cb := db.Callback()
+	return errors.Join(
+		cb.Create().Before("*").Register("tlog:before_create", p.before),
+		cb.Create().After("*").Register("tlog:after_create", p.after("create")),
+		cb.Query().Before("*").Register("tlog:before_query", p.before),
+		cb.Query().After("*").Register("tlog:after_query", p.after("query")),
+		cb.Update().Before("*").Register("tlog:before_update", p.before),
+		cb.Update().After("*").Register("tlog:after_update", p.after("update")),
+		cb.Delete().Before("*").Register("tlog:before_delete", p.before),
+		cb.Delete().After("*").Register("tlog:after_delete", p.after("delete")),
+		cb.Row().Before("*").Register("tlog:before_row", p.before),
+		cb.Row().After("*").Register("tlog:after_row", p.after("row")),
+		cb.Raw().Before("*").Register("tlog:before_raw", p.before),
+		cb.Raw().After("*").Register("tlog:after_raw", p.after("raw")),
+	)
+}
+
+// before records the start time and tags the statement context with the
+// statement and the current transaction ID so GormLogger.Trace includes them.
+func (p *GormPlugin) before(db *gorm.DB) {
+	db.InstanceSet(gormPluginStartKey, time.Now())
+	if stmt, _ := db.Statement.Context.Value(gormStatementKey{}).(*gorm.Statement); stmt != db.Statement {
+		db.Statement.Context = context.WithValue(db.Statement.Context, gormStatementKey{}, db.Statement)
+	}
+	if tx := trackedTxOf(db.Statement.ConnPool); tx != nil {
+		if id, _ := db.Statement.Context.Value(TxIDKey).(string); id != tx.id {
+			db.Statement.Context = WithTxID(db.Statement.Context, tx.id)
+		}
+	}
+}
+
+// after returns the callback that logs the finished statement for chain.
+func (p *GormPlugin) after(chain string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		if !p.cfg.LogStatements {
+			return
+		}
+		logger := FromContext(db.Statement.Context)
+		ce := logger.Check(p.cfg.StatementLevel, "Database statement finished")
+		if ce == nil {
+			return
+		}
+		gormCallSite().annotate(ce)
+
+		stmt := db.Statement
+		fields := []zap.Field{
+			zap.String("component", "gorm"),
+			zap.String("callback", chain),
+			zap.String("table", stmt.Table),
+			zap.Int64("rows_affected", db.RowsAffected),
+		}
+		if model := modelName(stmt); model != "" {
+			fields = append(fields, zap.String("model", model))
+		}
+		if stmt.Dest != nil {
+			fields = append(fields, zap.String("dest_type", fmt.Sprintf("%T", stmt.Dest)))
+		}
+		if hooks := modelHooks(stmt, chain); len(hooks) > 0 {
+			fields = append(fields, zap.Strings("hooks", hooks))
+		}
+		if start, ok := db.InstanceGet(gormPluginStartKey); ok {
+			if t, ok := start.(time.Time); ok {
+				fields = append(fields, zap.Int64("duration_ms", time.Since(t).Milliseconds()))
+			}
+		}
+		if db.Error != nil {
+			fields = append(fields, zap.Error(db.Error))
+		}
+		ce.Write(fields...)
+	}
+}
+
+// modelName returns the struct name of the statement model.
+func modelName(stmt *gorm.Statement) string {
+	if stmt.Schema != nil {
+		return stmt.Schema.Name
+	}
+	if stmt.Model == nil {
+		return ""
+	}
+	t := reflect.TypeOf(stmt.Model)
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+// modelHooks lists the model hook methods run by the callback chain.
+func modelHooks(stmt *gorm.Statement, chain string) []string {
+	s := stmt.Schema
+	if s == nil || stmt.SkipHooks {
+		return nil
+	}
+
+	var hooks []string
+	add := func(enabled bool, name string) {
+		if enabled {
+			hooks = append(hooks, name)
+		}
+	}
+	switch chain {
+	case "create":
+		add(s.BeforeSave, "BeforeSave")
+		add(s.BeforeCreate, "BeforeCreate")
+		add(s.AfterCreate, "AfterCreate")
+		add(s.AfterSave, "AfterSave")
+	case "update":
+		add(s.BeforeSave, "BeforeSave")
+		add(s.BeforeUpdate, "BeforeUpdate")
+		add(s.AfterUpdate, "AfterUpdate")
+		add(s.AfterSave, "AfterSave")
+	case "delete":
+		add(s.BeforeDelete, "BeforeDelete")
+		add(s.AfterDelete, "AfterDelete")
+	case "query":
+		add(s.AfterFind, "AfterFind")
+	}
+	return hooks
+}
+
+// newTxID returns a new time-ordered transaction ID.
+func newTxID() string {
+	return uuid.Must(uuid.NewV7()).String()
+}
+
+// txTrackingPool wraps a gorm.ConnPool to log transactions.
+type txTrackingPool struct {
+	gorm.ConnPool
+	level zapcore.Level
+}
+
+// BeginTx starts a transaction on the wrapped pool and logs it.
+func (p *txTrackingPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (gorm.ConnPool, error) {
+	var (
+		tx  gorm.ConnPool
+		err error
+	)
+	switch beginner := p.ConnPool.(type) {
+	case gorm.TxBeginner:
+		var sqlTx *sql.Tx
+		if sqlTx, err = beginner.BeginTx(ctx, opts); err == nil {
+			tx = sqlTx
+		}
+	case gorm.ConnPoolBeginner:
+		tx, err = beginner.BeginTx(ctx, opts)
+	default:
+		err = gorm.ErrInvalidTransaction
+	}
+
+	id := newTxID()
+	logger := FromContext(WithTxID(ctx, id))
+	if err != nil {
+		writeTxEvent(logger, zapcore.ErrorLevel, "Database transaction begin failed", zap.String("component", "gorm"), zap.Error(err))
+		return nil, err
+	}
+
+	fields := []zap.Field{zap.String("component", "gorm")}
+	if opts != nil {
+		fields = append(fields,
+			zap.String("isolation", opts.Isolation.String()),
+			zap.Bool("read_only", opts.ReadOnly),
+		)
+	}
+	writeTxEvent(logger, p.level, "Database transaction started", fields...)
+
+	return &trackedTx{ConnPool: tx, pool: p, id: id, ctx: ctx, start: time.Now()}, nil
+}
+
+// GetDBConn returns the underlying *sql.DB so db.DB() keeps working.
+func (p *txTrackingPool) GetDBConn() (*sql.DB, error) {
+	if connector, ok := p.ConnPool.(gorm.GetDBConnector); ok {
+		return connector.GetDBConn()
+	}
+	if sqlDB, ok := p.ConnPool.(*sql.DB); ok {
+		return sqlDB, nil
+	}
+	return nil, gorm.ErrInvalidDB
+}
+
+// Ping pings the wrapped pool when it supports it.
+func (p *txTrackingPool) Ping() error {
+	if pinger, ok := p.ConnPool.(interface{ Ping() error }); ok {
+		return pinger.Ping()
+	}
+	return nil
+}
+
+// trackedTx wraps a transaction to log commit and rollback.
+type trackedTx struct {
+	gorm.ConnPool
+	pool  *txTrackingPool
+	id    string
+	ctx   context.Context
+	start time.Time
+
+	// mu guards the functions run on commit, such as pending audit events,
+	// and the number of them at each savepoint.
+	mu         sync.Mutex
+	onCommit   []func()
+	savepoints map[string]int
+}
+
+// trackedTxOf returns the tracked transaction behind pool, if any.
+func trackedTxOf(pool gorm.ConnPool) *trackedTx {
+	switch v := pool.(type) {
+	case *trackedTx:
+		return v
+	case *gorm.PreparedStmtTX:
+		tx, _ := v.Tx.(*trackedTx)
+		return tx
+	}
+	return nil
+}
+
+// Commit commits the transaction, logs the outcome and, on success, runs
+// the functions registered with afterCommit.
+func (t *trackedTx) Commit() error {
+	committer, ok := t.ConnPool.(gorm.TxCommitter)
+	if !ok {
+		return gorm.ErrInvalidTransaction
+	}
+	err := committer.Commit()
+	t.log("Database transaction committed", "Database transaction commit failed", err)
+
+	t.mu.Lock()
+	onCommit := t.onCommit
+	t.onCommit, t.savepoints = nil, nil
+	t.mu.Unlock()
+	if err == nil {
+		for _, fn := range onCommit {
+			fn()
+		}
+	}
+	return err
+}
+
+// Rollback rolls back the transaction, logs the outcome and drops the
+// functions registered with afterCommit.
+func (t *trackedTx) Rollback() error {
+	committer, ok := t.ConnPool.(gorm.TxCommitter)
+	if !ok {
+		return gorm.ErrInvalidTransaction
+	}
+	err := committer.Rollback()
+	t.log("Database transaction rolled back", "Database transaction rollback failed", err)
+
+	t.mu.Lock()
+	t.onCommit, t.savepoints = nil, nil
+	t.mu.Unlock()
+	return err
+}
+
+// afterCommit registers fn to run once the transaction commits. It is
+// dropped when the transaction, or a savepoint set before fn was
+// registered, rolls back.
+func (t *trackedTx) afterCommit(fn func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.onCommit = append(t.onCommit, fn)
+}
+
+// ExecContext executes a statement, following the savepoints it sets and
+// rolls back to. Savepoints run as prepared statements, with PrepareStmt,
+// are not seen.
+func (t *trackedTx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	res, err := t.ConnPool.ExecContext(ctx, query, args...)
+	if err == nil {
+		t.trackSavepoint(query)
+	}
+	return res, err
+}
+
+// trackSavepoint notes a SAVEPOINT statement and drops the functions
+// registered since the savepoint on ROLLBACK TO.
+func (t *trackedTx) trackSavepoint(query string) {
+	words := strings.Fields(strings.ToUpper(query))
+	if len(words) < 2 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case len(words) == 2 && words[0] == "SAVEPOINT":
+		if t.savepoints == nil {
+			t.savepoints = make(map[string]int)
+		}
+		t.savepoints[words[1]] = len(t.onCommit)
+	case len(words) >= 3 && words[0] == "ROLLBACK" && words[1] == "TO":
+		if n, ok := t.savepoints[words[len(words)-1]]; ok && n <= len(t.onCommit) {
+			t.onCommit = t.onCommit[:n]
+		}
+	}
+}
+
+// StmtContext returns a transaction-specific prepared statement, allowing
+// GORM's PreparedStmt mode to use the tracked transaction.
+func (t *trackedTx) StmtContext(ctx context.Context, stmt *sql.Stmt) *sql.Stmt {
+	if tx, ok := t.ConnPool.(interface {
+		StmtContext(context.Context, *sql.Stmt) *sql.Stmt
+	}); ok {
+		return tx.StmtContext(ctx, stmt)
+	}
+	return stmt
+}
+
+// GetDBConn returns the *sql.DB the transaction was started on.
+func (t *trackedTx) GetDBConn() (*sql.DB, error) {
+	return t.pool.GetDBConn()
+}
+
+func (t *trackedTx) log(msg, failMsg string, err error) {
+	logger := FromContext(WithTxID(t.ctx, t.id))
+	component := zap.String("component", "gorm")
+	duration := zap.Int64("duration_ms", time.Since(t.start).Milliseconds())
+	if err != nil && !errors.Is(err, sql.ErrTxDone) {
+		writeTxEvent(logger, zapcore.ErrorLevel, failMsg, component, duration, zap.Error(err))
+		return
+	}
+	writeTxEvent(logger, t.pool.level, msg, component, duration)
+}
+
+// writeTxEvent logs a transaction event with the caller set to the
+// application code that started or finished the transaction.
+func writeTxEvent(logger *zap.Logger, level zapcore.Level, msg string, fields ...zap.Field) {
+	if ce := logger.Check(level, msg); ce != nil {
+		gormCallSite().annotate(ce)
+		ce.Write(fields...)
+	}
+}
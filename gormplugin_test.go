@@ -0,0 +1,218 @@
+package tlog
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+// gormHookUser is a model with hooks, for the hooks field.
+type gormHookUser struct {
+	ID   uint
+	Name string
+}
+
+func (u *gormHookUser) BeforeCreate(*gorm.DB) error { return nil }
+func (u *gormHookUser) AfterFind(*gorm.DB) error    { return nil }
+
+// openPluginTestDB opens a SQLite file database with GormLogger and
+// GormPlugin. A file keeps the tables shared by every pooled connection.
+func openPluginTestDB(t *testing.T, cfg *gorm.Config, opts ...GormPluginOption) *gorm.DB {
+	t.Helper()
+	cfg.Logger = NewGormLogger(WithGormLogLevel(gormlogger.Info))
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), cfg)
+	if err != nil {
+		t.Fatalf("open sqlite: %v", err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	if err := db.Use(NewGormPlugin(opts...)); err != nil {
+		t.Fatalf("use plugin: %v", err)
+	}
+	if err := db.AutoMigrate(&gormTestUser{}, &gormHookUser{}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return db
+}
+
+// txIDs returns the tx_id of each entry with msg, "" when absent.
+func txIDs(logs *observer.ObservedLogs, msg string) []string {
+	var ids []string
+	for _, e := range logs.FilterMessage(msg).All() {
+		id, _ := e.ContextMap()["tx_id"].(string)
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestGormPluginTransactions(t *testing.T) {
+	for _, prepare := range []bool{false, true} {
+		name := "plain"
+		if prepare {
+			name = "prepared statements"
+		}
+		t.Run(name, func(t *testing.T) {
+			db := openPluginTestDB(t, &gorm.Config{PrepareStmt: prepare})
+			logs := observeLogs(t, zapcore.DebugLevel)
+
+			err := db.Transaction(func(tx *gorm.DB) error {
+				if err := tx.Create(&gormTestUser{Name: "alice"}).Error; err != nil {
+					return err
+				}
+				var users []gormTestUser
+				return tx.Find(&users).Error
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			errRollback := errors.New("rollback")
+			if err := db.Transaction(func(tx *gorm.DB) error {
+				tx.Create(&gormTestUser{Name: "bob"})
+				return errRollback
+			}); !errors.Is(err, errRollback) {
+				t.Fatalf("Transaction() = %v", err)
+			}
+
+			started := txIDs(logs, "Database transaction started")
+			committed := txIDs(logs, "Database transaction committed")
+			rolledBack := txIDs(logs, "Database transaction rolled back")
+			if len(started) != 2 || len(committed) != 1 || len(rolledBack) != 1 {
+				t.Fatalf("started %v, committed %v, rolled back %v", started, committed, rolledBack)
+			}
+			if started[0] == "" || started[0] != committed[0] || started[1] != rolledBack[0] || started[0] == started[1] {
+				t.Errorf("started %v, committed %v, rolled back %v, want one tx_id per transaction", started, committed, rolledBack)
+			}
+
+			// Queries and statement events inside carry the tx_id
+			queries := txIDs(logs, "Database query executed")
+			statements := txIDs(logs, "Database statement finished")
+			for _, got := range [][]string{queries, statements} {
+				if len(got) != 3 || got[0] != started[0] || got[1] != started[0] || got[2] != started[1] {
+					t.Errorf("tx_ids %v, want %s twice then %s", got, started[0], started[1])
+				}
+			}
+
+			// Outside a transaction there is none
+			db.Find(&[]gormTestUser{})
+			if ids := txIDs(logs, "Database query executed"); ids[len(ids)-1] != "" {
+				t.Errorf("query outside a transaction has tx_id %q", ids[len(ids)-1])
+			}
+		})
+	}
+}
+
+func TestGormPluginStatementFields(t *testing.T) {
+	db := openPluginTestDB(t, &gorm.Config{})
+	logs := observeLogs(t, zapcore.DebugLevel)
+
+	db.Create(&gormHookUser{Name: "alice"})
+	var users []gormHookUser
+	db.Find(&users)
+	db.Model(&gormTestUser{}).Where("id = ?", 1).Update("name", "bob")
+	db.Delete(&gormTestUser{}, 1)
+	db.Raw("SELECT 1").Row()
+
+	tests := []struct {
+		callback, table, model, dest string
+		hooks                        []interface{}
+	}{
+		{"create", "gorm_hook_users", "gormHookUser", "*tlog.gormHookUser", []interface{}{"BeforeCreate"}},
+		{"query", "gorm_hook_users", "gormHookUser", "*[]tlog.gormHookUser", []interface{}{"AfterFind"}},
+		{"update", "gorm_test_users", "gormTestUser", "map[string]interface {}", nil},
+		{"delete", "gorm_test_users", "gormTestUser", "*tlog.gormTestUser", nil},
+		{"row", "", "", "*sql.Row", nil},
+	}
+	entries := logs.FilterMessage("Database statement finished").All()
+	if len(entries) != len(tests) {
+		t.Fatalf("%d statement events, want %d", len(entries), len(tests))
+	}
+	for i, tt := range tests {
+		fields := entries[i].ContextMap()
+		if fields["component"] != "gorm" || fields["callback"] != tt.callback || fields["table"] != tt.table {
+			t.Errorf("event %d = %v, want callback %s on %q", i, fields, tt.callback, tt.table)
+		}
+		if model, _ := fields["model"].(string); model != tt.model {
+			t.Errorf("%s: model = %q, want %q", tt.callback, model, tt.model)
+		}
+		if dest, _ := fields["dest_type"].(string); dest != tt.dest {
+			t.Errorf("%s: dest_type = %q, want %q", tt.callback, dest, tt.dest)
+		}
+		if hooks, _ := fields["hooks"].([]interface{}); len(hooks) != len(tt.hooks) || len(hooks) > 0 && hooks[0] != tt.hooks[0] {
+			t.Errorf("%s: hooks = %v, want %v", tt.callback, hooks, tt.hooks)
+		}
+		if _, ok := fields["duration_ms"]; !ok {
+			t.Errorf("%s: duration_ms missing", tt.callback)
+		}
+	}
+}
+
+func TestGormPluginSavePoints(t *testing.T) {
+	db := openPluginTestDB(t, &gorm.Config{})
+	logs := observeLogs(t, zapcore.DebugLevel)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		tx.Create(&gormTestUser{Name: "outer"})
+		// A failed nested transaction rolls back to its savepoint only
+		tx.Transaction(func(tx2 *gorm.DB) error {
+			tx2.Create(&gormTestUser{Name: "nested failed"})
+			return errors.New("nested")
+		})
+		return tx.Transaction(func(tx2 *gorm.DB) error {
+			return tx2.Create(&gormTestUser{Name: "nested"}).Error
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Manual savepoints on an explicit transaction
+	tx := db.Begin()
+	tx.Create(&gormTestUser{Name: "kept"})
+	tx.SavePoint("sp")
+	tx.Create(&gormTestUser{Name: "undone"})
+	tx.RollbackTo("sp")
+	if err := tx.Commit().Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	db.Model(&gormTestUser{}).Order("id").Pluck("name", &names)
+	if got := len(names); got != 3 || names[0] != "outer" || names[1] != "nested" || names[2] != "kept" {
+		t.Errorf("rows %v, want outer, nested, kept", names)
+	}
+	// Savepoints stay inside their transaction
+	if started := txIDs(logs, "Database transaction started"); len(started) != 2 {
+		t.Errorf("%d transactions logged, want 2", len(started))
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("DB() through the wrapped pool: %v", err)
+	}
+	if err := sqlDB.Ping(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGormPluginDisabled(t *testing.T) {
+	db := openPluginTestDB(t, &gorm.Config{}, WithPluginStatements(false), WithPluginTransactions(false))
+	if _, wrapped := db.ConnPool.(*txTrackingPool); wrapped {
+		t.Error("pool wrapped with transaction tracking disabled")
+	}
+	logs := observeLogs(t, zapcore.DebugLevel)
+	db.Transaction(func(tx *gorm.DB) error {
+		return tx.Create(&gormTestUser{Name: "alice"}).Error
+	})
+	if n := logs.FilterMessage("Database statement finished").Len() + logs.FilterMessage("Database transaction started").Len(); n != 0 {
+		t.Errorf("%d plugin events logged while disabled", n)
+	}
+}
@@ -0,0 +1,217 @@
+package tlog
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// JournaldConfig configures a sink for the systemd journal.
+type JournaldConfig struct {
+	// SocketPath is the journal's native protocol socket.
+	// Default: "/run/systemd/journal/socket"
+	SocketPath string
+
+	// SyslogIdentifier is the SYSLOG_IDENTIFIER of entries, shown by
+	// journalctl and matched by journalctl -t.
+	// Default: Config.AppName, or the program name
+	SyslogIdentifier string
+}
+
+// JournaldSink writes entries to the systemd journal with the native
+// protocol, keeping fields as journal fields. It is available on Linux
+// only. Create it with NewJournaldSink.
+type JournaldSink struct {
+	cfg        JournaldConfig
+	identifier string
+
+	mu   sync.Mutex
+	conn journalConn
+}
+
+// journalConn is the platform connection to the journal socket.
+type journalConn interface {
+	// send writes one serialized entry.
+	send(msg []byte) error
+	Close() error
+}
+
+// NewJournaldSink creates a journald sink, applying defaults to unset
+// fields. It fails on platforms without systemd. The socket is opened on
+// the first Send.
+func NewJournaldSink(cfg JournaldConfig) (*JournaldSink, error) {
+	if err := journalSupported(); err != nil {
+		return nil, err
+	}
+	if cfg.SocketPath == "" {
+		cfg.SocketPath = "/run/systemd/journal/socket"
+	}
+	s := &JournaldSink{cfg: cfg}
+	s.configure(Config{})
+	return s, nil
+}
+
+// Name returns "journald".
+func (s *JournaldSink) Name() string { return "journald" }
+
+// configure takes the identifier from the logger configuration.
+func (s *JournaldSink) configure(cfg Config) {
+	s.identifier = s.cfg.SyslogIdentifier
+	if s.identifier == "" {
+		s.identifier = cfg.AppName
+	}
+	if s.identifier == "" {
+		s.identifier = filepath.Base(os.Args[0])
+	}
+}
+
+// Send writes the entries of a batch, one datagram each. A failed write
+// reopens the socket and is retried once.
+func (s *JournaldSink) Send(ctx context.Context, batch []SinkEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range batch {
+		msg := encodeJournal(e, s.identifier)
+		if err := s.write(msg); err != nil {
+			s.closeConn()
+			if err := s.write(msg); err != nil {
+				s.closeConn()
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes the socket.
+func (s *JournaldSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeConn()
+}
+
+// write sends one entry, opening the socket when needed.
+func (s *JournaldSink) write(msg []byte) error {
+	if s.conn == nil {
+		conn, err := dialJournal(s.cfg.SocketPath)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	return s.conn.send(msg)
+}
+
+// closeConn closes and forgets the socket.
+func (s *JournaldSink) closeConn() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// journalBuiltinFields are the journal fields set from the entry itself.
+// Fields with the same name get the TLOG_ prefix instead of replacing them.
+var journalBuiltinFields = map[string]bool{
+	"MESSAGE":           true,
+	"PRIORITY":          true,
+	"SYSLOG_IDENTIFIER": true,
+	"LEVEL":             true,
+	"LOGGER":            true,
+	"CODE_FILE":         true,
+	"CODE_LINE":         true,
+	"CODE_FUNC":         true,
+	"STACKTRACE":        true,
+}
+
+// encodeJournal serializes an entry in the journal native protocol. The
+// message, priority and code location use the well-known journal fields;
+// tlog fields are added with upper-cased names, e.g. REQUEST_ID, and
+// TLOG_MESSAGE for a field named like a built-in one.
+func encodeJournal(e SinkEntry, identifier string) []byte {
+	fields := make(map[string]string, len(e.Fields)+8)
+	fields["MESSAGE"] = e.Message
+	fields["PRIORITY"] = strconv.Itoa(syslogSeverity(e.Level))
+	fields["SYSLOG_IDENTIFIER"] = identifier
+	fields["LEVEL"] = e.Level.String()
+	if e.LoggerName != "" {
+		fields["LOGGER"] = e.LoggerName
+	}
+	if e.Caller.Defined {
+		fields["CODE_FILE"] = e.Caller.File
+		fields["CODE_LINE"] = strconv.Itoa(e.Caller.Line)
+		if e.Caller.Function != "" {
+			fields["CODE_FUNC"] = e.Caller.Function
+		}
+	}
+	if e.Stack != "" {
+		fields["STACKTRACE"] = e.Stack
+	}
+	for k, v := range e.Fields {
+		name := journalFieldName(k)
+		if name == "" {
+			continue
+		}
+		if journalBuiltinFields[name] {
+			name = "TLOG_" + name
+		}
+		fields[name] = syslogString(v)
+	}
+
+	var b bytes.Buffer
+	for _, k := range sortedKeys(fields) {
+		appendJournalField(&b, k, fields[k])
+	}
+	return b.Bytes()
+}
+
+// appendJournalField writes NAME=value, or for values containing a newline
+// NAME, a newline, the little-endian 64-bit length and the value.
+func appendJournalField(b *bytes.Buffer, name, value string) {
+	b.WriteString(name)
+	if strings.IndexByte(value, '\n') < 0 {
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteByte('\n')
+		return
+	}
+	b.WriteByte('\n')
+	var n [8]byte
+	binary.LittleEndian.PutUint64(n[:], uint64(len(value)))
+	b.Write(n[:])
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+// journalFieldName returns the journal field name of a tlog field: upper
+// case letters, digits and underscores, at most 64 characters, starting
+// with a letter. Names starting with an underscore are reserved for fields
+// added by journald, so leading underscores are dropped.
+func journalFieldName(k string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, k)
+	name = strings.TrimLeft(name, "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "F_" + name
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
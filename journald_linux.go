@@ -0,0 +1,67 @@
+//go:build linux
+
+package tlog
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// journalSupported reports whether the journal can be used.
+func journalSupported() error { return nil }
+
+// unixJournalConn is an unbound datagram socket sending to the journal.
+// It is not connected, since descriptors cannot be passed with
+// net.UnixConn.WriteMsgUnix on a connected datagram socket.
+type unixJournalConn struct {
+	*net.UnixConn
+	addr *net.UnixAddr
+}
+
+// dialJournal opens a socket for the journal at path.
+func dialJournal(path string) (journalConn, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("tlog: journal socket: %w", err)
+	}
+	autobind := &net.UnixAddr{Net: "unixgram"}
+	conn, err := net.ListenUnixgram("unixgram", autobind)
+	if err != nil {
+		return nil, err
+	}
+	return unixJournalConn{UnixConn: conn, addr: &net.UnixAddr{Name: path, Net: "unixgram"}}, nil
+}
+
+// send writes an entry as one datagram. Entries too large for a datagram
+// are written to a sealed memfd whose descriptor is passed instead, as
+// sd_journal_send does.
+func (c unixJournalConn) send(msg []byte) error {
+	_, err := c.WriteToUnix(msg, c.addr)
+	if err == nil || !(errors.Is(err, unix.EMSGSIZE) || errors.Is(err, unix.ENOBUFS)) {
+		return err
+	}
+	return c.sendMemfd(msg)
+}
+
+// sendMemfd passes the entry in a sealed memory file.
+func (c unixJournalConn) sendMemfd(msg []byte) error {
+	fd, err := unix.MemfdCreate("tlog-journal", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		return fmt.Errorf("tlog: journal memfd: %w", err)
+	}
+	f := os.NewFile(uintptr(fd), "tlog-journal")
+	defer f.Close()
+
+	if _, err := f.Write(msg); err != nil {
+		return fmt.Errorf("tlog: journal memfd: %w", err)
+	}
+	seals := unix.F_SEAL_SHRINK | unix.F_SEAL_GROW | unix.F_SEAL_WRITE | unix.F_SEAL_SEAL
+	if _, err := unix.FcntlInt(f.Fd(), unix.F_ADD_SEALS, seals); err != nil {
+		return fmt.Errorf("tlog: journal memfd: %w", err)
+	}
+	_, _, err = c.WriteMsgUnix(nil, unix.UnixRights(int(f.Fd())), c.addr)
+	return err
+}
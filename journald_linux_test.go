@@ -0,0 +1,156 @@
+package tlog
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// journalTestSocket binds a datagram socket standing in for the journal and
+// returns the entries it receives, reading those passed as a memfd.
+func journalTestSocket(t *testing.T) (string, chan map[string]string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "journal.socket")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	entries := make(chan map[string]string, 10)
+	go func() {
+		buf := make([]byte, 1<<20)
+		oob := make([]byte, unix.CmsgSpace(4))
+		for {
+			n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+			if err != nil {
+				return
+			}
+			msg := append([]byte(nil), buf[:n]...)
+			if oobn > 0 {
+				msg, err = readJournalMemfd(oob[:oobn])
+				if err != nil {
+					t.Error(err)
+					continue
+				}
+			}
+			fields, err := decodeJournal(msg)
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			entries <- fields
+		}
+	}()
+	return path, entries
+}
+
+// readJournalMemfd reads the entry in the file passed with a message.
+func readJournalMemfd(oob []byte) ([]byte, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	fds, err := unix.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fds[0]), "memfd")
+	defer f.Close()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(f)
+}
+
+func receiveJournal(t *testing.T, entries chan map[string]string) map[string]string {
+	t.Helper()
+	select {
+	case e := <-entries:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("no journal entry received")
+		return nil
+	}
+}
+
+func TestJournaldSinkSend(t *testing.T) {
+	path, entries := journalTestSocket(t)
+	sink, err := NewJournaldSink(JournaldConfig{SocketPath: path, SyslogIdentifier: "api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	large := strings.Repeat("x", 512<<10)
+	batch := []SinkEntry{
+		{Time: time.Now(), Message: "small", Fields: map[string]interface{}{"request_id": "r-1"}},
+		{Time: time.Now(), Message: "large", Fields: map[string]interface{}{"body": large}},
+	}
+	if err := sink.Send(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+
+	small := receiveJournal(t, entries)
+	if small["MESSAGE"] != "small" || small["REQUEST_ID"] != "r-1" || small["SYSLOG_IDENTIFIER"] != "api" {
+		t.Errorf("entry = %v", small)
+	}
+	big := receiveJournal(t, entries)
+	if big["MESSAGE"] != "large" || big["BODY"] != large {
+		t.Errorf("large entry not passed intact: MESSAGE = %q, BODY of %d bytes", big["MESSAGE"], len(big["BODY"]))
+	}
+}
+
+func TestJournaldSinkReopensSocket(t *testing.T) {
+	path, entries := journalTestSocket(t)
+	sink, err := NewJournaldSink(JournaldConfig{SocketPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	send := func(msg string) error {
+		return sink.Send(context.Background(), []SinkEntry{{Time: time.Now(), Message: msg}})
+	}
+	if err := send("first"); err != nil {
+		t.Fatal(err)
+	}
+	receiveJournal(t, entries)
+
+	// journald restarted: the socket is recreated at the same path
+	os.Remove(path)
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := send("second"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields, err := decodeJournal(buf[:n]); err != nil || fields["MESSAGE"] != "second" {
+		t.Errorf("entry = %v, %v", fields, err)
+	}
+}
+
+func TestJournaldSinkMissingSocket(t *testing.T) {
+	sink, err := NewJournaldSink(JournaldConfig{SocketPath: filepath.Join(t.TempDir(), "missing")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Send(context.Background(), []SinkEntry{{Message: "m"}}); err == nil {
+		t.Error("Send() to a missing socket succeeded")
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package tlog
+
+import "errors"
+
+// errNoJournal is returned on platforms without systemd.
+var errNoJournal = errors.New("tlog: journald is only available on Linux")
+
+// journalSupported reports whether the journal can be used.
+func journalSupported() error { return errNoJournal }
+
+// dialJournal always fails outside Linux.
+func dialJournal(path string) (journalConn, error) { return nil, errNoJournal }
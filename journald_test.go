@@ -0,0 +1,142 @@
+package tlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// decodeJournal parses an entry in the journal native protocol.
+func decodeJournal(msg []byte) (map[string]string, error) {
+	fields := map[string]string{}
+	for len(msg) > 0 {
+		i := bytes.IndexAny(msg, "=\n")
+		if i < 0 {
+			return nil, fmt.Errorf("journal: field without value: %q", msg)
+		}
+		name := string(msg[:i])
+		if _, ok := fields[name]; ok {
+			return nil, fmt.Errorf("journal: duplicate field %s", name)
+		}
+		if msg[i] == '=' {
+			msg = msg[i+1:]
+			j := bytes.IndexByte(msg, '\n')
+			if j < 0 {
+				return nil, fmt.Errorf("journal: unterminated field %s", name)
+			}
+			fields[name] = string(msg[:j])
+			msg = msg[j+1:]
+			continue
+		}
+		msg = msg[i+1:]
+		if len(msg) < 8 {
+			return nil, fmt.Errorf("journal: short length of %s", name)
+		}
+		n := int(binary.LittleEndian.Uint64(msg))
+		msg = msg[8:]
+		if len(msg) < n+1 || msg[n] != '\n' {
+			return nil, fmt.Errorf("journal: bad binary field %s", name)
+		}
+		fields[name] = string(msg[:n])
+		msg = msg[n+1:]
+	}
+	return fields, nil
+}
+
+func TestEncodeJournal(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry SinkEntry
+		want  map[string]string
+	}{
+		{
+			name: "built-in fields",
+			entry: SinkEntry{
+				Level:      zapcore.WarnLevel,
+				LoggerName: "db",
+				Message:    "slow query",
+				Caller:     zapcore.EntryCaller{Defined: true, File: "/src/app/repo.go", Line: 12, Function: "app.find"},
+				Stack:      "goroutine 1\nmain.main()",
+				Fields:     map[string]interface{}{"request_id": "r-1", "rows": 3, "http.method": "GET", "_private": "x", "2xx": true},
+			},
+			want: map[string]string{
+				"MESSAGE":           "slow query",
+				"PRIORITY":          "4",
+				"SYSLOG_IDENTIFIER": "api",
+				"LEVEL":             "warn",
+				"LOGGER":            "db",
+				"CODE_FILE":         "/src/app/repo.go",
+				"CODE_LINE":         "12",
+				"CODE_FUNC":         "app.find",
+				"STACKTRACE":        "goroutine 1\nmain.main()",
+				"REQUEST_ID":        "r-1",
+				"ROWS":              "3",
+				"HTTP_METHOD":       "GET",
+				"PRIVATE":           "x",
+				"F_2XX":             "true",
+			},
+		},
+		{
+			name: "fields named like built-ins",
+			entry: SinkEntry{
+				Level:   zapcore.ErrorLevel,
+				Message: "failed",
+				Fields: map[string]interface{}{
+					"message":           "user message",
+					"priority":          "high",
+					"level":             "custom",
+					"logger":            "job",
+					"stacktrace":        "none",
+					"syslog_identifier": "other",
+					"code_line":         7,
+				},
+			},
+			want: map[string]string{
+				"MESSAGE":                "failed",
+				"PRIORITY":               "3",
+				"SYSLOG_IDENTIFIER":      "api",
+				"LEVEL":                  "error",
+				"TLOG_MESSAGE":           "user message",
+				"TLOG_PRIORITY":          "high",
+				"TLOG_LEVEL":             "custom",
+				"TLOG_LOGGER":            "job",
+				"TLOG_STACKTRACE":        "none",
+				"TLOG_SYSLOG_IDENTIFIER": "other",
+				"TLOG_CODE_LINE":         "7",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeJournal(encodeJournal(tt.entry, "api"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("fields = %v\nwant %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJournalFieldName(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"request_id", "REQUEST_ID"},
+		{"http.status-code", "HTTP_STATUS_CODE"},
+		{"__cursor", "CURSOR"},
+		{"9lives", "F_9LIVES"},
+		{"___", ""},
+		{string(bytes.Repeat([]byte("a"), 70)), string(bytes.Repeat([]byte("A"), 64))},
+	}
+	for _, tt := range tests {
+		if got := journalFieldName(tt.in); got != tt.want {
+			t.Errorf("journalFieldName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package tlog
 
 import (
+	"errors"
+	"io"
 	"os"
 	"time"
 
@@ -9,14 +11,63 @@ import (
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
-var globalLogger *zap.Logger
+var (
+	globalLogger  *zap.Logger
+	globalOutputs zapcore.Core
+	globalClose   func() error
+	globalReopen  func() error
+)
+
+// builtLogger is a logger with the resources behind it.
+type builtLogger struct {
+	logger *zap.Logger
+
+	// outputs writes to every output regardless of level, sampling and
+	// dedup; request buffers flush through it.
+	outputs zapcore.Core
+
+	// close releases the logger's resources.
+	close func() error
+
+	// reopen reopens the logger's files.
+	reopen func() error
+}
 
 // Init initializes the global logger with the provided configuration.
 func Init(cfg Config) error {
-	if err := cfg.Validate(); err != nil {
+	b, err := build(cfg)
+	if err != nil {
 		return err
 	}
 
+	globalLogger = b.logger
+	globalOutputs = b.outputs
+	globalClose = b.close
+	globalReopen = b.reopen
+	zap.ReplaceGlobals(b.logger)
+
+	return nil
+}
+
+// New builds a logger from the provided configuration without replacing the
+// global logger. Use it for dedicated sinks such as an audit log.
+// The returned close func does for the logger what Close does for the global
+// one: it drains the async queue, flushes remote sinks and closes files and
+// goroutines. Call it once the logger is no longer used.
+func New(cfg Config) (*zap.Logger, func() error, error) {
+	b, err := build(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b.logger, b.close, nil
+}
+
+// build creates a logger from the configuration.
+func build(cfg Config) (*builtLogger, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
 	// Parse log level
 	level, err := zapcore.ParseLevel(cfg.Level)
 	if err != nil {
@@ -26,48 +77,111 @@ func Init(cfg Config) error {
 	// Create encoder config based on environment
 	encoderConfig := createEncoderConfig(cfg)
 
-	var cores []zapcore.Core
+	// Async queue shared by all outputs
+	var queue *asyncQueue
+	if cfg.Async.Enabled {
+		queue = newAsyncQueue(cfg.Async)
+	}
+	newCore := func(enc zapcore.Encoder, out zapcore.WriteSyncer) zapcore.Core {
+		if queue != nil {
+			return newAsyncCore(enc, out, level, queue)
+		}
+		return zapcore.NewCore(enc, out, level)
+	}
+
+	var (
+		cores     []zapcore.Core
+		closers   []io.Closer
+		reopeners []reopener
+	)
 
 	// Console core
 	if cfg.EnableConsole {
 		consoleEncoder := createConsoleEncoder(cfg, encoderConfig)
-		consoleCore := zapcore.NewCore(
-			consoleEncoder,
-			zapcore.Lock(os.Stdout),
-			level,
-		)
-		cores = append(cores, consoleCore)
+		cores = append(cores, newCore(consoleEncoder, zapcore.Lock(os.Stdout)))
+	}
+
+	fail := func(err error) (*builtLogger, error) {
+		for _, c := range closers {
+			c.Close()
+		}
+		if queue != nil {
+			queue.close()
+		}
+		return nil, err
 	}
 
 	// File core
 	if cfg.EnableFile {
-		fileWriter := &lumberjack.Logger{
-			Filename:   cfg.FilePath,
-			MaxSize:    cfg.MaxSizeMB,
-			MaxBackups: cfg.MaxBackups,
-			MaxAge:     cfg.MaxAgeDays,
-			Compress:   cfg.Compress,
+		fileWriter, err := createFileWriter(cfg)
+		if err != nil {
+			return fail(err)
 		}
-		fileCore := zapcore.NewCore(
-			zapcore.NewJSONEncoder(encoderConfig),
-			zapcore.AddSync(fileWriter),
-			level,
-		)
-		cores = append(cores, fileCore)
+		closers = append(closers, fileWriter)
+		reopeners = append(reopeners, fileWriter)
+		cores = append(cores, newCore(zapcore.NewJSONEncoder(encoderConfig), zapcore.AddSync(fileWriter)))
+	}
+
+	// Routed file cores
+	for _, o := range cfg.Outputs {
+		fileWriter, err := createFileWriter(o.fileConfig(cfg))
+		if err != nil {
+			return fail(err)
+		}
+		closers = append(closers, fileWriter)
+		reopeners = append(reopeners, fileWriter)
+		minLevel, _ := zapcore.ParseLevel(o.MinLevel)
+		maxLevel, _ := zapcore.ParseLevel(o.MaxLevel)
+		core := newCore(zapcore.NewJSONEncoder(encoderConfig), zapcore.AddSync(fileWriter))
+		cores = append(cores, newRouteCore(core, minLevel, maxLevel, o.Components))
 	}
 
 	// If no cores configured, default to console
 	if len(cores) == 0 {
-		consoleCore := zapcore.NewCore(
-			zapcore.NewConsoleEncoder(encoderConfig),
-			zapcore.Lock(os.Stdout),
-			level,
-		)
-		cores = append(cores, consoleCore)
+		cores = append(cores, newCore(zapcore.NewConsoleEncoder(encoderConfig), zapcore.Lock(os.Stdout)))
+	}
+
+	// Global fields
+	var globalFields []zap.Field
+	if cfg.AppName != "" {
+		globalFields = append(globalFields, zap.String("service", cfg.AppName))
+	}
+	if cfg.Version != "" {
+		globalFields = append(globalFields, zap.String("version", cfg.Version))
+	}
+
+	// Remote sink cores; their diagnostics go to the local outputs only
+	var batchers []*sinkBatcher
+	if len(cfg.Sinks) > 0 {
+		diag := zap.New(zapcore.NewTee(cores...), zap.AddCaller()).With(globalFields...)
+		for _, o := range cfg.Sinks {
+			if c, ok := o.Sink.(sinkConfigurer); ok {
+				c.configure(cfg)
+			}
+			b := newSinkBatcher(o, diag)
+			batchers = append(batchers, b)
+
+			minLevel, _ := zapcore.ParseLevel(o.MinLevel)
+			cores = append(cores, newRouteCore(newSinkCore(b, level), minLevel, zapcore.FatalLevel, o.Components))
+		}
 	}
 
 	// Create tee core
 	core := zapcore.NewTee(cores...)
+	outputs := core
+
+	// Sampling drops entries in Check; dedup wraps it so repeats are counted
+	// before sampling and repeat counts are never sampled out
+	unsampled := core
+	if cfg.Sampling.Enabled {
+		core = newSamplerCore(core, cfg.Sampling)
+	}
+	var dedup *dedupState
+	if cfg.Dedup.Enabled {
+		var dc *dedupCore
+		dc, dedup = newDedupCore(core, unsampled, cfg.Dedup)
+		core = dc
+	}
 
 	// Build logger with options
 	logger := zap.New(core,
@@ -77,21 +191,68 @@ func Init(cfg Config) error {
 	)
 
 	// Add global fields
-	var globalFields []zap.Field
-	if cfg.AppName != "" {
-		globalFields = append(globalFields, zap.String("service", cfg.AppName))
-	}
-	if cfg.Version != "" {
-		globalFields = append(globalFields, zap.String("version", cfg.Version))
-	}
 	if len(globalFields) > 0 {
 		logger = logger.With(globalFields...)
+		outputs = outputs.With(globalFields)
 	}
 
-	globalLogger = logger
-	zap.ReplaceGlobals(logger)
+	if queue != nil {
+		go queue.reportDrops(logger)
+	}
 
-	return nil
+	closeFn := func() error {
+		var errs []error
+		if dedup != nil {
+			errs = append(errs, dedup.Close())
+		}
+		if queue != nil {
+			queue.logDrops(logger)
+			errs = append(errs, queue.close())
+		}
+		for _, b := range batchers {
+			errs = append(errs, b.close())
+		}
+		for _, c := range closers {
+			errs = append(errs, c.Close())
+		}
+		return errors.Join(errs...)
+	}
+
+	reopenFn := func() error {
+		var errs []error
+		for _, r := range reopeners {
+			errs = append(errs, r.Reopen())
+		}
+		return errors.Join(errs...)
+	}
+
+	return &builtLogger{logger: logger, outputs: outputs, close: closeFn, reopen: reopenFn}, nil
+}
+
+// logFileWriter is the writer behind a file output.
+type logFileWriter interface {
+	io.WriteCloser
+	reopener
+}
+
+// createFileWriter creates the writer for FilePath: lumberjack by default,
+// the built-in rotating writer with Rotation, or a plain file with
+// ExternalRotation.
+func createFileWriter(cfg Config) (logFileWriter, error) {
+	switch {
+	case cfg.ExternalRotation:
+		return newPlainFile(cfg.FilePath)
+	case cfg.Rotation.Enabled:
+		return newRotatingWriter(cfg)
+	default:
+		return lumberjackFile{&lumberjack.Logger{
+			Filename:   cfg.FilePath,
+			MaxSize:    cfg.MaxSizeMB,
+			MaxBackups: cfg.MaxBackups,
+			MaxAge:     cfg.MaxAgeDays,
+			Compress:   cfg.Compress,
+		}}, nil
+	}
 }
 
 // InitWithDefaults initializes the logger with default configuration.
@@ -199,3 +360,13 @@ func Sync() error {
 	}
 	return nil
 }
+
+// Close emits pending duplicate counts, drains the async queue, if enabled,
+// and closes the log files of the global logger. Call it once before exiting; entries logged afterwards are
+// written synchronously.
+func Close() error {
+	if globalClose != nil {
+		return globalClose()
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package tlog
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// observeLogs replaces the global logger with one recording entries at
+// level and above until the test ends.
+func observeLogs(t *testing.T, level zapcore.Level) *observer.ObservedLogs {
+	t.Helper()
+	core, logs := observer.New(level)
+	prev := globalLogger
+	globalLogger = zap.New(core)
+	t.Cleanup(func() { globalLogger = prev })
+	return logs
+}
+
+func TestNewClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	cfg := DefaultConfig().WithConsole(false).WithFile(path)
+	cfg.Async = DefaultAsyncConfig()
+
+	logger, closeLogger, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("queued entry")
+	if err := closeLogger(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "queued entry") {
+		t.Errorf("log file lacks the queued entry:\n%s", data)
+	}
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Sinks = []SinkOutput{{}}
+	if _, closeLogger, err := New(cfg); err == nil || closeLogger != nil {
+		t.Errorf("New() error = %v, close func set = %t; want an error and no close func", err, closeLogger != nil)
+	}
+}
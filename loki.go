@@ -0,0 +1,345 @@
+package tlog
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// LokiFormat is the encoding of Loki push requests.
+type LokiFormat int
+
+const (
+	// LokiProtobuf sends snappy-compressed protobuf, like promtail.
+	LokiProtobuf LokiFormat = iota
+	// LokiJSON sends JSON, optionally gzipped.
+	LokiJSON
+)
+
+// LokiConfig configures a sink for the Loki HTTP push API.
+type LokiConfig struct {
+	// URL is the push endpoint. Required.
+	// Example: "http://loki:3100/loki/api/v1/push"
+	URL string
+
+	// Format is the request encoding.
+	// Default: LokiProtobuf
+	Format LokiFormat
+
+	// Labels are static labels added to every stream.
+	// Example: map[string]string{"env": "production"}
+	Labels map[string]string
+
+	// LabelFields are the fields turned into stream labels; "level" is the
+	// entry level. Fields with unbounded values, such as request_id, are
+	// rejected. Label fields are removed from the log line.
+	// Default: []string{"service", "level", "version"}
+	LabelFields []string
+
+	// MaxStreams caps the number of distinct label sets. Entries that would
+	// create more streams get the static labels only.
+	// Default: 1000
+	MaxStreams int
+
+	// Gzip compresses JSON requests. Protobuf requests are always snappy
+	// compressed.
+	// Default: false
+	Gzip bool
+
+	// TenantID is sent as X-Scope-OrgID for multi-tenant Loki.
+	TenantID string
+
+	// Username and Password enable basic authentication.
+	Username string
+	Password string
+
+	// Headers are added to every request.
+	Headers map[string]string
+
+	// Client sends the requests.
+	// Default: a client with a 30s timeout
+	Client *http.Client
+}
+
+// highCardinalityFields are fields whose values are unbounded, so they
+// cannot be Loki labels without creating a stream per value.
+var highCardinalityFields = map[string]bool{
+	"request_id":      true,
+	"trace_id":        true,
+	"span_id":         true,
+	"tx_id":           true,
+	"user_id":         true,
+	"client_ip":       true,
+	"ip_address":      true,
+	"user_agent":      true,
+	"query":           true,
+	"query_string":    true,
+	"sql":             true,
+	"sql_hash":        true,
+	"sql_fingerprint": true,
+	"error":           true,
+	"duration_ms":     true,
+}
+
+// lokiLabelName matches valid Loki label names.
+var lokiLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// LokiSink pushes entries to Loki. Create it with NewLokiSink.
+type LokiSink struct {
+	cfg     LokiConfig
+	headers map[string]string
+	service string
+
+	mu      sync.Mutex
+	streams map[string]bool
+}
+
+// NewLokiSink creates a Loki sink, applying defaults to unset fields.
+func NewLokiSink(cfg LokiConfig) (*LokiSink, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("tlog: loki URL is required")
+	}
+	if cfg.Format != LokiProtobuf && cfg.Format != LokiJSON {
+		return nil, fmt.Errorf("tlog: invalid loki format %d", int(cfg.Format))
+	}
+	if cfg.LabelFields == nil {
+		cfg.LabelFields = []string{"service", "level", "version"}
+	}
+	if cfg.MaxStreams <= 0 {
+		cfg.MaxStreams = 1000
+	}
+	if cfg.Client == nil {
+		cfg.Client = defaultHTTPClient
+	}
+	for _, f := range cfg.LabelFields {
+		if highCardinalityFields[f] {
+			return nil, fmt.Errorf("tlog: loki label %q has unbounded values; keep it in the log line", f)
+		}
+		if !lokiLabelName.MatchString(f) {
+			return nil, fmt.Errorf("tlog: invalid loki label name %q", f)
+		}
+	}
+	for name := range cfg.Labels {
+		if !lokiLabelName.MatchString(name) {
+			return nil, fmt.Errorf("tlog: invalid loki label name %q", name)
+		}
+	}
+
+	headers := make(map[string]string, len(cfg.Headers)+2)
+	for k, v := range cfg.Headers {
+		headers[k] = v
+	}
+	if cfg.TenantID != "" {
+		headers["X-Scope-OrgID"] = cfg.TenantID
+	}
+	if cfg.Username != "" || cfg.Password != "" {
+		headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(cfg.Username+":"+cfg.Password))
+	}
+
+	return &LokiSink{cfg: cfg, headers: headers, streams: make(map[string]bool)}, nil
+}
+
+// Name returns "loki".
+func (s *LokiSink) Name() string { return "loki" }
+
+// Close does nothing; requests are independent.
+func (s *LokiSink) Close() error { return nil }
+
+// configure uses the service name for streams beyond MaxStreams.
+func (s *LokiSink) configure(cfg Config) {
+	s.service = cfg.AppName
+}
+
+// lokiStream is the entries of one label set.
+type lokiStream struct {
+	labels  map[string]string
+	entries []lokiEntry
+}
+
+// lokiEntry is a log line with its timestamp in nanoseconds.
+type lokiEntry struct {
+	ts   int64
+	line string
+}
+
+// Send pushes a batch, grouped into streams by label set.
+func (s *LokiSink) Send(ctx context.Context, batch []SinkEntry) error {
+	streams := make(map[string]*lokiStream)
+	for _, e := range batch {
+		labels := s.labels(e)
+		key := lokiLabelString(labels)
+		if !s.admit(key) {
+			labels = s.fallbackLabels()
+			key = lokiLabelString(labels)
+		}
+
+		rec := e.record()
+		for _, f := range s.cfg.LabelFields {
+			if f != "level" && f != "message" {
+				delete(rec, f)
+			}
+		}
+		line, err := json.Marshal(rec)
+		if err != nil {
+			line = []byte(fmt.Sprintf(`{"level":%q,"message":%q,"encode_error":%q}`, e.Level.String(), e.Message, err.Error()))
+		}
+
+		st := streams[key]
+		if st == nil {
+			st = &lokiStream{labels: labels}
+			streams[key] = st
+		}
+		st.entries = append(st.entries, lokiEntry{ts: e.Time.UnixNano(), line: string(line)})
+	}
+
+	keys := make([]string, 0, len(streams))
+	for k, st := range streams {
+		keys = append(keys, k)
+		sort.SliceStable(st.entries, func(i, j int) bool { return st.entries[i].ts < st.entries[j].ts })
+	}
+	sort.Strings(keys)
+
+	req := httpRequest{url: s.cfg.URL, headers: s.headers}
+	if s.cfg.Format == LokiJSON {
+		req.body = lokiJSON(keys, streams)
+		req.contentType = "application/json"
+		req.gzip = s.cfg.Gzip
+	} else {
+		req.body = snappyEncode(lokiProtobuf(keys, streams))
+		req.contentType = "application/x-protobuf"
+	}
+	_, err := postHTTP(ctx, s.cfg.Client, req)
+	return err
+}
+
+// labels returns the stream labels of an entry.
+func (s *LokiSink) labels(e SinkEntry) map[string]string {
+	labels := make(map[string]string, len(s.cfg.Labels)+len(s.cfg.LabelFields))
+	for k, v := range s.cfg.Labels {
+		labels[k] = v
+	}
+	for _, f := range s.cfg.LabelFields {
+		if f == "level" {
+			labels[f] = e.Level.String()
+			continue
+		}
+		if v, ok := e.Fields[f]; ok {
+			labels[f] = fmt.Sprint(v)
+		}
+	}
+	if len(labels) == 0 {
+		return s.fallbackLabels()
+	}
+	return labels
+}
+
+// fallbackLabels returns the labels of entries beyond MaxStreams: the
+// static labels, or the service name when there are none.
+func (s *LokiSink) fallbackLabels() map[string]string {
+	if len(s.cfg.Labels) > 0 {
+		return s.cfg.Labels
+	}
+	if s.service != "" {
+		return map[string]string{"service": s.service}
+	}
+	return map[string]string{"job": "tlog"}
+}
+
+// admit reports whether the label set may be used, tracking new ones up to
+// MaxStreams.
+func (s *LokiSink) admit(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.streams[key] {
+		return true
+	}
+	if len(s.streams) >= s.cfg.MaxStreams {
+		return false
+	}
+	s.streams[key] = true
+	return true
+}
+
+// lokiLabelString formats labels the way Loki expects: {a="b", c="d"}.
+func lokiLabelString(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, k := range names {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[k]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// lokiJSON encodes a push request in the JSON format.
+func lokiJSON(keys []string, streams map[string]*lokiStream) []byte {
+	type stream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	req := struct {
+		Streams []stream `json:"streams"`
+	}{Streams: make([]stream, 0, len(keys))}
+
+	for _, k := range keys {
+		st := streams[k]
+		values := make([][2]string, len(st.entries))
+		for i, e := range st.entries {
+			values[i] = [2]string{strconv.FormatInt(e.ts, 10), e.line}
+		}
+		req.Streams = append(req.Streams, stream{Stream: st.labels, Values: values})
+	}
+	body, _ := json.Marshal(req)
+	return body
+}
+
+// lokiProtobuf encodes a push request in the logproto format:
+//
+//	PushRequest   { repeated StreamAdapter streams = 1; }
+//	StreamAdapter { string labels = 1; repeated EntryAdapter entries = 2; }
+//	EntryAdapter  { google.protobuf.Timestamp timestamp = 1; string line = 2; }
+func lokiProtobuf(keys []string, streams map[string]*lokiStream) []byte {
+	var req, stream, entry, ts []byte
+	for _, k := range keys {
+		stream = protowire.AppendTag(stream[:0], 1, protowire.BytesType)
+		stream = protowire.AppendString(stream, k)
+		for _, e := range streams[k].entries {
+			ts = protowire.AppendTag(ts[:0], 1, protowire.VarintType)
+			ts = protowire.AppendVarint(ts, uint64(e.ts/1e9))
+			ts = protowire.AppendTag(ts, 2, protowire.VarintType)
+			ts = protowire.AppendVarint(ts, uint64(e.ts%1e9))
+
+			entry = protowire.AppendTag(entry[:0], 1, protowire.BytesType)
+			entry = protowire.AppendBytes(entry, ts)
+			entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+			entry = protowire.AppendString(entry, e.line)
+
+			stream = protowire.AppendTag(stream, 2, protowire.BytesType)
+			stream = protowire.AppendBytes(stream, entry)
+		}
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, stream)
+	}
+	return req
+}
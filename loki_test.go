@@ -0,0 +1,337 @@
+package tlog
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// lokiTestStream is a decoded push request stream.
+type lokiTestStream struct {
+	labels string
+	ts     []int64
+	lines  []string
+}
+
+// lokiTestPush is a push request received by a test server.
+type lokiTestPush struct {
+	header  http.Header
+	streams []lokiTestStream
+}
+
+// newLokiTestServer decodes the push requests it receives, in either format.
+func newLokiTestServer(t *testing.T) (*httptest.Server, chan lokiTestPush) {
+	t.Helper()
+	pushes := make(chan lokiTestPush, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body = zr
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		var streams []lokiTestStream
+		switch r.Header.Get("Content-Type") {
+		case "application/x-protobuf":
+			data, err = snappyDecode(data)
+			if err == nil {
+				streams, err = decodeLokiProtobuf(data)
+			}
+		case "application/json":
+			streams, err = decodeLokiJSON(data)
+		default:
+			t.Errorf("unexpected content type %q", r.Header.Get("Content-Type"))
+		}
+		if err != nil {
+			t.Error(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		pushes <- lokiTestPush{header: r.Header, streams: streams}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, pushes
+}
+
+func decodeLokiJSON(data []byte) ([]lokiTestStream, error) {
+	var req struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, err
+	}
+	var streams []lokiTestStream
+	for _, s := range req.Streams {
+		st := lokiTestStream{labels: lokiLabelString(s.Stream)}
+		for _, v := range s.Values {
+			ts, err := strconv.ParseInt(v[0], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			st.ts = append(st.ts, ts)
+			st.lines = append(st.lines, v[1])
+		}
+		streams = append(streams, st)
+	}
+	return streams, nil
+}
+
+// consumeFields calls fn for each field of a protobuf message, with the
+// payload of length-delimited fields or the value of numeric ones.
+func consumeFields(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte, n uint64)) error {
+	for len(b) > 0 {
+		num, typ, k := protowire.ConsumeTag(b)
+		if k < 0 {
+			return protowire.ParseError(k)
+		}
+		b = b[k:]
+		switch typ {
+		case protowire.BytesType:
+			v, k := protowire.ConsumeBytes(b)
+			if k < 0 {
+				return protowire.ParseError(k)
+			}
+			fn(num, typ, v, 0)
+			b = b[k:]
+		case protowire.VarintType:
+			v, k := protowire.ConsumeVarint(b)
+			if k < 0 {
+				return protowire.ParseError(k)
+			}
+			fn(num, typ, nil, v)
+			b = b[k:]
+		case protowire.Fixed64Type:
+			v, k := protowire.ConsumeFixed64(b)
+			if k < 0 {
+				return protowire.ParseError(k)
+			}
+			fn(num, typ, nil, v)
+			b = b[k:]
+		default:
+			k := protowire.ConsumeFieldValue(num, typ, b)
+			if k < 0 {
+				return protowire.ParseError(k)
+			}
+			b = b[k:]
+		}
+	}
+	return nil
+}
+
+func decodeLokiProtobuf(data []byte) ([]lokiTestStream, error) {
+	var streams []lokiTestStream
+	var err error
+	perr := consumeFields(data, func(_ protowire.Number, _ protowire.Type, stream []byte, _ uint64) {
+		var st lokiTestStream
+		e := consumeFields(stream, func(num protowire.Number, _ protowire.Type, v []byte, _ uint64) {
+			if num == 1 {
+				st.labels = string(v)
+				return
+			}
+			var ts int64
+			var line string
+			e := consumeFields(v, func(num protowire.Number, _ protowire.Type, v []byte, _ uint64) {
+				if num == 2 {
+					line = string(v)
+					return
+				}
+				e := consumeFields(v, func(num protowire.Number, _ protowire.Type, _ []byte, n uint64) {
+					if num == 1 {
+						ts += int64(n) * 1e9
+					} else {
+						ts += int64(n)
+					}
+				})
+				if e != nil {
+					err = e
+				}
+			})
+			if e != nil {
+				err = e
+			}
+			st.ts = append(st.ts, ts)
+			st.lines = append(st.lines, line)
+		})
+		if e != nil {
+			err = e
+		}
+		streams = append(streams, st)
+	})
+	if perr != nil {
+		return nil, perr
+	}
+	return streams, err
+}
+
+func lokiTestBatch(base time.Time) []SinkEntry {
+	return []SinkEntry{
+		{Time: base.Add(2 * time.Millisecond), Level: zapcore.InfoLevel, Message: "second", Fields: map[string]interface{}{"service": "api", "request_id": "r-2"}},
+		{Time: base.Add(time.Millisecond), Level: zapcore.InfoLevel, Message: "first", Fields: map[string]interface{}{"service": "api", "request_id": "r-1"}},
+		{Time: base, Level: zapcore.ErrorLevel, Message: "failed", Fields: map[string]interface{}{"service": "api"}},
+	}
+}
+
+func TestLokiSinkSend(t *testing.T) {
+	base := time.Unix(1700000000, 123456789)
+	tests := []struct {
+		name   string
+		format LokiFormat
+		gzip   bool
+	}{
+		{"protobuf", LokiProtobuf, false},
+		{"json", LokiJSON, false},
+		{"json gzip", LokiJSON, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, pushes := newLokiTestServer(t)
+			sink, err := NewLokiSink(LokiConfig{
+				URL:      srv.URL,
+				Format:   tt.format,
+				Gzip:     tt.gzip,
+				Labels:   map[string]string{"env": "test"},
+				TenantID: "team-a",
+				Username: "user",
+				Password: "secret",
+				Headers:  map[string]string{"X-Extra": "1"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := sink.Send(context.Background(), lokiTestBatch(base)); err != nil {
+				t.Fatal(err)
+			}
+
+			push := <-pushes
+			if push.header.Get("X-Scope-OrgID") != "team-a" || push.header.Get("X-Extra") != "1" {
+				t.Errorf("headers = %v", push.header)
+			}
+			if user, pass, ok := (&http.Request{Header: push.header}).BasicAuth(); !ok || user != "user" || pass != "secret" {
+				t.Errorf("basic auth = %q %q %t", user, pass, ok)
+			}
+
+			if len(push.streams) != 2 {
+				t.Fatalf("got %d streams, want 2: %+v", len(push.streams), push.streams)
+			}
+			errStream, infoStream := push.streams[0], push.streams[1]
+			if errStream.labels != `{env="test", level="error", service="api"}` || infoStream.labels != `{env="test", level="info", service="api"}` {
+				t.Errorf("labels = %s, %s", errStream.labels, infoStream.labels)
+			}
+			if len(infoStream.lines) != 2 || !strings.Contains(infoStream.lines[0], `"first"`) || infoStream.ts[0] != base.Add(time.Millisecond).UnixNano() {
+				t.Errorf("info stream not ordered by time: %+v", infoStream)
+			}
+			var line map[string]interface{}
+			if err := json.Unmarshal([]byte(infoStream.lines[0]), &line); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := line["service"]; ok {
+				t.Errorf("label field kept in the line: %v", line)
+			}
+			if line["request_id"] != "r-1" || line["level"] != "info" {
+				t.Errorf("line = %v", line)
+			}
+		})
+	}
+}
+
+func TestLokiSinkMaxStreams(t *testing.T) {
+	srv, pushes := newLokiTestServer(t)
+	sink, err := NewLokiSink(LokiConfig{URL: srv.URL, LabelFields: []string{"tenant"}, MaxStreams: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.configure(Config{AppName: "billing"})
+
+	var batch []SinkEntry
+	for _, tenant := range []string{"a", "b", "c", "d"} {
+		batch = append(batch, SinkEntry{Time: time.Now(), Message: "m", Fields: map[string]interface{}{"tenant": tenant}})
+	}
+	if err := sink.Send(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]int{}
+	for _, st := range (<-pushes).streams {
+		got[st.labels] = len(st.lines)
+	}
+	want := map[string]int{`{tenant="a"}`: 1, `{tenant="b"}`: 1, `{service="billing"}`: 2}
+	if len(got) != len(want) {
+		t.Fatalf("streams = %v, want %v", got, want)
+	}
+	for k, n := range want {
+		if got[k] != n {
+			t.Errorf("stream %s has %d entries, want %d", k, got[k], n)
+		}
+	}
+}
+
+func TestLokiSinkStatus(t *testing.T) {
+	tests := []struct {
+		status        int
+		wantPermanent bool
+	}{
+		{http.StatusBadRequest, true},
+		{http.StatusTooManyRequests, false},
+		{http.StatusBadGateway, false},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "entry out of order", tt.status)
+			}))
+			defer srv.Close()
+
+			sink, err := NewLokiSink(LokiConfig{URL: srv.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = sink.Send(context.Background(), lokiTestBatch(time.Now()))
+			if err == nil || isPermanent(err) != tt.wantPermanent {
+				t.Errorf("Send() error = %v, permanent %t, want permanent %t", err, isPermanent(err), tt.wantPermanent)
+			}
+		})
+	}
+}
+
+func TestNewLokiSinkValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  LokiConfig
+	}{
+		{"no url", LokiConfig{}},
+		{"bad format", LokiConfig{URL: "http://loki", Format: LokiFormat(9)}},
+		{"high cardinality label", LokiConfig{URL: "http://loki", LabelFields: []string{"request_id"}}},
+		{"bad label field", LokiConfig{URL: "http://loki", LabelFields: []string{"http.method"}}},
+		{"bad static label", LokiConfig{URL: "http://loki", Labels: map[string]string{"1env": "x"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewLokiSink(tt.cfg); err == nil {
+				t.Error("NewLokiSink() error = nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package tlog
+
+import "regexp"
+
+// DefaultMaskValue is the default replacement for masked fields.
+const DefaultMaskValue = "******"
+
+// DefaultMaskPatterns are the column and field name patterns masked by
+// default in logged SQL and audit events: passwords, secrets, tokens, keys
+// and payment card data.
+var DefaultMaskPatterns = []string{
+	`(?i)passw(or)?d|^pwd$`,
+	`(?i)secret`,
+	`(?i)token`,
+	`(?i)api_?key|private_?key`,
+	`(?i)credit_?card|card_?number|^cvv$|^cvc$`,
+	`(?i)^ssn$`,
+}
+
+// compilePatterns compiles regex patterns, silently skipping invalid ones.
+func compilePatterns(patterns []string) []*regexp.Regexp {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		if re, err := regexp.Compile(p); err == nil {
+			compiled = append(compiled, re)
+		}
+	}
+	return compiled
+}
+
+// shouldMask checks if a field name matches any of the mask patterns.
+func shouldMask(fieldName string, patterns []*regexp.Regexp) bool {
+	for _, p := range patterns {
+		if p.MatchString(fieldName) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,507 @@
+package tlog
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// OTLPProtocol is the encoding of OTLP/HTTP requests.
+type OTLPProtocol int
+
+const (
+	// OTLPProtobuf sends binary protobuf.
+	OTLPProtobuf OTLPProtocol = iota
+	// OTLPJSON sends the OTLP JSON encoding.
+	OTLPJSON
+)
+
+// OTLPConfig configures an OTLP/HTTP logs exporter, e.g. to an
+// OpenTelemetry Collector.
+type OTLPConfig struct {
+	// Endpoint is the logs endpoint. "/v1/logs" is appended when the URL
+	// has no path. Required.
+	// Example: "http://otel-collector:4318"
+	Endpoint string
+
+	// Protocol is the request encoding.
+	// Default: OTLPProtobuf
+	Protocol OTLPProtocol
+
+	// ResourceAttributes are added to the resource, next to service.name and
+	// service.version from Config.AppName and Config.Version.
+	// Example: map[string]string{"deployment.environment": "production"}
+	ResourceAttributes map[string]string
+
+	// Gzip compresses request bodies.
+	// Default: false
+	Gzip bool
+
+	// Headers are added to every request, e.g. for authentication.
+	Headers map[string]string
+
+	// Client sends the requests.
+	// Default: a client with a 30s timeout
+	Client *http.Client
+}
+
+// otlpScopeName is the instrumentation scope of exported records.
+const otlpScopeName = "github.com/thienel/tlog"
+
+// OTLPSink exports entries as OTLP log records. Create it with NewOTLPSink.
+type OTLPSink struct {
+	cfg      OTLPConfig
+	resource []otlpKeyValue
+	service  string
+	version  string
+}
+
+// NewOTLPSink creates an OTLP exporter, applying defaults to unset fields.
+func NewOTLPSink(cfg OTLPConfig) (*OTLPSink, error) {
+	if cfg.Endpoint == "" {
+		return nil, errors.New("tlog: OTLP endpoint is required")
+	}
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("tlog: invalid OTLP endpoint: %w", err)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/logs"
+		cfg.Endpoint = u.String()
+	}
+	if cfg.Protocol != OTLPProtobuf && cfg.Protocol != OTLPJSON {
+		return nil, fmt.Errorf("tlog: invalid OTLP protocol %d", int(cfg.Protocol))
+	}
+	if cfg.Client == nil {
+		cfg.Client = defaultHTTPClient
+	}
+
+	s := &OTLPSink{cfg: cfg}
+	s.configure(Config{})
+	return s, nil
+}
+
+// Name returns "otlp".
+func (s *OTLPSink) Name() string { return "otlp" }
+
+// Close does nothing; requests are independent.
+func (s *OTLPSink) Close() error { return nil }
+
+// configure builds the resource attributes from the logger configuration.
+func (s *OTLPSink) configure(cfg Config) {
+	s.service, s.version = cfg.AppName, cfg.Version
+	attrs := make(map[string]interface{}, len(s.cfg.ResourceAttributes)+3)
+	for k, v := range s.cfg.ResourceAttributes {
+		attrs[k] = v
+	}
+	if cfg.AppName != "" {
+		attrs["service.name"] = cfg.AppName
+	}
+	if cfg.Version != "" {
+		attrs["service.version"] = cfg.Version
+	}
+	if host, err := os.Hostname(); err == nil {
+		if _, ok := attrs["host.name"]; !ok {
+			attrs["host.name"] = host
+		}
+	}
+	s.resource = otlpAttributes(attrs)
+}
+
+// otlpKeyValue is an attribute with a value converted from a field.
+type otlpKeyValue struct {
+	key   string
+	value interface{}
+}
+
+// otlpRecord is a log record in the OTLP data model.
+type otlpRecord struct {
+	time     int64
+	severity int
+	text     string
+	body     string
+	attrs    []otlpKeyValue
+	traceID  []byte
+	spanID   []byte
+}
+
+// Send exports a batch in one request.
+func (s *OTLPSink) Send(ctx context.Context, batch []SinkEntry) error {
+	records := make([]otlpRecord, len(batch))
+	for i, e := range batch {
+		records[i] = s.record(e)
+	}
+
+	req := httpRequest{url: s.cfg.Endpoint, headers: s.cfg.Headers, gzip: s.cfg.Gzip}
+	if s.cfg.Protocol == OTLPJSON {
+		body, err := s.encodeJSON(records)
+		if err != nil {
+			return PermanentError(fmt.Errorf("tlog: encode OTLP JSON: %w", err))
+		}
+		req.body = body
+		req.contentType = "application/json"
+	} else {
+		req.body = s.encodeProtobuf(records)
+		req.contentType = "application/x-protobuf"
+	}
+	_, err := postHTTP(ctx, s.cfg.Client, req)
+	return err
+}
+
+// record converts an entry to the OTLP log data model. Valid trace_id and
+// span_id fields become the record's trace context; code location and stack
+// trace use the semantic convention attribute names.
+func (s *OTLPSink) record(e SinkEntry) otlpRecord {
+	fields := make(map[string]interface{}, len(e.Fields)+5)
+	for k, v := range e.Fields {
+		fields[k] = v
+	}
+
+	r := otlpRecord{
+		time:     e.Time.UnixNano(),
+		severity: otlpSeverity(e.Level),
+		text:     strings.ToUpper(e.Level.String()),
+		body:     e.Message,
+	}
+	// The global service and version fields are resource attributes already.
+	if s.service != "" && fields["service"] == s.service {
+		delete(fields, "service")
+	}
+	if s.version != "" && fields["version"] == s.version {
+		delete(fields, "version")
+	}
+	if id, ok := otlpID(fields["trace_id"], 16); ok {
+		r.traceID = id
+		delete(fields, "trace_id")
+	}
+	if id, ok := otlpID(fields["span_id"], 8); ok {
+		r.spanID = id
+		delete(fields, "span_id")
+	}
+	if e.LoggerName != "" {
+		fields["logger.name"] = e.LoggerName
+	}
+	if e.Caller.Defined {
+		fields["code.filepath"] = e.Caller.File
+		fields["code.lineno"] = e.Caller.Line
+		if e.Caller.Function != "" {
+			fields["code.function"] = e.Caller.Function
+		}
+	}
+	if e.Stack != "" {
+		fields["exception.stacktrace"] = e.Stack
+	}
+	r.attrs = otlpAttributes(fields)
+	return r
+}
+
+// otlpSeverity maps a level to an OTLP severity number.
+func otlpSeverity(level zapcore.Level) int {
+	switch level {
+	case zapcore.DebugLevel:
+		return 5 // DEBUG
+	case zapcore.InfoLevel:
+		return 9 // INFO
+	case zapcore.WarnLevel:
+		return 13 // WARN
+	case zapcore.ErrorLevel:
+		return 17 // ERROR
+	case zapcore.DPanicLevel:
+		return 18 // ERROR2
+	case zapcore.PanicLevel:
+		return 21 // FATAL
+	case zapcore.FatalLevel:
+		return 22 // FATAL2
+	default:
+		return 0 // UNSPECIFIED
+	}
+}
+
+// otlpID decodes a hex trace or span ID of n bytes.
+func otlpID(v interface{}, n int) ([]byte, bool) {
+	s, ok := v.(string)
+	if !ok || len(s) != 2*n {
+		return nil, false
+	}
+	id, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, false
+	}
+	for _, b := range id {
+		if b != 0 {
+			return id, true
+		}
+	}
+	return nil, false
+}
+
+// otlpAttributes converts fields to attributes sorted by key.
+func otlpAttributes(fields map[string]interface{}) []otlpKeyValue {
+	attrs := make([]otlpKeyValue, 0, len(fields))
+	for k, v := range fields {
+		attrs = append(attrs, otlpKeyValue{key: k, value: v})
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].key < attrs[j].key })
+	return attrs
+}
+
+// encodeProtobuf encodes an ExportLogsServiceRequest:
+//
+//	ExportLogsServiceRequest { repeated ResourceLogs resource_logs = 1; }
+//	ResourceLogs { Resource resource = 1; repeated ScopeLogs scope_logs = 2; }
+//	Resource     { repeated KeyValue attributes = 1; }
+//	ScopeLogs    { InstrumentationScope scope = 1; repeated LogRecord log_records = 2; }
+func (s *OTLPSink) encodeProtobuf(records []otlpRecord) []byte {
+	var resource []byte
+	for _, kv := range s.resource {
+		resource = protowire.AppendTag(resource, 1, protowire.BytesType)
+		resource = protowire.AppendBytes(resource, appendOTLPKeyValue(nil, kv))
+	}
+
+	var scope []byte
+	scope = protowire.AppendTag(scope, 1, protowire.BytesType)
+	scope = protowire.AppendString(scope, otlpScopeName)
+
+	var scopeLogs []byte
+	scopeLogs = protowire.AppendTag(scopeLogs, 1, protowire.BytesType)
+	scopeLogs = protowire.AppendBytes(scopeLogs, scope)
+	var rec []byte
+	for _, r := range records {
+		rec = appendOTLPRecord(rec[:0], r)
+		scopeLogs = protowire.AppendTag(scopeLogs, 2, protowire.BytesType)
+		scopeLogs = protowire.AppendBytes(scopeLogs, rec)
+	}
+
+	var resourceLogs []byte
+	resourceLogs = protowire.AppendTag(resourceLogs, 1, protowire.BytesType)
+	resourceLogs = protowire.AppendBytes(resourceLogs, resource)
+	resourceLogs = protowire.AppendTag(resourceLogs, 2, protowire.BytesType)
+	resourceLogs = protowire.AppendBytes(resourceLogs, scopeLogs)
+
+	var req []byte
+	req = protowire.AppendTag(req, 1, protowire.BytesType)
+	return protowire.AppendBytes(req, resourceLogs)
+}
+
+// appendOTLPRecord appends a LogRecord:
+//
+//	LogRecord { fixed64 time_unix_nano = 1; SeverityNumber severity_number = 2;
+//	            string severity_text = 3; AnyValue body = 5; repeated KeyValue attributes = 6;
+//	            bytes trace_id = 9; bytes span_id = 10; fixed64 observed_time_unix_nano = 11; }
+func appendOTLPRecord(b []byte, r otlpRecord) []byte {
+	b = protowire.AppendTag(b, 1, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, uint64(r.time))
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(r.severity))
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	b = protowire.AppendString(b, r.text)
+	b = protowire.AppendTag(b, 5, protowire.BytesType)
+	b = protowire.AppendBytes(b, appendOTLPValue(nil, r.body))
+	for _, kv := range r.attrs {
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		b = protowire.AppendBytes(b, appendOTLPKeyValue(nil, kv))
+	}
+	if r.traceID != nil {
+		b = protowire.AppendTag(b, 9, protowire.BytesType)
+		b = protowire.AppendBytes(b, r.traceID)
+	}
+	if r.spanID != nil {
+		b = protowire.AppendTag(b, 10, protowire.BytesType)
+		b = protowire.AppendBytes(b, r.spanID)
+	}
+	b = protowire.AppendTag(b, 11, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, uint64(time.Now().UnixNano()))
+}
+
+// appendOTLPKeyValue appends a KeyValue { string key = 1; AnyValue value = 2; }.
+func appendOTLPKeyValue(b []byte, kv otlpKeyValue) []byte {
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, kv.key)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendBytes(b, appendOTLPValue(nil, kv.value))
+}
+
+// appendOTLPValue appends an AnyValue:
+//
+//	AnyValue { string string_value = 1; bool bool_value = 2; int64 int_value = 3;
+//	           double double_value = 4; ArrayValue array_value = 5;
+//	           KeyValueList kvlist_value = 6; bytes bytes_value = 7; }
+func appendOTLPValue(b []byte, v interface{}) []byte {
+	switch v := otlpNormalize(v).(type) {
+	case string:
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		return protowire.AppendString(b, v)
+	case bool:
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		return protowire.AppendVarint(b, protowire.EncodeBool(v))
+	case int64:
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		return protowire.AppendVarint(b, uint64(v))
+	case float64:
+		b = protowire.AppendTag(b, 4, protowire.Fixed64Type)
+		return protowire.AppendFixed64(b, math.Float64bits(v))
+	case []interface{}:
+		var arr []byte
+		for _, item := range v {
+			arr = protowire.AppendTag(arr, 1, protowire.BytesType)
+			arr = protowire.AppendBytes(arr, appendOTLPValue(nil, item))
+		}
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		return protowire.AppendBytes(b, arr)
+	case map[string]interface{}:
+		var list []byte
+		for _, kv := range otlpAttributes(v) {
+			list = protowire.AppendTag(list, 1, protowire.BytesType)
+			list = protowire.AppendBytes(list, appendOTLPKeyValue(nil, kv))
+		}
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		return protowire.AppendBytes(b, list)
+	case []byte:
+		b = protowire.AppendTag(b, 7, protowire.BytesType)
+		return protowire.AppendBytes(b, v)
+	default:
+		return b
+	}
+}
+
+// otlpNormalize converts a field value to string, bool, int64, float64,
+// []interface{}, map[string]interface{} or []byte.
+func otlpNormalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string, bool, int64, float64, []interface{}, map[string]interface{}, []byte:
+		return v
+	case int:
+		return int64(v)
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint:
+		return int64(v)
+	case uint8:
+		return int64(v)
+	case uint16:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case uint64:
+		if v > math.MaxInt64 {
+			return strconv.FormatUint(v, 10)
+		}
+		return int64(v)
+	case uintptr:
+		return int64(v)
+	case float32:
+		return float64(v)
+	case complex64, complex128:
+		return fmt.Sprint(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case time.Duration:
+		return v.String()
+	case nil:
+		return ""
+	default:
+		if data, err := json.Marshal(v); err == nil {
+			return string(data)
+		}
+		return fmt.Sprint(v)
+	}
+}
+
+// encodeJSON encodes an ExportLogsServiceRequest in the OTLP JSON encoding:
+// camelCase names, 64-bit integers and non-finite doubles as strings and hex
+// trace IDs.
+func (s *OTLPSink) encodeJSON(records []otlpRecord) ([]byte, error) {
+	logRecords := make([]map[string]interface{}, len(records))
+	observed := strconv.FormatInt(time.Now().UnixNano(), 10)
+	for i, r := range records {
+		rec := map[string]interface{}{
+			"timeUnixNano":         strconv.FormatInt(r.time, 10),
+			"observedTimeUnixNano": observed,
+			"severityNumber":       r.severity,
+			"severityText":         r.text,
+			"body":                 otlpJSONValue(r.body),
+			"attributes":           otlpJSONAttributes(r.attrs),
+		}
+		if r.traceID != nil {
+			rec["traceId"] = hex.EncodeToString(r.traceID)
+		}
+		if r.spanID != nil {
+			rec["spanId"] = hex.EncodeToString(r.spanID)
+		}
+		logRecords[i] = rec
+	}
+
+	req := map[string]interface{}{
+		"resourceLogs": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": otlpJSONAttributes(s.resource)},
+			"scopeLogs": []interface{}{map[string]interface{}{
+				"scope":      map[string]interface{}{"name": otlpScopeName},
+				"logRecords": logRecords,
+			}},
+		}},
+	}
+	return json.Marshal(req)
+}
+
+// otlpJSONAttributes encodes attributes as a JSON KeyValue list.
+func otlpJSONAttributes(attrs []otlpKeyValue) []interface{} {
+	out := make([]interface{}, len(attrs))
+	for i, kv := range attrs {
+		out[i] = map[string]interface{}{"key": kv.key, "value": otlpJSONValue(kv.value)}
+	}
+	return out
+}
+
+// otlpJSONValue encodes a value as a JSON AnyValue.
+func otlpJSONValue(v interface{}) map[string]interface{} {
+	switch v := otlpNormalize(v).(type) {
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		// encoding/json rejects NaN and infinities; the protobuf JSON
+		// mapping spells them as strings.
+		switch {
+		case math.IsNaN(v):
+			return map[string]interface{}{"doubleValue": "NaN"}
+		case math.IsInf(v, 1):
+			return map[string]interface{}{"doubleValue": "Infinity"}
+		case math.IsInf(v, -1):
+			return map[string]interface{}{"doubleValue": "-Infinity"}
+		}
+		return map[string]interface{}{"doubleValue": v}
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, item := range v {
+			values[i] = otlpJSONValue(item)
+		}
+		return map[string]interface{}{"arrayValue": map[string]interface{}{"values": values}}
+	case map[string]interface{}:
+		return map[string]interface{}{"kvlistValue": map[string]interface{}{"values": otlpJSONAttributes(otlpAttributes(v))}}
+	case []byte:
+		return map[string]interface{}{"bytesValue": base64.StdEncoding.EncodeToString(v)}
+	default:
+		return map[string]interface{}{}
+	}
+}
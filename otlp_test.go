@@ -0,0 +1,500 @@
+package tlog
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// otlpTestRecord is a decoded log record, with values as string, bool,
+// int64, float64, []interface{}, map[string]interface{} or []byte.
+type otlpTestRecord struct {
+	time     int64
+	severity int
+	text     string
+	body     interface{}
+	attrs    map[string]interface{}
+	traceID  string
+	spanID   string
+}
+
+// otlpTestExport is an export request received by a test collector.
+type otlpTestExport struct {
+	path     string
+	header   http.Header
+	resource map[string]interface{}
+	scope    string
+	records  []otlpTestRecord
+}
+
+// newOTLPTestCollector decodes the export requests it receives, in either
+// protocol, and answers with status.
+func newOTLPTestCollector(t *testing.T, status int) (*httptest.Server, chan otlpTestExport) {
+	t.Helper()
+	exports := make(chan otlpTestExport, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body = zr
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		exp := otlpTestExport{path: r.URL.Path, header: r.Header}
+		if r.Header.Get("Content-Type") == "application/json" {
+			err = decodeOTLPJSON(data, &exp)
+		} else {
+			err = decodeOTLPProtobuf(data, &exp)
+		}
+		if err != nil {
+			t.Error(err)
+		}
+		exports <- exp
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, exports
+}
+
+func decodeOTLPProtobuf(data []byte, exp *otlpTestExport) error {
+	var errs []error
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	check(consumeFields(data, func(_ protowire.Number, _ protowire.Type, resourceLogs []byte, _ uint64) {
+		check(consumeFields(resourceLogs, func(num protowire.Number, _ protowire.Type, v []byte, _ uint64) {
+			if num == 1 {
+				exp.resource = map[string]interface{}{}
+				check(consumeFields(v, func(_ protowire.Number, _ protowire.Type, kv []byte, _ uint64) {
+					k, val, err := decodeOTLPKeyValue(kv)
+					check(err)
+					exp.resource[k] = val
+				}))
+				return
+			}
+			check(consumeFields(v, func(num protowire.Number, _ protowire.Type, v []byte, _ uint64) {
+				if num == 1 {
+					check(consumeFields(v, func(num protowire.Number, _ protowire.Type, name []byte, _ uint64) {
+						if num == 1 {
+							exp.scope = string(name)
+						}
+					}))
+					return
+				}
+				rec := otlpTestRecord{attrs: map[string]interface{}{}}
+				check(consumeFields(v, func(num protowire.Number, _ protowire.Type, v []byte, n uint64) {
+					switch num {
+					case 1:
+						rec.time = int64(n)
+					case 2:
+						rec.severity = int(n)
+					case 3:
+						rec.text = string(v)
+					case 5:
+						val, err := decodeOTLPValue(v)
+						check(err)
+						rec.body = val
+					case 6:
+						k, val, err := decodeOTLPKeyValue(v)
+						check(err)
+						rec.attrs[k] = val
+					case 9:
+						rec.traceID = hex.EncodeToString(v)
+					case 10:
+						rec.spanID = hex.EncodeToString(v)
+					}
+				}))
+				exp.records = append(exp.records, rec)
+			}))
+		}))
+	}))
+	return errors.Join(errs...)
+}
+
+func decodeOTLPKeyValue(b []byte) (string, interface{}, error) {
+	var key string
+	var value interface{}
+	var verr error
+	err := consumeFields(b, func(num protowire.Number, _ protowire.Type, v []byte, _ uint64) {
+		if num == 1 {
+			key = string(v)
+		} else {
+			value, verr = decodeOTLPValue(v)
+		}
+	})
+	return key, value, errors.Join(err, verr)
+}
+
+func decodeOTLPValue(b []byte) (interface{}, error) {
+	var value interface{}
+	var errs []error
+	errs = append(errs, consumeFields(b, func(num protowire.Number, _ protowire.Type, v []byte, n uint64) {
+		switch num {
+		case 1:
+			value = string(v)
+		case 2:
+			value = n != 0
+		case 3:
+			value = int64(n)
+		case 4:
+			value = math.Float64frombits(n)
+		case 5:
+			arr := []interface{}{}
+			errs = append(errs, consumeFields(v, func(_ protowire.Number, _ protowire.Type, item []byte, _ uint64) {
+				val, err := decodeOTLPValue(item)
+				errs = append(errs, err)
+				arr = append(arr, val)
+			}))
+			value = arr
+		case 6:
+			list := map[string]interface{}{}
+			errs = append(errs, consumeFields(v, func(_ protowire.Number, _ protowire.Type, kv []byte, _ uint64) {
+				k, val, err := decodeOTLPKeyValue(kv)
+				errs = append(errs, err)
+				list[k] = val
+			}))
+			value = list
+		case 7:
+			value = append([]byte{}, v...)
+		}
+	}))
+	return value, errors.Join(errs...)
+}
+
+type otlpTestJSONKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func decodeOTLPJSON(data []byte, exp *otlpTestExport) error {
+	var req struct {
+		ResourceLogs []struct {
+			Resource struct {
+				Attributes []otlpTestJSONKeyValue `json:"attributes"`
+			} `json:"resource"`
+			ScopeLogs []struct {
+				Scope struct {
+					Name string `json:"name"`
+				} `json:"scope"`
+				LogRecords []struct {
+					TimeUnixNano   string                 `json:"timeUnixNano"`
+					SeverityNumber int                    `json:"severityNumber"`
+					SeverityText   string                 `json:"severityText"`
+					Body           map[string]interface{} `json:"body"`
+					Attributes     []otlpTestJSONKeyValue `json:"attributes"`
+					TraceID        string                 `json:"traceId"`
+					SpanID         string                 `json:"spanId"`
+				} `json:"logRecords"`
+			} `json:"scopeLogs"`
+		} `json:"resourceLogs"`
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return err
+	}
+	for _, rl := range req.ResourceLogs {
+		exp.resource = otlpTestJSONAttributes(rl.Resource.Attributes)
+		for _, sl := range rl.ScopeLogs {
+			exp.scope = sl.Scope.Name
+			for _, r := range sl.LogRecords {
+				ts, err := strconv.ParseInt(r.TimeUnixNano, 10, 64)
+				if err != nil {
+					return err
+				}
+				exp.records = append(exp.records, otlpTestRecord{
+					time:     ts,
+					severity: r.SeverityNumber,
+					text:     r.SeverityText,
+					body:     otlpTestJSONValue(r.Body),
+					attrs:    otlpTestJSONAttributes(r.Attributes),
+					traceID:  r.TraceID,
+					spanID:   r.SpanID,
+				})
+			}
+		}
+	}
+	return nil
+}
+
+func otlpTestJSONAttributes(attrs []otlpTestJSONKeyValue) map[string]interface{} {
+	m := make(map[string]interface{}, len(attrs))
+	for _, kv := range attrs {
+		m[kv.Key] = otlpTestJSONValue(kv.Value)
+	}
+	return m
+}
+
+func otlpTestJSONValue(v map[string]interface{}) interface{} {
+	for k, val := range v {
+		switch k {
+		case "stringValue", "boolValue", "doubleValue":
+			return val
+		case "intValue":
+			n, _ := strconv.ParseInt(val.(string), 10, 64)
+			return n
+		case "bytesValue":
+			b, _ := base64.StdEncoding.DecodeString(val.(string))
+			return b
+		case "arrayValue":
+			arr := []interface{}{}
+			for _, item := range val.(map[string]interface{})["values"].([]interface{}) {
+				arr = append(arr, otlpTestJSONValue(item.(map[string]interface{})))
+			}
+			return arr
+		case "kvlistValue":
+			list := map[string]interface{}{}
+			for _, item := range val.(map[string]interface{})["values"].([]interface{}) {
+				kv := item.(map[string]interface{})
+				list[kv["key"].(string)] = otlpTestJSONValue(kv["value"].(map[string]interface{}))
+			}
+			return list
+		}
+	}
+	return nil
+}
+
+func TestOTLPSinkSend(t *testing.T) {
+	ts := time.Unix(1700000000, 987654321)
+	batch := []SinkEntry{{
+		Time:       ts,
+		Level:      zapcore.WarnLevel,
+		LoggerName: "http",
+		Message:    "slow request",
+		Caller:     zapcore.EntryCaller{Defined: true, File: "/app/handler.go", Line: 42, Function: "main.handle"},
+		Stack:      "goroutine 1 [running]",
+		Fields: map[string]interface{}{
+			"service":     "api",
+			"version":     "1.2.3",
+			"trace_id":    "4bf92f3577b34da6a3ce929d0e0e4736",
+			"span_id":     "00f067aa0ba902b7",
+			"status_code": 200,
+			"ratio":       0.5,
+			"cached":      true,
+			"tags":        []interface{}{"a", int64(1)},
+			"user":        map[string]interface{}{"id": int64(7)},
+			"raw":         []byte{1, 2},
+			"elapsed":     1500 * time.Millisecond,
+		},
+	}}
+	wantAttrs := map[string]interface{}{
+		"status_code":          int64(200),
+		"ratio":                0.5,
+		"cached":               true,
+		"tags":                 []interface{}{"a", int64(1)},
+		"user":                 map[string]interface{}{"id": int64(7)},
+		"raw":                  []byte{1, 2},
+		"elapsed":              "1.5s",
+		"logger.name":          "http",
+		"code.filepath":        "/app/handler.go",
+		"code.lineno":          int64(42),
+		"code.function":        "main.handle",
+		"exception.stacktrace": "goroutine 1 [running]",
+	}
+
+	tests := []struct {
+		name     string
+		protocol OTLPProtocol
+		gzip     bool
+	}{
+		{"protobuf", OTLPProtobuf, false},
+		{"protobuf gzip", OTLPProtobuf, true},
+		{"json", OTLPJSON, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, exports := newOTLPTestCollector(t, http.StatusOK)
+			sink, err := NewOTLPSink(OTLPConfig{
+				Endpoint:           srv.URL,
+				Protocol:           tt.protocol,
+				Gzip:               tt.gzip,
+				ResourceAttributes: map[string]string{"deployment.environment": "test", "host.name": "web-1"},
+				Headers:            map[string]string{"Authorization": "Bearer token"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sink.configure(Config{AppName: "api", Version: "1.2.3"})
+			if err := sink.Send(context.Background(), batch); err != nil {
+				t.Fatal(err)
+			}
+
+			exp := <-exports
+			if exp.path != "/v1/logs" || exp.header.Get("Authorization") != "Bearer token" {
+				t.Errorf("path = %q, headers = %v", exp.path, exp.header)
+			}
+			wantResource := map[string]interface{}{
+				"service.name":           "api",
+				"service.version":        "1.2.3",
+				"deployment.environment": "test",
+				"host.name":              "web-1",
+			}
+			if !reflect.DeepEqual(exp.resource, wantResource) {
+				t.Errorf("resource = %v, want %v", exp.resource, wantResource)
+			}
+			if exp.scope != otlpScopeName {
+				t.Errorf("scope = %q", exp.scope)
+			}
+			if len(exp.records) != 1 {
+				t.Fatalf("got %d records", len(exp.records))
+			}
+			rec := exp.records[0]
+			if rec.time != ts.UnixNano() || rec.severity != 13 || rec.text != "WARN" || rec.body != "slow request" {
+				t.Errorf("record = %+v", rec)
+			}
+			if rec.traceID != "4bf92f3577b34da6a3ce929d0e0e4736" || rec.spanID != "00f067aa0ba902b7" {
+				t.Errorf("trace context = %s/%s", rec.traceID, rec.spanID)
+			}
+			if !reflect.DeepEqual(rec.attrs, wantAttrs) {
+				t.Errorf("attributes = %v\nwant %v", rec.attrs, wantAttrs)
+			}
+		})
+	}
+}
+
+func TestOTLPSinkKeepsInvalidTraceID(t *testing.T) {
+	srv, exports := newOTLPTestCollector(t, http.StatusOK)
+	sink, err := NewOTLPSink(OTLPConfig{Endpoint: srv.URL + "/custom/logs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sink.Send(context.Background(), []SinkEntry{{
+		Time:   time.Now(),
+		Fields: map[string]interface{}{"trace_id": "not-hex", "span_id": "0000000000000000"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := <-exports
+	if exp.path != "/custom/logs" {
+		t.Errorf("path = %q, want the configured path", exp.path)
+	}
+	rec := exp.records[0]
+	if rec.traceID != "" || rec.spanID != "" {
+		t.Errorf("invalid IDs used as trace context: %s/%s", rec.traceID, rec.spanID)
+	}
+	if rec.attrs["trace_id"] != "not-hex" || rec.attrs["span_id"] != "0000000000000000" {
+		t.Errorf("invalid IDs not kept as attributes: %v", rec.attrs)
+	}
+}
+
+func TestOTLPSinkJSONNonFiniteFloats(t *testing.T) {
+	srv, exports := newOTLPTestCollector(t, http.StatusOK)
+	sink, err := NewOTLPSink(OTLPConfig{Endpoint: srv.URL, Protocol: OTLPJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sink.Send(context.Background(), []SinkEntry{{
+		Time:    time.Now(),
+		Message: "m",
+		Fields: map[string]interface{}{
+			"nan":     math.NaN(),
+			"pos_inf": math.Inf(1),
+			"neg_inf": float32(math.Inf(-1)),
+			"list":    []interface{}{math.NaN(), 1.5},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := <-exports
+	if len(exp.records) != 1 {
+		t.Fatalf("got %d records, want the batch delivered", len(exp.records))
+	}
+	want := map[string]interface{}{
+		"nan":     "NaN",
+		"pos_inf": "Infinity",
+		"neg_inf": "-Infinity",
+		"list":    []interface{}{"NaN", 1.5},
+	}
+	if got := exp.records[0].attrs; !reflect.DeepEqual(got, want) {
+		t.Errorf("attributes = %v, want %v", got, want)
+	}
+}
+
+func TestOTLPSinkStatus(t *testing.T) {
+	tests := []struct {
+		status        int
+		wantErr       bool
+		wantPermanent bool
+	}{
+		{http.StatusOK, false, false},
+		{http.StatusBadRequest, true, true},
+		{http.StatusServiceUnavailable, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			srv, _ := newOTLPTestCollector(t, tt.status)
+			sink, err := NewOTLPSink(OTLPConfig{Endpoint: srv.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = sink.Send(context.Background(), []SinkEntry{{Time: time.Now(), Message: "m"}})
+			if (err != nil) != tt.wantErr || isPermanent(err) != tt.wantPermanent {
+				t.Errorf("Send() error = %v, want error %t, permanent %t", err, tt.wantErr, tt.wantPermanent)
+			}
+		})
+	}
+}
+
+func TestOTLPSeverity(t *testing.T) {
+	tests := []struct {
+		level zapcore.Level
+		want  int
+	}{
+		{zapcore.DebugLevel, 5},
+		{zapcore.InfoLevel, 9},
+		{zapcore.WarnLevel, 13},
+		{zapcore.ErrorLevel, 17},
+		{zapcore.DPanicLevel, 18},
+		{zapcore.PanicLevel, 21},
+		{zapcore.FatalLevel, 22},
+	}
+	for _, tt := range tests {
+		if got := otlpSeverity(tt.level); got != tt.want {
+			t.Errorf("otlpSeverity(%v) = %d, want %d", tt.level, got, tt.want)
+		}
+	}
+}
+
+func TestNewOTLPSinkValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  OTLPConfig
+	}{
+		{"no endpoint", OTLPConfig{}},
+		{"bad endpoint", OTLPConfig{Endpoint: "http://[::1"}},
+		{"bad protocol", OTLPConfig{Endpoint: "http://otel:4318", Protocol: OTLPProtocol(5)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewOTLPSink(tt.cfg); err == nil {
+				t.Error("NewOTLPSink() error = nil")
+			}
+		})
+	}
+}
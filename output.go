@@ -0,0 +1,185 @@
+package tlog
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// FileOutput is an additional log file receiving the entries within a level
+// range and, optionally, from some components only. Entries must first pass
+// Config.Level.
+type FileOutput struct {
+	// Path is the path to the log file. Required.
+	Path string
+
+	// MinLevel is the lowest level written to the file.
+	// Default: "debug"
+	MinLevel string
+
+	// MaxLevel is the highest level written to the file.
+	// Default: "fatal"
+	MaxLevel string
+
+	// Components limits the file to entries whose "component" field or logger
+	// name is listed. The Gin middleware tags entries "http", the GORM adapter
+	// and plugin "gorm", the database/sql wrapper "sql", and the audit logger
+	// is named "audit". Empty writes entries from every component.
+	// Example: []string{"gorm", "sql"}
+	Components []string
+
+	// Rotation settings, as in Config
+	MaxSizeMB        int            // Maximum size in MB before rotation (default 100)
+	MaxBackups       int            // Number of old files to keep (0 = unlimited)
+	MaxAgeDays       int            // Maximum age in days to keep (0 = unlimited)
+	Compress         bool           // Compress rotated files
+	ExternalRotation bool           // Plain file rotated externally, see Reopen
+	Rotation         RotationConfig // Time-based rotation and total size cap
+}
+
+// validate applies defaults to unset fields.
+func (o *FileOutput) validate() error {
+	if o.Path == "" {
+		return errors.New("tlog: file output path is required")
+	}
+	if o.MinLevel == "" {
+		o.MinLevel = "debug"
+	}
+	if o.MaxLevel == "" {
+		o.MaxLevel = "fatal"
+	}
+	if o.MaxSizeMB <= 0 {
+		o.MaxSizeMB = 100
+	}
+	minLevel, err := zapcore.ParseLevel(o.MinLevel)
+	if err != nil {
+		return fmt.Errorf("tlog: invalid min level %q for %s: %w", o.MinLevel, o.Path, err)
+	}
+	maxLevel, err := zapcore.ParseLevel(o.MaxLevel)
+	if err != nil {
+		return fmt.Errorf("tlog: invalid max level %q for %s: %w", o.MaxLevel, o.Path, err)
+	}
+	if minLevel > maxLevel {
+		return fmt.Errorf("tlog: min level %q above max level %q for %s", o.MinLevel, o.MaxLevel, o.Path)
+	}
+	if o.ExternalRotation && o.Rotation.Enabled {
+		return fmt.Errorf("tlog: ExternalRotation and Rotation cannot both be enabled for %s", o.Path)
+	}
+	if o.Rotation.Enabled {
+		return o.Rotation.validate(o.Path)
+	}
+	return nil
+}
+
+// fileConfig returns cfg with the file settings of the output, for
+// createFileWriter.
+func (o FileOutput) fileConfig(cfg Config) Config {
+	cfg.FilePath = o.Path
+	cfg.MaxSizeMB = o.MaxSizeMB
+	cfg.MaxBackups = o.MaxBackups
+	cfg.MaxAgeDays = o.MaxAgeDays
+	cfg.Compress = o.Compress
+	cfg.ExternalRotation = o.ExternalRotation
+	cfg.Rotation = o.Rotation
+	return cfg
+}
+
+// routeCore passes entries within a level range and from the listed
+// components to the wrapped core.
+type routeCore struct {
+	zapcore.Core
+	minLevel   zapcore.Level
+	maxLevel   zapcore.Level
+	components map[string]bool
+
+	// component is the "component" field added with With, if any.
+	component string
+}
+
+// newRouteCore wraps core with a level range and component filter. An
+// empty components list passes every component.
+func newRouteCore(core zapcore.Core, minLevel, maxLevel zapcore.Level, components []string) zapcore.Core {
+	c := &routeCore{Core: core, minLevel: minLevel, maxLevel: maxLevel}
+	if len(components) > 0 {
+		c.components = make(map[string]bool, len(components))
+		for _, name := range components {
+			c.components[name] = true
+		}
+	}
+	return c
+}
+
+// Enabled reports whether the level is within the range and enabled.
+func (c *routeCore) Enabled(level zapcore.Level) bool {
+	return c.inRange(level) && c.Core.Enabled(level)
+}
+
+// inRange reports whether the level is within the output's range.
+func (c *routeCore) inRange(level zapcore.Level) bool {
+	return level >= c.minLevel && level <= c.maxLevel
+}
+
+// With adds structured context, remembering the component.
+func (c *routeCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := *c
+	clone.Core = c.Core.With(fields)
+	if component, ok := componentOf(fields); ok {
+		clone.component = component
+	}
+	return &clone
+}
+
+// Check adds the core when the level is within the range. Components are
+// matched in Write, once the fields are known.
+func (c *routeCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+// Write writes the entry when it matches the output. The level is checked
+// again since entries flushed from request buffers skip Check.
+func (c *routeCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	if !c.inRange(ent.Level) || !c.matches(ent, fields) {
+		return nil
+	}
+	return c.Core.Write(ent, fields)
+}
+
+// matches reports whether the entry comes from one of the listed components.
+func (c *routeCore) matches(ent zapcore.Entry, fields []zapcore.Field) bool {
+	if c.components == nil {
+		return true
+	}
+	component := c.component
+	if fc, ok := componentOf(fields); ok {
+		component = fc
+	}
+	if component != "" && c.components[component] {
+		return true
+	}
+	for name := ent.LoggerName; name != ""; {
+		if c.components[name] {
+			return true
+		}
+		i := strings.LastIndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[:i]
+	}
+	return false
+}
+
+// componentOf returns the last "component" string field among fields.
+func componentOf(fields []zapcore.Field) (string, bool) {
+	for i := len(fields) - 1; i >= 0; i-- {
+		if fields[i].Key == "component" && fields[i].Type == zapcore.StringType {
+			return fields[i].String, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,180 @@
+package tlog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+func TestRouteCoreLevels(t *testing.T) {
+	obs, logs := observer.New(zapcore.DebugLevel)
+	core := newRouteCore(obs, zapcore.InfoLevel, zapcore.WarnLevel, nil)
+	for _, level := range []zapcore.Level{zapcore.DebugLevel, zapcore.InfoLevel, zapcore.WarnLevel, zapcore.ErrorLevel} {
+		checkWrite(core, zapcore.Entry{Level: level, Message: level.String()})
+		// Flushed request buffers write without Check
+		core.Write(zapcore.Entry{Level: level, Message: "flushed " + level.String()}, nil)
+	}
+	var got []string
+	for _, e := range logs.All() {
+		got = append(got, e.Message)
+	}
+	if strings.Join(got, ",") != "info,flushed info,warn,flushed warn" {
+		t.Errorf("routed %v, want info and warn only", got)
+	}
+	if core.Enabled(zapcore.DebugLevel) || core.Enabled(zapcore.ErrorLevel) || !core.Enabled(zapcore.InfoLevel) {
+		t.Error("Enabled() ignores the level range")
+	}
+}
+
+func TestRouteCoreComponents(t *testing.T) {
+	tests := []struct {
+		name   string
+		logger string
+		with   []zapcore.Field
+		fields []zapcore.Field
+		want   bool
+	}{
+		{name: "field", fields: []zapcore.Field{zap.String("component", "gorm")}, want: true},
+		{name: "other field", fields: []zapcore.Field{zap.String("component", "http")}},
+		{name: "with", with: []zapcore.Field{zap.String("component", "sql")}, want: true},
+		{name: "field overrides with", with: []zapcore.Field{zap.String("component", "sql")}, fields: []zapcore.Field{zap.String("component", "http")}},
+		{name: "non-string field", fields: []zapcore.Field{zap.Int("component", 1)}},
+		{name: "logger name", logger: "gorm", want: true},
+		{name: "logger name prefix", logger: "gorm.migrate", want: true},
+		{name: "logger name with other field", logger: "gorm", fields: []zapcore.Field{zap.String("component", "http")}, want: true},
+		{name: "similar logger name", logger: "gormx"},
+		{name: "nested logger name", logger: "app.gorm"},
+		{name: "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obs, logs := observer.New(zapcore.DebugLevel)
+			core := newRouteCore(obs, zapcore.DebugLevel, zapcore.FatalLevel, []string{"gorm", "sql"})
+			if tt.with != nil {
+				core = core.With(tt.with)
+			}
+			checkWrite(core, zapcore.Entry{Level: zapcore.InfoLevel, LoggerName: tt.logger, Message: "m"}, tt.fields...)
+			if got := logs.Len() == 1; got != tt.want {
+				t.Errorf("routed = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutputsGinAndGorm(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	app, access, sql := filepath.Join(dir, "app.log"), filepath.Join(dir, "access.log"), filepath.Join(dir, "sql.log")
+	initTestLogger(t, DefaultConfig().WithConsole(false).WithLevel("debug").WithFile(app).
+		WithOutput(FileOutput{Path: access, Components: []string{"http"}}).
+		WithOutput(FileOutput{Path: sql, Components: []string{"gorm", "sql"}}))
+
+	db := openTestDB(t, ":memory:", NewGormLogger(WithGormLogLevel(gormlogger.Info)))
+	r := gin.New()
+	r.Use(GinMiddleware())
+	r.GET("/users", func(c *gin.Context) {
+		var users []gormTestUser
+		db.WithContext(c.Request.Context()).Find(&users)
+		Info("handler done")
+		c.Status(http.StatusOK)
+	})
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users", nil))
+	Sync()
+
+	for _, e := range readJSONLines(t, access) {
+		if e["component"] != "http" {
+			t.Errorf("access.log has %v", e)
+		}
+	}
+	if got := messages(readJSONLines(t, access)); strings.Join(got, ",") != "Request received,Request completed" {
+		t.Errorf("access.log = %v", got)
+	}
+	sqlEntries := readJSONLines(t, sql)
+	if len(sqlEntries) == 0 {
+		t.Fatal("sql.log is empty")
+	}
+	for _, e := range sqlEntries {
+		if e["component"] != "gorm" {
+			t.Errorf("sql.log has %v", e)
+		}
+	}
+	// The main file still gets everything
+	if got := messages(readJSONLines(t, app)); len(got) != 3+len(sqlEntries) {
+		t.Errorf("app.log = %v", got)
+	}
+}
+
+func TestOutputsOwnRotation(t *testing.T) {
+	dir := t.TempDir()
+	app, sized, external := filepath.Join(dir, "app.log"), filepath.Join(dir, "sized.log"), filepath.Join(dir, "external.log")
+	initTestLogger(t, DefaultConfig().WithConsole(false).WithFile(app).
+		WithOutput(FileOutput{Path: sized, Components: []string{"sized"}, MaxSizeMB: 1, Rotation: RotationConfig{Enabled: true}}).
+		WithOutput(FileOutput{Path: external, Components: []string{"external"}, ExternalRotation: true}))
+
+	// Over 1MB rotates sized.log only
+	padding := strings.Repeat("x", 1024)
+	for i := 0; i < 1200; i++ {
+		L().Named("sized").Info(padding)
+	}
+	L().Named("external").Info("before")
+	Sync()
+	if _, err := os.Stat(filepath.Join(dir, "sized.1.log")); err != nil {
+		t.Errorf("sized.log not rotated: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "app.1.log")); err == nil {
+		t.Error("app.log rotated with the output's size limit")
+	}
+
+	// Reopen only recreates the externally rotated file
+	if err := os.Rename(external, external+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	L().Named("external").Info("after")
+	Sync()
+	if got := messages(readJSONLines(t, external)); strings.Join(got, ",") != "after" {
+		t.Errorf("external.log after Reopen = %v", got)
+	}
+	if got := messages(readJSONLines(t, external+".1")); strings.Join(got, ",") != "before" {
+		t.Errorf("moved external.log = %v", got)
+	}
+}
+
+func TestOutputsRequestBufferFlush(t *testing.T) {
+	dir := t.TempDir()
+	app, jobs, warnings := filepath.Join(dir, "app.log"), filepath.Join(dir, "jobs.log"), filepath.Join(dir, "warnings.log")
+	initTestLogger(t, DefaultConfig().WithConsole(false).WithLevel("warn").WithFile(app).
+		WithOutput(FileOutput{Path: jobs, Components: []string{"jobs"}}).
+		WithOutput(FileOutput{Path: warnings, MinLevel: "warn", MaxLevel: "warn"}))
+
+	buf, ctx := newTestRequestBuffer(t, RequestBufferConfig{Level: "warn"})
+	logger := FromContext(ctx)
+	logger.Named("jobs").Debug("job step")
+	logger.Info("request step")
+	time.Sleep(time.Millisecond)
+	logger.Named("jobs").Error("job failed")
+	buf.close(true)
+	Sync()
+
+	if got := messages(readJSONLines(t, jobs)); strings.Join(got, ",") != "job step,job failed" {
+		t.Errorf("jobs.log = %v, want the flushed entry of the component", got)
+	}
+	if got := messages(readJSONLines(t, app)); strings.Join(got, ",") != "job step,request step,job failed" {
+		t.Errorf("app.log = %v", got)
+	}
+	if data, err := os.ReadFile(warnings); len(data) > 0 || err != nil && !os.IsNotExist(err) {
+		t.Errorf("warnings.log = %q, %v, want flushed entries outside its range left out", data, err)
+	}
+}
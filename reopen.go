@@ -0,0 +1,165 @@
+package tlog
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// reopener is a file writer that can reopen its file after it was moved by
+// an external tool such as logrotate.
+type reopener interface {
+	Reopen() error
+}
+
+// plainFile is an unrotated log file for deployments that rotate externally.
+type plainFile struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// newPlainFile opens path for appending, creating its directory if needed.
+func newPlainFile(path string) (*plainFile, error) {
+	f := &plainFile{path: path}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the file at path. The caller holds mu or has exclusive access.
+func (f *plainFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0o755); err != nil {
+		return fmt.Errorf("tlog: create log directory: %w", err)
+	}
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("tlog: open log file: %w", err)
+	}
+	f.file = file
+	return nil
+}
+
+// Write appends p to the file, opening it again after Close.
+func (f *plainFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	return f.file.Write(p)
+}
+
+// Sync commits the file to stable storage.
+func (f *plainFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Sync()
+}
+
+// Reopen closes the file and opens path again. Writes wait for it, so no
+// entry is lost or written to the moved file afterwards.
+func (f *plainFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file != nil {
+		f.file.Sync()
+		f.file.Close()
+		f.file = nil
+	}
+	return f.open()
+}
+
+// Close closes the file.
+func (f *plainFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// Reopen closes the current file and opens the file for the current period
+// again, continuing after the highest existing size index, or the fixed file
+// name when rotating on size only.
+func (w *rotatingWriter) Reopen() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file != nil {
+		w.file.Sync()
+		w.file.Close()
+		w.file = nil
+	}
+	return w.open(time.Now())
+}
+
+// lumberjackFile adds Reopen to lumberjack, which opens Filename again on
+// the first write after Close.
+type lumberjackFile struct {
+	*lumberjack.Logger
+}
+
+// Reopen closes the file; the next write opens Filename again.
+func (l lumberjackFile) Reopen() error {
+	return l.Logger.Close()
+}
+
+// Reopen reopens the log files of the global logger, so entries go to a
+// fresh file at Config.FilePath after an external tool moved the old one.
+// Entries logged meanwhile wait and are written to the new file.
+func Reopen() error {
+	if globalReopen != nil {
+		return globalReopen()
+	}
+	return nil
+}
+
+// HandleReopenSignal calls Reopen whenever the process receives one of sigs,
+// SIGHUP if none are given, until ctx is done. Use it with logrotate when
+// copytruncate is disabled. The returned channel is closed once the handler
+// has stopped.
+func HandleReopenSignal(ctx context.Context, sigs ...os.Signal) <-chan struct{} {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGHUP}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer signal.Stop(ch)
+
+		for {
+			select {
+			case sig := <-ch:
+				if err := Reopen(); err != nil {
+					L().Error("Failed to reopen log files", zap.Stringer("signal", sig), zap.Error(err))
+					continue
+				}
+				L().Info("Log files reopened", zap.Stringer("signal", sig))
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return done
+}
@@ -0,0 +1,115 @@
+package tlog
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestReopenAfterRename(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  func(Config) Config
+	}{
+		{"external rotation", func(c Config) Config { return c.WithExternalRotation() }},
+		{"rotation", func(c Config) Config { return c.WithRotation(RotationConfig{}) }},
+		{"daily rotation", func(c Config) Config {
+			return c.WithRotation(RotationConfig{Interval: 24 * time.Hour, Pattern: filepath.Join(filepath.Dir(c.FilePath), "app.log")})
+		}},
+		{"lumberjack", func(c Config) Config { return c }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "app.log")
+			cfg := tt.cfg(DefaultConfig().WithFile(path))
+			if err := cfg.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			w, err := createFileWriter(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+
+			if _, err := w.Write([]byte("before\n")); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Rename(path, path+".1"); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Reopen(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write([]byte("after\n")); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := readFile(t, path); got != "after\n" {
+				t.Errorf("new file = %q, want the entry written after Reopen", got)
+			}
+			if got := readFile(t, path+".1"); got != "before\n" {
+				t.Errorf("moved file = %q, want the entry written before Reopen", got)
+			}
+		})
+	}
+}
+
+// initTestLogger initializes the global logger with cfg until the test ends.
+func initTestLogger(t *testing.T, cfg Config) {
+	t.Helper()
+	prevLogger, prevOutputs, prevClose, prevReopen := globalLogger, globalOutputs, globalClose, globalReopen
+	prevZap := zap.L()
+	if err := Init(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		Close()
+		globalLogger, globalOutputs, globalClose, globalReopen = prevLogger, prevOutputs, prevClose, prevReopen
+		zap.ReplaceGlobals(prevZap)
+	})
+}
+
+func TestHandleReopenSignal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	initTestLogger(t, DefaultConfig().WithConsole(false).WithFile(path).WithExternalRotation())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := HandleReopenSignal(ctx)
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	Info("before")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if data, err := os.ReadFile(path); err == nil && strings.Contains(string(data), "Log files reopened") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("file not reopened after SIGHUP")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	Info("after")
+
+	if moved := readFile(t, path+".1"); !strings.Contains(moved, "before") || strings.Contains(moved, "after") {
+		t.Errorf("moved file:\n%s", moved)
+	}
+	if current := readFile(t, path); !strings.Contains(current, "after") || strings.Contains(current, `"before"`) {
+		t.Errorf("new file:\n%s", current)
+	}
+}
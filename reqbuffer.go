@@ -0,0 +1,259 @@
+package tlog
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// RequestBufferConfig configures fingers-crossed request logging: entries
+// below Level logged with a request's context are held in memory, discarded
+// when the request succeeds, and written in order with their original
+// timestamps when the request fails.
+type RequestBufferConfig struct {
+	// Enabled turns on request buffering.
+	// Default: false
+	Enabled bool
+
+	// Level is the level below which entries are buffered, regardless of the
+	// logger level. Entries at or above it are logged immediately.
+	// Default: "info"
+	Level string
+
+	// FlushLevel is the level at or above which logging an entry flushes the
+	// buffer. A status code of 500 or more also flushes it.
+	// Default: "error"
+	FlushLevel string
+
+	// MaxEntries caps the number of buffered entries per request; the oldest
+	// are dropped beyond it.
+	// Default: 1000
+	MaxEntries int
+
+	// MaxBytes caps the approximate memory held per request; the oldest
+	// entries are dropped beyond it.
+	// Default: 1 MiB
+	MaxBytes int
+}
+
+// validate applies defaults to unset fields.
+func (c *RequestBufferConfig) validate() error {
+	if c.Level == "" {
+		c.Level = "info"
+	}
+	if c.FlushLevel == "" {
+		c.FlushLevel = "error"
+	}
+	if c.MaxEntries <= 0 {
+		c.MaxEntries = 1000
+	}
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = 1 << 20
+	}
+	if _, err := zapcore.ParseLevel(c.Level); err != nil {
+		return fmt.Errorf("tlog: invalid request buffer level %q: %w", c.Level, err)
+	}
+	if _, err := zapcore.ParseLevel(c.FlushLevel); err != nil {
+		return fmt.Errorf("tlog: invalid request buffer flush level %q: %w", c.FlushLevel, err)
+	}
+	return nil
+}
+
+// requestBufferKey is the context key of the request buffer.
+type requestBufferKey struct{}
+
+// bufferState is the lifecycle of a request buffer.
+type bufferState int
+
+const (
+	// bufferActive holds entries until the request ends.
+	bufferActive bufferState = iota
+	// bufferFlushed writes entries through, since the request has failed.
+	bufferFlushed
+	// bufferClosed no longer captures entries; the request has ended.
+	bufferClosed
+)
+
+// bufferedEntry is an entry held for a request.
+type bufferedEntry struct {
+	ent    zapcore.Entry
+	fields []zapcore.Field
+	size   int
+}
+
+// requestBuffer holds the below-level entries of one request.
+type requestBuffer struct {
+	level      zapcore.Level
+	flushLevel zapcore.Level
+	maxEntries int
+	maxBytes   int
+
+	// out receives flushed entries, bypassing the logger level.
+	out zapcore.Core
+	// fields identify the request in the overflow notice.
+	fields []zapcore.Field
+
+	mu      sync.Mutex
+	state   bufferState
+	entries []bufferedEntry
+	size    int
+	dropped int
+}
+
+// newRequestBuffer creates a buffer writing to the global logger's outputs.
+// fields identify the request. cfg must be validated.
+func newRequestBuffer(cfg RequestBufferConfig, fields ...zapcore.Field) *requestBuffer {
+	level, _ := zapcore.ParseLevel(cfg.Level)
+	flushLevel, _ := zapcore.ParseLevel(cfg.FlushLevel)
+	out := globalOutputs
+	if out == nil {
+		out = L().Core()
+	}
+	return &requestBuffer{
+		level:      level,
+		flushLevel: flushLevel,
+		maxEntries: cfg.MaxEntries,
+		maxBytes:   cfg.MaxBytes,
+		out:        out,
+		fields:     fields,
+	}
+}
+
+// withRequestBuffer stores buf in the context so FromContext buffers into it.
+func withRequestBuffer(ctx context.Context, buf *requestBuffer) context.Context {
+	return context.WithValue(ctx, requestBufferKey{}, buf)
+}
+
+// requestBufferFrom returns the request buffer carried by ctx, if any.
+func requestBufferFrom(ctx context.Context) *requestBuffer {
+	if ctx == nil {
+		return nil
+	}
+	buf, _ := ctx.Value(requestBufferKey{}).(*requestBuffer)
+	return buf
+}
+
+// capturing reports whether entries below the buffer level are still taken.
+func (b *requestBuffer) capturing() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state != bufferClosed
+}
+
+// add buffers an entry, or writes it through once the buffer was flushed.
+func (b *requestBuffer) add(ent zapcore.Entry, fields []zapcore.Field) error {
+	b.mu.Lock()
+	switch b.state {
+	case bufferFlushed:
+		b.mu.Unlock()
+		return b.out.Write(ent, fields)
+	case bufferClosed:
+		b.mu.Unlock()
+		return nil
+	}
+	defer b.mu.Unlock()
+
+	e := bufferedEntry{ent: ent, fields: fields, size: entrySize(ent, fields)}
+	b.entries = append(b.entries, e)
+	b.size += e.size
+	for len(b.entries) > 1 && (len(b.entries) > b.maxEntries || b.size > b.maxBytes) {
+		b.size -= b.entries[0].size
+		b.entries[0] = bufferedEntry{}
+		b.entries = b.entries[1:]
+		b.dropped++
+	}
+	return nil
+}
+
+// flush writes the buffered entries in order and switches to write-through.
+func (b *requestBuffer) flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != bufferActive {
+		return
+	}
+	b.state = bufferFlushed
+
+	if b.dropped > 0 && len(b.entries) > 0 {
+		first := b.entries[0].ent
+		_ = b.out.Write(zapcore.Entry{
+			Level:      zapcore.WarnLevel,
+			Time:       first.Time,
+			LoggerName: first.LoggerName,
+			Message:    "Request log buffer overflowed",
+		}, append(b.fields[:len(b.fields):len(b.fields)], zap.Int("buffer_dropped", b.dropped)))
+	}
+	for _, e := range b.entries {
+		_ = b.out.Write(e.ent, e.fields)
+	}
+	b.entries, b.size, b.dropped = nil, 0, 0
+}
+
+// close ends the request: it flushes when failed and discards otherwise.
+func (b *requestBuffer) close(failed bool) {
+	if failed {
+		b.flush()
+	}
+	b.mu.Lock()
+	b.state = bufferClosed
+	b.entries, b.size, b.dropped = nil, 0, 0
+	b.mu.Unlock()
+}
+
+// entrySize approximates the memory held by a buffered entry.
+func entrySize(ent zapcore.Entry, fields []zapcore.Field) int {
+	size := 128 + len(ent.Message) + len(ent.Stack)
+	for _, f := range fields {
+		size += 64 + len(f.Key) + len(f.String)
+	}
+	return size
+}
+
+// bufferingCore routes entries below the buffer level into a request buffer
+// and flushes it when an entry at the flush level is logged.
+type bufferingCore struct {
+	zapcore.Core
+	buf *requestBuffer
+
+	// with holds the fields added with With, which the buffer's output lacks.
+	with []zapcore.Field
+}
+
+// Enabled reports whether the level is logged or buffered.
+func (c *bufferingCore) Enabled(level zapcore.Level) bool {
+	return c.Core.Enabled(level) || level < c.buf.level
+}
+
+// With adds structured context to both the wrapped core and buffered entries.
+func (c *bufferingCore) With(fields []zapcore.Field) zapcore.Core {
+	return &bufferingCore{
+		Core: c.Core.With(fields),
+		buf:  c.buf,
+		with: append(c.with[:len(c.with):len(c.with)], fields...),
+	}
+}
+
+// Check buffers entries below the buffer level and flushes the buffer before
+// an entry at the flush level is written.
+func (c *bufferingCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if ent.Level < c.buf.level {
+		if c.buf.capturing() {
+			return ce.AddCore(ent, c)
+		}
+		return c.Core.Check(ent, ce)
+	}
+	if ent.Level >= c.buf.flushLevel {
+		c.buf.flush()
+	}
+	return c.Core.Check(ent, ce)
+}
+
+// Write buffers an entry added by Check.
+func (c *bufferingCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	all := make([]zapcore.Field, 0, len(c.with)+len(fields))
+	all = append(append(all, c.with...), fields...)
+	return c.buf.add(ent, all)
+}
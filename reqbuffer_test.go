@@ -0,0 +1,199 @@
+package tlog
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// readJSONLines decodes the entries of a JSON log file.
+func readJSONLines(t *testing.T, path string) []map[string]interface{} {
+	t.Helper()
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(readFile(t, path)), "\n") {
+		if line == "" {
+			continue
+		}
+		var e map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// messages returns the message of each entry.
+func messages(entries []map[string]interface{}) []string {
+	var msgs []string
+	for _, e := range entries {
+		msgs = append(msgs, e["message"].(string))
+	}
+	return msgs
+}
+
+// initBufferTestLogger logs at info to app.log, with debug entries routed to
+// debug.log, and returns both paths.
+func initBufferTestLogger(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	app, debug := filepath.Join(dir, "app.log"), filepath.Join(dir, "debug.log")
+	initTestLogger(t, DefaultConfig().WithConsole(false).WithLevel("info").WithFile(app).
+		WithOutput(FileOutput{Path: debug, MaxLevel: "debug"}))
+	return app, debug
+}
+
+// newTestRequestBuffer returns a validated buffer and a context carrying it.
+func newTestRequestBuffer(t *testing.T, cfg RequestBufferConfig) (*requestBuffer, context.Context) {
+	t.Helper()
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	buf := newRequestBuffer(cfg)
+	return buf, withRequestBuffer(WithRequestID(context.Background(), "req-1"), buf)
+}
+
+func TestRequestBufferDiscard(t *testing.T) {
+	app, debug := initBufferTestLogger(t)
+	buf, ctx := newTestRequestBuffer(t, RequestBufferConfig{})
+
+	FromContext(ctx).Debug("buffered")
+	FromContext(ctx).Info("immediate")
+	buf.close(false)
+	Sync()
+
+	if got := messages(readJSONLines(t, app)); strings.Join(got, ",") != "immediate" {
+		t.Errorf("app.log = %v, want the info entry only", got)
+	}
+	if data, err := os.ReadFile(debug); len(data) > 0 || err != nil && !os.IsNotExist(err) {
+		t.Errorf("debug.log = %q, %v, want buffered entries discarded", data, err)
+	}
+}
+
+func TestRequestBufferFlushOnError(t *testing.T) {
+	app, debug := initBufferTestLogger(t)
+	buf, ctx := newTestRequestBuffer(t, RequestBufferConfig{})
+	logger := FromContext(ctx)
+
+	logger.Debug("first")
+	time.Sleep(5 * time.Millisecond)
+	logger.Debug("second")
+	time.Sleep(5 * time.Millisecond)
+	logger.Error("failed")
+	logger.Debug("after flush")
+	Sync()
+
+	entries := readJSONLines(t, app)
+	if got := strings.Join(messages(entries), ","); got != "first,second,failed,after flush" {
+		t.Fatalf("app.log = %s, want buffered entries ahead of the error", got)
+	}
+	if !(entries[0]["timestamp"].(string) < entries[1]["timestamp"].(string)) ||
+		!(entries[1]["timestamp"].(string) < entries[2]["timestamp"].(string)) {
+		t.Errorf("timestamps %v, %v, %v, want the original ones", entries[0]["timestamp"], entries[1]["timestamp"], entries[2]["timestamp"])
+	}
+	for _, e := range entries {
+		if e["request_id"] != "req-1" {
+			t.Errorf("%q has request_id %v", e["message"], e["request_id"])
+		}
+	}
+	// Routed outputs receive the flush too
+	if got := strings.Join(messages(readJSONLines(t, debug)), ","); got != "first,second,after flush" {
+		t.Errorf("debug.log = %s", got)
+	}
+
+	// Once the request ends, entries take the normal path
+	buf.close(true)
+	logger.Debug("closed")
+	logger.Info("closed info")
+	Sync()
+	if got := messages(readJSONLines(t, app)); got[len(got)-1] != "closed info" || len(got) != 5 {
+		t.Errorf("app.log after close = %v", got)
+	}
+}
+
+func TestRequestBufferCaps(t *testing.T) {
+	long := strings.Repeat("x", 1000)
+	tests := []struct {
+		name    string
+		cfg     RequestBufferConfig
+		msgs    []string
+		want    []string
+		dropped float64
+	}{
+		{
+			name:    "max entries",
+			cfg:     RequestBufferConfig{MaxEntries: 3},
+			msgs:    []string{"1", "2", "3", "4", "5"},
+			want:    []string{"3", "4", "5"},
+			dropped: 2,
+		},
+		{
+			name:    "max bytes",
+			cfg:     RequestBufferConfig{MaxBytes: 2500},
+			msgs:    []string{"1" + long, "2" + long, "3" + long},
+			want:    []string{"2" + long, "3" + long},
+			dropped: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, _ := initBufferTestLogger(t)
+			buf, ctx := newTestRequestBuffer(t, tt.cfg)
+			for _, msg := range tt.msgs {
+				FromContext(ctx).Debug(msg)
+			}
+			buf.close(true)
+			Sync()
+
+			entries := readJSONLines(t, app)
+			if len(entries) == 0 || entries[0]["message"] != "Request log buffer overflowed" || entries[0]["buffer_dropped"] != tt.dropped {
+				t.Fatalf("app.log starts with %v, want an overflow notice", entries)
+			}
+			if got := messages(entries[1:]); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("flushed %d entries, want the newest %d", len(got), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestGinMiddlewareRequestBuffer(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		status int
+		want   bool
+	}{
+		{http.StatusOK, false},
+		{http.StatusNotFound, false},
+		{http.StatusInternalServerError, true},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			app, _ := initBufferTestLogger(t)
+			r := gin.New()
+			r.Use(GinMiddleware(WithRequestBuffer(RequestBufferConfig{})))
+			r.GET("/", func(c *gin.Context) {
+				FromContext(c.Request.Context()).Debug("handler detail")
+				c.Status(tt.status)
+			})
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+			Sync()
+
+			msgs := messages(readJSONLines(t, app))
+			got := strings.Join(msgs, ",")
+			if flushed := strings.Contains(got, "handler detail"); flushed != tt.want {
+				t.Fatalf("app.log = %v, flushed %t, want %t", msgs, flushed, tt.want)
+			}
+			if tt.want && !strings.HasSuffix(got, "handler detail,Request completed with server error") {
+				t.Errorf("app.log = %v, want the buffered entry ahead of the completion entry", msgs)
+			}
+		})
+	}
+}
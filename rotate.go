@@ -0,0 +1,590 @@
+package tlog
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotationConfig configures the built-in rotating file writer, which adds
+// time-based rotation, date-named files and a total size cap to the size
+// rotation lumberjack provides. MaxSizeMB, MaxBackups, MaxAgeDays and
+// Compress from Config apply to it as well.
+type RotationConfig struct {
+	// Enabled selects the built-in rotating writer instead of lumberjack.
+	// Default: false
+	Enabled bool
+
+	// Interval starts a new file at every interval boundary, aligned to
+	// midnight in Config.Timezone, e.g. time.Hour or 24*time.Hour.
+	// Zero rotates on size only.
+	// Default: 0
+	Interval time.Duration
+
+	// Pattern is the file name pattern, formatted with the start of the
+	// period in Config.Timezone. Supported verbs: %Y %m %d %H %M %S %%.
+	// When a file exceeds MaxSizeMB within a period, an index is added
+	// before the extension: app-2026-10-16.1.log. With a zero Interval the
+	// file keeps its name and the full file is renamed to the next index:
+	// app.log is moved to app.1.log, then app.2.log.
+	// Default: FilePath with "-%Y-%m-%d" (daily) or "-%Y-%m-%d-%H" (sub-daily)
+	// before the extension, or FilePath itself when Interval is zero
+	Pattern string
+
+	// MaxTotalSizeMB caps the total size of the log files matching Pattern;
+	// the oldest are removed first. Zero means unlimited.
+	// Default: 0
+	MaxTotalSizeMB int
+}
+
+// validate derives the default pattern from filePath and checks the settings.
+func (c *RotationConfig) validate(filePath string) error {
+	if c.Interval < 0 {
+		return fmt.Errorf("tlog: invalid rotation interval %s", c.Interval)
+	}
+	if c.Interval > 24*time.Hour {
+		c.Interval = 24 * time.Hour
+	}
+	if c.Pattern == "" {
+		ext := filepath.Ext(filePath)
+		base := strings.TrimSuffix(filePath, ext)
+		switch {
+		case c.Interval == 0:
+			c.Pattern = filePath
+		case c.Interval >= 24*time.Hour:
+			c.Pattern = base + "-%Y-%m-%d" + ext
+		case c.Interval >= time.Hour:
+			c.Pattern = base + "-%Y-%m-%d-%H" + ext
+		default:
+			c.Pattern = base + "-%Y-%m-%d-%H%M" + ext
+		}
+	}
+	if _, err := patternRegexp(c.Pattern); err != nil {
+		return err
+	}
+	return nil
+}
+
+// patternVerbs maps pattern verbs to time layouts and match expressions.
+var patternVerbs = map[byte]struct{ layout, re string }{
+	'Y': {"2006", `\d{4}`},
+	'm': {"01", `\d{2}`},
+	'd': {"02", `\d{2}`},
+	'H': {"15", `\d{2}`},
+	'M': {"04", `\d{2}`},
+	'S': {"05", `\d{2}`},
+}
+
+// formatPattern expands the verbs of pattern for t.
+func formatPattern(pattern string, t time.Time) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' || i+1 == len(pattern) {
+			b.WriteByte(pattern[i])
+			continue
+		}
+		i++
+		if v, ok := patternVerbs[pattern[i]]; ok {
+			b.WriteString(t.Format(v.layout))
+		} else {
+			b.WriteByte(pattern[i])
+		}
+	}
+	return b.String()
+}
+
+// patternRegexp returns a regexp matching the base names of files produced
+// by pattern, including size indexes and the .gz suffix.
+func patternRegexp(pattern string) (*regexp.Regexp, error) {
+	base := filepath.Base(pattern)
+	ext := filepath.Ext(base)
+	base = strings.TrimSuffix(base, ext)
+
+	var b strings.Builder
+	b.WriteByte('^')
+	for i := 0; i < len(base); i++ {
+		if base[i] != '%' || i+1 == len(base) {
+			b.WriteString(regexp.QuoteMeta(base[i : i+1]))
+			continue
+		}
+		i++
+		if v, ok := patternVerbs[base[i]]; ok {
+			b.WriteString(v.re)
+		} else if base[i] == '%' {
+			b.WriteByte('%')
+		} else {
+			return nil, fmt.Errorf("tlog: unsupported rotation pattern verb %%%c", base[i])
+		}
+	}
+	b.WriteString(`(\.\d+)?`)
+	b.WriteString(regexp.QuoteMeta(ext))
+	b.WriteString(`(\.gz)?$`)
+	return regexp.Compile(b.String())
+}
+
+// indexedName inserts a size index before the extension of name.
+func indexedName(name string, index int) string {
+	if index == 0 {
+		return name
+	}
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + strconv.Itoa(index) + ext
+}
+
+// rotatingWriter is an io.WriteCloser writing to files rotated by time and
+// size, with retention by count, age and total size.
+type rotatingWriter struct {
+	pattern    string
+	match      *regexp.Regexp
+	interval   time.Duration
+	loc        *time.Location
+	maxSize    int64
+	maxBackups int
+	maxAge     time.Duration
+	maxTotal   int64
+	compress   bool
+
+	mu     sync.Mutex
+	file   *os.File
+	name   string
+	base   string
+	index  int
+	size   int64
+	next   time.Time
+	closed bool
+
+	millCh chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// newRotatingWriter creates a rotating writer from a validated Config and
+// starts its rotation scheduler and retention worker.
+func newRotatingWriter(cfg Config) (*rotatingWriter, error) {
+	match, err := patternRegexp(cfg.Rotation.Pattern)
+	if err != nil {
+		return nil, err
+	}
+	w := &rotatingWriter{
+		pattern:    cfg.Rotation.Pattern,
+		match:      match,
+		interval:   cfg.Rotation.Interval,
+		loc:        cfg.Timezone,
+		maxSize:    int64(cfg.MaxSizeMB) * 1024 * 1024,
+		maxBackups: cfg.MaxBackups,
+		maxAge:     time.Duration(cfg.MaxAgeDays) * 24 * time.Hour,
+		maxTotal:   int64(cfg.Rotation.MaxTotalSizeMB) * 1024 * 1024,
+		compress:   cfg.Compress,
+		millCh:     make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	if err := w.open(time.Now()); err != nil {
+		return nil, err
+	}
+
+	w.wg.Add(2)
+	go w.schedule()
+	go w.mill()
+	w.millCh <- struct{}{}
+	return w, nil
+}
+
+// periodStart returns the start of the rotation period containing t.
+func (w *rotatingWriter) periodStart(t time.Time) time.Time {
+	t = t.In(w.loc)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, w.loc)
+	if w.interval >= 24*time.Hour {
+		return midnight
+	}
+	return midnight.Add(t.Sub(midnight).Truncate(w.interval))
+}
+
+// nextPeriod returns the start of the period after the one starting at start.
+func (w *rotatingWriter) nextPeriod(start time.Time) time.Time {
+	if w.interval >= 24*time.Hour {
+		return start.AddDate(0, 0, 1)
+	}
+	next := start.Add(w.interval)
+	if midnight := time.Date(start.Year(), start.Month(), start.Day()+1, 0, 0, 0, 0, w.loc); next.After(midnight) {
+		next = midnight
+	}
+	return next
+}
+
+// open opens the file for the period containing now, continuing the highest
+// existing size index, or the fixed file name when rotating on size only.
+// The caller holds mu or has exclusive access.
+func (w *rotatingWriter) open(now time.Time) error {
+	start := now
+	if w.interval > 0 {
+		start = w.periodStart(now)
+		w.next = w.nextPeriod(start)
+	}
+	w.base = formatPattern(w.pattern, start.In(w.loc))
+	if w.interval == 0 {
+		w.index = 0
+		return w.openIndex()
+	}
+
+	index, found := highestIndex(w.base)
+	w.index = index
+	if found {
+		info, err := os.Stat(indexedName(w.base, index))
+		if err != nil || (w.maxSize > 0 && info.Size() >= w.maxSize) {
+			// Full, or already rotated and compressed
+			w.index++
+		}
+	}
+	return w.openIndex()
+}
+
+// highestIndex returns the highest size index among the existing files for
+// base, compressed or not, and whether any exists.
+func highestIndex(base string) (int, bool) {
+	entries, err := os.ReadDir(filepath.Dir(base))
+	if err != nil {
+		return 0, false
+	}
+
+	name := filepath.Base(base)
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext) + "."
+
+	highest, found := 0, false
+	for _, e := range entries {
+		n := strings.TrimSuffix(e.Name(), ".gz")
+		if n == name {
+			found = true
+			continue
+		}
+		if !strings.HasPrefix(n, stem) || !strings.HasSuffix(n, ext) || len(n) <= len(stem)+len(ext) {
+			continue
+		}
+		index, err := strconv.Atoi(n[len(stem) : len(n)-len(ext)])
+		if err != nil || index <= 0 {
+			continue
+		}
+		if index > highest {
+			highest = index
+		}
+		found = true
+	}
+	return highest, found
+}
+
+// openIndex opens the current base name at the current index for appending.
+func (w *rotatingWriter) openIndex() error {
+	name := indexedName(w.base, w.index)
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return fmt.Errorf("tlog: create log directory: %w", err)
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("tlog: open log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("tlog: stat log file: %w", err)
+	}
+	if w.file != nil {
+		w.file.Close()
+	}
+	w.file, w.name, w.size = f, name, info.Size()
+	return nil
+}
+
+// Write writes p to the current file, rotating first when the period has
+// ended or the file would exceed MaxSizeMB.
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		// Reopened after Close, like lumberjack
+		if err := w.open(time.Now()); err != nil {
+			return 0, err
+		}
+	}
+	if w.interval > 0 && !time.Now().Before(w.next) {
+		if err := w.rotateLocked(time.Now()); err != nil {
+			return 0, err
+		}
+	}
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotateSizeLocked(); err != nil {
+			return 0, err
+		}
+		w.triggerMill()
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// rotateSizeLocked starts a new file once the current one is full. Dated
+// files continue at the next index; a fixed name keeps being written, after
+// the full file is renamed to the next index. When the rename fails, writing
+// continues in the full file.
+func (w *rotatingWriter) rotateSizeLocked() error {
+	if w.interval > 0 {
+		w.index++
+		return w.openIndex()
+	}
+
+	highest, _ := highestIndex(w.base)
+	w.file.Close()
+	w.file = nil
+	if err := os.Rename(w.base, indexedName(w.base, highest+1)); err != nil {
+		fmt.Fprintf(os.Stderr, "%v tlog: rotate log file: %v\n", time.Now(), err)
+	}
+	return w.openIndex()
+}
+
+// rotateLocked switches to the file of the period containing now.
+func (w *rotatingWriter) rotateLocked(now time.Time) error {
+	if err := w.open(now); err != nil {
+		return err
+	}
+	w.triggerMill()
+	return nil
+}
+
+// Sync commits the current file to stable storage.
+func (w *rotatingWriter) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Sync()
+}
+
+// Close stops the scheduler and closes the current file. Entries written
+// afterwards reopen the file without rotation scheduling or cleanup.
+func (w *rotatingWriter) Close() error {
+	w.mu.Lock()
+	stop := !w.closed
+	w.closed = true
+	w.mu.Unlock()
+
+	if stop {
+		close(w.done)
+		w.wg.Wait()
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// schedule rotates at every period boundary, so files switch and old ones
+// are compressed even when nothing is logged.
+func (w *rotatingWriter) schedule() {
+	defer w.wg.Done()
+	if w.interval <= 0 {
+		<-w.done
+		return
+	}
+
+	for {
+		w.mu.Lock()
+		wait := time.Until(w.next)
+		w.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case now := <-timer.C:
+			w.mu.Lock()
+			if !w.closed && !now.Before(w.next) {
+				if err := w.rotateLocked(now); err != nil {
+					fmt.Fprintf(os.Stderr, "%v tlog: rotate log file: %v\n", now, err)
+				}
+			}
+			w.mu.Unlock()
+		case <-w.done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// triggerMill asks the retention worker to run without blocking.
+func (w *rotatingWriter) triggerMill() {
+	if w.closed {
+		return
+	}
+	select {
+	case w.millCh <- struct{}{}:
+	default:
+	}
+}
+
+// mill compresses and removes old files when triggered.
+func (w *rotatingWriter) mill() {
+	defer w.wg.Done()
+	for {
+		select {
+		case <-w.millCh:
+			if err := w.millOnce(); err != nil {
+				fmt.Fprintf(os.Stderr, "%v tlog: clean up log files: %v\n", time.Now(), err)
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// logFile is a file produced by the rotating writer.
+type logFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// millOnce applies compression, MaxBackups, MaxAgeDays and MaxTotalSizeMB to
+// the rotated files. The current file is never touched.
+func (w *rotatingWriter) millOnce() error {
+	files, current, err := w.rotatedFiles()
+	if err != nil {
+		return err
+	}
+
+	// Newest first
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.After(files[j].modTime) })
+
+	var remove []logFile
+	keep := files[:0]
+	cutoff := time.Now().Add(-w.maxAge)
+	for i, f := range files {
+		if (w.maxBackups > 0 && i >= w.maxBackups) || (w.maxAge > 0 && f.modTime.Before(cutoff)) {
+			remove = append(remove, f)
+			continue
+		}
+		keep = append(keep, f)
+	}
+
+	if w.maxTotal > 0 {
+		var total int64
+		if info, err := os.Stat(current); err == nil {
+			total = info.Size()
+		}
+		kept := keep[:0]
+		for _, f := range keep {
+			if total+f.size > w.maxTotal {
+				remove = append(remove, f)
+				continue
+			}
+			total += f.size
+			kept = append(kept, f)
+		}
+		keep = kept
+	}
+
+	var errs []error
+	for _, f := range remove {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	if w.compress {
+		for _, f := range keep {
+			if !strings.HasSuffix(f.path, ".gz") {
+				if err := compressFile(f.path); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// rotatedFiles lists the files matching the pattern, except the current
+// file, which it also returns. The current file is read after listing, so a
+// file created by a concurrent rotation is never treated as rotated.
+func (w *rotatingWriter) rotatedFiles() ([]logFile, string, error) {
+	w.mu.Lock()
+	dir := filepath.Dir(w.name)
+	w.mu.Unlock()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, "", err
+	}
+
+	w.mu.Lock()
+	current := w.name
+	w.mu.Unlock()
+
+	var files []logFile
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		if e.IsDir() || !w.match.MatchString(e.Name()) || path == filepath.Clean(current) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, logFile{path: path, size: info.Size(), modTime: info.ModTime()})
+	}
+	return files, current, nil
+}
+
+// compressFile gzips path to path.gz and removes the original.
+func compressFile(path string) (err error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(path + ".gz")
+		}
+	}()
+
+	gz := gzip.NewWriter(dst)
+	if _, err = io.Copy(gz, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err = gz.Close(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err = dst.Close(); err != nil {
+		return err
+	}
+	if err = os.Chtimes(path+".gz", info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
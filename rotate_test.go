@@ -0,0 +1,166 @@
+package tlog
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestRotatingWriter returns a rotating writer for dir/app.log that
+// rotates at maxSize bytes. Its background workers are stopped, so tests
+// run retention with millOnce.
+func newTestRotatingWriter(t *testing.T, dir string, rotation RotationConfig, maxSize int64, maxBackups int, compress bool) *rotatingWriter {
+	t.Helper()
+	cfg := DefaultConfig().
+		WithFile(filepath.Join(dir, "app.log")).
+		WithFileRotation(1, maxBackups, 0, compress).
+		WithRotation(rotation)
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	w, err := newRotatingWriter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Writes after Close reopen the file without the background workers.
+	w.Close()
+	w.maxSize = maxSize
+	t.Cleanup(func() { w.Close() })
+	return w
+}
+
+// dirFiles returns the sorted names of the files in dir.
+func dirFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotatingWriterSizeOnly(t *testing.T) {
+	dir := t.TempDir()
+	w := newTestRotatingWriter(t, dir, RotationConfig{}, 100, 0, false)
+
+	for _, c := range []string{"a", "b", "c"} {
+		if _, err := w.Write([]byte(strings.Repeat(c, 60))); err != nil {
+			t.Fatal(err)
+		}
+		if w.name != filepath.Join(dir, "app.log") {
+			t.Fatalf("writing to %s, want app.log", w.name)
+		}
+	}
+
+	if got, want := dirFiles(t, dir), []string{"app.1.log", "app.2.log", "app.log"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("files = %v, want %v", got, want)
+	}
+	for name, want := range map[string]string{"app.1.log": "a", "app.2.log": "b", "app.log": "c"} {
+		if got := readFile(t, filepath.Join(dir, name)); got != strings.Repeat(want, 60) {
+			t.Errorf("%s = %q", name, got)
+		}
+	}
+}
+
+func TestRotatingWriterSizeOnlyRetention(t *testing.T) {
+	dir := t.TempDir()
+	w := newTestRotatingWriter(t, dir, RotationConfig{}, 100, 1, true)
+
+	for i := 0; i < 3; i++ {
+		if _, err := w.Write([]byte(strings.Repeat("x", 60))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The active file is the oldest by modification time and must survive.
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "app.log"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.millOnce(); err != nil {
+		t.Fatal(err)
+	}
+	files := dirFiles(t, dir)
+	if len(files) != 2 || files[1] != "app.log" || !strings.HasSuffix(files[0], ".log.gz") {
+		t.Fatalf("files = %v, want app.log and one compressed backup", files)
+	}
+
+	// Numbering continues after compressed backups.
+	if _, err := w.Write([]byte(strings.Repeat("y", 60))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "app.3.log")); err != nil {
+		t.Errorf("next backup: %v; files %v", err, dirFiles(t, dir))
+	}
+}
+
+func TestRotatingWriterInterval(t *testing.T) {
+	dir := t.TempDir()
+	w := newTestRotatingWriter(t, dir, RotationConfig{Interval: 24 * time.Hour}, 100, 0, false)
+
+	for i := 0; i < 2; i++ {
+		if _, err := w.Write([]byte(strings.Repeat("x", 60))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	day := time.Now().In(w.loc).Format("2006-01-02")
+	want := []string{"app-" + day + ".1.log", "app-" + day + ".log"}
+	if got := dirFiles(t, dir); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("files = %v, want %v", got, want)
+	}
+	if filepath.Base(w.name) != want[0] {
+		t.Errorf("writing to %s, want %s", w.name, want[0])
+	}
+}
+
+func TestPatternRegexp(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"logs/app.log", "app.log", true},
+		{"logs/app.log", "app.12.log.gz", true},
+		{"logs/app.log", "app.log.1", false},
+		{"logs/app.log", "other.log", false},
+		{"logs/app-%Y-%m-%d.log", "app-2026-10-16.log", true},
+		{"logs/app-%Y-%m-%d.log", "app-2026-10-16.3.log.gz", true},
+		{"logs/app-%Y-%m-%d.log", "app-2026-10.log", false},
+		{"logs/app-%Y%%.log", "app-2026%.log", true},
+	}
+	for _, tt := range tests {
+		re, err := patternRegexp(tt.pattern)
+		if err != nil {
+			t.Fatalf("patternRegexp(%q): %v", tt.pattern, err)
+		}
+		if got := re.MatchString(tt.name); got != tt.want {
+			t.Errorf("patternRegexp(%q) matches %q = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+	if _, err := patternRegexp("app-%Q.log"); err == nil {
+		t.Error("unsupported verb accepted")
+	}
+}
+
+func TestFormatPattern(t *testing.T) {
+	ts := time.Date(2026, 10, 16, 9, 5, 3, 0, time.UTC)
+	if got, want := formatPattern("logs/%Y/%m/app-%d-%H%M%S-%%.log", ts), "logs/2026/10/app-16-090503-%.log"; got != want {
+		t.Errorf("formatPattern() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,401 @@
+package tlog
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// SamplingRule limits how many entries with the same level and message are
+// logged per tick: the first Initial, then every Thereafter-th one.
+// Thereafter of zero drops everything after the first Initial.
+type SamplingRule struct {
+	Initial    int
+	Thereafter int
+}
+
+// SamplingConfig configures zap-style log sampling.
+type SamplingConfig struct {
+	// Enabled turns on sampling.
+	// Default: false
+	Enabled bool
+
+	// Tick is the period over which entries are counted.
+	// Default: 1s
+	Tick time.Duration
+
+	// Initial is the number of entries per level and message logged each tick.
+	// Default: 100
+	Initial int
+
+	// Thereafter logs every Thereafter-th entry once Initial is exceeded.
+	// Default: 100
+	Thereafter int
+
+	// Levels overrides Initial/Thereafter per level name, e.g. "debug".
+	Levels map[string]SamplingRule
+
+	// Messages overrides Initial/Thereafter per exact message. It takes
+	// precedence over Levels.
+	Messages map[string]SamplingRule
+
+	// ExemptErrors logs every entry at error level and above regardless of sampling.
+	// Default: false
+	ExemptErrors bool
+}
+
+// DedupConfig configures duplicate suppression: repeats of an entry within
+// Window are collapsed into one entry with a "repeated" count.
+type DedupConfig struct {
+	// Enabled turns on duplicate suppression.
+	// Default: false
+	Enabled bool
+
+	// Window is how long repeats are collapsed after the first occurrence.
+	// Default: 5s
+	Window time.Duration
+
+	// KeyFields narrows the fields that, with level, message and caller,
+	// identify duplicates. Fields not listed are ignored when comparing
+	// entries, and the last occurrence's values are logged.
+	// Default: all fields, so only identical entries are collapsed
+	// Example: []string{"error", "table", "status"}
+	KeyFields []string
+
+	// MaxGroups bounds the number of distinct entries tracked per window;
+	// entries beyond it are logged without suppression.
+	// Default: 10000
+	MaxGroups int
+}
+
+// validate applies defaults to unset fields.
+func (c *SamplingConfig) validate() error {
+	if c.Tick <= 0 {
+		c.Tick = time.Second
+	}
+	if c.Initial <= 0 {
+		c.Initial = 100
+	}
+	if c.Thereafter <= 0 {
+		c.Thereafter = 100
+	}
+	for name := range c.Levels {
+		if _, err := zapcore.ParseLevel(name); err != nil {
+			return fmt.Errorf("tlog: invalid sampling level %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// validate applies defaults to unset fields.
+func (c *DedupConfig) validate() error {
+	if c.Window <= 0 {
+		c.Window = 5 * time.Second
+	}
+	if c.MaxGroups <= 0 {
+		c.MaxGroups = 10000
+	}
+	return nil
+}
+
+// sampleCounters is the number of counters per level; messages hash into them.
+const sampleCounters = 4096
+
+// sampleCounter counts entries for one level and message hash within a tick.
+type sampleCounter struct {
+	resetAt atomic.Int64
+	count   atomic.Uint64
+}
+
+// inc counts an entry at t and returns its position within the current tick.
+func (c *sampleCounter) inc(t time.Time, tick time.Duration) uint64 {
+	now := t.UnixNano()
+	resetAt := c.resetAt.Load()
+	if resetAt > now {
+		return c.count.Add(1)
+	}
+	c.count.Store(1)
+	if !c.resetAt.CompareAndSwap(resetAt, now+tick.Nanoseconds()) {
+		return c.count.Add(1)
+	}
+	return 1
+}
+
+// samplerCore drops entries beyond the sampling rules in Check, before any
+// fields are encoded.
+type samplerCore struct {
+	zapcore.Core
+	cfg      SamplingConfig
+	levels   map[zapcore.Level]SamplingRule
+	counters *[zapcore.FatalLevel - zapcore.DebugLevel + 1][sampleCounters]sampleCounter
+}
+
+// newSamplerCore wraps core with sampling. cfg must be validated.
+func newSamplerCore(core zapcore.Core, cfg SamplingConfig) zapcore.Core {
+	levels := make(map[zapcore.Level]SamplingRule, len(cfg.Levels))
+	for name, rule := range cfg.Levels {
+		level, _ := zapcore.ParseLevel(name)
+		levels[level] = rule
+	}
+	return &samplerCore{
+		Core:     core,
+		cfg:      cfg,
+		levels:   levels,
+		counters: new([zapcore.FatalLevel - zapcore.DebugLevel + 1][sampleCounters]sampleCounter),
+	}
+}
+
+// With adds structured context, sharing the sampling counters.
+func (c *samplerCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := *c
+	clone.Core = c.Core.With(fields)
+	return &clone
+}
+
+// Check samples the entry before passing it to the wrapped core. Audit
+// events are never sampled.
+func (c *samplerCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !c.Enabled(ent.Level) {
+		return ce
+	}
+	if (c.cfg.ExemptErrors && ent.Level >= zapcore.ErrorLevel) || isAuditEntry(ent) ||
+		ent.Level < zapcore.DebugLevel || ent.Level > zapcore.FatalLevel {
+		return c.Core.Check(ent, ce)
+	}
+
+	rule, ok := c.cfg.Messages[ent.Message]
+	if !ok {
+		if rule, ok = c.levels[ent.Level]; !ok {
+			rule = SamplingRule{Initial: c.cfg.Initial, Thereafter: c.cfg.Thereafter}
+		}
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(ent.Message))
+	counter := &c.counters[ent.Level-zapcore.DebugLevel][h.Sum32()%sampleCounters]
+
+	n := counter.inc(ent.Time, c.cfg.Tick)
+	if n > uint64(rule.Initial) && (rule.Thereafter <= 0 || (n-uint64(rule.Initial))%uint64(rule.Thereafter) != 0) {
+		return ce
+	}
+	return c.Core.Check(ent, ce)
+}
+
+// dedupGroup tracks repeats of one entry within a window.
+type dedupGroup struct {
+	start    time.Time
+	repeated int
+	ent      zapcore.Entry
+	fields   []zapcore.Field
+	core     zapcore.Core
+}
+
+// dedupState is shared by a dedupCore and its children.
+type dedupState struct {
+	cfg  DedupConfig
+	keys map[string]bool
+
+	mu     sync.Mutex
+	groups map[uint64]*dedupGroup
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// dedupCore collapses repeated entries into one entry with a "repeated" count.
+type dedupCore struct {
+	zapcore.Core
+	state *dedupState
+
+	// summary receives the repeat counts, bypassing any sampling in Core.
+	summary zapcore.Core
+
+	// context holds the key fields added with With, encoded for hashing.
+	context string
+}
+
+// newDedupCore wraps core with duplicate suppression and starts the
+// goroutine that emits expired groups. Repeat counts are written to summary,
+// the core underneath any sampling. cfg must be validated.
+func newDedupCore(core, summary zapcore.Core, cfg DedupConfig) (*dedupCore, *dedupState) {
+	state := &dedupState{
+		cfg:    cfg,
+		keys:   make(map[string]bool, len(cfg.KeyFields)),
+		groups: make(map[uint64]*dedupGroup),
+		done:   make(chan struct{}),
+	}
+	for _, k := range cfg.KeyFields {
+		state.keys[k] = true
+	}
+	go state.run()
+	return &dedupCore{Core: core, state: state, summary: summary}, state
+}
+
+// With adds structured context, keeping key fields for duplicate detection.
+func (c *dedupCore) With(fields []zapcore.Field) zapcore.Core {
+	return &dedupCore{
+		Core:    c.Core.With(fields),
+		state:   c.state,
+		summary: c.summary.With(fields),
+		context: c.context + c.state.keyFields(fields),
+	}
+}
+
+// Check adds the core when the wrapped core would log the entry.
+func (c *dedupCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+// Write logs the first occurrence of an entry and counts repeats within the
+// window. Entries above error level and audit events are never suppressed.
+func (c *dedupCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	if ent.Level > zapcore.ErrorLevel || isAuditEntry(ent) {
+		return c.write(ent, fields)
+	}
+
+	key := c.key(ent, fields)
+	s := c.state
+
+	s.mu.Lock()
+	g, ok := s.groups[key]
+	if ok && ent.Time.Sub(g.start) < s.cfg.Window {
+		g.repeated++
+		g.ent = ent
+		g.fields = append([]zapcore.Field(nil), fields...)
+		g.core = c.summary
+		s.mu.Unlock()
+		return nil
+	}
+
+	var expired *dedupGroup
+	if ok && g.repeated > 0 {
+		expired = g // replaced below, so safe to emit after unlocking
+	}
+	if ok || len(s.groups) < s.cfg.MaxGroups {
+		s.groups[key] = &dedupGroup{start: ent.Time}
+	}
+	s.mu.Unlock()
+
+	if expired != nil {
+		expired.emit()
+	}
+	return c.write(ent, fields)
+}
+
+// write passes the entry to the wrapped core through Check so its level
+// filters still apply.
+func (c *dedupCore) write(ent zapcore.Entry, fields []zapcore.Field) error {
+	c.Core.Check(ent, nil).Write(fields...)
+	return nil
+}
+
+// Sync emits pending repeat counts and syncs the wrapped core.
+func (c *dedupCore) Sync() error {
+	c.state.flush(time.Time{})
+	return c.Core.Sync()
+}
+
+// key hashes the level, message, caller and key fields of an entry, all
+// fields when KeyFields is empty.
+func (c *dedupCore) key(ent zapcore.Entry, fields []zapcore.Field) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d\x00%s\x00%s\x00%s\x00%s", ent.Level, ent.LoggerName, ent.Message, ent.Caller.String(), c.context)
+	h.Write([]byte(c.state.keyFields(fields)))
+	return h.Sum64()
+}
+
+// keyFields encodes the configured key fields among fields, or all of them
+// without KeyFields, in a stable order.
+func (s *dedupState) keyFields(fields []zapcore.Field) string {
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range fields {
+		if len(s.keys) == 0 || s.keys[f.Key] {
+			f.AddTo(enc)
+		}
+	}
+	if len(enc.Fields) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(enc.Fields))
+	for k := range enc.Fields {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var out string
+	for _, k := range names {
+		out += fmt.Sprintf("\x00%s=%v", k, enc.Fields[k])
+	}
+	return out
+}
+
+// isAuditEntry reports whether an entry comes from the audit logger, whose
+// events must not be lossy.
+func isAuditEntry(ent zapcore.Entry) bool {
+	return ent.LoggerName == auditLoggerName || strings.HasPrefix(ent.LoggerName, auditLoggerName+".")
+}
+
+// emit logs the last repeat of the group with the number of suppressed repeats.
+func (g *dedupGroup) emit() {
+	fields := append(g.fields, zap.Int("repeated", g.repeated))
+	g.core.Check(g.ent, nil).Write(fields...)
+}
+
+// run emits expired groups every window until the state is closed.
+func (s *dedupState) run() {
+	ticker := time.NewTicker(s.cfg.Window)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.flush(now)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// flush emits and forgets groups whose window ended before now. When now is
+// zero, it emits every pending repeat count but keeps the windows open.
+func (s *dedupState) flush(now time.Time) {
+	var expired []dedupGroup
+
+	s.mu.Lock()
+	for key, g := range s.groups {
+		if now.IsZero() || now.Sub(g.start) >= s.cfg.Window {
+			if g.repeated > 0 {
+				expired = append(expired, *g)
+				g.repeated, g.fields = 0, nil
+			}
+			if !now.IsZero() {
+				delete(s.groups, key)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(expired, func(i, j int) bool { return expired[i].ent.Time.Before(expired[j].ent.Time) })
+	for i := range expired {
+		expired[i].emit()
+	}
+}
+
+// Close stops the background goroutine and emits pending repeat counts.
+func (s *dedupState) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.flush(time.Time{})
+	})
+	return nil
+}
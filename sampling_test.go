@@ -0,0 +1,255 @@
+package tlog
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// checkWrite logs an entry through core as a logger would.
+func checkWrite(core zapcore.Core, ent zapcore.Entry, fields ...zapcore.Field) {
+	if ce := core.Check(ent, nil); ce != nil {
+		ce.Write(fields...)
+	}
+}
+
+func TestSamplerCore(t *testing.T) {
+	cfg := SamplingConfig{
+		Initial:    2,
+		Thereafter: 3,
+		Levels:     map[string]SamplingRule{"debug": {Initial: 1}},
+		Messages:   map[string]SamplingRule{"hot": {Initial: 1, Thereafter: 5}},
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		ent    zapcore.Entry
+		n      int
+		want   int
+		exempt bool
+	}{
+		// 1, 2, then 5 and 8
+		{name: "initial then thereafter", ent: zapcore.Entry{Level: zapcore.InfoLevel, Message: "m"}, n: 10, want: 4},
+		{name: "per level", ent: zapcore.Entry{Level: zapcore.DebugLevel, Message: "m"}, n: 10, want: 1},
+		// 1, then 6 and 11; messages take precedence over levels
+		{name: "per message", ent: zapcore.Entry{Level: zapcore.DebugLevel, Message: "hot"}, n: 12, want: 3},
+		{name: "errors sampled", ent: zapcore.Entry{Level: zapcore.ErrorLevel, Message: "m"}, n: 10, want: 4},
+		{name: "errors exempt", ent: zapcore.Entry{Level: zapcore.ErrorLevel, Message: "m"}, n: 10, want: 10, exempt: true},
+		{name: "audit", ent: zapcore.Entry{Level: zapcore.InfoLevel, LoggerName: "audit", Message: "audit"}, n: 10, want: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obs, logs := observer.New(zapcore.DebugLevel)
+			c := cfg
+			c.ExemptErrors = tt.exempt
+			core := newSamplerCore(obs, c)
+
+			ent := tt.ent
+			ent.Time = now
+			for i := 0; i < tt.n; i++ {
+				checkWrite(core, ent)
+			}
+			if logs.Len() != tt.want {
+				t.Errorf("logged %d of %d, want %d", logs.Len(), tt.n, tt.want)
+			}
+
+			// Counters reset with the next tick
+			ent.Time = now.Add(c.Tick)
+			checkWrite(core, ent)
+			if logs.Len() != tt.want+1 {
+				t.Error("first entry of the next tick was sampled out")
+			}
+		})
+	}
+}
+
+func TestSamplerCoreCountersPerMessage(t *testing.T) {
+	cfg := SamplingConfig{Initial: 1, Thereafter: 100}
+	cfg.validate()
+	obs, logs := observer.New(zapcore.DebugLevel)
+	core := newSamplerCore(obs, cfg).With([]zapcore.Field{zap.String("component", "http")})
+
+	now := time.Now()
+	for _, msg := range []string{"a", "b", "a", "b"} {
+		checkWrite(core, zapcore.Entry{Level: zapcore.InfoLevel, Message: msg, Time: now})
+	}
+	checkWrite(core, zapcore.Entry{Level: zapcore.WarnLevel, Message: "a", Time: now})
+	if logs.Len() != 3 {
+		t.Errorf("logged %d, want the first of each level and message", logs.Len())
+	}
+	if logs.All()[0].ContextMap()["component"] != "http" {
+		t.Error("With context lost")
+	}
+}
+
+// newTestDedup returns a dedup core over an observer. Its window never
+// expires on its own; tests call flush.
+func newTestDedup(t *testing.T, cfg DedupConfig) (zapcore.Core, *dedupState, *observer.ObservedLogs) {
+	t.Helper()
+	if cfg.Window == 0 {
+		cfg.Window = time.Hour
+	}
+	cfg.validate()
+	obs, logs := observer.New(zapcore.DebugLevel)
+	core, state := newDedupCore(obs, obs, cfg)
+	t.Cleanup(func() { state.Close() })
+	return core, state, logs
+}
+
+// repeatedCounts returns the repeated field of each logged entry, 0 when
+// absent.
+func repeatedCounts(logs *observer.ObservedLogs) []int64 {
+	var counts []int64
+	for _, e := range logs.All() {
+		n, _ := e.ContextMap()["repeated"].(int64)
+		counts = append(counts, n)
+	}
+	return counts
+}
+
+func TestDedupCoreWindow(t *testing.T) {
+	core, state, logs := newTestDedup(t, DedupConfig{})
+	t0 := time.Now()
+	ent := zapcore.Entry{Level: zapcore.ErrorLevel, Message: "Database query failed"}
+	for i := 0; i < 4; i++ {
+		ent.Time = t0.Add(time.Duration(i) * time.Second)
+		checkWrite(core, ent, zap.String("error", "refused"))
+	}
+	if logs.Len() != 1 {
+		t.Fatalf("logged %d, want the first occurrence only", logs.Len())
+	}
+
+	state.flush(t0.Add(time.Hour))
+	got := logs.All()
+	if len(got) != 2 || got[1].ContextMap()["repeated"] != int64(3) || !got[1].Time.Equal(t0.Add(3*time.Second)) {
+		t.Fatalf("window end logged %v, want the last repeat with repeated=3", repeatedCounts(logs))
+	}
+
+	// The group is forgotten: the next occurrence is logged right away
+	ent.Time = t0.Add(time.Hour + time.Second)
+	checkWrite(core, ent, zap.String("error", "refused"))
+	if logs.Len() != 3 {
+		t.Errorf("logged %d after the window, want 3", logs.Len())
+	}
+}
+
+func TestDedupCoreExpiredOnWrite(t *testing.T) {
+	core, _, logs := newTestDedup(t, DedupConfig{Window: time.Minute})
+	t0 := time.Now()
+	ent := zapcore.Entry{Level: zapcore.WarnLevel, Message: "slow"}
+	for _, at := range []time.Duration{0, time.Second, 2 * time.Minute} {
+		ent.Time = t0.Add(at)
+		checkWrite(core, ent)
+	}
+	// First occurrence, repeat count of the old window, first of the new one
+	if got := repeatedCounts(logs); len(got) != 3 || got[0] != 0 || got[1] != 1 || got[2] != 0 {
+		t.Errorf("repeated counts %v, want [0 1 0]", got)
+	}
+}
+
+func TestDedupCoreKey(t *testing.T) {
+	t0 := time.Now()
+	ent := zapcore.Entry{Level: zapcore.InfoLevel, Message: "Request completed", Time: t0}
+	requests := [][]zapcore.Field{
+		{zap.String("path", "/a"), zap.Int("status_code", 200), zap.Int64("duration_ms", 3)},
+		{zap.String("path", "/b"), zap.Int("status_code", 200), zap.Int64("duration_ms", 3)},
+		{zap.String("path", "/a"), zap.Int("status_code", 200), zap.Int64("duration_ms", 9)},
+		{zap.String("path", "/a"), zap.Int("status_code", 200), zap.Int64("duration_ms", 3)},
+	}
+	tests := []struct {
+		name      string
+		keyFields []string
+		want      int
+	}{
+		{"all fields", nil, 3},
+		{"key fields", []string{"path", "status_code"}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, _, logs := newTestDedup(t, DedupConfig{KeyFields: tt.keyFields})
+			for _, fields := range requests {
+				checkWrite(core, ent, fields...)
+			}
+			if logs.Len() != tt.want {
+				t.Errorf("logged %d, want %d", logs.Len(), tt.want)
+			}
+		})
+	}
+}
+
+func TestDedupCoreWithContext(t *testing.T) {
+	core, state, logs := newTestDedup(t, DedupConfig{})
+	alice := core.With([]zapcore.Field{zap.String("user", "alice")})
+	bob := core.With([]zapcore.Field{zap.String("user", "bob")})
+
+	ent := zapcore.Entry{Level: zapcore.InfoLevel, Message: "login", Time: time.Now()}
+	checkWrite(alice, ent)
+	checkWrite(bob, ent)
+	checkWrite(alice, ent)
+	if logs.Len() != 2 {
+		t.Fatalf("logged %d, want one entry per context", logs.Len())
+	}
+	state.flush(time.Time{})
+	if got := logs.All(); len(got) != 3 || got[2].ContextMap()["user"] != "alice" || got[2].ContextMap()["repeated"] != int64(1) {
+		t.Errorf("repeat count logged as %v", got[len(got)-1].ContextMap())
+	}
+}
+
+func TestDedupCoreMaxGroups(t *testing.T) {
+	core, _, logs := newTestDedup(t, DedupConfig{MaxGroups: 2})
+	ent := zapcore.Entry{Level: zapcore.InfoLevel, Time: time.Now()}
+	for _, msg := range []string{"a", "b", "c", "c", "a"} {
+		ent.Message = msg
+		checkWrite(core, ent)
+	}
+	// "c" is beyond MaxGroups and logged every time; "a" is tracked
+	if logs.Len() != 4 {
+		t.Errorf("logged %d, want 4", logs.Len())
+	}
+}
+
+func TestDedupCoreSync(t *testing.T) {
+	core, state, logs := newTestDedup(t, DedupConfig{})
+	ent := zapcore.Entry{Level: zapcore.InfoLevel, Message: "m", Time: time.Now()}
+	checkWrite(core, ent)
+	checkWrite(core, ent)
+	if err := core.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got := repeatedCounts(logs); len(got) != 2 || got[1] != 1 {
+		t.Fatalf("repeated counts %v after Sync, want [0 1]", got)
+	}
+
+	// The window stays open; Close emits the rest
+	checkWrite(core, ent)
+	if logs.Len() != 2 {
+		t.Errorf("repeat after Sync logged")
+	}
+	state.Close()
+	if got := repeatedCounts(logs); len(got) != 3 || got[2] != 1 {
+		t.Errorf("repeated counts %v after Close, want [0 1 1]", got)
+	}
+}
+
+func TestDedupCorePassthrough(t *testing.T) {
+	core, _, logs := newTestDedup(t, DedupConfig{})
+	now := time.Now()
+	for _, ent := range []zapcore.Entry{
+		{Level: zapcore.DPanicLevel, Message: "m", Time: now},
+		{Level: zapcore.DPanicLevel, Message: "m", Time: now},
+		{Level: zapcore.InfoLevel, LoggerName: "audit", Message: "audit", Time: now},
+		{Level: zapcore.InfoLevel, LoggerName: "audit", Message: "audit", Time: now},
+	} {
+		checkWrite(core, ent)
+	}
+	if logs.Len() != 4 {
+		t.Errorf("logged %d, want panics and audit events unsuppressed", logs.Len())
+	}
+}
@@ -0,0 +1,662 @@
+package tlog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// SinkEntry is a log entry handed to a Sink, with its fields encoded into
+// plain Go values.
+type SinkEntry struct {
+	Time       time.Time
+	Level      zapcore.Level
+	LoggerName string
+	Message    string
+	Caller     zapcore.EntryCaller
+	Stack      string
+
+	// Fields holds the fields of the entry and those added with With, as
+	// encoded by zapcore.MapObjectEncoder.
+	Fields map[string]interface{}
+}
+
+// record returns the entry as a flat map for JSON-based sinks: its fields
+// plus level, message and, when set, logger, caller and stacktrace.
+func (e SinkEntry) record() map[string]interface{} {
+	rec := make(map[string]interface{}, len(e.Fields)+5)
+	for k, v := range e.Fields {
+		rec[k] = v
+	}
+	rec["level"] = e.Level.String()
+	rec["message"] = e.Message
+	if e.LoggerName != "" {
+		rec["logger"] = e.LoggerName
+	}
+	if e.Caller.Defined {
+		rec["caller"] = e.Caller.TrimmedPath()
+	}
+	if e.Stack != "" {
+		rec["stacktrace"] = e.Stack
+	}
+	return rec
+}
+
+// Sink delivers batches of entries to a remote system. Sends are retried
+// with backoff unless the error is wrapped with PermanentError.
+type Sink interface {
+	// Name identifies the sink in diagnostics, e.g. "loki".
+	Name() string
+
+	// Send delivers a batch of entries in logging order.
+	Send(ctx context.Context, batch []SinkEntry) error
+
+	// Close releases the sink's connections.
+	Close() error
+}
+
+// sinkConfigurer is implemented by sinks that take defaults from the logger
+// configuration, such as the service name or timezone.
+type sinkConfigurer interface {
+	configure(cfg Config)
+}
+
+// sinkTimeouter is implemented by sinks whose Send waits longer than the
+// default Timeout, such as Splunk with indexer acknowledgement.
+type sinkTimeouter interface {
+	// sendTimeout returns the shortest Timeout Send can work with.
+	sendTimeout() time.Duration
+}
+
+// permanentError marks an error that retrying cannot fix.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// PermanentError wraps err so the batch is dropped instead of retried,
+// e.g. when the remote system rejected it as invalid.
+func PermanentError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// isPermanent reports whether err was wrapped with PermanentError.
+func isPermanent(err error) bool {
+	var pe *permanentError
+	return errors.As(err, &pe)
+}
+
+// SinkOutput sends the entries within a level range to a Sink through a
+// bounded queue, in batches, with retries. Logging never blocks on the
+// network: entries are dropped and counted when the queue is full.
+type SinkOutput struct {
+	// Sink delivers the batches. Required.
+	Sink Sink
+
+	// MinLevel is the lowest level sent. Entries must also pass Config.Level.
+	// Default: "debug"
+	MinLevel string
+
+	// Components limits the sink to entries whose "component" field or
+	// logger name is listed, as in FileOutput.
+	// Default: all
+	Components []string
+
+	// QueueSize is the maximum number of entries waiting to be sent.
+	// Default: 10000
+	QueueSize int
+
+	// BatchSize is the maximum number of entries per Send.
+	// Default: 500
+	BatchSize int
+
+	// FlushInterval is how long entries wait for a batch to fill up.
+	// Default: 1s
+	FlushInterval time.Duration
+
+	// MaxRetries is the number of retries of a failed batch before it is
+	// dropped. Negative disables retries.
+	// Default: 5
+	MaxRetries int
+
+	// RetryBackoff is the wait before the first retry; it doubles, with
+	// jitter, up to MaxRetryBackoff.
+	// Default: 500ms
+	RetryBackoff time.Duration
+
+	// MaxRetryBackoff caps the wait between retries.
+	// Default: 30s
+	MaxRetryBackoff time.Duration
+
+	// Timeout bounds each Send. Sinks that wait within Send, such as Splunk
+	// with UseAck, reject a shorter Timeout than they need.
+	// Default: 10s, or what the sink needs when more
+	Timeout time.Duration
+
+	// DrainTimeout bounds how long Sync and Close wait for queued entries.
+	// Default: 5s
+	DrainTimeout time.Duration
+
+	// Spool makes delivery durable: batches are written to it and replayed
+	// in order, across restarts, until the sink accepts them. MaxRetries
+	// does not apply to spooled batches; they are retried with backoff
+	// until delivered or dropped by the spool limits. A Spool serves one
+	// SinkOutput; sharing it is rejected.
+	// Default: nil (in-memory queue only)
+	Spool *Spool
+}
+
+// validate applies defaults to unset fields.
+func (o *SinkOutput) validate() error {
+	if o.Sink == nil {
+		return errors.New("tlog: sink output requires a Sink")
+	}
+	if o.MinLevel == "" {
+		o.MinLevel = "debug"
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = 10000
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 500
+	}
+	if o.FlushInterval <= 0 {
+		o.FlushInterval = time.Second
+	}
+	if o.MaxRetries == 0 {
+		o.MaxRetries = 5
+	}
+	if o.RetryBackoff <= 0 {
+		o.RetryBackoff = 500 * time.Millisecond
+	}
+	if o.MaxRetryBackoff <= 0 {
+		o.MaxRetryBackoff = 30 * time.Second
+	}
+	var minTimeout time.Duration
+	if st, ok := o.Sink.(sinkTimeouter); ok {
+		minTimeout = st.sendTimeout()
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = max(10*time.Second, minTimeout)
+	}
+	if o.Timeout < minTimeout {
+		return fmt.Errorf("tlog: sink %s needs a Timeout of at least %s, got %s", o.Sink.Name(), minTimeout, o.Timeout)
+	}
+	if o.DrainTimeout <= 0 {
+		o.DrainTimeout = 5 * time.Second
+	}
+	if _, err := zapcore.ParseLevel(o.MinLevel); err != nil {
+		return fmt.Errorf("tlog: invalid min level %q for sink %s: %w", o.MinLevel, o.Sink.Name(), err)
+	}
+	if o.Spool != nil && o.Spool.attached.Load() {
+		return fmt.Errorf("tlog: spool in %s is already used by another logger", o.Spool.cfg.Dir)
+	}
+	return nil
+}
+
+// sinkReportInterval is how often a sink batcher logs dropped entry counts.
+const sinkReportInterval = time.Minute
+
+// sinkBatcher queues entries for a Sink and sends them in batches from a
+// background goroutine.
+type sinkBatcher struct {
+	cfg  SinkOutput
+	sink Sink
+
+	// logger receives diagnostics; it writes to local outputs only, so a
+	// failing sink does not feed its own failures back into the queue.
+	logger *zap.Logger
+
+	ch      chan SinkEntry
+	pending atomic.Int64
+	dropped atomic.Uint64
+	failed  atomic.Uint64
+
+	reportMu sync.Mutex
+	reported uint64
+
+	// ctx is the parent of every Send; close cancels it once DrainTimeout
+	// has passed.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	closeOnce sync.Once
+	done      chan struct{}
+	stopped   chan struct{}
+	replayed  chan struct{}
+}
+
+// newSinkBatcher starts the background sender. cfg must be validated.
+func newSinkBatcher(cfg SinkOutput, logger *zap.Logger) *sinkBatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &sinkBatcher{
+		ctx:      ctx,
+		cancel:   cancel,
+		cfg:      cfg,
+		sink:     cfg.Sink,
+		logger:   logger.With(zap.String("sink", cfg.Sink.Name())),
+		ch:       make(chan SinkEntry, cfg.QueueSize),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		replayed: make(chan struct{}),
+	}
+	go b.run()
+	go b.reportDrops()
+	if cfg.Spool != nil {
+		cfg.Spool.attached.Store(true)
+		go b.replay()
+	} else {
+		close(b.replayed)
+	}
+	return b
+}
+
+// enqueue queues an entry, dropping it when the queue is full.
+func (b *sinkBatcher) enqueue(e SinkEntry) {
+	if b.closing() {
+		b.dropped.Add(1)
+		return
+	}
+
+	b.pending.Add(1)
+	select {
+	case b.ch <- e:
+	default:
+		b.pending.Add(-1)
+		b.dropped.Add(1)
+	}
+}
+
+// run sends full batches immediately and partial ones every FlushInterval,
+// until the batcher is closed, then sends whatever is left.
+func (b *sinkBatcher) run() {
+	defer close(b.stopped)
+
+	ticker := time.NewTicker(b.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]SinkEntry, 0, b.cfg.BatchSize)
+	for {
+		select {
+		case e := <-b.ch:
+			batch = append(batch, e)
+			if len(batch) >= b.cfg.BatchSize {
+				b.deliver(batch)
+				batch = make([]SinkEntry, 0, b.cfg.BatchSize)
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				b.deliver(batch)
+				batch = make([]SinkEntry, 0, b.cfg.BatchSize)
+			}
+		case <-b.done:
+			for {
+				select {
+				case e := <-b.ch:
+					batch = append(batch, e)
+					if len(batch) >= b.cfg.BatchSize {
+						b.deliver(batch)
+						batch = make([]SinkEntry, 0, b.cfg.BatchSize)
+					}
+				default:
+					if len(batch) > 0 {
+						b.deliver(batch)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver writes a batch to the spool, or sends it when there is no spool
+// or the spool cannot be written.
+func (b *sinkBatcher) deliver(batch []SinkEntry) {
+	if b.cfg.Spool != nil {
+		err := b.cfg.Spool.append(batch)
+		if err == nil {
+			b.pending.Add(-int64(len(batch)))
+			return
+		}
+		b.logger.Warn("Remote sink spool write failed", zap.Int("entries", len(batch)), zap.Error(err))
+	}
+	b.send(batch)
+}
+
+// replay sends spooled batches in order, retrying each with backoff until
+// the sink accepts it. Once the batcher is closed, it keeps sending while
+// the sink accepts batches and leaves the rest for the next run.
+func (b *sinkBatcher) replay() {
+	defer close(b.replayed)
+
+	spool := b.cfg.Spool
+	backoff := b.cfg.RetryBackoff
+	failing := false
+	runDone := false
+	for {
+		batch, ok := spool.next()
+		if !ok {
+			if b.closing() {
+				if runDone {
+					return
+				}
+				// Wait for run to spool the last entries
+				<-b.stopped
+				runDone = true
+				continue
+			}
+			select {
+			case <-spool.notify:
+			case <-b.done:
+			}
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(b.ctx, b.cfg.Timeout)
+		err := b.sink.Send(ctx, batch)
+		cancel()
+		if err == nil || isPermanent(err) {
+			if err != nil {
+				b.failed.Add(uint64(len(batch)))
+				b.logger.Warn("Remote sink delivery failed", zap.Int("entries", len(batch)), zap.Error(err))
+			} else if failing {
+				entries, size := spool.Depth()
+				b.logger.Info("Remote sink delivery resumed", zap.Int("spooled_entries", entries), zap.Int64("spooled_bytes", size))
+				failing = false
+			}
+			if err := spool.commit(); err != nil {
+				b.logger.Warn("Remote sink spool cursor not saved", zap.Error(err))
+			}
+			backoff = b.cfg.RetryBackoff
+			continue
+		}
+
+		if b.closing() {
+			return
+		}
+		if !failing {
+			b.logger.Warn("Remote sink delivery failed, entries kept in spool", zap.Error(err))
+			failing = true
+		}
+		wait := jitter(backoff)
+		select {
+		case <-time.After(wait):
+		case <-b.done:
+		}
+		if backoff *= 2; backoff > b.cfg.MaxRetryBackoff {
+			backoff = b.cfg.MaxRetryBackoff
+		}
+	}
+}
+
+// send delivers a batch, retrying with backoff. Once the batcher is closed,
+// a failed batch is retried at most once more.
+func (b *sinkBatcher) send(batch []SinkEntry) {
+	defer b.pending.Add(-int64(len(batch)))
+
+	backoff := b.cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(b.ctx, b.cfg.Timeout)
+		err := b.sink.Send(ctx, batch)
+		cancel()
+		if err == nil {
+			return
+		}
+
+		if isPermanent(err) || attempt >= b.cfg.MaxRetries || b.closing() {
+			b.failed.Add(uint64(len(batch)))
+			b.logger.Warn("Remote sink delivery failed",
+				zap.Int("entries", len(batch)),
+				zap.Int("attempts", attempt+1),
+				zap.Error(err),
+			)
+			return
+		}
+
+		// Closing cuts the wait short for one last attempt
+		wait := jitter(backoff)
+		select {
+		case <-time.After(wait):
+		case <-b.done:
+		}
+		if backoff *= 2; backoff > b.cfg.MaxRetryBackoff {
+			backoff = b.cfg.MaxRetryBackoff
+		}
+	}
+}
+
+// jitter returns a random wait between half of backoff and backoff.
+func jitter(backoff time.Duration) time.Duration {
+	return backoff/2 + rand.N(backoff/2+1)
+}
+
+// closing reports whether close has been called.
+func (b *sinkBatcher) closing() bool {
+	select {
+	case <-b.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// flush waits until every queued entry has been sent or DrainTimeout passes.
+func (b *sinkBatcher) flush() error {
+	deadline := time.Now().Add(b.cfg.DrainTimeout)
+	for b.pending.Load() > 0 {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("tlog: sink %s not drained within %s (%d entries pending)", b.sink.Name(), b.cfg.DrainTimeout, b.pending.Load())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return nil
+}
+
+// reportDrops periodically logs the number of entries dropped because the
+// queue was full, until the batcher is closed.
+func (b *sinkBatcher) reportDrops() {
+	ticker := time.NewTicker(sinkReportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.logDrops()
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// logDrops logs the entries dropped since the previous report, if any.
+func (b *sinkBatcher) logDrops() {
+	b.reportMu.Lock()
+	defer b.reportMu.Unlock()
+
+	total := b.dropped.Load()
+	if total == b.reported {
+		return
+	}
+	b.logger.Warn("Remote sink entries dropped",
+		zap.Uint64("dropped", total-b.reported),
+		zap.Uint64("dropped_total", total),
+		zap.Int("queue_size", b.cfg.QueueSize),
+	)
+	b.reported = total
+}
+
+// close sends the queued entries within DrainTimeout and closes the sink.
+// With a spool, batches not delivered in time stay spooled. Sends still
+// running after DrainTimeout are cancelled, and the spool and the sink are
+// closed only once they have returned.
+func (b *sinkBatcher) close() error {
+	var err error
+	b.closeOnce.Do(func() {
+		close(b.done)
+
+		timeout := time.After(b.cfg.DrainTimeout)
+		select {
+		case <-b.stopped:
+		case <-timeout:
+			err = fmt.Errorf("tlog: sink %s not drained within %s (%d entries pending)", b.sink.Name(), b.cfg.DrainTimeout, b.pending.Load())
+		}
+		if err == nil {
+			select {
+			case <-b.replayed:
+			case <-timeout:
+			}
+		}
+		b.cancel()
+		<-b.stopped
+		<-b.replayed
+
+		b.logDrops()
+		if b.cfg.Spool != nil {
+			err = errors.Join(err, b.cfg.Spool.Close())
+		}
+		err = errors.Join(err, b.sink.Close())
+	})
+	return err
+}
+
+// sinkCore is a zapcore.Core that encodes entries into SinkEntry values and
+// queues them on a sinkBatcher.
+type sinkCore struct {
+	zapcore.LevelEnabler
+	batcher *sinkBatcher
+
+	// context holds the fields added with With, already encoded.
+	context map[string]interface{}
+}
+
+// newSinkCore creates a core sending to batcher.
+func newSinkCore(batcher *sinkBatcher, enab zapcore.LevelEnabler) zapcore.Core {
+	return &sinkCore{LevelEnabler: enab, batcher: batcher}
+}
+
+// With adds structured context to the core.
+func (c *sinkCore) With(fields []zapcore.Field) zapcore.Core {
+	enc := zapcore.NewMapObjectEncoder()
+	for k, v := range c.context {
+		enc.Fields[k] = v
+	}
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	return &sinkCore{LevelEnabler: c.LevelEnabler, batcher: c.batcher, context: enc.Fields}
+}
+
+// Check adds the core to the checked entry when the level is enabled.
+func (c *sinkCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+// Write encodes the entry and queues it.
+func (c *sinkCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	enc := zapcore.NewMapObjectEncoder()
+	for k, v := range c.context {
+		enc.Fields[k] = v
+	}
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	c.batcher.enqueue(SinkEntry{
+		Time:       ent.Time,
+		Level:      ent.Level,
+		LoggerName: ent.LoggerName,
+		Message:    ent.Message,
+		Caller:     ent.Caller,
+		Stack:      ent.Stack,
+		Fields:     enc.Fields,
+	})
+	return nil
+}
+
+// Sync waits for queued entries to be sent.
+func (c *sinkCore) Sync() error {
+	return c.batcher.flush()
+}
+
+// httpRequest is a request of an HTTP-based sink.
+type httpRequest struct {
+	method      string // Default: POST
+	url         string
+	body        []byte
+	contentType string
+	headers     map[string]string
+	gzip        bool
+}
+
+// postHTTP posts a request and returns the response body. Responses with
+// status 429 or 5xx, and transport errors, are retryable; other non-2xx
+// responses are permanent errors.
+func postHTTP(ctx context.Context, client *http.Client, r httpRequest) ([]byte, error) {
+	body := r.body
+	if r.gzip {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(body)
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		body = buf.Bytes()
+	}
+
+	method := r.method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequestWithContext(ctx, method, r.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, PermanentError(err)
+	}
+	req.Header.Set("Content-Type", r.contentType)
+	if r.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	for k, v := range r.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return respBody, nil
+	}
+
+	err = fmt.Errorf("tlog: %s returned %s: %s", r.url, resp.Status, bytes.TrimSpace(respBody))
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return nil, err
+	}
+	return nil, PermanentError(err)
+}
+
+// defaultHTTPClient is used by HTTP-based sinks without a Client.
+var defaultHTTPClient = &http.Client{Timeout: 30 * time.Second}
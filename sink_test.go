@@ -0,0 +1,440 @@
+package tlog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// fakeSink records the batches it is sent. fail, when set, decides the
+// result of each call from its 1-based number.
+type fakeSink struct {
+	mu      sync.Mutex
+	batches [][]SinkEntry
+	calls   int
+	closed  bool
+	fail    func(call int) error
+	block   chan struct{}
+
+	// sending counts the Sends in progress; closedWhileSending records a
+	// Close during one.
+	sending            int
+	closedWhileSending bool
+}
+
+func (s *fakeSink) Name() string { return "fake" }
+
+func (s *fakeSink) Send(ctx context.Context, batch []SinkEntry) error {
+	s.mu.Lock()
+	s.sending++
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.sending--
+		s.mu.Unlock()
+	}()
+
+	if s.block != nil {
+		select {
+		case <-s.block:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if s.fail != nil {
+		if err := s.fail(s.calls); err != nil {
+			return err
+		}
+	}
+	s.batches = append(s.batches, append([]SinkEntry(nil), batch...))
+	return nil
+}
+
+func (s *fakeSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.closedWhileSending = s.closedWhileSending || s.sending > 0
+	return nil
+}
+
+// sizes returns the number of entries in each delivered batch.
+func (s *fakeSink) sizes() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var sizes []int
+	for _, b := range s.batches {
+		sizes = append(sizes, len(b))
+	}
+	return sizes
+}
+
+// newTestBatcher starts a batcher for sink with validated cfg, recording
+// its diagnostics.
+func newTestBatcher(t *testing.T, sink Sink, cfg SinkOutput) (*sinkBatcher, *observer.ObservedLogs) {
+	t.Helper()
+	cfg.Sink = sink
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	core, logs := observer.New(zapcore.DebugLevel)
+	b := newSinkBatcher(cfg, zap.New(core))
+	t.Cleanup(func() { b.close() })
+	return b, logs
+}
+
+func testSinkEntry(msg string) SinkEntry {
+	return SinkEntry{Time: time.Now(), Level: zapcore.InfoLevel, Message: msg, Fields: map[string]interface{}{}}
+}
+
+func TestSinkBatcherBatches(t *testing.T) {
+	sink := &fakeSink{}
+	b, _ := newTestBatcher(t, sink, SinkOutput{BatchSize: 3, FlushInterval: 20 * time.Millisecond})
+
+	for i := 0; i < 7; i++ {
+		b.enqueue(testSinkEntry("entry"))
+	}
+	if err := b.flush(); err != nil {
+		t.Fatal(err)
+	}
+	got := sink.sizes()
+	total := 0
+	for _, n := range got {
+		if n > 3 {
+			t.Errorf("batch of %d entries exceeds BatchSize 3", n)
+		}
+		total += n
+	}
+	if total != 7 {
+		t.Errorf("delivered %d entries in batches %v, want 7", total, got)
+	}
+}
+
+func TestSinkBatcherRetries(t *testing.T) {
+	transient := errors.New("connection refused")
+	tests := []struct {
+		name       string
+		maxRetries int
+		fail       func(call int) error
+		wantCalls  int
+		wantFailed uint64
+	}{
+		{"success", 3, nil, 1, 0},
+		{"transient then success", 3, func(call int) error {
+			if call < 3 {
+				return transient
+			}
+			return nil
+		}, 3, 0},
+		{"retries exhausted", 2, func(int) error { return transient }, 3, 1},
+		{"retries disabled", -1, func(int) error { return transient }, 1, 1},
+		{"permanent", 3, func(int) error { return PermanentError(errors.New("bad request")) }, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &fakeSink{fail: tt.fail}
+			b, logs := newTestBatcher(t, sink, SinkOutput{
+				BatchSize:    1,
+				MaxRetries:   tt.maxRetries,
+				RetryBackoff: time.Millisecond,
+			})
+			b.enqueue(testSinkEntry("entry"))
+			if err := b.flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			sink.mu.Lock()
+			calls := sink.calls
+			sink.mu.Unlock()
+			if calls != tt.wantCalls {
+				t.Errorf("Send called %d times, want %d", calls, tt.wantCalls)
+			}
+			if got := b.failed.Load(); got != tt.wantFailed {
+				t.Errorf("failed = %d, want %d", got, tt.wantFailed)
+			}
+			if n := logs.FilterMessage("Remote sink delivery failed").Len(); uint64(n) != tt.wantFailed {
+				t.Errorf("logged %d delivery failures, want %d", n, tt.wantFailed)
+			}
+		})
+	}
+}
+
+func TestSinkBatcherQueueFull(t *testing.T) {
+	sink := &fakeSink{block: make(chan struct{})}
+	b, logs := newTestBatcher(t, sink, SinkOutput{QueueSize: 2, BatchSize: 1})
+
+	for i := 0; i < 20; i++ {
+		b.enqueue(testSinkEntry("entry"))
+	}
+	if b.dropped.Load() == 0 {
+		t.Fatal("no entries dropped with a stalled sink and a full queue")
+	}
+	b.logDrops()
+	if logs.FilterMessage("Remote sink entries dropped").Len() != 1 {
+		t.Errorf("drop report not logged: %v", logs.All())
+	}
+	close(sink.block)
+}
+
+func TestSinkBatcherCloseDrains(t *testing.T) {
+	sink := &fakeSink{}
+	b, _ := newTestBatcher(t, sink, SinkOutput{FlushInterval: time.Hour})
+
+	for i := 0; i < 5; i++ {
+		b.enqueue(testSinkEntry("entry"))
+	}
+	if err := b.close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := sink.sizes(); len(got) != 1 || got[0] != 5 {
+		t.Errorf("batches on close = %v, want [5]", got)
+	}
+	if !sink.closed {
+		t.Error("sink not closed")
+	}
+
+	b.enqueue(testSinkEntry("late"))
+	if b.dropped.Load() != 1 {
+		t.Errorf("entry after close not counted as dropped")
+	}
+}
+
+func TestSinkOutputValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  SinkOutput
+		wantErr bool
+	}{
+		{"defaults", SinkOutput{Sink: &fakeSink{}}, false},
+		{"no sink", SinkOutput{}, true},
+		{"bad level", SinkOutput{Sink: &fakeSink{}, MinLevel: "loud"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.output.validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validate() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if err == nil && (tt.output.QueueSize != 10000 || tt.output.BatchSize != 500 || tt.output.Timeout != 10*time.Second) {
+				t.Errorf("defaults not applied: %+v", tt.output)
+			}
+		})
+	}
+}
+
+func TestSinkThroughLogger(t *testing.T) {
+	sink := &fakeSink{}
+	cfg := DefaultConfig().WithConsole(false).WithFile(filepath.Join(t.TempDir(), "app.log")).WithSink(SinkOutput{Sink: sink, MinLevel: "warn"})
+
+	logger, closeLogger, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.With(zap.String("request_id", "r-1")).Warn("disk almost full", zap.Int("percent", 93))
+	logger.Info("below min level")
+	if err := closeLogger(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sink.batches) != 1 || len(sink.batches[0]) != 1 {
+		t.Fatalf("batches = %v, want one entry", sink.sizes())
+	}
+	e := sink.batches[0][0]
+	if e.Message != "disk almost full" || e.Level != zapcore.WarnLevel {
+		t.Errorf("entry = %q at %v", e.Message, e.Level)
+	}
+	if e.Fields["request_id"] != "r-1" || e.Fields["percent"] != int64(93) {
+		t.Errorf("fields = %v", e.Fields)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for _, backoff := range []time.Duration{0, time.Nanosecond, time.Millisecond, 30 * time.Second} {
+		for i := 0; i < 100; i++ {
+			if d := jitter(backoff); d < backoff/2 || d > backoff {
+				t.Fatalf("jitter(%s) = %s, want within [%s, %s]", backoff, d, backoff/2, backoff)
+			}
+		}
+	}
+}
+
+func TestPostHTTP(t *testing.T) {
+	tests := []struct {
+		status        int
+		wantErr       bool
+		wantPermanent bool
+	}{
+		{http.StatusOK, false, false},
+		{http.StatusNoContent, false, false},
+		{http.StatusBadRequest, true, true},
+		{http.StatusUnauthorized, true, true},
+		{http.StatusTooManyRequests, true, false},
+		{http.StatusInternalServerError, true, false},
+		{http.StatusServiceUnavailable, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Content-Type") != "application/json" || r.Header.Get("X-Test") != "1" {
+					t.Errorf("headers = %v", r.Header)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte("reply"))
+			}))
+			defer srv.Close()
+
+			body, err := postHTTP(context.Background(), srv.Client(), httpRequest{
+				url:         srv.URL,
+				body:        []byte("{}"),
+				contentType: "application/json",
+				headers:     map[string]string{"X-Test": "1"},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("postHTTP() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if isPermanent(err) != tt.wantPermanent {
+				t.Errorf("isPermanent = %t, want %t", isPermanent(err), tt.wantPermanent)
+			}
+			if tt.status == http.StatusOK && string(body) != "reply" {
+				t.Errorf("body = %q", body)
+			}
+		})
+	}
+}
+
+func TestPostHTTPTransportErrorRetryable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+
+	_, err := postHTTP(context.Background(), http.DefaultClient, httpRequest{url: url})
+	if err == nil || isPermanent(err) {
+		t.Errorf("postHTTP() to a closed server = %v, want a retryable error", err)
+	}
+}
+
+func TestSinkBatcherCloseCancelsSend(t *testing.T) {
+	newSpool := func(t *testing.T) *Spool {
+		sp, err := NewSpool(SpoolConfig{Dir: t.TempDir()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sp
+	}
+	tests := []struct {
+		name  string
+		spool bool
+	}{
+		{"memory", false},
+		{"spool", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The sink never answers; only cancellation ends a Send
+			sink := &fakeSink{block: make(chan struct{})}
+			cfg := SinkOutput{BatchSize: 1, Timeout: time.Hour, DrainTimeout: 20 * time.Millisecond}
+			if tt.spool {
+				cfg.Spool = newSpool(t)
+			}
+			b, _ := newTestBatcher(t, sink, cfg)
+			b.enqueue(testSinkEntry("stuck"))
+			for {
+				sink.mu.Lock()
+				sending := sink.sending
+				sink.mu.Unlock()
+				if sending > 0 {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			done := make(chan error, 1)
+			go func() { done <- b.close() }()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("close did not return")
+			}
+			if !sink.closed || sink.closedWhileSending {
+				t.Errorf("closed = %t, closed while sending = %t; want closed after the Send returned", sink.closed, sink.closedWhileSending)
+			}
+			if tt.spool {
+				if entries, _ := cfg.Spool.Depth(); entries != 1 {
+					t.Errorf("spool holds %d entries, want the undelivered one", entries)
+				}
+			}
+		})
+	}
+}
+
+func TestSinkBatcherSpoolReplay(t *testing.T) {
+	dir := t.TempDir()
+	newSpool := func() *Spool {
+		sp, err := NewSpool(SpoolConfig{Dir: dir})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sp
+	}
+
+	// The sink is down: entries stay in the spool across a restart
+	down := &fakeSink{fail: func(int) error { return errors.New("connection refused") }}
+	b, _ := newTestBatcher(t, down, SinkOutput{BatchSize: 2, RetryBackoff: time.Millisecond, DrainTimeout: 50 * time.Millisecond, Spool: newSpool()})
+	for _, msg := range []string{"a", "b", "c"} {
+		b.enqueue(testSinkEntry(msg))
+	}
+	b.flush()
+	b.close()
+
+	up := &fakeSink{}
+	b, _ = newTestBatcher(t, up, SinkOutput{BatchSize: 2, RetryBackoff: time.Millisecond, Spool: newSpool()})
+	b.enqueue(testSinkEntry("d"))
+	if err := b.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, batch := range up.batches {
+		for _, e := range batch {
+			got = append(got, e.Message)
+		}
+	}
+	if fmt.Sprint(got) != "[a b c d]" {
+		t.Errorf("replayed %v, want [a b c d] in order", got)
+	}
+}
+
+func TestSinkOutputSpoolReuse(t *testing.T) {
+	spool, err := NewSpool(SpoolConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := DefaultConfig().WithConsole(false).WithFile(filepath.Join(t.TempDir(), "app.log"))
+
+	shared := base.WithSink(SinkOutput{Sink: &fakeSink{}, Spool: spool}).WithSink(SinkOutput{Sink: &fakeSink{}, Spool: spool})
+	if _, _, err := New(shared); err == nil {
+		t.Error("New() accepted a spool shared by two sink outputs")
+	}
+
+	_, closeLogger, err := New(base.WithSink(SinkOutput{Sink: &fakeSink{}, Spool: spool}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeLogger()
+	if _, _, err := New(base.WithSink(SinkOutput{Sink: &fakeSink{}, Spool: spool})); err == nil {
+		t.Error("New() accepted a spool already used by another logger")
+	}
+}
@@ -0,0 +1,93 @@
+package tlog
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// snappyEncode compresses src in the snappy block format, as required by
+// the Loki and Prometheus remote protocols. It is a simple greedy encoder:
+// the output is valid snappy, if a little larger than the reference one.
+func snappyEncode(src []byte) []byte {
+	dst := binary.AppendUvarint(make([]byte, 0, len(src)/2+16), uint64(len(src)))
+	for len(src) > 0 {
+		block := src
+		if len(block) > snappyBlockSize {
+			block = block[:snappyBlockSize]
+		}
+		dst = snappyEncodeBlock(dst, block)
+		src = src[len(block):]
+	}
+	return dst
+}
+
+const (
+	// snappyBlockSize keeps copy offsets within 16 bits.
+	snappyBlockSize = 1 << 16
+	// snappyTableBits sizes the match hash table.
+	snappyTableBits = 14
+)
+
+// snappyEncodeBlock appends the compressed form of one block to dst.
+func snappyEncodeBlock(dst, src []byte) []byte {
+	if len(src) < 8 {
+		return snappyLiteral(dst, src)
+	}
+
+	var table [1 << snappyTableBits]int32 // position+1, 0 when empty
+	hash := func(u uint32) uint32 { return (u * 0x1e35a7bd) >> (32 - snappyTableBits) }
+
+	lit := 0
+	for i := 0; i+4 <= len(src); {
+		u := binary.LittleEndian.Uint32(src[i:])
+		h := hash(u)
+		cand := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if cand < 0 || binary.LittleEndian.Uint32(src[cand:]) != u {
+			i++
+			continue
+		}
+
+		dst = snappyLiteral(dst, src[lit:i])
+		n := 4
+		for i+n < len(src) && src[cand+n] == src[i+n] {
+			n++
+		}
+		dst = snappyCopy(dst, i-cand, n)
+		i += n
+		lit = i
+	}
+	return snappyLiteral(dst, src[lit:])
+}
+
+// snappyLiteral appends a literal element for lit.
+func snappyLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := uint32(len(lit) - 1)
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n<<2))
+	default:
+		size := (bits.Len32(n) + 7) / 8
+		dst = append(dst, byte((59+size)<<2))
+		for j := 0; j < size; j++ {
+			dst = append(dst, byte(n>>(8*j)))
+		}
+	}
+	return append(dst, lit...)
+}
+
+// snappyCopy appends copy elements with a 2-byte offset for n bytes.
+func snappyCopy(dst []byte, offset, n int) []byte {
+	for n > 0 {
+		l := n
+		if l > 64 {
+			l = 64
+		}
+		dst = append(dst, byte((l-1)<<2|2), byte(offset), byte(offset>>8))
+		n -= l
+	}
+	return dst
+}
@@ -0,0 +1,134 @@
+package tlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand/v2"
+	"strings"
+	"testing"
+)
+
+// snappyDecode decodes the snappy block format, independently of the
+// encoder, to check its output.
+func snappyDecode(src []byte) ([]byte, error) {
+	n, k := binary.Uvarint(src)
+	if k <= 0 {
+		return nil, errors.New("snappy: bad length")
+	}
+	src = src[k:]
+	dst := make([]byte, 0, n)
+	for len(src) > 0 {
+		tag := src[0]
+		switch tag & 3 {
+		case 0:
+			l := int(tag >> 2)
+			src = src[1:]
+			if l >= 60 {
+				size := l - 59
+				if len(src) < size {
+					return nil, errors.New("snappy: short literal length")
+				}
+				l = 0
+				for j := size - 1; j >= 0; j-- {
+					l = l<<8 | int(src[j])
+				}
+				src = src[size:]
+			}
+			l++
+			if len(src) < l {
+				return nil, errors.New("snappy: short literal")
+			}
+			dst = append(dst, src[:l]...)
+			src = src[l:]
+			continue
+		case 1:
+			if len(src) < 2 {
+				return nil, errors.New("snappy: short copy1")
+			}
+			l := 4 + int(tag>>2&7)
+			off := int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+			if err := snappyTestCopy(&dst, off, l); err != nil {
+				return nil, err
+			}
+		case 2:
+			if len(src) < 3 {
+				return nil, errors.New("snappy: short copy2")
+			}
+			l := 1 + int(tag>>2)
+			off := int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+			if err := snappyTestCopy(&dst, off, l); err != nil {
+				return nil, err
+			}
+		case 3:
+			if len(src) < 5 {
+				return nil, errors.New("snappy: short copy4")
+			}
+			l := 1 + int(tag>>2)
+			off := int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+			if err := snappyTestCopy(&dst, off, l); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if uint64(len(dst)) != n {
+		return nil, errors.New("snappy: length mismatch")
+	}
+	return dst, nil
+}
+
+// snappyTestCopy appends l bytes starting off bytes back; they may overlap.
+func snappyTestCopy(dst *[]byte, off, l int) error {
+	if off <= 0 || off > len(*dst) {
+		return errors.New("snappy: bad offset")
+	}
+	for i := 0; i < l; i++ {
+		*dst = append(*dst, (*dst)[len(*dst)-off])
+	}
+	return nil
+}
+
+func TestSnappyRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	random := make([]byte, 200000)
+	for i := range random {
+		random[i] = byte(r.IntN(256))
+	}
+	line := `{"level":"info","message":"User created","service":"api","user_id":42}` + "\n"
+
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"empty", nil},
+		{"short", []byte("abc")},
+		{"no matches", []byte("abcdefghijklmnopqrstuvwxyz")},
+		{"run", bytes.Repeat([]byte("a"), 1000)},
+		{"repeated lines", []byte(strings.Repeat(line, 5000))},
+		{"random", random},
+		{"long literal", random[:70000]},
+		{"mixed blocks", append(append([]byte(strings.Repeat(line, 1000)), random[:100000]...), strings.Repeat(line, 1000)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded := snappyEncode(tt.input)
+			decoded, err := snappyDecode(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decoded, tt.input) {
+				t.Fatalf("round trip differs: %d bytes in, %d out", len(tt.input), len(decoded))
+			}
+		})
+	}
+}
+
+func TestSnappyCompresses(t *testing.T) {
+	src := []byte(strings.Repeat(`{"level":"info","message":"request served"}`+"\n", 1000))
+	if n := len(snappyEncode(src)); n > len(src)/10 {
+		t.Errorf("encoded %d bytes to %d", len(src), n)
+	}
+}
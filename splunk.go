@@ -0,0 +1,411 @@
+package tlog
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SplunkConfig configures a sink for the Splunk HTTP Event Collector.
+type SplunkConfig struct {
+	// URL is the HEC address. Required.
+	// Example: "https://splunk.internal:8088"
+	URL string
+
+	// Token is the HEC token, sent as "Authorization: Splunk <Token>".
+	// Required.
+	Token string
+
+	// Index is the target index.
+	// Default: the default index of the token
+	Index string
+
+	// Source is the source of events.
+	// Default: Config.AppName
+	Source string
+
+	// SourceType is the sourcetype of events.
+	// Default: "_json"
+	SourceType string
+
+	// Host is the host of events.
+	// Default: the hostname
+	Host string
+
+	// IndexedFields are fields also sent as HEC indexed fields, for fast
+	// tstats searches. "level" is the entry level.
+	// Example: []string{"level", "service"}
+	IndexedFields []string
+
+	// UseAck enables indexer acknowledgement: a batch only succeeds once
+	// every request is reported as indexed, and is retried otherwise. The
+	// token must have acknowledgement enabled. Polling runs within Send, so
+	// SinkOutput.Timeout must exceed AckTimeout; it defaults to AckTimeout
+	// plus 10s.
+	// Default: false
+	UseAck bool
+
+	// AckPollInterval is the wait between acknowledgement polls.
+	// Default: 1s
+	AckPollInterval time.Duration
+
+	// AckTimeout is how long to poll before retrying the batch. It is
+	// checked against SinkOutput.Timeout, which bounds the whole Send.
+	// Default: 60s
+	AckTimeout time.Duration
+
+	// MaxBatchBytes splits a batch into several requests above this size;
+	// keep it below the max_content_length of the HEC input.
+	// Default: 1 MiB
+	MaxBatchBytes int
+
+	// Gzip compresses request bodies.
+	// Default: false
+	Gzip bool
+
+	// Headers are added to every request.
+	Headers map[string]string
+
+	// Client sends the requests. Use a client trusting the Splunk
+	// certificate when it is self-signed.
+	// Default: a client with a 30s timeout
+	Client *http.Client
+}
+
+// SplunkSink sends entries to the HTTP Event Collector. Create it with
+// NewSplunkSink.
+type SplunkSink struct {
+	cfg     SplunkConfig
+	headers map[string]string
+	source  string
+
+	mu sync.Mutex
+	// retryKey identifies the batch of the last failed Send, and delivered
+	// holds the positions of its events in requests that succeeded, so the
+	// retried batch does not send them again.
+	retryKey  [sha256.Size]byte
+	delivered map[int]bool
+}
+
+// NewSplunkSink creates a Splunk HEC sink, applying defaults to unset
+// fields.
+func NewSplunkSink(cfg SplunkConfig) (*SplunkSink, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("tlog: splunk URL is required")
+	}
+	if cfg.Token == "" {
+		return nil, errors.New("tlog: splunk HEC token is required")
+	}
+	cfg.URL = strings.TrimRight(cfg.URL, "/")
+	if cfg.SourceType == "" {
+		cfg.SourceType = "_json"
+	}
+	if cfg.Host == "" {
+		cfg.Host, _ = os.Hostname()
+	}
+	if cfg.AckPollInterval <= 0 {
+		cfg.AckPollInterval = time.Second
+	}
+	if cfg.AckTimeout <= 0 {
+		cfg.AckTimeout = time.Minute
+	}
+	if cfg.MaxBatchBytes <= 0 {
+		cfg.MaxBatchBytes = 1 << 20
+	}
+	if cfg.Client == nil {
+		cfg.Client = defaultHTTPClient
+	}
+
+	headers := make(map[string]string, len(cfg.Headers)+2)
+	for k, v := range cfg.Headers {
+		headers[k] = v
+	}
+	headers["Authorization"] = "Splunk " + cfg.Token
+	if cfg.UseAck {
+		headers["X-Splunk-Request-Channel"] = uuid.NewString()
+	}
+
+	s := &SplunkSink{cfg: cfg, headers: headers}
+	s.configure(Config{})
+	return s, nil
+}
+
+// Name returns "splunk".
+func (s *SplunkSink) Name() string { return "splunk" }
+
+// Close does nothing; requests are independent.
+func (s *SplunkSink) Close() error { return nil }
+
+// splunkAckMargin is the time left to post a batch when SinkOutput.Timeout
+// is derived from AckTimeout.
+const splunkAckMargin = 10 * time.Second
+
+// sendTimeout returns the shortest SinkOutput.Timeout that lets Send wait
+// AckTimeout for acknowledgements.
+func (s *SplunkSink) sendTimeout() time.Duration {
+	if !s.cfg.UseAck {
+		return 0
+	}
+	return s.cfg.AckTimeout + splunkAckMargin
+}
+
+// configure takes the default source from the logger configuration.
+func (s *SplunkSink) configure(cfg Config) {
+	s.source = s.cfg.Source
+	if s.source == "" {
+		s.source = cfg.AppName
+	}
+}
+
+// hecEvent is an event of the /services/collector/event endpoint.
+type hecEvent struct {
+	Time       json.RawMessage        `json:"time"`
+	Host       string                 `json:"host,omitempty"`
+	Source     string                 `json:"source,omitempty"`
+	SourceType string                 `json:"sourcetype,omitempty"`
+	Index      string                 `json:"index,omitempty"`
+	Event      map[string]interface{} `json:"event"`
+	Fields     map[string]string      `json:"fields,omitempty"`
+}
+
+// hecResponse is the response of the event and ack endpoints.
+type hecResponse struct {
+	Text  string          `json:"text"`
+	Code  int             `json:"code"`
+	AckID *int64          `json:"ackId"`
+	Acks  map[string]bool `json:"acks"`
+}
+
+// splunkEvent is an encoded event with its position in the batch.
+type splunkEvent struct {
+	pos  int
+	data []byte
+}
+
+// Send posts a batch, split by MaxBatchBytes, and with UseAck polls until
+// every request is indexed. When Send fails, the events of requests that
+// succeeded are skipped if the same batch is sent again.
+func (s *SplunkSink) Send(ctx context.Context, batch []SinkEntry) error {
+	events := make([]splunkEvent, 0, len(batch))
+	h := sha256.New()
+	for i, e := range batch {
+		data, err := json.Marshal(s.event(e))
+		if err != nil {
+			continue
+		}
+		h.Write(data)
+		h.Write([]byte{'\n'})
+		events = append(events, splunkEvent{pos: i, data: data})
+	}
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+
+	delivered := s.retried(key)
+	remaining := events[:0]
+	for _, e := range events {
+		if !delivered[e.pos] {
+			remaining = append(remaining, e)
+		}
+	}
+	err := s.send(ctx, remaining, delivered)
+	s.remember(key, delivered, err)
+	return err
+}
+
+// send posts events and records the positions of those delivered.
+func (s *SplunkSink) send(ctx context.Context, events []splunkEvent, delivered map[int]bool) error {
+	type pending struct {
+		ackID  int64
+		events []splunkEvent
+	}
+	var acks []pending
+	var sendErr error
+	for len(events) > 0 {
+		var body bytes.Buffer
+		n := 0
+		for ; n < len(events); n++ {
+			if n > 0 && body.Len()+len(events[n].data)+1 > s.cfg.MaxBatchBytes {
+				break
+			}
+			body.Write(events[n].data)
+			body.WriteByte('\n')
+		}
+
+		ackID, err := s.post(ctx, body.Bytes())
+		if err != nil {
+			sendErr = err
+			break
+		}
+		if s.cfg.UseAck && ackID != nil {
+			acks = append(acks, pending{ackID: *ackID, events: events[:n]})
+		} else {
+			markDelivered(delivered, events[:n])
+		}
+		events = events[n:]
+	}
+	if len(acks) == 0 {
+		return sendErr
+	}
+
+	// Acknowledgements are collected even when a request failed, so events
+	// of requests indexed before the failure are not sent again.
+	ids := make([]int64, len(acks))
+	for i, p := range acks {
+		ids[i] = p.ackID
+	}
+	acked, err := s.waitAcks(ctx, ids)
+	for _, p := range acks {
+		if acked[p.ackID] {
+			markDelivered(delivered, p.events)
+		}
+	}
+	if sendErr != nil {
+		return sendErr
+	}
+	if err != nil {
+		return err
+	}
+	if len(acked) < len(ids) {
+		return fmt.Errorf("tlog: splunk acknowledged %d of %d requests within %s", len(acked), len(ids), s.cfg.AckTimeout)
+	}
+	return nil
+}
+
+// event converts an entry to an HEC event.
+func (s *SplunkSink) event(e SinkEntry) hecEvent {
+	ev := hecEvent{
+		Time:       json.RawMessage(fmt.Sprintf("%d.%03d", e.Time.Unix(), e.Time.Nanosecond()/1e6)),
+		Host:       s.cfg.Host,
+		Source:     s.source,
+		SourceType: s.cfg.SourceType,
+		Index:      s.cfg.Index,
+		Event:      e.record(),
+	}
+	for _, f := range s.cfg.IndexedFields {
+		if ev.Fields == nil {
+			ev.Fields = make(map[string]string, len(s.cfg.IndexedFields))
+		}
+		if f == "level" {
+			ev.Fields[f] = e.Level.String()
+		} else if v, ok := e.Fields[f]; ok {
+			ev.Fields[f] = syslogString(v)
+		}
+	}
+	return ev
+}
+
+// post sends one request of newline separated events and returns its ack
+// ID, if any. HEC reports invalid events with status 400 and a code, which
+// postHTTP turns into a permanent error.
+func (s *SplunkSink) post(ctx context.Context, body []byte) (*int64, error) {
+	resp, err := postHTTP(ctx, s.cfg.Client, httpRequest{
+		url:         s.cfg.URL + "/services/collector/event",
+		body:        body,
+		contentType: "application/json",
+		headers:     s.headers,
+		gzip:        s.cfg.Gzip,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result hecResponse
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return nil, fmt.Errorf("tlog: decode splunk response: %w", err)
+	}
+	if result.Code != 0 {
+		return nil, fmt.Errorf("tlog: splunk returned code %d: %s", result.Code, result.Text)
+	}
+	return result.AckID, nil
+}
+
+// waitAcks polls the ack endpoint until every ID is acknowledged or
+// AckTimeout passes, and returns the acknowledged IDs.
+func (s *SplunkSink) waitAcks(ctx context.Context, ids []int64) (map[int64]bool, error) {
+	acked := make(map[int64]bool, len(ids))
+	deadline := time.Now().Add(s.cfg.AckTimeout)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return acked, ctx.Err()
+		case <-timer.C:
+		}
+
+		waiting := make([]int64, 0, len(ids))
+		for _, id := range ids {
+			if !acked[id] {
+				waiting = append(waiting, id)
+			}
+		}
+		body, _ := json.Marshal(map[string][]int64{"acks": waiting})
+		resp, err := postHTTP(ctx, s.cfg.Client, httpRequest{
+			url:         s.cfg.URL + "/services/collector/ack?channel=" + s.headers["X-Splunk-Request-Channel"],
+			body:        body,
+			contentType: "application/json",
+			headers:     s.headers,
+		})
+		if err != nil {
+			return acked, err
+		}
+		var result hecResponse
+		if err := json.Unmarshal(resp, &result); err != nil {
+			return acked, fmt.Errorf("tlog: decode splunk ack response: %w", err)
+		}
+		for _, id := range waiting {
+			if result.Acks[strconv.FormatInt(id, 10)] {
+				acked[id] = true
+			}
+		}
+
+		if len(acked) == len(ids) || time.Now().After(deadline) {
+			return acked, nil
+		}
+		timer.Reset(s.cfg.AckPollInterval)
+	}
+}
+
+// markDelivered records the positions of delivered events.
+func markDelivered(delivered map[int]bool, events []splunkEvent) {
+	for _, e := range events {
+		delivered[e.pos] = true
+	}
+}
+
+// retried returns the positions delivered by earlier attempts of the batch
+// identified by key, or an empty set for a new batch.
+func (s *SplunkSink) retried(key [sha256.Size]byte) map[int]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delivered := make(map[int]bool)
+	if s.delivered != nil && s.retryKey == key {
+		for pos := range s.delivered {
+			delivered[pos] = true
+		}
+	}
+	return delivered
+}
+
+// remember keeps the delivered positions of a failed batch for its retry,
+// and forgets them once a Send succeeds.
+func (s *SplunkSink) remember(key [sha256.Size]byte, delivered map[int]bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.delivered = nil
+		return
+	}
+	s.retryKey, s.delivered = key, delivered
+}
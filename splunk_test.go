@@ -0,0 +1,323 @@
+package tlog
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// hecMock is a local HTTP Event Collector. fail decides the status of an
+// event request from its 1-based number; ackAfter is the number of polls
+// before a request is acknowledged, negative for never.
+type hecMock struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests int
+	events   []map[string]interface{}
+	polls    map[int64]int
+	fail     func(request int) int
+	ackAfter int
+	channel  string
+}
+
+func newHECMock(t *testing.T) *hecMock {
+	t.Helper()
+	m := &hecMock{polls: map[int64]int{}}
+	m.Server = httptest.NewServer(http.HandlerFunc(m.handle))
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *hecMock) handle(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r.Header.Get("Authorization") != "Splunk token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"text":"Invalid token","code":4}`)
+		return
+	}
+	channel := r.Header.Get("X-Splunk-Request-Channel")
+
+	switch r.URL.Path {
+	case "/services/collector/event":
+		m.requests++
+		if m.fail != nil {
+			if status := m.fail(m.requests); status != http.StatusOK {
+				w.WriteHeader(status)
+				fmt.Fprint(w, `{"text":"Server is busy","code":9}`)
+				return
+			}
+		}
+		body, _ := io.ReadAll(r.Body)
+		sc := bufio.NewScanner(bytes.NewReader(body))
+		for sc.Scan() {
+			var ev map[string]interface{}
+			json.Unmarshal(sc.Bytes(), &ev)
+			m.events = append(m.events, ev)
+		}
+		if channel == "" {
+			fmt.Fprint(w, `{"text":"Success","code":0}`)
+			return
+		}
+		m.channel = channel
+		fmt.Fprintf(w, `{"text":"Success","code":0,"ackId":%d}`, m.requests)
+	case "/services/collector/ack":
+		if r.URL.Query().Get("channel") != channel {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var req struct {
+			Acks []int64 `json:"acks"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		acks := map[string]bool{}
+		for _, id := range req.Acks {
+			m.polls[id]++
+			acks[strconv.FormatInt(id, 10)] = m.ackAfter >= 0 && m.polls[id] > m.ackAfter
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"acks": acks})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// messages returns the messages of the events received so far.
+func (m *hecMock) messages() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var msgs []string
+	for _, ev := range m.events {
+		msgs = append(msgs, ev["event"].(map[string]interface{})["message"].(string))
+	}
+	return msgs
+}
+
+func splunkTestBatch(messages ...string) []SinkEntry {
+	batch := make([]SinkEntry, len(messages))
+	for i, m := range messages {
+		batch[i] = SinkEntry{
+			Time:    time.Unix(1700000000, 250000000),
+			Level:   zapcore.InfoLevel,
+			Message: m,
+			Fields:  map[string]interface{}{"service": "api"},
+		}
+	}
+	return batch
+}
+
+func TestSplunkSinkSend(t *testing.T) {
+	hec := newHECMock(t)
+	sink, err := NewSplunkSink(SplunkConfig{
+		URL:           hec.URL + "/",
+		Token:         "token",
+		Index:         "app",
+		Host:          "web-1",
+		IndexedFields: []string{"level", "service"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.configure(Config{AppName: "api"})
+
+	if err := sink.Send(context.Background(), splunkTestBatch("one", "one")); err != nil {
+		t.Fatal(err)
+	}
+	if got := hec.messages(); len(got) != 2 {
+		t.Fatalf("received %v, want both identical events", got)
+	}
+	ev := hec.events[0]
+	if ev["time"] != 1700000000.25 || ev["host"] != "web-1" || ev["source"] != "api" || ev["sourcetype"] != "_json" || ev["index"] != "app" {
+		t.Errorf("event metadata = %v", ev)
+	}
+	fields, _ := ev["fields"].(map[string]interface{})
+	if fields["level"] != "info" || fields["service"] != "api" {
+		t.Errorf("indexed fields = %v", ev["fields"])
+	}
+}
+
+func TestSplunkSinkRetrySkipsDelivered(t *testing.T) {
+	hec := newHECMock(t)
+	hec.fail = func(request int) int {
+		if request == 2 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	}
+	// One event per request
+	sink, err := NewSplunkSink(SplunkConfig{URL: hec.URL, Token: "token", MaxBatchBytes: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch := splunkTestBatch("a", "b", "c")
+	if err := sink.Send(context.Background(), batch); err == nil || isPermanent(err) {
+		t.Fatalf("Send() error = %v, want a retryable error", err)
+	}
+	if err := sink.Send(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(hec.messages()); got != "[a b c]" {
+		t.Errorf("after retry received %s, want [a b c]", got)
+	}
+
+	// The same events logged again later are new events
+	if err := sink.Send(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(hec.messages()); got != "[a b c a b c]" {
+		t.Errorf("received %s, want the later batch sent in full", got)
+	}
+}
+
+func TestSplunkSinkOtherBatchAfterFailure(t *testing.T) {
+	hec := newHECMock(t)
+	hec.fail = func(request int) int {
+		if request == 2 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	}
+	sink, err := NewSplunkSink(SplunkConfig{URL: hec.URL, Token: "token", MaxBatchBytes: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sink.Send(context.Background(), splunkTestBatch("a", "b")); err == nil {
+		t.Fatal("Send() error = nil")
+	}
+	// A different batch, e.g. after the failed one was dropped, skips nothing
+	if err := sink.Send(context.Background(), splunkTestBatch("a", "c")); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(hec.messages()); got != "[a a c]" {
+		t.Errorf("received %s, want [a a c]", got)
+	}
+}
+
+func TestSplunkSinkAck(t *testing.T) {
+	tests := []struct {
+		name     string
+		ackAfter int
+		wantErr  bool
+	}{
+		{"acknowledged", 2, false},
+		{"not acknowledged", -1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hec := newHECMock(t)
+			hec.ackAfter = tt.ackAfter
+			sink, err := NewSplunkSink(SplunkConfig{
+				URL:             hec.URL,
+				Token:           "token",
+				UseAck:          true,
+				AckPollInterval: 5 * time.Millisecond,
+				AckTimeout:      100 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			batch := splunkTestBatch("a")
+			err = sink.Send(context.Background(), batch)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Send() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if hec.channel == "" {
+				t.Error("no request channel sent")
+			}
+			if !tt.wantErr {
+				return
+			}
+
+			// An unacknowledged request is sent again
+			hec.ackAfter = 0
+			if err := sink.Send(context.Background(), batch); err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprint(hec.messages()); got != "[a a]" {
+				t.Errorf("received %s, want the unacknowledged event resent", got)
+			}
+		})
+	}
+}
+
+func TestSplunkSinkErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		token         string
+		status        int
+		wantPermanent bool
+	}{
+		{"bad token", "wrong", http.StatusOK, true},
+		{"busy", "token", http.StatusServiceUnavailable, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hec := newHECMock(t)
+			hec.fail = func(int) int { return tt.status }
+			sink, err := NewSplunkSink(SplunkConfig{URL: hec.URL, Token: tt.token})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = sink.Send(context.Background(), splunkTestBatch("a"))
+			if err == nil || isPermanent(err) != tt.wantPermanent {
+				t.Errorf("Send() error = %v, want permanent %t", err, tt.wantPermanent)
+			}
+		})
+	}
+}
+
+func TestSplunkSinkOutputTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     SplunkConfig
+		timeout time.Duration
+		want    time.Duration
+		wantErr bool
+	}{
+		{"no ack", SplunkConfig{}, 0, 10 * time.Second, false},
+		{"ack default", SplunkConfig{UseAck: true}, 0, 70 * time.Second, false},
+		{"ack custom", SplunkConfig{UseAck: true, AckTimeout: 5 * time.Second}, 0, 15 * time.Second, false},
+		{"ack explicit timeout", SplunkConfig{UseAck: true}, 90 * time.Second, 90 * time.Second, false},
+		{"ack timeout too short", SplunkConfig{UseAck: true}, 10 * time.Second, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.URL, tt.cfg.Token = "http://splunk:8088", "token"
+			sink, err := NewSplunkSink(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := SinkOutput{Sink: sink, Timeout: tt.timeout}
+			err = out.validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validate() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if err == nil && out.Timeout != tt.want {
+				t.Errorf("Timeout = %s, want %s", out.Timeout, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewSplunkSinkValidation(t *testing.T) {
+	if _, err := NewSplunkSink(SplunkConfig{Token: "token"}); err == nil {
+		t.Error("NewSplunkSink() without URL succeeded")
+	}
+	if _, err := NewSplunkSink(SplunkConfig{URL: "http://splunk:8088"}); err == nil {
+		t.Error("NewSplunkSink() without token succeeded")
+	}
+}
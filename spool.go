@@ -0,0 +1,693 @@
+package tlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// SpoolConfig configures a Spool.
+type SpoolConfig struct {
+	// Dir holds the segment files and the read cursor. Required; use one
+	// directory per spool.
+	Dir string
+
+	// SegmentSizeMB is the size at which a new segment file is started.
+	// Default: 16
+	SegmentSizeMB int
+
+	// MaxSizeMB caps the spool size; the oldest segments are dropped above it.
+	// Default: 1024
+	MaxSizeMB int
+
+	// MaxAge drops segments last written longer ago than this.
+	// Default: 7 days
+	MaxAge time.Duration
+
+	// SyncWrites calls fsync after every batch, so spooled entries survive a
+	// machine crash and not only a process crash.
+	// Default: false
+	SyncWrites bool
+}
+
+// validate applies defaults to unset fields.
+func (c *SpoolConfig) validate() error {
+	if c.Dir == "" {
+		return errors.New("tlog: spool directory is required")
+	}
+	if c.SegmentSizeMB <= 0 {
+		c.SegmentSizeMB = 16
+	}
+	if c.MaxSizeMB <= 0 {
+		c.MaxSizeMB = 1024
+	}
+	if c.MaxAge <= 0 {
+		c.MaxAge = 7 * 24 * time.Hour
+	}
+	if c.SegmentSizeMB > c.MaxSizeMB {
+		return fmt.Errorf("tlog: spool segment size %dMB exceeds max size %dMB", c.SegmentSizeMB, c.MaxSizeMB)
+	}
+	return nil
+}
+
+const (
+	// spoolSegmentExt is the extension of segment files, named by sequence.
+	spoolSegmentExt = ".seg"
+	// spoolCursorFile records the position of the oldest undelivered batch.
+	spoolCursorFile = "cursor"
+	// spoolHeaderSize is the size of a record header: payload length, entry
+	// count and CRC-32C of the count and payload.
+	spoolHeaderSize = 12
+)
+
+// spoolCRC is the CRC-32C table for record checksums.
+var spoolCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// spoolSegment is a segment file of the spool.
+type spoolSegment struct {
+	seq     uint64
+	size    int64
+	entries int
+	modTime time.Time
+}
+
+// Spool is a durable, segmented on-disk queue of batches for a remote
+// sink. Set it as SinkOutput.Spool: batches are written to the spool, then
+// replayed in order until the sink accepts them, including after a
+// restart. A Spool serves one SinkOutput and is closed with the logger.
+//
+// A Spool is also a StatsSource reporting its depth and dropped bytes.
+type Spool struct {
+	cfg     SpoolConfig
+	maxSize int64
+	segSize int64
+
+	mu       sync.Mutex
+	segments []spoolSegment
+	w        *os.File // active segment, the last of segments when set
+	r        *os.File // segment being read
+	rSeq     uint64
+	rOff     int64
+	rEntries int // entries of the read segment before rOff
+	nextSeq  uint64
+	closed   bool
+
+	// peek is the oldest batch, returned by next until commit.
+	peek     []SinkEntry
+	peekSize int64
+
+	notify       chan struct{}
+	droppedBytes atomic.Uint64
+	reported     uint64
+
+	// attached is set once a sink output uses the spool.
+	attached atomic.Bool
+}
+
+// NewSpool opens the spool in cfg.Dir, creating it when needed, and picks
+// up batches left by a previous run.
+func NewSpool(cfg SpoolConfig) (*Spool, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("tlog: create spool directory: %w", err)
+	}
+
+	s := &Spool{
+		cfg:     cfg,
+		maxSize: int64(cfg.MaxSizeMB) << 20,
+		segSize: int64(cfg.SegmentSizeMB) << 20,
+		notify:  make(chan struct{}, 1),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	s.enforceLimits(time.Now())
+	return s, nil
+}
+
+// load lists the segments and restores the read cursor. Segments before the
+// cursor were delivered and are removed.
+func (s *Spool) load() error {
+	entries, err := os.ReadDir(s.cfg.Dir)
+	if err != nil {
+		return fmt.Errorf("tlog: read spool directory: %w", err)
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, spoolSegmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, spoolSegment{seq: seq, size: info.Size(), modTime: info.ModTime()})
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+
+	s.readCursor()
+	kept := s.segments[:0]
+	for _, seg := range s.segments {
+		if seg.seq < s.rSeq {
+			os.Remove(s.segmentPath(seg.seq))
+			continue
+		}
+		kept = append(kept, seg)
+	}
+	s.segments = kept
+
+	if len(s.segments) == 0 {
+		s.rSeq, s.rOff = 0, 0
+	} else if s.segments[0].seq != s.rSeq {
+		s.rSeq, s.rOff = s.segments[0].seq, 0
+	}
+	for i := range s.segments {
+		seg := &s.segments[i]
+		var before int
+		seg.entries, before = s.countEntries(seg.seq, seg.size)
+		if seg.seq == s.rSeq {
+			s.rEntries = before
+		}
+	}
+
+	// New batches always go to a new segment, so a record torn by a crash
+	// is never followed by valid ones in the same file.
+	if n := len(s.segments); n > 0 {
+		s.nextSeq = s.segments[n-1].seq + 1
+	}
+	return nil
+}
+
+// countEntries returns the number of entries in a segment, and of those
+// before the read cursor when it is the read segment, from record headers.
+func (s *Spool) countEntries(seq uint64, size int64) (total, before int) {
+	f, err := os.Open(s.segmentPath(seq))
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+
+	var hdr [spoolHeaderSize]byte
+	for off := int64(0); off+spoolHeaderSize <= size; {
+		if _, err := f.ReadAt(hdr[:], off); err != nil {
+			break
+		}
+		n := int(binary.BigEndian.Uint32(hdr[4:8]))
+		total += n
+		if seq == s.rSeq && off < s.rOff {
+			before += n
+		}
+		off += spoolHeaderSize + int64(binary.BigEndian.Uint32(hdr[0:4]))
+	}
+	return total, before
+}
+
+// readCursor restores the read position saved by commit.
+func (s *Spool) readCursor() {
+	data, err := os.ReadFile(filepath.Join(s.cfg.Dir, spoolCursorFile))
+	if err != nil {
+		return
+	}
+	var seq uint64
+	var off int64
+	if _, err := fmt.Sscanf(string(data), "%d %d", &seq, &off); err == nil && off >= 0 {
+		s.rSeq, s.rOff = seq, off
+	}
+}
+
+// writeCursor saves the read position atomically.
+func (s *Spool) writeCursor() error {
+	path := filepath.Join(s.cfg.Dir, spoolCursorFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", s.rSeq, s.rOff)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// segmentPath returns the file name of a segment.
+func (s *Spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.cfg.Dir, fmt.Sprintf("%020d%s", seq, spoolSegmentExt))
+}
+
+// append writes a batch as one record at the end of the spool.
+func (s *Spool) append(batch []SinkEntry) error {
+	payload, err := encodeSpoolBatch(batch)
+	if err != nil {
+		return err
+	}
+	rec := make([]byte, spoolHeaderSize, spoolHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(rec[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(rec[4:8], uint32(len(batch)))
+	rec = append(rec, payload...)
+	binary.BigEndian.PutUint32(rec[8:12], crc32.Update(crc32.Checksum(rec[4:8], spoolCRC), spoolCRC, payload))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("tlog: spool is closed")
+	}
+
+	now := time.Now()
+	if s.w == nil || s.segments[len(s.segments)-1].size+int64(len(rec)) > s.segSize {
+		if err := s.rotate(now); err != nil {
+			return err
+		}
+	}
+	seg := &s.segments[len(s.segments)-1]
+	if _, err := s.w.Write(rec); err != nil {
+		// Start over in a new segment rather than after a partial record
+		s.w.Close()
+		s.w = nil
+		seg.size, _ = fileSize(s.segmentPath(seg.seq))
+		return fmt.Errorf("tlog: write spool: %w", err)
+	}
+	if s.cfg.SyncWrites {
+		if err := s.w.Sync(); err != nil {
+			return fmt.Errorf("tlog: sync spool: %w", err)
+		}
+	}
+	seg.size += int64(len(rec))
+	seg.entries += len(batch)
+	seg.modTime = now
+
+	s.enforceLimits(now)
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// rotate closes the active segment and starts a new one.
+func (s *Spool) rotate(now time.Time) error {
+	if s.w != nil {
+		s.w.Close()
+		s.w = nil
+	}
+	seq := s.nextSeq
+	f, err := os.OpenFile(s.segmentPath(seq), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("tlog: create spool segment: %w", err)
+	}
+	s.w = f
+	s.nextSeq++
+	s.segments = append(s.segments, spoolSegment{seq: seq, modTime: now})
+	if len(s.segments) == 1 {
+		s.rSeq, s.rOff, s.rEntries = seq, 0, 0
+	}
+	return nil
+}
+
+// active reports whether seq is the segment being written.
+func (s *Spool) active(seq uint64) bool {
+	return s.w != nil && s.segments[len(s.segments)-1].seq == seq
+}
+
+// enforceLimits drops the oldest segments while the spool is above
+// MaxSizeMB, and segments older than MaxAge. The active segment is kept.
+func (s *Spool) enforceLimits(now time.Time) {
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+	for len(s.segments) > 0 && !s.active(s.segments[0].seq) {
+		seg := s.segments[0]
+		if total <= s.maxSize && now.Sub(seg.modTime) <= s.cfg.MaxAge {
+			break
+		}
+		total -= seg.size
+		s.dropSegment()
+	}
+}
+
+// dropSegment removes the oldest segment, counting its undelivered bytes
+// as dropped.
+func (s *Spool) dropSegment() {
+	seg := s.segments[0]
+	undelivered := seg.size
+	if seg.seq == s.rSeq {
+		undelivered -= s.rOff
+	}
+	if undelivered > 0 {
+		s.droppedBytes.Add(uint64(undelivered))
+	}
+	s.removeSegment()
+}
+
+// removeSegment deletes the oldest segment and moves the cursor to the next.
+func (s *Spool) removeSegment() {
+	seg := s.segments[0]
+	if seg.seq == s.rSeq {
+		if s.r != nil {
+			s.r.Close()
+			s.r = nil
+		}
+		s.peek = nil
+	}
+	os.Remove(s.segmentPath(seg.seq))
+	s.segments = s.segments[1:]
+	if seg.seq >= s.rSeq {
+		s.rOff, s.rEntries = 0, 0
+		if len(s.segments) > 0 {
+			s.rSeq = s.segments[0].seq
+		} else {
+			s.rSeq = s.nextSeq
+		}
+		s.writeCursor()
+	}
+}
+
+// next returns the oldest batch without removing it; ok is false when the
+// spool is empty. Corrupt records are skipped and counted as dropped.
+func (s *Spool) next() (batch []SinkEntry, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, false
+	}
+	if s.peek != nil {
+		return s.peek, true
+	}
+	s.enforceLimits(time.Now())
+
+	for len(s.segments) > 0 {
+		seg := s.segments[0]
+		if s.rSeq != seg.seq {
+			s.rSeq, s.rOff, s.rEntries = seg.seq, 0, 0
+		}
+		if s.rOff >= seg.size {
+			if s.active(seg.seq) {
+				return nil, false
+			}
+			s.removeSegment()
+			continue
+		}
+
+		batch, size, count, err := s.readRecord(seg.size)
+		if err != nil && size > 0 {
+			// The record is intact as a frame, only its content is bad
+			s.droppedBytes.Add(uint64(size))
+			s.rOff += size
+			s.rEntries += count
+			continue
+		}
+		if err != nil {
+			// Skip the rest of a segment with a torn record
+			s.droppedBytes.Add(uint64(seg.size - s.rOff))
+			if s.active(seg.seq) {
+				s.rOff = seg.size
+				return nil, false
+			}
+			s.removeSegment()
+			continue
+		}
+		s.peek, s.peekSize = batch, size
+		return batch, true
+	}
+	return nil, false
+}
+
+// readRecord reads and checks the record at the cursor, returning its
+// batch, size and entry count. The size and count are also returned for a
+// record that fails its checksum or decoding, so it can be skipped.
+func (s *Spool) readRecord(segSize int64) (batch []SinkEntry, size int64, count int, err error) {
+	if s.r == nil {
+		f, err := os.Open(s.segmentPath(s.rSeq))
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		s.r = f
+	}
+
+	var hdr [spoolHeaderSize]byte
+	if segSize-s.rOff < spoolHeaderSize {
+		return nil, 0, 0, io.ErrUnexpectedEOF
+	}
+	if _, err := s.r.ReadAt(hdr[:], s.rOff); err != nil {
+		return nil, 0, 0, err
+	}
+	n := int64(binary.BigEndian.Uint32(hdr[0:4]))
+	count = int(binary.BigEndian.Uint32(hdr[4:8]))
+	if segSize-s.rOff-spoolHeaderSize < n {
+		return nil, 0, 0, io.ErrUnexpectedEOF
+	}
+	payload := make([]byte, n)
+	if _, err := s.r.ReadAt(payload, s.rOff+spoolHeaderSize); err != nil {
+		return nil, 0, 0, err
+	}
+	if crc32.Update(crc32.Checksum(hdr[4:8], spoolCRC), spoolCRC, payload) != binary.BigEndian.Uint32(hdr[8:12]) {
+		return nil, spoolHeaderSize + n, count, errors.New("tlog: spool record checksum mismatch")
+	}
+	batch, err = decodeSpoolBatch(payload)
+	if err != nil {
+		return nil, spoolHeaderSize + n, count, err
+	}
+	return batch, spoolHeaderSize + n, count, nil
+}
+
+// commit removes the batch returned by next and saves the cursor.
+func (s *Spool) commit() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.peek == nil || s.closed {
+		return nil
+	}
+	s.rOff += s.peekSize
+	s.rEntries += len(s.peek)
+	s.peek = nil
+	return s.writeCursor()
+}
+
+// Close closes the segment files. Undelivered batches stay on disk for the
+// next run.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	var err error
+	if s.w != nil {
+		err = s.w.Close()
+		s.w = nil
+	}
+	if s.r != nil {
+		err = errors.Join(err, s.r.Close())
+		s.r = nil
+	}
+	return err
+}
+
+// Depth returns the number of undelivered entries and their size in bytes.
+func (s *Spool) Depth() (entries int, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, seg := range s.segments {
+		entries += seg.entries
+		size += seg.size
+	}
+	for _, seg := range s.segments {
+		if seg.seq == s.rSeq {
+			entries -= s.rEntries
+			size -= s.rOff
+		}
+	}
+	return entries, size
+}
+
+// DroppedBytes returns the bytes dropped by the size and age limits or as
+// corrupt since the spool was opened.
+func (s *Spool) DroppedBytes() uint64 {
+	return s.droppedBytes.Load()
+}
+
+// StatsName implements StatsSource.
+func (s *Spool) StatsName() string {
+	return "spool:" + filepath.Base(s.cfg.Dir)
+}
+
+// CollectStats implements StatsSource. It warns when bytes were dropped
+// since the previous collection.
+func (s *Spool) CollectStats() ([]zap.Field, []string) {
+	entries, size := s.Depth()
+	dropped := s.DroppedBytes()
+
+	s.mu.Lock()
+	segments := len(s.segments)
+	delta := dropped - s.reported
+	s.reported = dropped
+	s.mu.Unlock()
+
+	fields := []zap.Field{
+		zap.Int("depth_entries", entries),
+		zap.Int64("depth_bytes", size),
+		zap.Int("segments", segments),
+		zap.Uint64("dropped_bytes", dropped),
+	}
+	var warnings []string
+	if delta > 0 {
+		warnings = append(warnings, fmt.Sprintf("spool dropped %d bytes since the last report", delta))
+	}
+	return fields, warnings
+}
+
+// fileSize returns the size of a file.
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// spoolEntry is the on-disk form of a SinkEntry.
+type spoolEntry struct {
+	Time    int64                  `json:"t"`
+	Level   zapcore.Level          `json:"l"`
+	Logger  string                 `json:"n,omitempty"`
+	Message string                 `json:"m"`
+	File    string                 `json:"cf,omitempty"`
+	Line    int                    `json:"cl,omitempty"`
+	Func    string                 `json:"cn,omitempty"`
+	Stack   string                 `json:"s,omitempty"`
+	Fields  map[string]interface{} `json:"f,omitempty"`
+}
+
+// encodeSpoolBatch encodes a batch as JSON. Times and durations in fields
+// are stored as strings, and numbers are restored by decodeSpoolBatch.
+func encodeSpoolBatch(batch []SinkEntry) ([]byte, error) {
+	entries := make([]spoolEntry, len(batch))
+	for i, e := range batch {
+		se := spoolEntry{
+			Time:    e.Time.UnixNano(),
+			Level:   e.Level,
+			Logger:  e.LoggerName,
+			Message: e.Message,
+			Stack:   e.Stack,
+		}
+		if e.Caller.Defined {
+			se.File, se.Line, se.Func = e.Caller.File, e.Caller.Line, e.Caller.Function
+		}
+		if len(e.Fields) > 0 {
+			se.Fields = spoolValue(e.Fields).(map[string]interface{})
+		}
+		entries[i] = se
+	}
+	return json.Marshal(entries)
+}
+
+// spoolValue converts values JSON cannot round trip to strings.
+func spoolValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[k] = spoolValue(item)
+		}
+		return m
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = spoolValue(item)
+		}
+		return items
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case time.Duration:
+		return v.String()
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return strconv.FormatFloat(v, 'g', -1, 64)
+		}
+		return v
+	case float32:
+		return spoolValue(float64(v))
+	case complex64, complex128:
+		return fmt.Sprint(v)
+	default:
+		if _, err := json.Marshal(v); err != nil {
+			return fmt.Sprint(v)
+		}
+		return v
+	}
+}
+
+// decodeSpoolBatch decodes a batch written by encodeSpoolBatch.
+func decodeSpoolBatch(data []byte) ([]SinkEntry, error) {
+	var entries []spoolEntry
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	batch := make([]SinkEntry, len(entries))
+	for i, se := range entries {
+		e := SinkEntry{
+			Time:       time.Unix(0, se.Time),
+			Level:      se.Level,
+			LoggerName: se.Logger,
+			Message:    se.Message,
+			Stack:      se.Stack,
+		}
+		if se.File != "" {
+			e.Caller = zapcore.EntryCaller{Defined: true, File: se.File, Line: se.Line, Function: se.Func}
+		}
+		if se.Fields != nil {
+			e.Fields = restoreSpoolNumbers(se.Fields).(map[string]interface{})
+		}
+		batch[i] = e
+	}
+	return batch, nil
+}
+
+// restoreSpoolNumbers turns json.Number values into int64 or float64.
+func restoreSpoolNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = restoreSpoolNumbers(item)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = restoreSpoolNumbers(item)
+		}
+		return v
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	default:
+		return v
+	}
+}
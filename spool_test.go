@@ -0,0 +1,355 @@
+package tlog
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// newTestSpool opens a spool in dir, closing it when the test ends.
+func newTestSpool(t *testing.T, cfg SpoolConfig) *Spool {
+	t.Helper()
+	s, err := NewSpool(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// spoolTestBatch returns n entries whose messages start with name and are
+// padded to size bytes.
+func spoolTestBatch(name string, n, size int) []SinkEntry {
+	batch := make([]SinkEntry, n)
+	for i := range batch {
+		msg := name
+		if len(msg) < size {
+			msg += strings.Repeat(".", size-len(msg))
+		}
+		batch[i] = SinkEntry{Time: time.Unix(1700000000, int64(i)), Level: zapcore.InfoLevel, Message: msg}
+	}
+	return batch
+}
+
+// spoolRecordSize returns the on-disk size of a batch.
+func spoolRecordSize(t *testing.T, batch []SinkEntry) int64 {
+	t.Helper()
+	payload, err := encodeSpoolBatch(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int64(spoolHeaderSize + len(payload))
+}
+
+// appendBatches appends batches to s.
+func appendBatches(t *testing.T, s *Spool, batches ...[]SinkEntry) {
+	t.Helper()
+	for _, b := range batches {
+		if err := s.append(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// nextName returns the message prefix of the oldest batch, "" when empty,
+// and commits it when commit is set.
+func nextName(t *testing.T, s *Spool, commit bool) string {
+	t.Helper()
+	batch, ok := s.next()
+	if !ok {
+		return ""
+	}
+	if commit {
+		if err := s.commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return strings.TrimRight(batch[0].Message, ".")
+}
+
+// spoolSegmentFiles returns the segment file paths in dir, in order.
+func spoolSegmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+spoolSegmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestSpoolSegmentRotation(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestSpool(t, SpoolConfig{Dir: dir, SegmentSizeMB: 1})
+	// Two batches of about 400KB fit in a segment
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		appendBatches(t, s, spoolTestBatch(name, 1, 400<<10))
+	}
+	if files := spoolSegmentFiles(t, dir); len(files) != 3 {
+		t.Fatalf("%d segments, want 3", len(files))
+	}
+	for _, f := range spoolSegmentFiles(t, dir) {
+		if size, _ := fileSize(f); size > 1<<20 {
+			t.Errorf("%s has %d bytes, above SegmentSizeMB", f, size)
+		}
+	}
+
+	var got []string
+	for name := nextName(t, s, true); name != ""; name = nextName(t, s, true) {
+		got = append(got, name)
+	}
+	if strings.Join(got, "") != "abcde" {
+		t.Errorf("replayed %v, want a to e in order", got)
+	}
+	// Read segments are removed, the active one is kept
+	if files := spoolSegmentFiles(t, dir); len(files) != 1 {
+		t.Errorf("%d segments left, want the active one", len(files))
+	}
+}
+
+func TestSpoolCursorPersists(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestSpool(t, SpoolConfig{Dir: dir})
+	appendBatches(t, s, spoolTestBatch("a", 2, 0), spoolTestBatch("b", 2, 0), spoolTestBatch("c", 2, 0))
+	if name := nextName(t, s, true); name != "a" {
+		t.Fatalf("first batch %q", name)
+	}
+	// Read but not committed: replayed again after a restart
+	if name := nextName(t, s, false); name != "b" {
+		t.Fatalf("second batch %q", name)
+	}
+	s.Close()
+
+	s = newTestSpool(t, SpoolConfig{Dir: dir})
+	if entries, _ := s.Depth(); entries != 4 {
+		t.Errorf("Depth() = %d entries after reopen, want 4", entries)
+	}
+	appendBatches(t, s, spoolTestBatch("d", 1, 0))
+	var got []string
+	for name := nextName(t, s, true); name != ""; name = nextName(t, s, true) {
+		got = append(got, name)
+	}
+	if strings.Join(got, "") != "bcd" {
+		t.Errorf("replayed %v after reopen, want b, c, d", got)
+	}
+}
+
+func TestSpoolCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestSpool(t, SpoolConfig{Dir: dir})
+	a, b, c := spoolTestBatch("a", 1, 100), spoolTestBatch("b", 1, 100), spoolTestBatch("c", 1, 100)
+	appendBatches(t, s, a, b, c)
+	s.Close()
+
+	// Flip a payload byte of the middle record
+	path := spoolSegmentFiles(t, dir)[0]
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[spoolRecordSize(t, a)+spoolHeaderSize+20] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s = newTestSpool(t, SpoolConfig{Dir: dir})
+	got := nextName(t, s, true) + nextName(t, s, true) + nextName(t, s, true)
+	if got != "ac" {
+		t.Errorf("replayed %q, want the corrupt record skipped", got)
+	}
+	if dropped := s.DroppedBytes(); dropped != uint64(spoolRecordSize(t, b)) {
+		t.Errorf("DroppedBytes() = %d, want the %d bytes of the record", dropped, spoolRecordSize(t, b))
+	}
+}
+
+func TestSpoolTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestSpool(t, SpoolConfig{Dir: dir})
+	a, b := spoolTestBatch("a", 1, 100), spoolTestBatch("b", 1, 100)
+	appendBatches(t, s, a, b)
+	s.Close()
+
+	// A crash in the middle of the last write
+	path := spoolSegmentFiles(t, dir)[0]
+	size := spoolRecordSize(t, a) + spoolRecordSize(t, b)
+	if err := os.Truncate(path, size-30); err != nil {
+		t.Fatal(err)
+	}
+
+	s = newTestSpool(t, SpoolConfig{Dir: dir})
+	appendBatches(t, s, spoolTestBatch("c", 1, 0))
+	got := nextName(t, s, true) + nextName(t, s, true) + nextName(t, s, true)
+	if got != "ac" {
+		t.Errorf("replayed %q, want the torn record skipped and later batches kept", got)
+	}
+	if dropped := s.DroppedBytes(); dropped != uint64(spoolRecordSize(t, b)-30) {
+		t.Errorf("DroppedBytes() = %d, want the %d bytes of the torn record", dropped, spoolRecordSize(t, b)-30)
+	}
+	if entries, size := s.Depth(); entries != 0 || size != 0 {
+		t.Errorf("Depth() = %d, %d, want empty", entries, size)
+	}
+}
+
+func TestSpoolMaxSize(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestSpool(t, SpoolConfig{Dir: dir, SegmentSizeMB: 1, MaxSizeMB: 2})
+	batch := spoolTestBatch("x", 1, 400<<10)
+	for i := 0; i < 9; i++ {
+		appendBatches(t, s, batch)
+	}
+	// Segments of two batches: the oldest two are dropped to fit the last
+	// five batches in 2MB
+	if files := spoolSegmentFiles(t, dir); len(files) != 3 {
+		t.Fatalf("%d segments, want 3", len(files))
+	}
+	if entries, _ := s.Depth(); entries != 5 {
+		t.Errorf("Depth() = %d entries, want 5", entries)
+	}
+	if dropped := s.DroppedBytes(); dropped != uint64(4*spoolRecordSize(t, batch)) {
+		t.Errorf("DroppedBytes() = %d, want 4 records", dropped)
+	}
+
+	// An oversized active segment is kept
+	dir = t.TempDir()
+	s = newTestSpool(t, SpoolConfig{Dir: dir, SegmentSizeMB: 1, MaxSizeMB: 1})
+	appendBatches(t, s, spoolTestBatch("big", 1, 3<<20))
+	if entries, _ := s.Depth(); entries != 1 || s.DroppedBytes() != 0 {
+		t.Errorf("Depth() = %d entries, dropped %d, want the active segment kept", entries, s.DroppedBytes())
+	}
+}
+
+func TestSpoolMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestSpool(t, SpoolConfig{Dir: dir})
+	batch := spoolTestBatch("old", 2, 0)
+	appendBatches(t, s, batch)
+
+	// The active segment is kept, however old
+	s.mu.Lock()
+	s.enforceLimits(time.Now().Add(30 * 24 * time.Hour))
+	s.mu.Unlock()
+	if entries, _ := s.Depth(); entries != 2 {
+		t.Fatalf("Depth() = %d entries, want the active segment kept", entries)
+	}
+	s.Close()
+
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(spoolSegmentFiles(t, dir)[0], old, old); err != nil {
+		t.Fatal(err)
+	}
+	s = newTestSpool(t, SpoolConfig{Dir: dir, MaxAge: time.Hour})
+	if entries, _ := s.Depth(); entries != 0 {
+		t.Errorf("Depth() = %d entries, want the old segment dropped", entries)
+	}
+	if dropped := s.DroppedBytes(); dropped != uint64(spoolRecordSize(t, batch)) {
+		t.Errorf("DroppedBytes() = %d, want %d", dropped, spoolRecordSize(t, batch))
+	}
+	if files := spoolSegmentFiles(t, dir); len(files) != 0 {
+		t.Errorf("segments left: %v", files)
+	}
+}
+
+func TestSpoolStats(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestSpool(t, SpoolConfig{Dir: dir})
+	a, b := spoolTestBatch("a", 2, 50), spoolTestBatch("b", 3, 50)
+	appendBatches(t, s, a, b)
+
+	stats := func() (map[string]interface{}, []string) {
+		fields, warnings := s.CollectStats()
+		enc := zapcore.NewMapObjectEncoder()
+		for _, f := range fields {
+			f.AddTo(enc)
+		}
+		return enc.Fields, warnings
+	}
+	fields, warnings := stats()
+	want := map[string]interface{}{
+		"depth_entries": int64(5),
+		"depth_bytes":   spoolRecordSize(t, a) + spoolRecordSize(t, b),
+		"segments":      int64(1),
+		"dropped_bytes": uint64(0),
+	}
+	if !reflect.DeepEqual(fields, want) || len(warnings) != 0 {
+		t.Errorf("CollectStats() = %v, %v, want %v", fields, warnings, want)
+	}
+
+	nextName(t, s, true)
+	if entries, size := s.Depth(); entries != 3 || size != spoolRecordSize(t, b) {
+		t.Errorf("Depth() = %d, %d after a commit, want 3, %d", entries, size, spoolRecordSize(t, b))
+	}
+
+	// A drop warns once
+	s.droppedBytes.Add(100)
+	if _, warnings := stats(); len(warnings) != 1 || !strings.Contains(warnings[0], "100 bytes") {
+		t.Errorf("warnings = %v, want the 100 dropped bytes", warnings)
+	}
+	if fields, warnings := stats(); len(warnings) != 0 || fields["dropped_bytes"] != uint64(100) {
+		t.Errorf("second collection = %v, %v, want no new warning", fields, warnings)
+	}
+}
+
+func TestSpoolBatchRoundTrip(t *testing.T) {
+	at := time.Date(2024, 1, 15, 10, 30, 45, 123456789, time.UTC)
+	batch := []SinkEntry{{
+		Time:       time.Unix(0, 1700000000123456789),
+		Level:      zapcore.ErrorLevel,
+		LoggerName: "app.db",
+		Message:    "query failed",
+		Caller:     zapcore.EntryCaller{Defined: true, File: "/app/db.go", Line: 42, Function: "app.query"},
+		Stack:      "app.query\n\t/app/db.go:42",
+		Fields: map[string]interface{}{
+			"nan":      math.NaN(),
+			"inf":      math.Inf(1),
+			"neg_inf":  math.Inf(-1),
+			"ratio":    0.25,
+			"small":    float32(1.5),
+			"count":    int64(42),
+			"big":      uint64(1 << 62),
+			"at":       at,
+			"duration": 1500 * time.Millisecond,
+			"ok":       true,
+			"name":     "orders",
+			"nested":   map[string]interface{}{"inf": math.Inf(1), "list": []interface{}{int64(1), "two", math.NaN()}},
+			"complex":  complex(1, 2),
+		},
+	}}
+
+	data, err := encodeSpoolBatch(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeSpoolBatch(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := batch[0]
+	want.Fields = map[string]interface{}{
+		"nan":      "NaN",
+		"inf":      "+Inf",
+		"neg_inf":  "-Inf",
+		"ratio":    0.25,
+		"small":    1.5,
+		"count":    int64(42),
+		"big":      int64(1 << 62),
+		"at":       "2024-01-15T10:30:45.123456789Z",
+		"duration": "1.5s",
+		"ok":       true,
+		"name":     "orders",
+		"nested":   map[string]interface{}{"inf": "+Inf", "list": []interface{}{int64(1), "two", "NaN"}},
+		"complex":  "(1+2i)",
+	}
+	if len(got) != 1 || !got[0].Time.Equal(want.Time) {
+		t.Fatalf("decoded %v", got)
+	}
+	got[0].Time = want.Time
+	if !reflect.DeepEqual(got[0], want) {
+		t.Errorf("round trip:\ngot  %#v\nwant %#v", got[0], want)
+	}
+}
@@ -0,0 +1,459 @@
+package tlog
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+// numericPlaceholder matches Postgres-style $1 placeholders.
+var numericPlaceholder = regexp.MustCompile(`\$(\d+)`)
+
+// WrapDriver returns a database/sql driver that logs the queries, statements
+// and transactions of d through the same slow query, redaction, policy and
+// request correlation logic as GormLogger.Trace. Entries are tagged
+// component=sql. Pass the context to QueryContext/ExecContext/BeginTx for
+// request_id to be included. Plan capture configured with
+// WithSlowQueryExplain runs for the life of the process; use OpenDB to stop
+// it with DB.Close.
+//
+// Example:
+//
+//	sql.Register("postgres-logged", tlog.WrapDriver(&pq.Driver{}, tlog.WithSlowThreshold(time.Second)))
+//	db, err := sql.Open("postgres-logged", dsn)
+func WrapDriver(d driver.Driver, opts ...GormOption) driver.Driver {
+	return &loggedDriver{Driver: d, logger: NewGormLogger(opts...)}
+}
+
+// OpenDB opens a database like sql.Open, with every query logged as by WrapDriver.
+// The driver must already be registered under driverName. Closing the
+// database stops its slow query plan capture.
+func OpenDB(driverName, dsn string, opts ...GormOption) (*sql.DB, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	d := db.Driver()
+	// sql.Open does not connect; the handle is only needed to look up the driver.
+	_ = db.Close()
+
+	connector, err := WrapDriver(d, opts...).(*loggedDriver).OpenConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	connector.(*loggedConnector).ownsDriver = true
+	return sql.OpenDB(connector), nil
+}
+
+// loggedDriver wraps a driver.Driver.
+type loggedDriver struct {
+	driver.Driver
+	logger *GormLogger
+}
+
+// Open opens a logged connection.
+func (d *loggedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &loggedConn{Conn: conn, driver: d}, nil
+}
+
+// OpenConnector returns a connector that opens logged connections, using the
+// wrapped driver's connector when it provides one.
+func (d *loggedDriver) OpenConnector(name string) (driver.Connector, error) {
+	if dc, ok := d.Driver.(driver.DriverContext); ok {
+		connector, err := dc.OpenConnector(name)
+		if err != nil {
+			return nil, err
+		}
+		return &loggedConnector{Connector: connector, driver: d}, nil
+	}
+	return &loggedConnector{Connector: dsnConnector{dsn: name, driver: d.Driver}, driver: d}, nil
+}
+
+// trace logs a finished query. driver.ErrSkip is not a failure: database/sql
+// retries through a prepared statement, which is logged instead.
+func (d *loggedDriver) trace(ctx context.Context, begin time.Time, query string, args []driver.NamedValue, rows int64, err error) {
+	if errors.Is(err, driver.ErrSkip) {
+		return
+	}
+	d.logger.trace(ctx, "sql", begin, func() (string, int64) {
+		return d.interpolate(query, args), rows
+	}, func() boundQuery {
+		return boundQuery{sql: query, vars: bindVars(args)}
+	}, err)
+}
+
+// bindVars converts driver arguments back to database/sql arguments, keeping
+// the names of named parameters.
+func bindVars(args []driver.NamedValue) []any {
+	vars := make([]any, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			vars[i] = sql.Named(arg.Name, arg.Value)
+		} else {
+			vars[i] = arg.Value
+		}
+	}
+	return vars
+}
+
+// interpolate substitutes args into query for logging. Redacted mode skips
+// it, since every literal is replaced anyway.
+func (d *loggedDriver) interpolate(query string, args []driver.NamedValue) string {
+	if len(args) == 0 || d.logger.cfg.SQLMode == SQLModeRedacted {
+		return query
+	}
+	vars := make([]interface{}, len(args))
+	for i, arg := range args {
+		vars[i] = arg.Value
+	}
+
+	var placeholder *regexp.Regexp
+	if d.logger.cfg.Dialect == DialectPostgres || (d.logger.cfg.Dialect == DialectAuto && strings.Contains(query, "$1")) {
+		placeholder = numericPlaceholder
+	}
+	return gormlogger.ExplainSQL(query, placeholder, "'", vars...)
+}
+
+// dsnConnector opens connections with Driver.Open for drivers without DriverContext.
+type dsnConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+// Connect opens a connection to the DSN.
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+// Driver returns the wrapped driver.
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// loggedConnector wraps a driver.Connector.
+type loggedConnector struct {
+	driver.Connector
+	driver *loggedDriver
+
+	// ownsDriver is set when the driver is private to the connector's DB,
+	// so closing the DB closes the driver's logger.
+	ownsDriver bool
+}
+
+// Connect opens a logged connection.
+func (c *loggedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &loggedConn{Conn: conn, driver: c.driver}, nil
+}
+
+// Driver returns the logged driver.
+func (c *loggedConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// Close closes the wrapped connector when it holds resources, and the
+// driver's logger when the connector owns the driver.
+func (c *loggedConnector) Close() error {
+	if c.ownsDriver {
+		c.driver.logger.Close()
+	}
+	if closer, ok := c.Connector.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// loggedConn wraps a driver.Conn. database/sql uses a connection from one
+// goroutine at a time, so the transaction state needs no locking.
+type loggedConn struct {
+	driver.Conn
+	driver *loggedDriver
+
+	txID    string
+	txCtx   context.Context
+	txStart time.Time
+}
+
+// withTx tags ctx with the ID of the connection's open transaction.
+func (c *loggedConn) withTx(ctx context.Context) context.Context {
+	if c.txID == "" {
+		return ctx
+	}
+	return WithTxID(ctx, c.txID)
+}
+
+// Prepare implements driver.Conn.
+func (c *loggedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+// PrepareContext prepares a logged statement. Failures are logged as failed queries.
+func (c *loggedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	begin := time.Now()
+	var (
+		stmt driver.Stmt
+		err  error
+	)
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		c.driver.trace(c.withTx(ctx), begin, query, nil, 0, err)
+		return nil, err
+	}
+	return &loggedStmt{Stmt: stmt, conn: c, query: query}, nil
+}
+
+// QueryContext runs and logs a query. Drivers without QueryerContext get
+// driver.ErrSkip, so database/sql falls back to a logged prepared statement.
+func (c *loggedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	begin := time.Now()
+	rows, err := queryer.QueryContext(ctx, query, args)
+	c.driver.trace(c.withTx(ctx), begin, query, args, -1, err)
+	return rows, err
+}
+
+// ExecContext runs and logs a statement. Drivers without ExecerContext get
+// driver.ErrSkip, so database/sql falls back to a logged prepared statement.
+func (c *loggedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	begin := time.Now()
+	result, err := execer.ExecContext(ctx, query, args)
+	c.driver.trace(c.withTx(ctx), begin, query, args, rowsAffected(result, err), err)
+	return result, err
+}
+
+// Begin implements driver.Conn.
+func (c *loggedConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// BeginTx starts and logs a transaction. Queries on the connection carry its
+// tx_id until it is committed or rolled back.
+func (c *loggedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	var (
+		tx  driver.Tx
+		err error
+	)
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		tx, err = beginner.BeginTx(ctx, opts)
+	} else if opts.Isolation != driver.IsolationLevel(sql.LevelDefault) || opts.ReadOnly {
+		err = errors.New("sql: driver does not support non-default isolation level or read-only transactions")
+	} else {
+		tx, err = c.Conn.Begin()
+	}
+
+	id := newTxID()
+	logger := FromContext(WithTxID(ctx, id))
+	if err != nil {
+		writeTxEvent(logger, zapcore.ErrorLevel, "Database transaction begin failed", zap.String("component", "sql"), zap.Error(err))
+		return nil, err
+	}
+	writeTxEvent(logger, zapcore.DebugLevel, "Database transaction started",
+		zap.String("component", "sql"),
+		zap.String("isolation", sql.IsolationLevel(opts.Isolation).String()),
+		zap.Bool("read_only", opts.ReadOnly),
+	)
+
+	c.txID, c.txCtx, c.txStart = id, ctx, time.Now()
+	return &loggedTx{Tx: tx, conn: c}, nil
+}
+
+// endTx logs the end of the connection's transaction and clears it.
+func (c *loggedConn) endTx(msg, failMsg string, err error) {
+	logger := FromContext(WithTxID(c.txCtx, c.txID))
+	fields := []zap.Field{
+		zap.String("component", "sql"),
+		zap.Int64("duration_ms", time.Since(c.txStart).Milliseconds()),
+	}
+	c.txID, c.txCtx = "", nil
+
+	if err != nil && !errors.Is(err, sql.ErrTxDone) {
+		writeTxEvent(logger, zapcore.ErrorLevel, failMsg, append(fields, zap.Error(err))...)
+		return
+	}
+	writeTxEvent(logger, zapcore.DebugLevel, msg, fields...)
+}
+
+// Ping pings the wrapped connection when it supports it.
+func (c *loggedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// ResetSession resets the wrapped connection when it supports it.
+func (c *loggedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+// IsValid reports whether the wrapped connection is still usable.
+func (c *loggedConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+// CheckNamedValue defers argument conversion to the wrapped connection, or
+// to database/sql's default conversion when it has none.
+func (c *loggedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// loggedTx wraps a driver.Tx.
+type loggedTx struct {
+	driver.Tx
+	conn *loggedConn
+}
+
+// Commit commits the transaction and logs the outcome.
+func (t *loggedTx) Commit() error {
+	err := t.Tx.Commit()
+	t.conn.endTx("Database transaction committed", "Database transaction commit failed", err)
+	return err
+}
+
+// Rollback rolls back the transaction and logs the outcome.
+func (t *loggedTx) Rollback() error {
+	err := t.Tx.Rollback()
+	t.conn.endTx("Database transaction rolled back", "Database transaction rollback failed", err)
+	return err
+}
+
+// loggedStmt wraps a driver.Stmt.
+type loggedStmt struct {
+	driver.Stmt
+	conn  *loggedConn
+	query string
+}
+
+// Exec implements driver.Stmt.
+func (s *loggedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+// Query implements driver.Stmt.
+func (s *loggedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+// ExecContext executes and logs the prepared statement.
+func (s *loggedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	begin := time.Now()
+	var (
+		result driver.Result
+		err    error
+	)
+	if execer, ok := s.Stmt.(driver.StmtExecContext); ok {
+		result, err = execer.ExecContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = plainValues(args); err == nil {
+			result, err = s.Stmt.Exec(values)
+		}
+	}
+	s.conn.driver.trace(s.conn.withTx(ctx), begin, s.query, args, rowsAffected(result, err), err)
+	return result, err
+}
+
+// QueryContext runs and logs the prepared query.
+func (s *loggedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	begin := time.Now()
+	var (
+		rows driver.Rows
+		err  error
+	)
+	if queryer, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = queryer.QueryContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = plainValues(args); err == nil {
+			rows, err = s.Stmt.Query(values)
+		}
+	}
+	s.conn.driver.trace(s.conn.withTx(ctx), begin, s.query, args, -1, err)
+	return rows, err
+}
+
+// CheckNamedValue defers argument conversion to the wrapped statement.
+func (s *loggedStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return s.conn.CheckNamedValue(nv)
+}
+
+// ColumnConverter returns the wrapped statement's converter, if any.
+func (s *loggedStmt) ColumnConverter(idx int) driver.ValueConverter {
+	if converter, ok := s.Stmt.(driver.ColumnConverter); ok {
+		return converter.ColumnConverter(idx)
+	}
+	return driver.DefaultParameterConverter
+}
+
+// rowsAffected returns the rows affected by a successful Exec, or -1.
+func rowsAffected(result driver.Result, err error) int64 {
+	if err != nil || result == nil {
+		return -1
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// namedValues converts positional values to ordinal named values.
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return named
+}
+
+// plainValues converts named values to positional values for drivers that
+// predate named parameters.
+func plainValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("sql: driver does not support the use of Named Parameters")
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
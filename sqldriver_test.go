@@ -0,0 +1,237 @@
+package tlog
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+// openLoggedDB opens a logged SQLite database with a users table.
+func openLoggedDB(t *testing.T, dsn string, opts ...GormOption) *sql.DB {
+	t.Helper()
+	db, err := OpenDB("sqlite", dsn, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	// One connection keeps an in-memory database alive across queries.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(`CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT, password TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestWrapDriverQueries(t *testing.T) {
+	db := openLoggedDB(t, ":memory:", WithGormLogLevel(gormlogger.Info))
+	stmt, err := db.Prepare(`SELECT name FROM users WHERE id = ?`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+
+	ctx := WithRequestID(context.Background(), "req-1")
+	tests := []struct {
+		name    string
+		run     func() error
+		msg     string
+		sql     string
+		rows    int64
+		wantErr bool
+	}{
+		{
+			name: "exec with args",
+			run: func() error {
+				_, err := db.ExecContext(ctx, `INSERT INTO users (name, password) VALUES (?, ?)`, "john", "hunter2")
+				return err
+			},
+			msg:  "Database query executed",
+			sql:  `INSERT INTO users (name, password) VALUES ('john', '******')`,
+			rows: 1,
+		},
+		{
+			name: "query",
+			run: func() error {
+				rows, err := db.QueryContext(ctx, `SELECT * FROM users WHERE name = ?`, "john")
+				if err == nil {
+					rows.Close()
+				}
+				return err
+			},
+			msg:  "Database query executed",
+			sql:  `SELECT * FROM users WHERE name = 'john'`,
+			rows: -1,
+		},
+		{
+			name: "prepared statement",
+			run: func() error {
+				var name string
+				return stmt.QueryRowContext(ctx, 1).Scan(&name)
+			},
+			msg:  "Database query executed",
+			sql:  `SELECT name FROM users WHERE id = 1`,
+			rows: -1,
+		},
+		{
+			name: "failed query",
+			run: func() error {
+				_, err := db.ExecContext(ctx, `INSERT INTO missing (a) VALUES (?)`, 1)
+				return err
+			},
+			msg:     "Database query failed",
+			sql:     `INSERT INTO missing (a) VALUES (1)`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := observeLogs(t, zapcore.DebugLevel)
+			if err := tt.run(); (err != nil) != tt.wantErr {
+				t.Fatalf("run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			entries := logs.FilterMessage(tt.msg).All()
+			if len(entries) != 1 {
+				t.Fatalf("got %d %q entries, want 1", len(entries), tt.msg)
+			}
+			fields := entries[0].ContextMap()
+			if fields["component"] != "sql" || fields["request_id"] != "req-1" {
+				t.Errorf("component = %v, request_id = %v", fields["component"], fields["request_id"])
+			}
+			if fields["sql"] != tt.sql {
+				t.Errorf("sql = %v, want %s", fields["sql"], tt.sql)
+			}
+			if !tt.wantErr && fields["rows_affected"] != tt.rows {
+				t.Errorf("rows_affected = %v, want %d", fields["rows_affected"], tt.rows)
+			}
+		})
+	}
+}
+
+func TestWrapDriverTransactions(t *testing.T) {
+	tests := []struct {
+		name   string
+		commit bool
+		msg    string
+	}{
+		{"commit", true, "Database transaction committed"},
+		{"rollback", false, "Database transaction rolled back"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openLoggedDB(t, ":memory:", WithGormLogLevel(gormlogger.Info))
+			logs := observeLogs(t, zapcore.DebugLevel)
+
+			tx, err := db.BeginTx(context.Background(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tx.Exec(`INSERT INTO users (name) VALUES (?)`, "john"); err != nil {
+				t.Fatal(err)
+			}
+			if tt.commit {
+				err = tx.Commit()
+			} else {
+				err = tx.Rollback()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var msgs []string
+			txIDs := map[any]bool{}
+			for _, e := range logs.All() {
+				msgs = append(msgs, e.Message)
+				txIDs[e.ContextMap()["tx_id"]] = true
+			}
+			want := []string{"Database transaction started", "Database query executed", tt.msg}
+			if !reflect.DeepEqual(msgs, want) {
+				t.Errorf("messages = %q, want %q", msgs, want)
+			}
+			if len(txIDs) != 1 || txIDs[nil] {
+				t.Errorf("tx_id values = %v, want one shared ID", txIDs)
+			}
+
+			// Queries after the transaction are not tagged.
+			logs.TakeAll()
+			db.Exec(`DELETE FROM users`)
+			if id, ok := logs.All()[0].ContextMap()["tx_id"]; ok {
+				t.Errorf("query after the transaction has tx_id %v", id)
+			}
+		})
+	}
+}
+
+func TestWrapDriverInterpolate(t *testing.T) {
+	args := []driver.NamedValue{{Ordinal: 1, Value: int64(7)}, {Ordinal: 2, Value: "x"}}
+	tests := []struct {
+		name  string
+		opts  []GormOption
+		query string
+		want  string
+	}{
+		{"question marks", nil, `SELECT * FROM t WHERE a = ? AND b = ?`, `SELECT * FROM t WHERE a = 7 AND b = 'x'`},
+		{"numbered", nil, `SELECT * FROM t WHERE b = $2 AND a = $1`, `SELECT * FROM t WHERE b = 'x' AND a = 7`},
+		{"postgres dialect", []GormOption{WithSQLDialect(DialectPostgres)}, `SELECT $1, $2`, `SELECT 7, 'x'`},
+		{"redacted mode skips", []GormOption{WithSQLMode(SQLModeRedacted)}, `SELECT ?, ?`, `SELECT ?, ?`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := WrapDriver(nil, tt.opts...).(*loggedDriver)
+			if got := d.interpolate(tt.query, args); got != tt.want {
+				t.Errorf("interpolate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBindVars(t *testing.T) {
+	got := bindVars([]driver.NamedValue{{Ordinal: 1, Value: 1}, {Name: "n", Ordinal: 2, Value: "x"}})
+	want := []any{1, sql.Named("n", "x")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("bindVars() = %v, want %v", got, want)
+	}
+}
+
+func TestWrapDriverSlowQueryPlan(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.db")
+	explainDB, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer explainDB.Close()
+
+	db := openLoggedDB(t, path,
+		WithSQLDialect(DialectSQLite),
+		WithSlowThreshold(time.Nanosecond),
+		WithSlowQueryExplain(ExplainConfig{DB: explainDB}),
+	)
+	logs := observeLogs(t, zapcore.DebugLevel)
+	rows, err := db.Query(`SELECT * FROM users WHERE name = ?`, "it's")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+
+	plan, _ := waitForLog(t, logs, "Slow query plan captured").ContextMap()["plan"].(string)
+	if !strings.Contains(plan, "users") {
+		t.Errorf("plan %q does not mention the table", plan)
+	}
+
+	// Closing the database stops plan capture.
+	explainer := db.Driver().(*loggedDriver).logger.explainer
+	db.Close()
+	select {
+	case <-explainer.done:
+	default:
+		t.Error("explainer still running after DB.Close")
+	}
+}
@@ -0,0 +1,314 @@
+package tlog
+
+import "strings"
+
+// SQLDialect selects the quoting rules used when tokenizing SQL statements.
+type SQLDialect int
+
+const (
+	// DialectAuto accepts "double" and `backtick` quoted identifiers and
+	// '' escaped string literals, which covers GORM's Postgres and MySQL output.
+	DialectAuto SQLDialect = iota
+	// DialectPostgres treats "..." as identifiers, supports E'...' escapes,
+	// $n parameters and $tag$...$tag$ dollar quoting.
+	DialectPostgres
+	// DialectMySQL treats `...` as identifiers, '...' and "..." as strings with
+	// backslash escapes, and # as a line comment.
+	DialectMySQL
+	// DialectSQLite treats `...` and [...] as identifiers and "..." as strings,
+	// matching the statements logged by GORM's SQLite driver.
+	DialectSQLite
+)
+
+// String returns the dialect name.
+func (d SQLDialect) String() string {
+	switch d {
+	case DialectPostgres:
+		return "postgres"
+	case DialectMySQL:
+		return "mysql"
+	case DialectSQLite:
+		return "sqlite"
+	default:
+		return "auto"
+	}
+}
+
+// ParseSQLDialect maps a GORM dialector name (db.Dialector.Name()) to a SQLDialect.
+// Unknown names map to DialectAuto.
+func ParseSQLDialect(name string) SQLDialect {
+	switch strings.ToLower(name) {
+	case "postgres", "postgresql", "pgx":
+		return DialectPostgres
+	case "mysql", "mariadb", "tidb":
+		return DialectMySQL
+	case "sqlite", "sqlite3":
+		return DialectSQLite
+	default:
+		return DialectAuto
+	}
+}
+
+// sqlTokenKind classifies a lexical token of a SQL statement.
+type sqlTokenKind int
+
+const (
+	sqlSpace   sqlTokenKind = iota // whitespace
+	sqlComment                     // -- line or /* block */ comment
+	sqlWord                        // keyword or unquoted identifier
+	sqlIdent                       // quoted identifier
+	sqlString                      // string, blob or dollar-quoted literal
+	sqlNumber                      // numeric literal
+	sqlParam                       // bind parameter such as ?, $1, :name or @p1
+	sqlPunct                       // operator or punctuation
+)
+
+// sqlToken is a single lexical token. Concatenating the text of all tokens
+// returned by lexSQL yields the original statement.
+type sqlToken struct {
+	kind sqlTokenKind
+	text string
+}
+
+// isLiteral reports whether the token is a string or numeric literal.
+func (t sqlToken) isLiteral() bool {
+	return t.kind == sqlString || t.kind == sqlNumber
+}
+
+// isKeyword reports whether the token is the unquoted word kw (case-insensitive).
+func (t sqlToken) isKeyword(kw string) bool {
+	return t.kind == sqlWord && strings.EqualFold(t.text, kw)
+}
+
+// isPunct reports whether the token is the punctuation p.
+func (t sqlToken) isPunct(p string) bool {
+	return t.kind == sqlPunct && t.text == p
+}
+
+// name returns the identifier name with any quoting removed.
+func (t sqlToken) name() string {
+	if t.kind != sqlIdent || len(t.text) < 2 {
+		return t.text
+	}
+	quote := t.text[:1]
+	if quote == "[" {
+		return t.text[1 : len(t.text)-1]
+	}
+	return strings.ReplaceAll(t.text[1:len(t.text)-1], quote+quote, quote)
+}
+
+// lexSQL splits a SQL statement into tokens using the quoting rules of
+// dialect. It never fails: unterminated strings and comments simply run to
+// the end of the input.
+func lexSQL(sql string, dialect SQLDialect) []sqlToken {
+	tokens := make([]sqlToken, 0, len(sql)/4)
+	for i := 0; i < len(sql); {
+		start := i
+		c := sql[i]
+		var kind sqlTokenKind
+
+		switch {
+		case isSQLSpace(c):
+			for i < len(sql) && isSQLSpace(sql[i]) {
+				i++
+			}
+			kind = sqlSpace
+
+		case c == '-' && peek(sql, i+1) == '-':
+			i = indexFrom(sql, i, "\n", 0)
+			kind = sqlComment
+
+		case c == '#' && dialect == DialectMySQL:
+			i = indexFrom(sql, i, "\n", 0)
+			kind = sqlComment
+
+		case c == '/' && peek(sql, i+1) == '*':
+			i = indexFrom(sql, i+2, "*/", 2)
+			kind = sqlComment
+
+		case c == '\'':
+			i = scanQuoted(sql, i, '\'', dialect == DialectMySQL)
+			kind = sqlString
+
+		case isStringPrefix(c) && peek(sql, i+1) == '\'':
+			escapes := dialect == DialectMySQL || c == 'E' || c == 'e'
+			i = scanQuoted(sql, i+1, '\'', escapes)
+			kind = sqlString
+
+		case c == '"' && (dialect == DialectMySQL || dialect == DialectSQLite):
+			i = scanQuoted(sql, i, c, dialect == DialectMySQL)
+			kind = sqlString
+
+		case c == '"' || c == '`':
+			i = scanQuoted(sql, i, c, false)
+			kind = sqlIdent
+
+		case c == '[' && dialect == DialectSQLite:
+			i = indexFrom(sql, i, "]", 1)
+			kind = sqlIdent
+
+		case c == '$' && isDigit(peek(sql, i+1)):
+			i++
+			for i < len(sql) && isDigit(sql[i]) {
+				i++
+			}
+			kind = sqlParam
+
+		case c == '$' && (dialect == DialectPostgres || dialect == DialectAuto):
+			if end, ok := scanDollarQuoted(sql, i); ok {
+				i = end
+				kind = sqlString
+			} else {
+				i++
+				kind = sqlPunct
+			}
+
+		case isDigit(c) || (c == '.' && isDigit(peek(sql, i+1))):
+			i = scanNumber(sql, i)
+			kind = sqlNumber
+
+		case c == '?':
+			i++
+			kind = sqlParam
+
+		case (c == ':' || c == '@') && isIdentStart(peek(sql, i+1)) && peek(sql, i-1) != ':':
+			i++
+			for i < len(sql) && isIdentPart(sql[i]) {
+				i++
+			}
+			kind = sqlParam
+
+		case isIdentStart(c):
+			for i < len(sql) && isIdentPart(sql[i]) {
+				i++
+			}
+			kind = sqlWord
+
+		default:
+			i += punctLen(sql, i)
+			kind = sqlPunct
+		}
+
+		tokens = append(tokens, sqlToken{kind: kind, text: sql[start:i]})
+	}
+	return tokens
+}
+
+// scanQuoted returns the index just past the quoted section starting at i.
+// A doubled quote character is an escaped quote; backslash escapes are
+// honoured when backslash is true.
+func scanQuoted(sql string, i int, quote byte, backslash bool) int {
+	for i++; i < len(sql); i++ {
+		switch sql[i] {
+		case '\\':
+			if backslash {
+				i++
+			}
+		case quote:
+			if peek(sql, i+1) != quote {
+				return i + 1
+			}
+			i++
+		}
+	}
+	return len(sql)
+}
+
+// scanDollarQuoted scans a Postgres dollar-quoted string ($$...$$ or $tag$...$tag$).
+func scanDollarQuoted(sql string, i int) (int, bool) {
+	j := i + 1
+	for j < len(sql) && isIdentPart(sql[j]) && sql[j] != '$' {
+		j++
+	}
+	if j >= len(sql) || sql[j] != '$' {
+		return i, false
+	}
+	tag := sql[i : j+1]
+	return indexFrom(sql, j+1, tag, len(tag)), true
+}
+
+// scanNumber returns the index just past the numeric literal starting at i.
+func scanNumber(sql string, i int) int {
+	if sql[i] == '0' && (peek(sql, i+1) == 'x' || peek(sql, i+1) == 'X') {
+		i += 2
+		for i < len(sql) && isHexDigit(sql[i]) {
+			i++
+		}
+		return i
+	}
+	for i < len(sql) && (isDigit(sql[i]) || sql[i] == '.') {
+		i++
+	}
+	if i < len(sql) && (sql[i] == 'e' || sql[i] == 'E') {
+		j := i + 1
+		if j < len(sql) && (sql[j] == '+' || sql[j] == '-') {
+			j++
+		}
+		if j < len(sql) && isDigit(sql[j]) {
+			i = j
+			for i < len(sql) && isDigit(sql[i]) {
+				i++
+			}
+		}
+	}
+	return i
+}
+
+// punctLen returns the length of the operator or punctuation at i.
+func punctLen(sql string, i int) int {
+	if i+1 < len(sql) {
+		switch sql[i : i+2] {
+		case "<=", ">=", "<>", "!=", "::", "||", "->", "=>":
+			return 2
+		}
+	}
+	return 1
+}
+
+// indexFrom returns the index just past the first occurrence of sep at or
+// after i, or len(s) when sep does not occur.
+func indexFrom(s string, i int, sep string, sepLen int) int {
+	if i > len(s) {
+		return len(s)
+	}
+	if n := strings.Index(s[i:], sep); n >= 0 {
+		return i + n + sepLen
+	}
+	return len(s)
+}
+
+func peek(s string, i int) byte {
+	if i < 0 || i >= len(s) {
+		return 0
+	}
+	return s[i]
+}
+
+func isSQLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || isDigit(c) || c == '$'
+}
+
+// isStringPrefix reports whether c can prefix a string literal such as E'...' or X'...'.
+func isStringPrefix(c byte) bool {
+	switch c {
+	case 'E', 'e', 'X', 'x', 'B', 'b', 'N', 'n':
+		return true
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package tlog
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLexSQLRoundTrip(t *testing.T) {
+	corpus := []string{
+		`SELECT * FROM "users" WHERE "name" = 'o''brien' -- note`,
+		"SELECT * FROM `users` WHERE `name` = \"o\\\"brien\" # mysql comment",
+		`SELECT $tag$ it's $tag$, E'a\'b', $1 FROM t /* unterminated`,
+		`SELECT [order] FROM "t" WHERE x = "str"`,
+		`INSERT INTO t VALUES (1.5e-3, .5, 0x1F, :name, @p1, ?)`,
+		`SELECT 'unterminated`,
+		``,
+	}
+	for _, dialect := range []SQLDialect{DialectAuto, DialectPostgres, DialectMySQL, DialectSQLite} {
+		for _, sql := range corpus {
+			var b strings.Builder
+			for _, tok := range lexSQL(sql, dialect) {
+				b.WriteString(tok.text)
+			}
+			if b.String() != sql {
+				t.Errorf("%s: tokens of %q concatenate to %q", dialect, sql, b.String())
+			}
+		}
+	}
+}
+
+func TestLexSQLQuoting(t *testing.T) {
+	tests := []struct {
+		dialect SQLDialect
+		sql     string
+		want    []sqlToken
+	}{
+		{
+			dialect: DialectAuto,
+			sql:     `"a" = 'b'`,
+			want:    []sqlToken{{sqlIdent, `"a"`}, {sqlPunct, "="}, {sqlString, `'b'`}},
+		},
+		{
+			dialect: DialectSQLite,
+			sql:     "`a` = \"b\"\"c\"",
+			want:    []sqlToken{{sqlIdent, "`a`"}, {sqlPunct, "="}, {sqlString, `"b""c"`}},
+		},
+		{
+			dialect: DialectMySQL,
+			sql:     `x = 'it\'s'`,
+			want:    []sqlToken{{sqlWord, "x"}, {sqlPunct, "="}, {sqlString, `'it\'s'`}},
+		},
+		{
+			dialect: DialectPostgres,
+			sql:     `x = $a$ '; DROP $a$`,
+			want:    []sqlToken{{sqlWord, "x"}, {sqlPunct, "="}, {sqlString, `$a$ '; DROP $a$`}},
+		},
+		{
+			dialect: DialectPostgres,
+			sql:     `x = $2 AND y = E'\''`,
+			want: []sqlToken{
+				{sqlWord, "x"}, {sqlPunct, "="}, {sqlParam, "$2"}, {sqlWord, "AND"},
+				{sqlWord, "y"}, {sqlPunct, "="}, {sqlString, `E'\''`},
+			},
+		},
+		{
+			dialect: DialectAuto,
+			sql:     `a::text >= 1.5`,
+			want:    []sqlToken{{sqlWord, "a"}, {sqlPunct, "::"}, {sqlWord, "text"}, {sqlPunct, ">="}, {sqlNumber, "1.5"}},
+		},
+	}
+	for _, tt := range tests {
+		var got []sqlToken
+		for _, tok := range lexSQL(tt.sql, tt.dialect) {
+			if tok.kind != sqlSpace {
+				got = append(got, tok)
+			}
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s %q: got %v, want %v", tt.dialect, tt.sql, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s %q: token %d = %v, want %v", tt.dialect, tt.sql, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestParseSQLDialect(t *testing.T) {
+	tests := map[string]SQLDialect{
+		"postgres":  DialectPostgres,
+		"pgx":       DialectPostgres,
+		"mysql":     DialectMySQL,
+		"MariaDB":   DialectMySQL,
+		"sqlite":    DialectSQLite,
+		"sqlite3":   DialectSQLite,
+		"sqlserver": DialectAuto,
+	}
+	for name, want := range tests {
+		if got := ParseSQLDialect(name); got != want {
+			t.Errorf("ParseSQLDialect(%q) = %s, want %s", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package tlog
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strings"
+)
+
+// SQLMode controls how SQL statements are written to the log.
+type SQLMode int
+
+const (
+	// SQLModeFull logs the interpolated statement as executed, with values of
+	// columns matching the mask patterns replaced.
+	SQLModeFull SQLMode = iota
+	// SQLModeRedacted logs the statement with every literal replaced by "?".
+	SQLModeRedacted
+)
+
+// sqlMaskLiteral is the literal written in place of masked values.
+const sqlMaskLiteral = "'" + DefaultMaskValue + "'"
+
+// normalizedSQL holds the loggable forms of a single statement.
+type normalizedSQL struct {
+	// Statement is the SQL text to log, according to the configured SQLMode.
+	Statement string
+	// Fingerprint is the statement with literals replaced, IN-lists and
+	// VALUES tuples collapsed and whitespace normalised.
+	Fingerprint string
+	// Hash is a stable hex hash of Fingerprint.
+	Hash string
+}
+
+// normalizeSQL produces the statement to log, its fingerprint and the
+// fingerprint hash from the tokens of sql.
+func normalizeSQL(sql string, tokens []sqlToken, mode SQLMode, maskColumns []*regexp.Regexp) normalizedSQL {
+	fingerprint := fingerprintSQL(tokens)
+
+	var statement string
+	switch mode {
+	case SQLModeRedacted:
+		statement = redactSQL(tokens)
+	default:
+		statement = maskSQL(sql, tokens, maskColumns)
+	}
+
+	return normalizedSQL{
+		Statement:   statement,
+		Fingerprint: fingerprint,
+		Hash:        hashFingerprint(fingerprint),
+	}
+}
+
+// hashFingerprint returns the 64-bit FNV-1a hash of a fingerprint as hex.
+func hashFingerprint(fingerprint string) string {
+	h := fnv.New64a()
+	h.Write([]byte(fingerprint))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// redactSQL replaces every literal with "?" and drops comments.
+func redactSQL(tokens []sqlToken) string {
+	var b strings.Builder
+	for _, t := range tokens {
+		switch {
+		case t.isLiteral():
+			b.WriteByte('?')
+		case t.kind == sqlComment:
+			b.WriteByte(' ')
+		default:
+			b.WriteString(t.text)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// maskSQL returns sql with the values of columns matching any pattern masked.
+func maskSQL(sql string, tokens []sqlToken, patterns []*regexp.Regexp) string {
+	if len(patterns) == 0 {
+		return sql
+	}
+	masked := maskedLiterals(tokens, patterns)
+	if len(masked) == 0 {
+		return sql
+	}
+
+	var b strings.Builder
+	b.Grow(len(sql))
+	for i, t := range tokens {
+		if masked[i] {
+			b.WriteString(sqlMaskLiteral)
+		} else {
+			b.WriteString(t.text)
+		}
+	}
+	return b.String()
+}
+
+// maskedLiterals returns the indexes of literal tokens that belong to a column
+// matching one of the patterns. It recognises comparisons (col = 'v',
+// col IN (...), col BETWEEN a AND b, col LIKE 'v'), also with the column
+// inside a function call (lower(col) = 'v') or on the right-hand side
+// ('v' = col), UPDATE ... SET col = 'v' and positional
+// INSERT ... (cols) VALUES (...) lists.
+func maskedLiterals(tokens []sqlToken, patterns []*regexp.Regexp) map[int]bool {
+	sig := significantTokens(tokens)
+	masked := make(map[int]bool)
+
+	for j := 0; j < len(sig); j++ {
+		t := tokens[sig[j]]
+
+		switch {
+		case isComparison(t):
+			left := j - 1
+			if left >= 0 && tokens[sig[left]].isKeyword("NOT") {
+				left--
+			}
+			if left < 0 {
+				continue
+			}
+			start := operandStart(tokens, sig, left)
+
+			if operandMatches(tokens, sig, start, left, patterns) {
+				markOperand(tokens, sig, j+1, masked)
+				if t.isKeyword("BETWEEN") {
+					for k := j + 1; k < len(sig); k++ {
+						if tokens[sig[k]].isKeyword("AND") {
+							markOperand(tokens, sig, k+1, masked)
+							break
+						}
+					}
+				}
+				continue
+			}
+
+			// Reversed comparison: 'v' = col.
+			if t.kind == sqlPunct && j+1 < len(sig) {
+				end := operandEnd(tokens, sig, j+1)
+				if operandMatches(tokens, sig, j+1, end, patterns) {
+					markLiterals(tokens, sig, start, left, masked)
+				}
+			}
+
+		case t.isKeyword("INTO"):
+			j = maskInsertValues(tokens, sig, j, patterns, masked)
+		}
+	}
+	return masked
+}
+
+// operandStart returns the index of the first token of the operand ending
+// at sig[end]: the operand itself, or the opening parenthesis, or function
+// name, of a parenthesised operand.
+func operandStart(tokens []sqlToken, sig []int, end int) int {
+	if !tokens[sig[end]].isPunct(")") {
+		return end
+	}
+	depth := 0
+	for k := end; k >= 0; k-- {
+		switch t := tokens[sig[k]]; {
+		case t.isPunct(")"):
+			depth++
+		case t.isPunct("("):
+			depth--
+			if depth == 0 {
+				if k > 0 && isColumnToken(tokens[sig[k-1]]) {
+					return k - 1
+				}
+				return k
+			}
+		}
+	}
+	return end
+}
+
+// operandEnd returns the index of the last token of the operand starting at
+// sig[start]: the operand itself, or the closing parenthesis of a
+// parenthesised list or function call.
+func operandEnd(tokens []sqlToken, sig []int, start int) int {
+	open := start
+	if isColumnToken(tokens[sig[start]]) && start+1 < len(sig) && tokens[sig[start+1]].isPunct("(") {
+		open = start + 1
+	}
+	if end := skipTuple(tokens, sig, open); end > open {
+		return end
+	}
+	return start
+}
+
+// operandMatches reports whether a column within sig[start..end] matches
+// one of the patterns. Function names are not columns.
+func operandMatches(tokens []sqlToken, sig []int, start, end int, patterns []*regexp.Regexp) bool {
+	for k := start; k <= end; k++ {
+		t := tokens[sig[k]]
+		if !isColumnToken(t) || (k+1 < len(sig) && tokens[sig[k+1]].isPunct("(")) {
+			continue
+		}
+		if shouldMask(t.name(), patterns) {
+			return true
+		}
+	}
+	return false
+}
+
+// markOperand marks the literals of the operand starting at sig[j]: a
+// literal, a parenthesised list or a function call.
+func markOperand(tokens []sqlToken, sig []int, j int, masked map[int]bool) {
+	if j >= len(sig) {
+		return
+	}
+	markLiterals(tokens, sig, j, operandEnd(tokens, sig, j), masked)
+}
+
+// markLiterals marks every literal within sig[start..end].
+func markLiterals(tokens []sqlToken, sig []int, start, end int, masked map[int]bool) {
+	for k := start; k <= end; k++ {
+		if tokens[sig[k]].isLiteral() {
+			masked[sig[k]] = true
+		}
+	}
+}
+
+// maskInsertValues handles INSERT INTO table (cols) VALUES (...), (...)
+// starting at the INTO keyword sig[j]. It returns the index to resume from.
+func maskInsertValues(tokens []sqlToken, sig []int, j int, patterns []*regexp.Regexp, masked map[int]bool) int {
+	// Skip the (possibly qualified) table name.
+	k := j + 1
+	for k < len(sig) && (isColumnToken(tokens[sig[k]]) || tokens[sig[k]].isPunct(".")) {
+		k++
+	}
+	if k >= len(sig) || !tokens[sig[k]].isPunct("(") {
+		return j
+	}
+
+	var maskPos []bool
+	anyMasked := false
+	for k++; k < len(sig) && !tokens[sig[k]].isPunct(")"); k++ {
+		t := tokens[sig[k]]
+		if isColumnToken(t) {
+			m := shouldMask(t.name(), patterns)
+			maskPos = append(maskPos, m)
+			anyMasked = anyMasked || m
+		}
+	}
+	if k+1 >= len(sig) || !tokens[sig[k+1]].isKeyword("VALUES") || !anyMasked {
+		return j
+	}
+
+	// Walk each tuple, tracking the column position at depth 1.
+	depth, pos := 0, 0
+	for k += 2; k < len(sig); k++ {
+		t := tokens[sig[k]]
+		switch {
+		case t.isPunct("("):
+			depth++
+			if depth == 1 {
+				pos = 0
+			}
+		case t.isPunct(")"):
+			depth--
+			if depth < 0 {
+				return k
+			}
+		case t.isPunct(",") && depth == 1:
+			pos++
+		case t.isLiteral() && depth >= 1:
+			if pos < len(maskPos) && maskPos[pos] {
+				masked[sig[k]] = true
+			}
+		case depth == 0 && !t.isPunct(","):
+			return k - 1
+		}
+	}
+	return k
+}
+
+// fingerprintSQL reduces a statement to its shape: literals and bind
+// parameters become "?", comments are dropped, whitespace is collapsed,
+// IN-lists become "IN (?)" and multi-row VALUES keep only the first tuple.
+func fingerprintSQL(tokens []sqlToken) string {
+	var b strings.Builder
+	sig := significantTokens(tokens)
+
+	for j := 0; j < len(sig); j++ {
+		i := sig[j]
+		t := tokens[i]
+
+		if j > 0 && i > 0 && (tokens[i-1].kind == sqlSpace || tokens[i-1].kind == sqlComment) {
+			b.WriteByte(' ')
+		}
+
+		switch {
+		case t.isLiteral() || t.kind == sqlParam:
+			b.WriteByte('?')
+
+		case t.isKeyword("IN"):
+			b.WriteString(t.text)
+			if end, ok := valueList(tokens, sig, j+1); ok {
+				b.WriteString(" (?)")
+				j = end
+			}
+
+		case t.isKeyword("VALUES"):
+			b.WriteString(t.text)
+			end := skipTuple(tokens, sig, j+1)
+			if end <= j+1 {
+				continue
+			}
+			b.WriteByte(' ')
+			b.WriteString(fingerprintSQL(sliceTokens(tokens, sig[j+1], sig[end])))
+			// Drop any further tuples.
+			for end+2 < len(sig) && tokens[sig[end+1]].isPunct(",") && tokens[sig[end+2]].isPunct("(") {
+				next := skipTuple(tokens, sig, end+2)
+				if next <= end+2 {
+					break
+				}
+				end = next
+			}
+			j = end
+
+		default:
+			b.WriteString(t.text)
+		}
+	}
+	return b.String()
+}
+
+// valueList reports whether sig[j] opens a parenthesised list of literals and
+// parameters, returning the index of the closing parenthesis.
+func valueList(tokens []sqlToken, sig []int, j int) (int, bool) {
+	if j >= len(sig) || !tokens[sig[j]].isPunct("(") {
+		return j, false
+	}
+	expectValue := true
+	for k := j + 1; k < len(sig); k++ {
+		t := tokens[sig[k]]
+		switch {
+		case expectValue && (t.isLiteral() || t.kind == sqlParam || t.isKeyword("NULL")):
+			expectValue = false
+		case !expectValue && t.isPunct(","):
+			expectValue = true
+		case !expectValue && t.isPunct(")"):
+			return k, true
+		default:
+			return j, false
+		}
+	}
+	return j, false
+}
+
+// skipTuple returns the index of the parenthesis closing the tuple opened at
+// sig[j], or j when sig[j] does not open one.
+func skipTuple(tokens []sqlToken, sig []int, j int) int {
+	if j >= len(sig) || !tokens[sig[j]].isPunct("(") {
+		return j
+	}
+	depth := 0
+	for k := j; k < len(sig); k++ {
+		switch t := tokens[sig[k]]; {
+		case t.isPunct("("):
+			depth++
+		case t.isPunct(")"):
+			depth--
+			if depth == 0 {
+				return k
+			}
+		}
+	}
+	return j
+}
+
+// sliceTokens returns tokens[from:to+1].
+func sliceTokens(tokens []sqlToken, from, to int) []sqlToken {
+	return tokens[from : to+1]
+}
+
+// significantTokens returns the indexes of tokens that are not whitespace or comments.
+func significantTokens(tokens []sqlToken) []int {
+	sig := make([]int, 0, len(tokens))
+	for i, t := range tokens {
+		if t.kind != sqlSpace && t.kind != sqlComment {
+			sig = append(sig, i)
+		}
+	}
+	return sig
+}
+
+// isComparison reports whether t compares a column with a value.
+func isComparison(t sqlToken) bool {
+	switch t.kind {
+	case sqlPunct:
+		switch t.text {
+		case "=", "!=", "<>", "<", ">", "<=", ">=":
+			return true
+		}
+	case sqlWord:
+		switch strings.ToUpper(t.text) {
+		case "LIKE", "ILIKE", "IN", "BETWEEN":
+			return true
+		}
+	}
+	return false
+}
+
+// isColumnToken reports whether t can name a column.
+func isColumnToken(t sqlToken) bool {
+	return t.kind == sqlWord || t.kind == sqlIdent
+}
@@ -0,0 +1,173 @@
+package tlog
+
+import "testing"
+
+func TestMaskSQL(t *testing.T) {
+	patterns := compilePatterns(append(DefaultMaskPatterns, `(?i)^email$`))
+
+	tests := []struct {
+		name string
+		sql  string
+		want string
+	}{
+		{
+			name: "equality",
+			sql:  `SELECT * FROM "users" WHERE "email" = 'a@b.c' AND "name" = 'john'`,
+			want: `SELECT * FROM "users" WHERE "email" = '******' AND "name" = 'john'`,
+		},
+		{
+			name: "qualified column",
+			sql:  `SELECT * FROM users u WHERE u.password = 'hunter2'`,
+			want: `SELECT * FROM users u WHERE u.password = '******'`,
+		},
+		{
+			name: "function wrapped column",
+			sql:  `SELECT * FROM users WHERE lower(email) = 'a@b.c'`,
+			want: `SELECT * FROM users WHERE lower(email) = '******'`,
+		},
+		{
+			name: "nested function wrapped column",
+			sql:  `SELECT * FROM users WHERE lower(trim("email")) = 'a@b.c' AND id = 1`,
+			want: `SELECT * FROM users WHERE lower(trim("email")) = '******' AND id = 1`,
+		},
+		{
+			name: "reversed comparison",
+			sql:  `SELECT * FROM users WHERE 'hunter2' = password AND 1 = id`,
+			want: `SELECT * FROM users WHERE '******' = password AND 1 = id`,
+		},
+		{
+			name: "reversed comparison with function",
+			sql:  `SELECT * FROM users WHERE lower('A@B.C') = lower(email)`,
+			want: `SELECT * FROM users WHERE lower('******') = lower(email)`,
+		},
+		{
+			name: "function wrapped value",
+			sql:  `UPDATE users SET password = crypt('hunter2', gen_salt('bf')) WHERE id = 7`,
+			want: `UPDATE users SET password = crypt('******', gen_salt('******')) WHERE id = 7`,
+		},
+		{
+			name: "in list",
+			sql:  `SELECT * FROM sessions WHERE token NOT IN ('a', 'b') AND user_id IN (1, 2)`,
+			want: `SELECT * FROM sessions WHERE token NOT IN ('******', '******') AND user_id IN (1, 2)`,
+		},
+		{
+			name: "between",
+			sql:  `SELECT * FROM cards WHERE card_number BETWEEN '4000' AND '4999'`,
+			want: `SELECT * FROM cards WHERE card_number BETWEEN '******' AND '******'`,
+		},
+		{
+			name: "like",
+			sql:  `SELECT * FROM users WHERE email LIKE '%@corp.com'`,
+			want: `SELECT * FROM users WHERE email LIKE '******'`,
+		},
+		{
+			name: "update set",
+			sql:  "UPDATE `users` SET `api_key`='k-123',`updated_at`='2024-01-01' WHERE `id` = 1",
+			want: "UPDATE `users` SET `api_key`='******',`updated_at`='2024-01-01' WHERE `id` = 1",
+		},
+		{
+			name: "insert values",
+			sql:  `INSERT INTO "users" ("name","email","password") VALUES ('john','a@b.c','x'),('jane','c@d.e','y')`,
+			want: `INSERT INTO "users" ("name","email","password") VALUES ('john','******','******'),('jane','******','******')`,
+		},
+		{
+			name: "unmatched columns untouched",
+			sql:  `SELECT * FROM orders WHERE status = 'paid' AND total > 10`,
+			want: `SELECT * FROM orders WHERE status = 'paid' AND total > 10`,
+		},
+		{
+			name: "function name is not a column",
+			sql:  `SELECT * FROM t WHERE token_hash(name) = 'abc'`,
+			want: `SELECT * FROM t WHERE token_hash(name) = 'abc'`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := maskSQL(tt.sql, lexSQL(tt.sql, DialectAuto), patterns)
+			if got != tt.want {
+				t.Errorf("maskSQL()\n got: %s\nwant: %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaskSQLDefaultPatterns(t *testing.T) {
+	cfg := DefaultGormConfig()
+	sql := `SELECT * FROM users WHERE password_hash = 'abc' AND reset_token = 'def' AND email = 'a@b.c'`
+	want := `SELECT * FROM users WHERE password_hash = '******' AND reset_token = '******' AND email = 'a@b.c'`
+
+	got := normalizeSQL(sql, lexSQL(sql, DialectAuto), cfg.SQLMode, cfg.MaskColumns).Statement
+	if got != want {
+		t.Errorf("Statement\n got: %s\nwant: %s", got, want)
+	}
+}
+
+func TestRedactSQL(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want string
+	}{
+		{`SELECT * FROM users WHERE id = 42 AND name = 'john'`, `SELECT * FROM users WHERE id = ? AND name = ?`},
+		{`SELECT 1 /* hint */ FROM t -- trailing`, `SELECT ?   FROM t`},
+		{`INSERT INTO t (a) VALUES (1.5e3), (-2)`, `INSERT INTO t (a) VALUES (?), (-?)`},
+		{`SELECT 'it''s', x'ff'`, `SELECT ?, ?`},
+	}
+	for _, tt := range tests {
+		if got := redactSQL(lexSQL(tt.sql, DialectAuto)); got != tt.want {
+			t.Errorf("redactSQL(%q) = %q, want %q", tt.sql, got, tt.want)
+		}
+	}
+}
+
+func TestFingerprintSQL(t *testing.T) {
+	tests := []struct {
+		name string
+		sql  string
+		want string
+	}{
+		{
+			name: "literals",
+			sql:  `SELECT * FROM users WHERE id = 42 AND name = 'john'`,
+			want: `SELECT * FROM users WHERE id = ? AND name = ?`,
+		},
+		{
+			name: "whitespace and comments",
+			sql:  "SELECT *\n\tFROM  users /* c */ WHERE id=1",
+			want: `SELECT * FROM users WHERE id=?`,
+		},
+		{
+			name: "in list",
+			sql:  `SELECT * FROM users WHERE id IN (1, 2, 3)`,
+			want: `SELECT * FROM users WHERE id IN (?)`,
+		},
+		{
+			name: "multi-row values",
+			sql:  `INSERT INTO t (a, b) VALUES (1, 'x'), (2, 'y'), (3, 'z')`,
+			want: `INSERT INTO t (a, b) VALUES (?, ?)`,
+		},
+		{
+			name: "bind parameters",
+			sql:  `SELECT * FROM t WHERE a = $1 AND b = ?`,
+			want: `SELECT * FROM t WHERE a = ? AND b = ?`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fingerprintSQL(lexSQL(tt.sql, DialectAuto)); got != tt.want {
+				t.Errorf("fingerprintSQL()\n got: %s\nwant: %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFingerprintHashGroupsValues(t *testing.T) {
+	a := normalizeSQL(`SELECT * FROM t WHERE id IN (1, 2)`, lexSQL(`SELECT * FROM t WHERE id IN (1, 2)`, DialectAuto), SQLModeFull, nil)
+	b := normalizeSQL(`SELECT * FROM t WHERE id IN (3)`, lexSQL(`SELECT * FROM t WHERE id IN (3)`, DialectAuto), SQLModeFull, nil)
+	if a.Hash != b.Hash {
+		t.Errorf("hashes differ: %s %s", a.Hash, b.Hash)
+	}
+	if len(a.Hash) != 16 {
+		t.Errorf("hash %q is not 16 hex digits", a.Hash)
+	}
+}
@@ -0,0 +1,338 @@
+package tlog
+
+import "strings"
+
+// Operations reported by parseSQL.
+const (
+	sqlOpSelect   = "SELECT"
+	sqlOpInsert   = "INSERT"
+	sqlOpUpdate   = "UPDATE"
+	sqlOpDelete   = "DELETE"
+	sqlOpUpsert   = "UPSERT"
+	sqlOpCreate   = "CREATE"
+	sqlOpAlter    = "ALTER"
+	sqlOpDrop     = "DROP"
+	sqlOpTruncate = "TRUNCATE"
+	sqlOpOther    = "OTHER"
+)
+
+// sqlInfo describes what a statement does and which tables it touches.
+type sqlInfo struct {
+	// Operation is the statement type, e.g. "SELECT" or "UPSERT".
+	Operation string
+	// Table is the primary table: the target of a write, or the first table
+	// read by the main query.
+	Table string
+	// Tables lists every table referenced, including joins and subqueries,
+	// in order of appearance. CTE names are excluded.
+	Tables []string
+}
+
+// parseSQL extracts the operation and referenced tables from a SQL query.
+func parseSQL(sql string, dialect SQLDialect) sqlInfo {
+	return analyzeSQL(lexSQL(sql, dialect))
+}
+
+// sqlStopWords are keywords that end a table reference, so they are never
+// taken as an alias.
+var sqlStopWords = map[string]bool{
+	"WHERE": true, "JOIN": true, "INNER": true, "LEFT": true, "RIGHT": true,
+	"FULL": true, "CROSS": true, "NATURAL": true, "OUTER": true, "ON": true,
+	"USING": true, "GROUP": true, "ORDER": true, "LIMIT": true, "OFFSET": true,
+	"HAVING": true, "UNION": true, "EXCEPT": true, "INTERSECT": true, "SET": true,
+	"VALUES": true, "RETURNING": true, "FOR": true, "WINDOW": true, "FETCH": true,
+	"SELECT": true, "DEFAULT": true, "OUTPUT": true, "LATERAL": true, "WITH": true,
+	"STRAIGHT_JOIN": true, "PARTITION": true, "DO": true, "OVERRIDING": true,
+}
+
+// sqlParser walks the significant tokens of a single statement.
+type sqlParser struct {
+	tokens []sqlToken
+	sig    []int
+
+	info sqlInfo
+	ctes map[string]bool
+	seen map[string]bool
+}
+
+// analyzeSQL extracts the operation and referenced tables from lexed tokens.
+func analyzeSQL(tokens []sqlToken) sqlInfo {
+	p := &sqlParser{
+		tokens: tokens,
+		sig:    significantTokens(tokens),
+		ctes:   make(map[string]bool),
+		seen:   make(map[string]bool),
+	}
+	p.info.Operation = p.operation()
+	p.collectTables()
+	return p.info
+}
+
+// tok returns the j-th significant token, or a zero token when out of range.
+func (p *sqlParser) tok(j int) sqlToken {
+	if j < 0 || j >= len(p.sig) {
+		return sqlToken{kind: sqlSpace}
+	}
+	return p.tokens[p.sig[j]]
+}
+
+// word returns the upper-cased keyword at j, or "" when it is not a bare word.
+func (p *sqlParser) word(j int) string {
+	if t := p.tok(j); t.kind == sqlWord {
+		return strings.ToUpper(t.text)
+	}
+	return ""
+}
+
+// operation determines the statement type, skipping any leading parentheses
+// and WITH clauses. It records CTE names along the way.
+func (p *sqlParser) operation() string {
+	j := 0
+	for p.tok(j).isPunct("(") {
+		j++
+	}
+
+	if p.word(j) == "WITH" {
+		j = p.skipCTEs(j + 1)
+	}
+
+	switch p.word(j) {
+	case "SELECT", "VALUES", "TABLE", "SHOW", "EXPLAIN", "DESCRIBE":
+		return sqlOpSelect
+	case "INSERT":
+		if p.isUpsert(j) {
+			return sqlOpUpsert
+		}
+		return sqlOpInsert
+	case "REPLACE", "MERGE", "UPSERT":
+		return sqlOpUpsert
+	case "UPDATE":
+		return sqlOpUpdate
+	case "DELETE":
+		return sqlOpDelete
+	case "CREATE":
+		return sqlOpCreate
+	case "ALTER":
+		return sqlOpAlter
+	case "DROP":
+		return sqlOpDrop
+	case "TRUNCATE":
+		return sqlOpTruncate
+	default:
+		return sqlOpOther
+	}
+}
+
+// skipCTEs records the names of the common table expressions following WITH
+// and returns the index of the main statement keyword.
+func (p *sqlParser) skipCTEs(j int) int {
+	if p.word(j) == "RECURSIVE" {
+		j++
+	}
+	for j < len(p.sig) {
+		if name := p.tok(j); isColumnToken(name) {
+			p.ctes[strings.ToLower(name.name())] = true
+			j++
+		}
+		if p.tok(j).isPunct("(") { // column list
+			j = skipTuple(p.tokens, p.sig, j) + 1
+		}
+		if p.word(j) != "AS" {
+			return j
+		}
+		j++
+		for p.word(j) == "NOT" || p.word(j) == "MATERIALIZED" {
+			j++
+		}
+		if !p.tok(j).isPunct("(") {
+			return j
+		}
+		j = skipTuple(p.tokens, p.sig, j) + 1
+		if !p.tok(j).isPunct(",") {
+			return j
+		}
+		j++
+	}
+	return j
+}
+
+// isUpsert reports whether the INSERT at j is an upsert
+// (INSERT OR REPLACE, ON CONFLICT or ON DUPLICATE KEY UPDATE).
+func (p *sqlParser) isUpsert(j int) bool {
+	if p.word(j+1) == "OR" && p.word(j+2) == "REPLACE" {
+		return true
+	}
+	for k := j + 1; k < len(p.sig); k++ {
+		if p.word(k) == "ON" && (p.word(k+1) == "CONFLICT" || p.word(k+1) == "DUPLICATE") {
+			return true
+		}
+	}
+	return false
+}
+
+// collectTables records every table reference. FROM inside a function call
+// such as EXTRACT(YEAR FROM col) is ignored by only honouring keywords at
+// the top level or directly inside a parenthesised subquery.
+func (p *sqlParser) collectTables() {
+	// queryDepth[i] reports whether the i-th open parenthesis starts a subquery.
+	queryDepth := []bool{true}
+	sawIndex := false
+
+	for j := 0; j < len(p.sig); j++ {
+		t := p.tok(j)
+		switch {
+		case t.isPunct("("):
+			switch p.word(j + 1) {
+			case "SELECT", "WITH", "VALUES", "INSERT", "UPDATE", "DELETE":
+				queryDepth = append(queryDepth, true)
+			default:
+				queryDepth = append(queryDepth, false)
+			}
+			continue
+		case t.isPunct(")"):
+			if len(queryDepth) > 1 {
+				queryDepth = queryDepth[:len(queryDepth)-1]
+			}
+			continue
+		}
+		if !queryDepth[len(queryDepth)-1] {
+			continue
+		}
+
+		top := len(queryDepth) == 1
+		switch w := p.word(j); w {
+		case "FROM", "JOIN", "STRAIGHT_JOIN", "INTO", "REFERENCES":
+			p.tableList(j+1, w, top)
+		case "UPDATE":
+			switch p.word(j - 1) {
+			case "KEY", "DO", "FOR", "ON":
+			default:
+				p.tableList(j+1, w, top)
+			}
+		case "USING":
+			if p.info.Operation == sqlOpDelete || p.info.Operation == sqlOpUpsert {
+				p.tableList(j+1, w, top)
+			}
+		case "TABLE":
+			p.tableList(p.skipWords(j+1, "IF", "NOT", "EXISTS", "ONLY"), w, top)
+		case "TRUNCATE":
+			if p.word(j+1) != "TABLE" {
+				p.tableList(p.skipWords(j+1, "ONLY"), w, top)
+			}
+		case "INDEX":
+			sawIndex = true
+		case "ON":
+			if sawIndex && p.info.Operation == sqlOpCreate {
+				p.tableList(p.skipWords(j+1, "ONLY"), w, top)
+				sawIndex = false
+			}
+		}
+	}
+
+	if p.info.Table == "" && len(p.info.Tables) > 0 {
+		p.info.Table = p.info.Tables[0]
+	}
+}
+
+// skipWords advances j past any of the given keywords.
+func (p *sqlParser) skipWords(j int, words ...string) int {
+	for {
+		w := p.word(j)
+		found := false
+		for _, s := range words {
+			if w == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return j
+		}
+		j++
+	}
+}
+
+// tableList reads the table reference at j introduced by keyword kw. After
+// FROM, UPDATE, USING, TABLE and TRUNCATE further comma-separated references
+// are read too. Parenthesised subqueries and function calls are skipped;
+// their contents are visited by collectTables. top reports whether the
+// reference belongs to the outermost statement.
+func (p *sqlParser) tableList(j int, kw string, top bool) {
+	var list, columnsFollow bool
+	switch kw {
+	case "FROM", "UPDATE", "USING", "TRUNCATE":
+		list = true
+	case "TABLE":
+		list, columnsFollow = true, true
+	case "INTO", "REFERENCES", "ON":
+		columnsFollow = true
+	}
+
+	for j < len(p.sig) {
+		j = p.skipWords(j, "ONLY", "LATERAL", "IGNORE", "LOW_PRIORITY", "QUICK")
+
+		if p.tok(j).isPunct("(") {
+			j = skipTuple(p.tokens, p.sig, j) + 1
+		} else {
+			name, next := p.readName(j)
+			if name == "" {
+				return
+			}
+			if p.tok(next).isPunct("(") {
+				// A column list after INTO t or CREATE TABLE t; otherwise a function call.
+				if columnsFollow {
+					p.addTable(name, top)
+				}
+				return
+			}
+			p.addTable(name, top)
+			j = next
+		}
+
+		// Optional alias.
+		if p.word(j) == "AS" {
+			j++
+		}
+		if t := p.tok(j); t.kind == sqlIdent || (t.kind == sqlWord && !sqlStopWords[strings.ToUpper(t.text)]) {
+			j++
+		}
+
+		if !list || !p.tok(j).isPunct(",") {
+			return
+		}
+		j++
+	}
+}
+
+// readName reads a possibly schema-qualified name at j, returning the
+// unquoted dotted name and the index following it.
+func (p *sqlParser) readName(j int) (string, int) {
+	t := p.tok(j)
+	if !isColumnToken(t) || (t.kind == sqlWord && sqlStopWords[strings.ToUpper(t.text)]) {
+		return "", j
+	}
+	parts := []string{t.name()}
+	j++
+	for p.tok(j).isPunct(".") && isColumnToken(p.tok(j+1)) {
+		parts = append(parts, p.tok(j+1).name())
+		j += 2
+	}
+	return strings.Join(parts, "."), j
+}
+
+// addTable records a table, ignoring CTE names and duplicates. The first
+// table of the outermost statement becomes the primary table.
+func (p *sqlParser) addTable(name string, top bool) {
+	key := strings.ToLower(name)
+	if p.ctes[key] {
+		return
+	}
+	if p.info.Table == "" && top {
+		p.info.Table = name
+	}
+	if p.seen[key] {
+		return
+	}
+	p.seen[key] = true
+	p.info.Tables = append(p.info.Tables, name)
+}
@@ -0,0 +1,204 @@
+package tlog
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// sqlCorpus is a set of statements as logged by GORM and typical raw SQL,
+// with the operation and tables parseSQL reports for them.
+var sqlCorpus = []struct {
+	name      string
+	dialect   SQLDialect
+	sql       string
+	operation string
+	table     string
+	tables    []string
+}{
+	{
+		name:      "gorm postgres select",
+		dialect:   DialectPostgres,
+		sql:       `SELECT * FROM "users" WHERE "users"."id" = 1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`,
+		operation: sqlOpSelect,
+		table:     "users",
+		tables:    []string{"users"},
+	},
+	{
+		name:      "gorm mysql insert",
+		dialect:   DialectMySQL,
+		sql:       "INSERT INTO `orders` (`user_id`,`total`) VALUES (1,9.5),(2,3)",
+		operation: sqlOpInsert,
+		table:     "orders",
+		tables:    []string{"orders"},
+	},
+	{
+		name:      "gorm sqlite update",
+		dialect:   DialectSQLite,
+		sql:       "UPDATE `users` SET `name`=\"from users\" WHERE `id` = 1",
+		operation: sqlOpUpdate,
+		table:     "users",
+		tables:    []string{"users"},
+	},
+	{
+		name:      "delete",
+		dialect:   DialectAuto,
+		sql:       `DELETE FROM sessions WHERE expires_at < NOW()`,
+		operation: sqlOpDelete,
+		table:     "sessions",
+		tables:    []string{"sessions"},
+	},
+	{
+		name:      "joins",
+		dialect:   DialectAuto,
+		sql:       `SELECT o.id FROM orders o JOIN users u ON u.id = o.user_id LEFT JOIN payments p ON p.order_id = o.id`,
+		operation: sqlOpSelect,
+		table:     "orders",
+		tables:    []string{"orders", "users", "payments"},
+	},
+	{
+		name:      "subquery",
+		dialect:   DialectAuto,
+		sql:       `SELECT * FROM users WHERE id IN (SELECT user_id FROM orders WHERE total > 100)`,
+		operation: sqlOpSelect,
+		table:     "users",
+		tables:    []string{"users", "orders"},
+	},
+	{
+		name:      "cte",
+		dialect:   DialectAuto,
+		sql:       `WITH recent AS (SELECT * FROM orders WHERE created_at > '2024-01-01') SELECT * FROM recent JOIN users ON users.id = recent.user_id`,
+		operation: sqlOpSelect,
+		table:     "users",
+		tables:    []string{"orders", "users"},
+	},
+	{
+		name:      "schema qualified",
+		dialect:   DialectPostgres,
+		sql:       `SELECT * FROM "public"."users"`,
+		operation: sqlOpSelect,
+		table:     "public.users",
+		tables:    []string{"public.users"},
+	},
+	{
+		name:      "upsert",
+		dialect:   DialectPostgres,
+		sql:       `INSERT INTO "counters" ("key","n") VALUES ('a',1) ON CONFLICT ("key") DO UPDATE SET "n"="excluded"."n"`,
+		operation: sqlOpUpsert,
+		table:     "counters",
+		tables:    []string{"counters"},
+	},
+	{
+		name:      "insert select",
+		dialect:   DialectAuto,
+		sql:       `INSERT INTO archive (id) SELECT id FROM orders WHERE total = 0`,
+		operation: sqlOpInsert,
+		table:     "archive",
+		tables:    []string{"archive", "orders"},
+	},
+	{
+		name:      "table name in string literal",
+		dialect:   DialectAuto,
+		sql:       `SELECT * FROM logs WHERE message = 'deleted FROM users'`,
+		operation: sqlOpSelect,
+		table:     "logs",
+		tables:    []string{"logs"},
+	},
+	{
+		name:      "table name in comment",
+		dialect:   DialectAuto,
+		sql:       "/* FROM admins */ SELECT * FROM accounts -- JOIN secrets",
+		operation: sqlOpSelect,
+		table:     "accounts",
+		tables:    []string{"accounts"},
+	},
+	{
+		name:      "create table",
+		dialect:   DialectSQLite,
+		sql:       "CREATE TABLE `users` (`id` integer,PRIMARY KEY (`id`))",
+		operation: sqlOpCreate,
+		table:     "users",
+		tables:    []string{"users"},
+	},
+}
+
+func TestParseSQLCorpus(t *testing.T) {
+	for _, tt := range sqlCorpus {
+		t.Run(tt.name, func(t *testing.T) {
+			info := parseSQL(tt.sql, tt.dialect)
+			if info.Operation != tt.operation {
+				t.Errorf("Operation = %q, want %q", info.Operation, tt.operation)
+			}
+			if info.Table != tt.table {
+				t.Errorf("Table = %q, want %q", info.Table, tt.table)
+			}
+			if !reflect.DeepEqual(info.Tables, tt.tables) {
+				t.Errorf("Tables = %q, want %q", info.Tables, tt.tables)
+			}
+		})
+	}
+}
+
+// regexTableName is the regular expression table extraction parseSQL
+// replaced, kept as the baseline of the benchmarks below.
+func regexTableName(sql string) string {
+	upper := strings.ToUpper(strings.TrimSpace(sql))
+	var pattern string
+	switch {
+	case strings.HasPrefix(upper, "SELECT"), strings.HasPrefix(upper, "DELETE"):
+		pattern = `(?i)\bFROM\s+["` + "`" + `]?(\w+)["` + "`" + `]?`
+	case strings.HasPrefix(upper, "INSERT"):
+		pattern = `(?i)\bINTO\s+["` + "`" + `]?(\w+)["` + "`" + `]?`
+	case strings.HasPrefix(upper, "UPDATE"):
+		pattern = `(?i)\bUPDATE\s+["` + "`" + `]?(\w+)["` + "`" + `]?`
+	default:
+		return ""
+	}
+	if m := regexp.MustCompile(pattern).FindStringSubmatch(sql); len(m) > 1 {
+		return m[1]
+	}
+	return ""
+}
+
+func TestRegexBaselineMisreadsCorpus(t *testing.T) {
+	// The cases the lexer was introduced for.
+	for _, tt := range sqlCorpus {
+		switch tt.name {
+		case "table name in comment", "schema qualified", "cte":
+			if got := regexTableName(tt.sql); got == tt.table {
+				t.Errorf("%s: regex baseline unexpectedly found %q", tt.name, got)
+			}
+		}
+	}
+}
+
+func BenchmarkParseSQL(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, tt := range sqlCorpus {
+			parseSQL(tt.sql, tt.dialect)
+		}
+	}
+}
+
+func BenchmarkParseSQLRegexBaseline(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, tt := range sqlCorpus {
+			regexTableName(tt.sql)
+		}
+	}
+}
+
+func BenchmarkNormalizeSQL(b *testing.B) {
+	patterns := compilePatterns(DefaultMaskPatterns)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, tt := range sqlCorpus {
+			tokens := lexSQL(tt.sql, tt.dialect)
+			analyzeSQL(tokens)
+			normalizeSQL(tt.sql, tokens, SQLModeFull, patterns)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package tlog
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// StatsSource provides metrics for StartStatsReporter.
+type StatsSource interface {
+	// StatsName identifies the source in the "source" field.
+	StatsName() string
+
+	// CollectStats returns the fields to log and a message for every
+	// threshold crossed since the previous collection.
+	CollectStats() (fields []zap.Field, warnings []string)
+}
+
+// StartStatsReporter logs a "Stats snapshot" entry per source every interval,
+// and a "Stats threshold crossed" warning for each crossed threshold. Go
+// runtime stats are always included; pass RuntimeStats to set thresholds.
+// The reporter stops when ctx is done; the returned channel is closed once
+// it has stopped. An interval <= 0 defaults to one minute.
+func StartStatsReporter(ctx context.Context, interval time.Duration, sources ...StatsSource) <-chan struct{} {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	hasRuntime := false
+	for _, s := range sources {
+		if _, ok := s.(*runtimeStats); ok {
+			hasRuntime = true
+			break
+		}
+	}
+	if !hasRuntime {
+		sources = append([]StatsSource{RuntimeStats(RuntimeThresholds{})}, sources...)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				reportStats(ctx, sources)
+			}
+		}
+	}()
+	return done
+}
+
+// reportStats collects and logs every source once.
+func reportStats(ctx context.Context, sources []StatsSource) {
+	logger := FromContext(ctx)
+	for _, s := range sources {
+		fields, warnings := s.CollectStats()
+		fields = append([]zap.Field{zap.String("source", s.StatsName())}, fields...)
+
+		logger.Info("Stats snapshot", fields...)
+		for _, w := range warnings {
+			logger.Warn("Stats threshold crossed", append(fields, zap.String("warning", w))...)
+		}
+	}
+}
+
+// dbStats reports sql.DBStats for a connection pool.
+type dbStats struct {
+	name string
+	db   func() (*sql.DB, error)
+
+	// last is the previous snapshot, set once seeded; deltas are relative to it.
+	last   sql.DBStats
+	seeded bool
+}
+
+// GormStats returns a StatsSource reporting the connection pool of a *gorm.DB.
+func GormStats(name string, db *gorm.DB) StatsSource {
+	return newDBStats(name, db.DB)
+}
+
+// SQLStats returns a StatsSource reporting the connection pool of a *sql.DB.
+func SQLStats(name string, db *sql.DB) StatsSource {
+	return newDBStats(name, func() (*sql.DB, error) { return db, nil })
+}
+
+// newDBStats returns a dbStats seeded with the pool's current stats, so
+// deltas cover only what happens after the source is created.
+func newDBStats(name string, db func() (*sql.DB, error)) *dbStats {
+	s := &dbStats{name: name, db: db}
+	if sqlDB, err := db(); err == nil {
+		s.last, s.seeded = sqlDB.Stats(), true
+	}
+	return s
+}
+
+// StatsName implements StatsSource.
+func (s *dbStats) StatsName() string {
+	return "db:" + s.name
+}
+
+// CollectStats implements StatsSource. It warns when callers had to wait for
+// a connection since the previous collection and when the pool is at its
+// open connection limit.
+func (s *dbStats) CollectStats() ([]zap.Field, []string) {
+	db, err := s.db()
+	if err != nil {
+		return []zap.Field{zap.Error(err)}, nil
+	}
+
+	st := db.Stats()
+	if !s.seeded {
+		s.last, s.seeded = st, true
+	}
+	waitDelta := st.WaitCount - s.last.WaitCount
+	s.last = st
+
+	fields := []zap.Field{
+		zap.Int("max_open_connections", st.MaxOpenConnections),
+		zap.Int("open_connections", st.OpenConnections),
+		zap.Int("in_use", st.InUse),
+		zap.Int("idle", st.Idle),
+		zap.Int64("wait_count", st.WaitCount),
+		zap.Int64("wait_count_delta", waitDelta),
+		zap.Int64("wait_duration_ms", st.WaitDuration.Milliseconds()),
+		zap.Int64("max_idle_closed", st.MaxIdleClosed),
+		zap.Int64("max_idle_time_closed", st.MaxIdleTimeClosed),
+		zap.Int64("max_lifetime_closed", st.MaxLifetimeClosed),
+	}
+
+	var warnings []string
+	if waitDelta > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d callers waited for a connection", waitDelta))
+	}
+	if st.MaxOpenConnections > 0 && st.OpenConnections >= st.MaxOpenConnections {
+		warnings = append(warnings, "connection pool at max open connections")
+	}
+	return fields, warnings
+}
+
+// RuntimeThresholds sets warning thresholds for runtime stats. Zero disables a threshold.
+type RuntimeThresholds struct {
+	// Goroutines warns when the goroutine count exceeds this value.
+	Goroutines int
+	// HeapBytes warns when the live heap exceeds this many bytes.
+	HeapBytes uint64
+	// GCPause warns when a GC pause since the previous collection exceeds this duration.
+	GCPause time.Duration
+	// OpenFDs warns when the process has more open file descriptors than this.
+	OpenFDs int
+}
+
+// runtimeStats reports Go runtime stats.
+type runtimeStats struct {
+	thresholds RuntimeThresholds
+	lastNumGC  uint32
+}
+
+// RuntimeStats returns a StatsSource reporting goroutines, heap, GC pauses
+// and open file descriptors, with the given warning thresholds. GC deltas
+// cover only collections after the source is created.
+func RuntimeStats(thresholds RuntimeThresholds) StatsSource {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return &runtimeStats{thresholds: thresholds, lastNumGC: m.NumGC}
+}
+
+// StatsName implements StatsSource.
+func (s *runtimeStats) StatsName() string {
+	return "runtime"
+}
+
+// CollectStats implements StatsSource.
+func (s *runtimeStats) CollectStats() ([]zap.Field, []string) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	goroutines := runtime.NumGoroutine()
+
+	// Longest pause among GCs since the previous collection; PauseNs is a
+	// circular buffer of the last 256 pauses.
+	var maxPause uint64
+	gcs := m.NumGC - s.lastNumGC
+	if gcs > uint32(len(m.PauseNs)) {
+		gcs = uint32(len(m.PauseNs))
+	}
+	for i := uint32(0); i < gcs; i++ {
+		if p := m.PauseNs[(m.NumGC-i+255)%256]; p > maxPause {
+			maxPause = p
+		}
+	}
+	gcDelta := m.NumGC - s.lastNumGC
+	s.lastNumGC = m.NumGC
+
+	fields := []zap.Field{
+		zap.Int("goroutines", goroutines),
+		zap.Uint64("heap_alloc_bytes", m.HeapAlloc),
+		zap.Uint64("heap_inuse_bytes", m.HeapInuse),
+		zap.Uint64("heap_objects", m.HeapObjects),
+		zap.Uint64("sys_bytes", m.Sys),
+		zap.Uint32("num_gc", m.NumGC),
+		zap.Uint32("num_gc_delta", gcDelta),
+		zap.Float64("gc_pause_total_ms", float64(m.PauseTotalNs)/1e6),
+		zap.Float64("gc_pause_max_ms", float64(maxPause)/1e6),
+	}
+
+	fds := openFDCount()
+	if fds >= 0 {
+		fields = append(fields, zap.Int("open_fds", fds))
+	}
+
+	var warnings []string
+	t := s.thresholds
+	if t.Goroutines > 0 && goroutines > t.Goroutines {
+		warnings = append(warnings, fmt.Sprintf("goroutines above %d", t.Goroutines))
+	}
+	if t.HeapBytes > 0 && m.HeapAlloc > t.HeapBytes {
+		warnings = append(warnings, fmt.Sprintf("heap above %d bytes", t.HeapBytes))
+	}
+	if t.GCPause > 0 && time.Duration(maxPause) > t.GCPause {
+		warnings = append(warnings, fmt.Sprintf("GC pause above %s", t.GCPause))
+	}
+	if t.OpenFDs > 0 && fds > t.OpenFDs {
+		warnings = append(warnings, fmt.Sprintf("open file descriptors above %d", t.OpenFDs))
+	}
+	return fields, warnings
+}
+
+// openFDCount returns the number of open file descriptors, or -1 when the
+// platform does not expose them through /proc or /dev/fd.
+func openFDCount() int {
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		if entries, err := os.ReadDir(dir); err == nil {
+			// Reading the directory itself holds one descriptor.
+			return len(entries) - 1
+		}
+	}
+	return -1
+}
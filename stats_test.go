@@ -0,0 +1,116 @@
+package tlog
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// causeWait makes one caller wait for the only connection of db.
+func causeWait(t *testing.T, db *sql.DB) {
+	t.Helper()
+	ctx := context.Background()
+	before := db.Stats().WaitCount
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		db.PingContext(ctx)
+	}()
+	for db.Stats().WaitCount == before {
+		time.Sleep(time.Millisecond)
+	}
+	conn.Close()
+	<-done
+}
+
+func TestSQLStatsWaitDelta(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	causeWait(t, db)
+	source := SQLStats("test", db)
+
+	// collect returns wait_count_delta and the wait warning, if any.
+	collect := func() (int64, string) {
+		fields, warnings := source.CollectStats()
+		enc := zapcore.NewMapObjectEncoder()
+		for _, f := range fields {
+			f.AddTo(enc)
+		}
+		var warning string
+		for _, w := range warnings {
+			if strings.Contains(w, "waited") {
+				warning = w
+			}
+		}
+		return enc.Fields["wait_count_delta"].(int64), warning
+	}
+
+	if delta, warning := collect(); delta != 0 || warning != "" {
+		t.Errorf("first collection: delta %d, warning %q; want waits before the source ignored", delta, warning)
+	}
+	causeWait(t, db)
+	delta, warning := collect()
+	if delta != 1 {
+		t.Errorf("wait_count_delta = %d, want 1", delta)
+	}
+	if warning != "1 callers waited for a connection" {
+		t.Errorf("warning = %q", warning)
+	}
+}
+
+type countingStats struct{ n chan struct{} }
+
+func (s countingStats) StatsName() string { return "counting" }
+
+func (s countingStats) CollectStats() ([]zap.Field, []string) {
+	select {
+	case s.n <- struct{}{}:
+	default:
+	}
+	return nil, nil
+}
+
+func TestStartStatsReporter(t *testing.T) {
+	logs := observeLogs(t, zapcore.InfoLevel)
+	ctx, cancel := context.WithCancel(context.Background())
+	source := countingStats{n: make(chan struct{}, 1)}
+
+	done := StartStatsReporter(ctx, 10*time.Millisecond, source)
+	select {
+	case <-source.n:
+	case <-time.After(5 * time.Second):
+		t.Fatal("source not collected")
+	}
+	cancel()
+	<-done
+
+	sources := map[any]bool{}
+	for _, e := range logs.FilterMessage("Stats snapshot").All() {
+		sources[e.ContextMap()["source"]] = true
+	}
+	if !sources["runtime"] || !sources["counting"] {
+		t.Errorf("snapshot sources = %v, want runtime and counting", sources)
+	}
+}
+
+func TestStartStatsReporterDefaultInterval(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := StartStatsReporter(ctx, 0)
+	cancel()
+	<-done
+}
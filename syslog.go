@@ -0,0 +1,469 @@
+package tlog
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// SyslogTransport is the network transport of a syslog sink.
+type SyslogTransport int
+
+const (
+	// SyslogUnix writes to the local syslog socket.
+	SyslogUnix SyslogTransport = iota
+	// SyslogUDP sends one datagram per message.
+	SyslogUDP
+	// SyslogTCP sends octet-counted messages (RFC 6587).
+	SyslogTCP
+	// SyslogTLS sends octet-counted messages over TLS (RFC 5425).
+	SyslogTLS
+)
+
+// SyslogFormat is the syslog message format.
+type SyslogFormat int
+
+const (
+	// SyslogRFC5424 writes RFC 5424 messages with fields as structured data.
+	SyslogRFC5424 SyslogFormat = iota
+	// SyslogRFC3164 writes BSD syslog messages with fields appended to the
+	// message as key=value pairs.
+	SyslogRFC3164
+)
+
+// syslogFacilities maps facility names to their codes.
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// SyslogConfig configures a sink for a syslog daemon or collector.
+type SyslogConfig struct {
+	// Transport is the network transport.
+	// Default: SyslogUnix
+	Transport SyslogTransport
+
+	// Address is the socket path for SyslogUnix, or host:port otherwise.
+	// Default: "/dev/log" for SyslogUnix, required otherwise
+	Address string
+
+	// Format is the message format. Some local daemons only parse RFC 3164
+	// on /dev/log.
+	// Default: SyslogRFC5424
+	Format SyslogFormat
+
+	// Facility is the facility name, e.g. "local0" or "daemon".
+	// Default: "user"
+	Facility string
+
+	// AppName is the APP-NAME (RFC 5424) or TAG (RFC 3164) of messages.
+	// Default: Config.AppName, or the program name
+	AppName string
+
+	// Hostname is the HOSTNAME of messages.
+	// Default: the hostname
+	Hostname string
+
+	// StructuredDataID is the SD-ID of the structured data element holding
+	// the fields in RFC 5424 messages.
+	// Default: "tlog@32473"
+	StructuredDataID string
+
+	// MaxMessageSize truncates longer messages.
+	// Default: 8192
+	MaxMessageSize int
+
+	// TLSConfig configures SyslogTLS.
+	// Default: system roots and the host of Address as server name
+	TLSConfig *tls.Config
+
+	// DialTimeout bounds connecting to Address.
+	// Default: 5s
+	DialTimeout time.Duration
+}
+
+// SyslogSink sends entries to syslog. Create it with NewSyslogSink.
+type SyslogSink struct {
+	cfg      SyslogConfig
+	facility int
+	appName  string
+	loc      *time.Location
+
+	mu     sync.Mutex
+	conn   net.Conn
+	stream bool
+}
+
+// NewSyslogSink creates a syslog sink, applying defaults to unset fields.
+// The connection is opened on the first Send.
+func NewSyslogSink(cfg SyslogConfig) (*SyslogSink, error) {
+	if cfg.Transport < SyslogUnix || cfg.Transport > SyslogTLS {
+		return nil, fmt.Errorf("tlog: invalid syslog transport %d", int(cfg.Transport))
+	}
+	if cfg.Format != SyslogRFC5424 && cfg.Format != SyslogRFC3164 {
+		return nil, fmt.Errorf("tlog: invalid syslog format %d", int(cfg.Format))
+	}
+	if cfg.Address == "" {
+		if cfg.Transport != SyslogUnix {
+			return nil, errors.New("tlog: syslog address is required")
+		}
+		cfg.Address = "/dev/log"
+	}
+	if cfg.Facility == "" {
+		cfg.Facility = "user"
+	}
+	facility, ok := syslogFacilities[strings.ToLower(cfg.Facility)]
+	if !ok {
+		return nil, fmt.Errorf("tlog: unknown syslog facility %q", cfg.Facility)
+	}
+	if cfg.Hostname == "" {
+		cfg.Hostname, _ = os.Hostname()
+	}
+	if cfg.StructuredDataID == "" {
+		cfg.StructuredDataID = "tlog@32473"
+	}
+	if cfg.MaxMessageSize <= 0 {
+		cfg.MaxMessageSize = 8192
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = 5 * time.Second
+	}
+
+	s := &SyslogSink{cfg: cfg, facility: facility, loc: time.Local}
+	s.configure(Config{})
+	return s, nil
+}
+
+// Name returns "syslog".
+func (s *SyslogSink) Name() string { return "syslog" }
+
+// configure takes the app name and timezone from the logger configuration.
+func (s *SyslogSink) configure(cfg Config) {
+	s.appName = s.cfg.AppName
+	if s.appName == "" {
+		s.appName = cfg.AppName
+	}
+	if s.appName == "" {
+		s.appName = filepath.Base(os.Args[0])
+	}
+	if cfg.Timezone != nil {
+		s.loc = cfg.Timezone
+	}
+}
+
+// Send writes the entries of a batch one message at a time, reconnecting
+// once on a failed write like GELFSink.
+func (s *SyslogSink) Send(ctx context.Context, batch []SinkEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil && s.stream && !connAlive(s.conn) {
+		s.closeConn()
+	}
+	for _, e := range batch {
+		msg := s.message(e)
+		if err := s.write(ctx, msg); err != nil {
+			s.closeConn()
+			if err := s.write(ctx, msg); err != nil {
+				s.closeConn()
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes the connection.
+func (s *SyslogSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeConn()
+}
+
+// message formats an entry in the configured format, truncated to
+// MaxMessageSize on a rune boundary.
+func (s *SyslogSink) message(e SinkEntry) []byte {
+	var msg []byte
+	if s.cfg.Format == SyslogRFC3164 {
+		msg = s.rfc3164(e)
+	} else {
+		msg = s.rfc5424(e)
+	}
+	return truncateUTF8(msg, s.cfg.MaxMessageSize)
+}
+
+// truncateUTF8 shortens b to at most n bytes without splitting a rune.
+func truncateUTF8(b []byte, n int) []byte {
+	if len(b) <= n {
+		return b
+	}
+	for n > 0 && !utf8.RuneStart(b[n]) {
+		n--
+	}
+	return b[:n]
+}
+
+// rfc5424 formats an entry as
+//
+//	<PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD-ID name="value" ...] MSG
+//
+// with the logger name as MSGID and the level, caller and fields as
+// structured data parameters.
+func (s *SyslogSink) rfc5424(e SinkEntry) []byte {
+	var b strings.Builder
+	b.WriteString("<")
+	b.WriteString(strconv.Itoa(s.facility*8 + syslogSeverity(e.Level)))
+	b.WriteString(">1 ")
+	b.WriteString(e.Time.In(s.loc).Format("2006-01-02T15:04:05.000000Z07:00"))
+	b.WriteByte(' ')
+	b.WriteString(syslogHeaderField(s.cfg.Hostname, 255))
+	b.WriteByte(' ')
+	b.WriteString(syslogHeaderField(s.appName, 48))
+	b.WriteByte(' ')
+	b.WriteString(strconv.Itoa(os.Getpid()))
+	b.WriteByte(' ')
+	b.WriteString(syslogHeaderField(e.LoggerName, 32))
+	b.WriteByte(' ')
+
+	params := make(map[string]string, len(e.Fields)+2)
+	params["level"] = e.Level.String()
+	if e.Caller.Defined {
+		params["caller"] = e.Caller.TrimmedPath()
+	}
+	for _, k := range sortedFieldKeys(e.Fields) {
+		params[syslogUniqueName(syslogParamName(k), params, 32)] = syslogString(e.Fields[k])
+	}
+	b.WriteByte('[')
+	b.WriteString(s.cfg.StructuredDataID)
+	for _, k := range sortedKeys(params) {
+		b.WriteByte(' ')
+		b.WriteString(k)
+		b.WriteString(`="`)
+		b.WriteString(syslogParamEscaper.Replace(params[k]))
+		b.WriteByte('"')
+	}
+	b.WriteByte(']')
+
+	b.WriteByte(' ')
+	b.WriteString(e.Message)
+	if e.Stack != "" {
+		b.WriteByte('\n')
+		b.WriteString(e.Stack)
+	}
+	return []byte(b.String())
+}
+
+// rfc3164 formats an entry as
+//
+//	<PRI>Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG key=value ...
+//
+// The hostname is left out on the local socket, where the daemon adds it.
+func (s *SyslogSink) rfc3164(e SinkEntry) []byte {
+	var b strings.Builder
+	b.WriteString("<")
+	b.WriteString(strconv.Itoa(s.facility*8 + syslogSeverity(e.Level)))
+	b.WriteString(">")
+	b.WriteString(e.Time.In(s.loc).Format(time.Stamp))
+	b.WriteByte(' ')
+	if s.cfg.Transport != SyslogUnix {
+		b.WriteString(syslogHeaderField(s.cfg.Hostname, 255))
+		b.WriteByte(' ')
+	}
+	b.WriteString(syslogHeaderField(s.appName, 32))
+	b.WriteString("[")
+	b.WriteString(strconv.Itoa(os.Getpid()))
+	b.WriteString("]: ")
+	b.WriteString(e.Message)
+
+	fields := make(map[string]string, len(e.Fields)+1)
+	if e.Caller.Defined {
+		fields["caller"] = e.Caller.TrimmedPath()
+	}
+	for _, k := range sortedFieldKeys(e.Fields) {
+		fields[syslogUniqueName(k, fields, len(k)+4)] = syslogString(e.Fields[k])
+	}
+	for _, k := range sortedKeys(fields) {
+		b.WriteByte(' ')
+		b.WriteString(k)
+		b.WriteByte('=')
+		v := fields[k]
+		if v == "" || strings.ContainsAny(v, " \"=\n") {
+			v = strconv.Quote(v)
+		}
+		b.WriteString(v)
+	}
+	if e.Stack != "" {
+		b.WriteByte('\n')
+		b.WriteString(e.Stack)
+	}
+	return []byte(b.String())
+}
+
+// write sends one message, dialing when there is no connection. TCP and TLS
+// messages are octet counted, messages on a local stream socket end with a
+// newline, and datagrams are sent as is.
+func (s *SyslogSink) write(ctx context.Context, msg []byte) error {
+	if s.conn == nil {
+		if err := s.dial(ctx); err != nil {
+			return err
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.conn.SetWriteDeadline(deadline)
+	}
+
+	switch {
+	case s.cfg.Transport == SyslogTCP || s.cfg.Transport == SyslogTLS:
+		frame := make([]byte, 0, len(msg)+8)
+		frame = strconv.AppendInt(frame, int64(len(msg)), 10)
+		frame = append(frame, ' ')
+		msg = append(frame, msg...)
+	case s.stream:
+		msg = append(msg, '\n')
+	}
+	_, err := s.conn.Write(msg)
+	return err
+}
+
+// dial connects to the syslog daemon. The local socket is tried as a
+// datagram socket first, then as a stream socket.
+func (s *SyslogSink) dial(ctx context.Context) error {
+	d := net.Dialer{Timeout: s.cfg.DialTimeout}
+	var conn net.Conn
+	var err error
+	switch s.cfg.Transport {
+	case SyslogUnix:
+		conn, err = d.DialContext(ctx, "unixgram", s.cfg.Address)
+		s.stream = false
+		if err != nil {
+			conn, err = d.DialContext(ctx, "unix", s.cfg.Address)
+			s.stream = true
+		}
+	case SyslogUDP:
+		conn, err = d.DialContext(ctx, "udp", s.cfg.Address)
+		s.stream = false
+	case SyslogTCP:
+		conn, err = d.DialContext(ctx, "tcp", s.cfg.Address)
+		s.stream = true
+	case SyslogTLS:
+		td := tls.Dialer{NetDialer: &d, Config: s.cfg.TLSConfig}
+		conn, err = td.DialContext(ctx, "tcp", s.cfg.Address)
+		s.stream = true
+	}
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+// closeConn closes and forgets the connection.
+func (s *SyslogSink) closeConn() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// syslogHeaderField returns a header field of at most n printable ASCII
+// characters without spaces, or "-" when empty.
+func syslogHeaderField(v string, n int) string {
+	v = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, v)
+	if len(v) > n {
+		v = v[:n]
+	}
+	if v == "" {
+		return "-"
+	}
+	return v
+}
+
+// syslogParamName returns a structured data parameter name: at most 32
+// printable ASCII characters other than '=', ' ', ']' and '"'.
+func syslogParamName(k string) string {
+	k = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, k)
+	if len(k) > 32 {
+		k = k[:32]
+	}
+	if k == "" {
+		return "_"
+	}
+	return k
+}
+
+// syslogUniqueName returns name, or when taken already, name with the first
+// free "_2", "_3", ... suffix, cut so the result has at most n bytes.
+func syslogUniqueName(name string, taken map[string]string, n int) string {
+	if _, ok := taken[name]; !ok {
+		return name
+	}
+	for i := 2; ; i++ {
+		suffix := "_" + strconv.Itoa(i)
+		base := name
+		if len(base)+len(suffix) > n {
+			base = base[:n-len(suffix)]
+		}
+		if _, ok := taken[base+suffix]; !ok {
+			return base + suffix
+		}
+	}
+}
+
+// syslogParamEscaper escapes structured data parameter values.
+var syslogParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// syslogString formats a field value as text.
+func syslogString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case time.Duration:
+		return v.String()
+	case nil:
+		return ""
+	case fmt.Stringer:
+		return v.String()
+	case map[string]interface{}, []interface{}:
+		if data, err := json.Marshal(v); err == nil {
+			return string(data)
+		}
+	}
+	return fmt.Sprint(v)
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,299 @@
+package tlog
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// syslogListener receives syslog messages on a local socket, unframing
+// octet-counted TCP and newline-terminated stream messages.
+func syslogListener(t *testing.T, network string) (string, chan string) {
+	t.Helper()
+	messages := make(chan string, 10)
+	addr := "127.0.0.1:0"
+	if strings.HasPrefix(network, "unix") {
+		addr = filepath.Join(t.TempDir(), "log")
+	}
+
+	switch network {
+	case "udp", "unixgram":
+		conn, err := net.ListenPacket(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		go func() {
+			buf := make([]byte, 65536)
+			for {
+				n, _, err := conn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				messages <- string(buf[:n])
+			}
+		}()
+		return conn.LocalAddr().String(), messages
+	}
+
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					if network == "unix" {
+						line, err := r.ReadString('\n')
+						if err != nil {
+							return
+						}
+						messages <- strings.TrimSuffix(line, "\n")
+						continue
+					}
+					var n int
+					if _, err := fmt.Fscanf(r, "%d ", &n); err != nil {
+						return
+					}
+					buf := make([]byte, n)
+					if _, err := r.Read(buf); err != nil {
+						return
+					}
+					messages <- string(buf)
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), messages
+}
+
+func receiveSyslog(t *testing.T, messages chan string) string {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no syslog message received")
+		return ""
+	}
+}
+
+func TestSyslogSinkTransports(t *testing.T) {
+	tests := []struct {
+		network   string
+		transport SyslogTransport
+	}{
+		{"udp", SyslogUDP},
+		{"tcp", SyslogTCP},
+		{"unixgram", SyslogUnix},
+		{"unix", SyslogUnix},
+	}
+	for _, tt := range tests {
+		t.Run(tt.network, func(t *testing.T) {
+			addr, messages := syslogListener(t, tt.network)
+			sink, err := NewSyslogSink(SyslogConfig{Transport: tt.transport, Address: addr, Facility: "local0", Hostname: "web-1", AppName: "api"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sink.Close()
+
+			batch := []SinkEntry{
+				{Time: time.Now(), Level: zapcore.InfoLevel, Message: "first", Fields: map[string]interface{}{"request_id": "r-1"}},
+				{Time: time.Now(), Level: zapcore.ErrorLevel, Message: "second"},
+			}
+			if err := sink.Send(context.Background(), batch); err != nil {
+				t.Fatal(err)
+			}
+			first, second := receiveSyslog(t, messages), receiveSyslog(t, messages)
+			if !strings.HasPrefix(first, "<134>1 ") || !strings.Contains(first, ` web-1 api `) || !strings.HasSuffix(first, `request_id="r-1"] first`) {
+				t.Errorf("first = %q", first)
+			}
+			if !strings.HasPrefix(second, "<131>1 ") || !strings.HasSuffix(second, "] second") {
+				t.Errorf("second = %q", second)
+			}
+		})
+	}
+}
+
+func TestSyslogSinkTCPReconnects(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conns := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+		}
+	}()
+
+	sink, err := NewSyslogSink(SyslogConfig{Transport: SyslogTCP, Address: ln.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	send := func(msg string) {
+		t.Helper()
+		if err := sink.Send(context.Background(), []SinkEntry{{Time: time.Now(), Message: msg}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send("first")
+	(<-conns).Close()
+	time.Sleep(10 * time.Millisecond)
+	send("second")
+
+	conn := <-conns
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	var n int
+	if _, err := fmt.Fscanf(r, "%d ", &n); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, n)
+	if _, err := r.Read(buf); err != nil || !strings.HasSuffix(string(buf), "second") {
+		t.Errorf("new connection got %q, %v", buf, err)
+	}
+}
+
+func TestSyslogRFC5424(t *testing.T) {
+	long := strings.Repeat("x", 32)
+	tests := []struct {
+		name   string
+		entry  SinkEntry
+		wantSD string
+	}{
+		{
+			name: "fields",
+			entry: SinkEntry{
+				Level:  zapcore.WarnLevel,
+				Caller: zapcore.EntryCaller{Defined: true, File: "/src/app/handlers/user.go", Line: 42},
+				Fields: map[string]interface{}{"status": 503, "path": `/a"b]c\`},
+			},
+			wantSD: `[tlog@32473 caller="handlers/user.go:42" level="warn" path="/a\"b\]c\\" status="503"]`,
+		},
+		{
+			name: "built-in names",
+			entry: SinkEntry{
+				Level:  zapcore.InfoLevel,
+				Caller: zapcore.EntryCaller{Defined: true, File: "/src/app/main.go", Line: 7},
+				Fields: map[string]interface{}{"level": "custom", "caller": "job", "caller_2": "taken"},
+			},
+			wantSD: `[tlog@32473 caller="app/main.go:7" caller_2="job" caller_2_2="taken" level="info" level_2="custom"]`,
+		},
+		{
+			name: "names cut to 32 characters",
+			entry: SinkEntry{
+				Level:  zapcore.InfoLevel,
+				Fields: map[string]interface{}{long + "_a": "a", long + "_b": "b", "a b=c": "d"},
+			},
+			wantSD: `[tlog@32473 a_b_c="d" level="info" ` + strings.Repeat("x", 30) + `_2="b" ` + long + `="a"]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink, err := NewSyslogSink(SyslogConfig{Hostname: "web 1", AppName: "api"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sink.loc = time.UTC
+			tt.entry.Time = time.Date(2024, 1, 15, 10, 30, 45, 123456000, time.UTC)
+			tt.entry.LoggerName = "http"
+			tt.entry.Message = "msg"
+
+			want := fmt.Sprintf("<%d>1 2024-01-15T10:30:45.123456Z web_1 api %d http %s msg",
+				8+syslogSeverity(tt.entry.Level), os.Getpid(), tt.wantSD)
+			if got := string(sink.message(tt.entry)); got != want {
+				t.Errorf("message =\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestSyslogRFC3164(t *testing.T) {
+	tests := []struct {
+		transport SyslogTransport
+		host      string
+	}{
+		{SyslogUnix, ""},
+		{SyslogUDP, "web-1 "},
+	}
+	for _, tt := range tests {
+		sink, err := NewSyslogSink(SyslogConfig{Transport: tt.transport, Address: "127.0.0.1:514", Format: SyslogRFC3164, Facility: "daemon", Hostname: "web-1", AppName: "api"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sink.loc = time.UTC
+		got := string(sink.message(SinkEntry{
+			Time:    time.Date(2024, 1, 5, 10, 30, 45, 0, time.UTC),
+			Level:   zapcore.ErrorLevel,
+			Message: "failed",
+			Caller:  zapcore.EntryCaller{Defined: true, File: "/src/app/main.go", Line: 7},
+			Fields:  map[string]interface{}{"caller": "job", "note": "two words", "empty": ""},
+		}))
+		want := "<27>Jan  5 10:30:45 " + tt.host + "api[" + strconv.Itoa(os.Getpid()) + `]: failed caller=app/main.go:7 caller_2=job empty="" note="two words"`
+		if got != want {
+			t.Errorf("message =\n%s\nwant\n%s", got, want)
+		}
+	}
+}
+
+func TestSyslogTruncatesOnRuneBoundary(t *testing.T) {
+	for size := 100; size < 110; size++ {
+		sink, err := NewSyslogSink(SyslogConfig{MaxMessageSize: size})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := sink.message(SinkEntry{Time: time.Now(), Message: strings.Repeat("日本語", 100)})
+		if len(msg) > size || len(msg) < size-3 {
+			t.Errorf("MaxMessageSize %d: message of %d bytes", size, len(msg))
+		}
+		if !utf8.Valid(msg) {
+			t.Errorf("MaxMessageSize %d: message split a rune: %q", size, msg[len(msg)-4:])
+		}
+	}
+}
+
+func TestNewSyslogSinkValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  SyslogConfig
+	}{
+		{"bad transport", SyslogConfig{Transport: SyslogTransport(9)}},
+		{"bad format", SyslogConfig{Format: SyslogFormat(9)}},
+		{"no network address", SyslogConfig{Transport: SyslogTCP}},
+		{"unknown facility", SyslogConfig{Facility: "local9"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewSyslogSink(tt.cfg); err == nil {
+				t.Error("NewSyslogSink() error = nil")
+			}
+		})
+	}
+}